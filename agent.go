@@ -0,0 +1,687 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	AGENT_MAX_FRAME     = 64 << 20         // bytes; the largest report a collector accepts
+	AGENT_MAX_HELLO     = 4 << 10          // bytes; the largest hello, read before an agent is authenticated
+	AGENT_TIMEOUT       = 30 * time.Second // to connect, or to send a report and have it acknowledged
+	AGENT_MIN_BACKOFF   = time.Second
+	AGENT_MAX_BACKOFF   = time.Minute
+	AGENT_CLOSE_TIMEOUT = 10 * time.Second // how long buffered reports are given to send on exit
+)
+
+// Options for reporting traffic to a collector, parsed from the command-line
+type AgentOptions struct {
+	Collector string // host:port
+	Host      string // how this machine is identified to the collector
+	Interval  time.Duration
+	Buffer    int    // reports kept while the collector is unreachable
+	Token     string // shared with the collector, from $PUFFIN_AGENT_TOKEN
+}
+
+// Read agent options from the command-line
+func ParseAgentOptions(opts docopt.Opts) (*AgentOptions, error) {
+	collector, _ := opts.String("--collector")
+	if _, _, err := net.SplitHostPort(collector); err != nil {
+		return nil, fmt.Errorf("--collector: %v", err)
+	}
+
+	host, _ := opts.String("--host")
+	if len(host) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("--host: could not read hostname: %v", err)
+		}
+		host = hostname
+	}
+
+	interval, _ := opts.Int("--report-interval")
+	if interval <= 0 {
+		return nil, fmt.Errorf("--report-interval must be a positive number of seconds")
+	}
+
+	buffer, _ := opts.Int("--agent-buffer")
+	if buffer <= 0 {
+		return nil, fmt.Errorf("--agent-buffer must be a positive number of reports")
+	}
+
+	return &AgentOptions{collector, host, time.Duration(interval) * time.Second, buffer, os.Getenv("PUFFIN_AGENT_TOKEN")}, nil
+}
+
+// A process-socket's traffic on one device & in one direction since the last report, like an
+// OutputRow. Connections without traffic are reported without a device, so the collector
+// still learns when they open and close. Traffic no socket was found for has no protocol
+type AgentRow struct {
+	Device    string
+	Direction string // out (local -> remote) or in
+	Bytes     int64
+	Packets   int64
+	First     int64 // the first and last packet's time, in nanoseconds
+	Last      int64
+	TCPFlow   TCPFlowStats
+
+	Protocol  string
+	LocalAddr net.IP
+	LocalPort uint64
+	RemAddr   net.IP
+	RemPort   uint64
+	Inode     uint64
+	UID       uint64
+	St        uint64
+	TxQueue   uint64
+	RxQueue   uint64
+
+	Pid         int
+	StartTime   uint64
+	Command     string
+	CommandLine string
+	UserName    string
+	Cgroup      string
+	Parents     []ProcessId
+	Opened      int64
+	Closed      int64 // zero while open
+}
+
+// Everything an agent captured since its last report
+type AgentReport struct {
+	Host         string
+	SessionStart int64  // when the agent started capturing, in nanoseconds
+	Time         int64  // when the report was built
+	Sequence     uint64 // increases by one each report of a session
+	Rows         []AgentRow
+}
+
+// Sent once per connection, so the collector checks the token before accepting large reports
+type AgentHello struct {
+	Host  string
+	Token string
+}
+
+// Fill in a row's process-socket
+func (row *AgentRow) setConnection(tracked *TrackedConnection) {
+	pidConn := tracked.ProcessSocket
+	conn := pidConn.Connection
+
+	row.Protocol, row.Inode, row.UID = conn.GetType(), conn.GetInode(), conn.GetUID()
+	row.LocalAddr, row.LocalPort, row.RemAddr, row.RemPort = conn.GetLocalAddr(), conn.GetLocalPort(), conn.GetRemAddr(), conn.GetRemPort()
+
+	switch conn := conn.(type) {
+	case TCPConnection:
+		row.St, row.TxQueue, row.RxQueue = conn.GetST(), conn.GetTxQueue(), conn.GetRxQueue()
+	case UDPConnection:
+		row.St, row.TxQueue, row.RxQueue = conn.GetST(), conn.GetTxQueue(), conn.GetRxQueue()
+	}
+
+	row.Pid, row.StartTime, row.Command, row.CommandLine = pidConn.Pid, pidConn.StartTime, pidConn.Command, pidConn.CommandLine
+	row.UserName, row.Cgroup, row.Parents = pidConn.UserName, pidConn.Cgroup, pidConn.PidParents
+
+	row.Opened = tracked.Lifetime.Start.UnixNano()
+	if !tracked.IsOpen() {
+		row.Closed = tracked.Lifetime.End.UnixNano()
+	}
+}
+
+// The row's socket, or nil for unattributed traffic
+func (row *AgentRow) connection() Connection {
+	switch row.Protocol {
+	case "TCP":
+		return TCPConnection{0, row.LocalAddr, row.LocalPort, row.RemAddr, row.RemPort, row.St, row.TxQueue, row.RxQueue, row.UID, row.Inode}
+	case "UDP":
+		return UDPConnection{0, row.LocalAddr, row.LocalPort, row.RemAddr, row.RemPort, row.St, row.TxQueue, row.RxQueue, row.UID, row.Inode}
+	}
+
+	return nil
+}
+
+// Build a report row for each flow in the store, and each connection without one; the caller
+// holds the store lock
+func BuildAgentRows(conns *ConnectionTable, store MachineNetworkStorage) []AgentRow {
+	rows := []AgentRow{}
+	withTraffic := map[*TrackedConnection]bool{}
+
+	for _, flow := range attributeFlows(conns, store) {
+		row := AgentRow{
+			Device: flow.device, Direction: flow.direction, Bytes: int64(flow.data.Size), Packets: int64(flow.data.Count),
+			First: int64(flow.data.From), Last: int64(flow.data.To), TCPFlow: flow.data.TCPFlow,
+		}
+
+		if flow.tracked != nil {
+			row.setConnection(flow.tracked)
+			withTraffic[flow.tracked] = true
+		} else {
+			row.LocalAddr, row.LocalPort, row.RemAddr, row.RemPort = flow.data.LocalAddr, flow.data.LocalPort, flow.data.RemAddr, flow.data.RemPort
+		}
+
+		rows = append(rows, row)
+	}
+
+	for _, tracked := range conns.Tracked() {
+		if !withTraffic[tracked] {
+			row := AgentRow{}
+			row.setConnection(tracked)
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+// Hellos & reports are protobuf messages, encoded by hand as the collector is their only reader:
+//
+//	message Hello {
+//	  string host  = 1;
+//	  string token = 2;
+//	}
+//
+//	message Report {
+//	  string   host          = 1;
+//	  int64    session_start = 2;
+//	  int64    time          = 3;
+//	  uint64   sequence      = 4;
+//	  reserved 5;
+//	  repeated Row rows      = 6;
+//	}
+//
+//	message Row {
+//	  string device = 1;  string direction = 2;  int64 bytes = 3;  int64 packets = 4;  int64 first = 5;  int64 last = 6;
+//	  string protocol = 7;  bytes local_addr = 8;  uint64 local_port = 9;  bytes rem_addr = 10;  uint64 rem_port = 11;
+//	  uint64 inode = 12;  uint64 uid = 13;  uint64 st = 14;  uint64 tx_queue = 15;  uint64 rx_queue = 16;
+//	  int64 pid = 17;  uint64 start_time = 18;  string command = 19;  string command_line = 20;  string username = 21;
+//	  string cgroup = 22;  repeated Parent parents = 23;  int64 opened = 24;  int64 closed = 25;
+//	  int64 retransmissions = 26;  int64 out_of_order = 27;  int64 duplicate_acks = 28;  int64 zero_windows = 29;
+//	  int64 handshake_rtt = 30;
+//	}
+//
+//	message Parent {
+//	  int64  pid        = 1;
+//	  uint64 start_time = 2;
+//	}
+//
+// Each is sent with a 4-byte big-endian length, and acknowledged with its 8-byte sequence number
+
+func protoVarint(buf []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+
+	buf = protowire.AppendTag(buf, num, protowire.VarintType)
+	return protowire.AppendVarint(buf, value)
+}
+
+func protoBytes(buf []byte, num protowire.Number, value []byte) []byte {
+	if len(value) == 0 {
+		return buf
+	}
+
+	buf = protowire.AppendTag(buf, num, protowire.BytesType)
+	return protowire.AppendBytes(buf, value)
+}
+
+// Call a function with each field of a message; varints are passed as value, everything else
+// as data. Fields of other types are skipped
+func eachProtoField(buf []byte, fn func(num protowire.Number, value uint64, data []byte) error) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		var err error
+
+		switch typ {
+		case protowire.VarintType:
+			var value uint64
+			value, n = protowire.ConsumeVarint(buf)
+			if n >= 0 {
+				err = fn(num, value, nil)
+			}
+		case protowire.BytesType:
+			var data []byte
+			data, n = protowire.ConsumeBytes(buf)
+			if n >= 0 {
+				err = fn(num, 0, data)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+
+	return nil
+}
+
+func (row *AgentRow) marshal() []byte {
+	var buf []byte
+
+	buf = protoBytes(buf, 1, []byte(row.Device))
+	buf = protoBytes(buf, 2, []byte(row.Direction))
+	buf = protoVarint(buf, 3, uint64(row.Bytes))
+	buf = protoVarint(buf, 4, uint64(row.Packets))
+	buf = protoVarint(buf, 5, uint64(row.First))
+	buf = protoVarint(buf, 6, uint64(row.Last))
+	buf = protoBytes(buf, 7, []byte(row.Protocol))
+	buf = protoBytes(buf, 8, row.LocalAddr)
+	buf = protoVarint(buf, 9, row.LocalPort)
+	buf = protoBytes(buf, 10, row.RemAddr)
+	buf = protoVarint(buf, 11, row.RemPort)
+	buf = protoVarint(buf, 12, row.Inode)
+	buf = protoVarint(buf, 13, row.UID)
+	buf = protoVarint(buf, 14, row.St)
+	buf = protoVarint(buf, 15, row.TxQueue)
+	buf = protoVarint(buf, 16, row.RxQueue)
+	buf = protoVarint(buf, 17, uint64(row.Pid))
+	buf = protoVarint(buf, 18, row.StartTime)
+	buf = protoBytes(buf, 19, []byte(row.Command))
+	buf = protoBytes(buf, 20, []byte(row.CommandLine))
+	buf = protoBytes(buf, 21, []byte(row.UserName))
+	buf = protoBytes(buf, 22, []byte(row.Cgroup))
+
+	for _, parent := range row.Parents {
+		var msg []byte
+		msg = protoVarint(msg, 1, uint64(parent.Pid))
+		msg = protoVarint(msg, 2, parent.StartTime)
+
+		buf = protowire.AppendTag(buf, 23, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+
+	buf = protoVarint(buf, 24, uint64(row.Opened))
+	buf = protoVarint(buf, 25, uint64(row.Closed))
+	buf = protoVarint(buf, 26, uint64(row.TCPFlow.Retransmissions))
+	buf = protoVarint(buf, 27, uint64(row.TCPFlow.OutOfOrder))
+	buf = protoVarint(buf, 28, uint64(row.TCPFlow.DuplicateAcks))
+	buf = protoVarint(buf, 29, uint64(row.TCPFlow.ZeroWindows))
+	buf = protoVarint(buf, 30, uint64(row.TCPFlow.HandshakeRTT))
+
+	return buf
+}
+
+func (row *AgentRow) unmarshal(buf []byte) error {
+	return eachProtoField(buf, func(num protowire.Number, value uint64, data []byte) error {
+		switch num {
+		case 1:
+			row.Device = string(data)
+		case 2:
+			row.Direction = string(data)
+		case 3:
+			row.Bytes = int64(value)
+		case 4:
+			row.Packets = int64(value)
+		case 5:
+			row.First = int64(value)
+		case 6:
+			row.Last = int64(value)
+		case 7:
+			row.Protocol = string(data)
+		case 8:
+			row.LocalAddr = net.IP(append([]byte{}, data...))
+		case 9:
+			row.LocalPort = value
+		case 10:
+			row.RemAddr = net.IP(append([]byte{}, data...))
+		case 11:
+			row.RemPort = value
+		case 12:
+			row.Inode = value
+		case 13:
+			row.UID = value
+		case 14:
+			row.St = value
+		case 15:
+			row.TxQueue = value
+		case 16:
+			row.RxQueue = value
+		case 17:
+			row.Pid = int(value)
+		case 18:
+			row.StartTime = value
+		case 19:
+			row.Command = string(data)
+		case 20:
+			row.CommandLine = string(data)
+		case 21:
+			row.UserName = string(data)
+		case 22:
+			row.Cgroup = string(data)
+		case 23:
+			parent := ProcessId{}
+			err := eachProtoField(data, func(num protowire.Number, value uint64, data []byte) error {
+				switch num {
+				case 1:
+					parent.Pid = int(value)
+				case 2:
+					parent.StartTime = value
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			row.Parents = append(row.Parents, parent)
+		case 24:
+			row.Opened = int64(value)
+		case 25:
+			row.Closed = int64(value)
+		case 26:
+			row.TCPFlow.Retransmissions = int(value)
+		case 27:
+			row.TCPFlow.OutOfOrder = int(value)
+		case 28:
+			row.TCPFlow.DuplicateAcks = int(value)
+		case 29:
+			row.TCPFlow.ZeroWindows = int(value)
+		case 30:
+			row.TCPFlow.HandshakeRTT = int64(value)
+		}
+
+		return nil
+	})
+}
+
+func (report *AgentReport) Marshal() []byte {
+	var buf []byte
+
+	buf = protoBytes(buf, 1, []byte(report.Host))
+	buf = protoVarint(buf, 2, uint64(report.SessionStart))
+	buf = protoVarint(buf, 3, uint64(report.Time))
+	buf = protoVarint(buf, 4, report.Sequence)
+
+	for _, row := range report.Rows {
+		buf = protowire.AppendTag(buf, 6, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, row.marshal())
+	}
+
+	return buf
+}
+
+func UnmarshalAgentReport(buf []byte) (*AgentReport, error) {
+	report := &AgentReport{Rows: []AgentRow{}}
+
+	err := eachProtoField(buf, func(num protowire.Number, value uint64, data []byte) error {
+		switch num {
+		case 1:
+			report.Host = string(data)
+		case 2:
+			report.SessionStart = int64(value)
+		case 3:
+			report.Time = int64(value)
+		case 4:
+			report.Sequence = value
+		case 6:
+			row := AgentRow{}
+			if err := row.unmarshal(data); err != nil {
+				return err
+			}
+			report.Rows = append(report.Rows, row)
+		}
+
+		return nil
+	})
+
+	if err == nil && len(report.Host) == 0 {
+		err = fmt.Errorf("report has no host")
+	}
+
+	return report, err
+}
+
+func (hello *AgentHello) Marshal() []byte {
+	var buf []byte
+
+	buf = protoBytes(buf, 1, []byte(hello.Host))
+	buf = protoBytes(buf, 2, []byte(hello.Token))
+
+	return buf
+}
+
+func UnmarshalAgentHello(buf []byte) (*AgentHello, error) {
+	hello := &AgentHello{}
+
+	err := eachProtoField(buf, func(num protowire.Number, value uint64, data []byte) error {
+		switch num {
+		case 1:
+			hello.Host = string(data)
+		case 2:
+			hello.Token = string(data)
+		}
+
+		return nil
+	})
+
+	if err == nil && len(hello.Host) == 0 {
+		err = fmt.Errorf("hello has no host")
+	}
+
+	return hello, err
+}
+
+func writeAgentFrame(writer io.Writer, body []byte) error {
+	frame := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+
+	_, err := writer.Write(append(frame, body...))
+	return err
+}
+
+// Read a frame, refusing any larger than the limit before allocating for it
+func readAgentFrame(reader io.Reader, limit uint32) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > limit {
+		return nil, fmt.Errorf("frame of %d bytes is larger than the %d byte limit", size, limit)
+	}
+
+	body := make([]byte, size)
+	_, err := io.ReadFull(reader, body)
+
+	return body, err
+}
+
+// An encoded report, waiting to be acknowledged
+type agentFrame struct {
+	sequence uint64
+	body     []byte
+}
+
+// Reports traffic to a collector. Reports are queued and sent in order by a single sender,
+// and only forgotten once the collector acknowledges them; while it is unreachable they are
+// buffered, dropping the oldest once the buffer is full
+type Agent struct {
+	Options  *AgentOptions
+	start    time.Time
+	sequence uint64
+	lock     sync.Mutex
+	pending  []agentFrame
+	dropped  int
+	wake     chan bool
+	done     chan bool
+	stopped  chan bool
+}
+
+func NewAgent(opts *AgentOptions, start time.Time) *Agent {
+	agent := &Agent{opts, start, 0, sync.Mutex{}, []agentFrame{}, 0, make(chan bool, 1), make(chan bool), make(chan bool)}
+	go agent.run()
+
+	return agent
+}
+
+// Queue a report of everything in the store; the caller holds the store lock, and empties the
+// store once it is reported
+func (agent *Agent) Report(conns *ConnectionTable, store MachineNetworkStorage, now time.Time) {
+	agent.sequence++
+
+	report := AgentReport{agent.Options.Host, agent.start.UnixNano(), now.UnixNano(), agent.sequence, BuildAgentRows(conns, store)}
+	frame := agentFrame{agent.sequence, report.Marshal()}
+
+	agent.lock.Lock()
+	agent.pending = append(agent.pending, frame)
+
+	if overflow := len(agent.pending) - agent.Options.Buffer; overflow > 0 {
+		agent.pending = agent.pending[overflow:]
+		agent.dropped += overflow
+		log.Printf("collector %s unreachable; dropped %d reports so far", agent.Options.Collector, agent.dropped)
+	}
+	agent.lock.Unlock()
+
+	select {
+	case agent.wake <- true:
+	default:
+	}
+}
+
+func (agent *Agent) next() (agentFrame, bool) {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	if len(agent.pending) == 0 {
+		return agentFrame{}, false
+	}
+	return agent.pending[0], true
+}
+
+// Forget a report once it is acknowledged, unless it was dropped in the meantime
+func (agent *Agent) acknowledged(sequence uint64) {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	if len(agent.pending) > 0 && agent.pending[0].sequence == sequence {
+		agent.pending = agent.pending[1:]
+	}
+}
+
+// Send a report, and wait for the collector to acknowledge it
+// Introduce the agent on a new connection, and wait for the collector to accept its token
+func (agent *Agent) hello(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(AGENT_TIMEOUT))
+
+	hello := AgentHello{agent.Options.Host, agent.Options.Token}
+	if err := writeAgentFrame(conn, hello.Marshal()); err != nil {
+		return err
+	}
+
+	// acknowledged as report zero; a collector that rejects the token disconnects instead
+	ack := make([]byte, 8)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("collector did not accept this agent (is $PUFFIN_AGENT_TOKEN correct?): %v", err)
+	}
+
+	return nil
+}
+
+func (agent *Agent) send(conn net.Conn, frame agentFrame) error {
+	conn.SetDeadline(time.Now().Add(AGENT_TIMEOUT))
+
+	if err := writeAgentFrame(conn, frame.body); err != nil {
+		return err
+	}
+
+	ack := make([]byte, 8)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+
+	if sequence := binary.BigEndian.Uint64(ack); sequence != frame.sequence {
+		return fmt.Errorf("collector acknowledged report %d, but %d was sent", sequence, frame.sequence)
+	}
+
+	return nil
+}
+
+// Send queued reports until closed, reconnecting with backoff
+func (agent *Agent) run() {
+	defer close(agent.stopped)
+
+	var conn net.Conn
+	backoff := AGENT_MIN_BACKOFF
+
+	for {
+		frame, ok := agent.next()
+		if !ok {
+			select {
+			case <-agent.wake:
+				continue
+			case <-agent.done:
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+		}
+
+		var err error
+		if conn == nil {
+			conn, err = net.DialTimeout("tcp", agent.Options.Collector, AGENT_TIMEOUT)
+			if err == nil {
+				err = agent.hello(conn)
+			}
+		}
+		if err == nil {
+			err = agent.send(conn, frame)
+		}
+
+		if err == nil {
+			agent.acknowledged(frame.sequence)
+			backoff = AGENT_MIN_BACKOFF
+			continue
+		}
+
+		log.Printf("could not report to collector %s, retrying in %s: %v", agent.Options.Collector, backoff, err)
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-agent.done:
+			return
+		}
+
+		if backoff *= 2; backoff > AGENT_MAX_BACKOFF {
+			backoff = AGENT_MAX_BACKOFF
+		}
+	}
+}
+
+// Give buffered reports a little time to send, then stop
+func (agent *Agent) Close() error {
+	close(agent.done)
+
+	select {
+	case <-agent.stopped:
+	case <-time.After(AGENT_CLOSE_TIMEOUT):
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	if len(agent.pending) > 0 {
+		return fmt.Errorf("%d reports were not delivered to collector %s", len(agent.pending), agent.Options.Collector)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// By default, list traffic per process
+const DEFAULT_ANALYSE_QUERY = `select p.pid, p.startTime, p.command, count(distinct pc.connection_id) as connections, coalesce(sum(s.size), 0) as bytes
+from process p
+join process_connection pc on pc.process_id = p.id
+left join conn_summary s on s.connection_id = pc.connection_id
+group by p.id
+order by bytes desc`
+
+// Each process's ancestors, nearest first
+const PROCESS_PARENTS_QUERY = `select p.pid, p.startTime, a.pid, a.startTime, pp.level
+from process_parent pp
+join process p on p.id = pp.process_id
+join process a on a.id = pp.parent_id
+order by p.pid, p.startTime, pp.level desc`
+
+// Open an existing puffin capture database, migrating captures written by older versions
+func OpenCaptureDB(fpath string) (*sql.DB, error) {
+	if _, err := os.Stat(fpath); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", fpath+SQLITE_OPTIONS)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := MigrateCaptureDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Open a capture without changing it, e.g. when it is an input to be compared or merged. A capture
+// at the latest schema is opened read-only; an older one is copied to a temporary file, and the copy
+// migrated. Returns the database, its path, and a function that closes it & removes any copy
+func OpenCaptureDBReadOnly(fpath string) (*sql.DB, string, func(), error) {
+	if _, err := os.Stat(fpath); err != nil {
+		return nil, "", nil, err
+	}
+
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	uri := (&url.URL{Scheme: "file", Path: abs}).String() + "?mode=ro&_busy_timeout=5000"
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	// unversioned captures have no schema_version table
+	var version int
+	if err := db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version); err != nil {
+		version = 0
+	}
+
+	latest := MIGRATIONS[len(MIGRATIONS)-1].Version
+	if version > latest {
+		db.Close()
+		return nil, "", nil, fmt.Errorf("capture has schema version %d, but this puffin only supports up to %d", version, latest)
+	}
+	if version == latest {
+		return db, uri, func() { db.Close() }, nil
+	}
+
+	dir, err := os.MkdirTemp("", "puffin-capture-")
+	if err != nil {
+		db.Close()
+		return nil, "", nil, err
+	}
+
+	// vacuum into copies the capture consistently, including anything still in its write-ahead log
+	copyPath := filepath.Join(dir, filepath.Base(abs))
+	_, err = db.Exec("vacuum into ?", copyPath)
+	db.Close()
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+
+	migrated, err := OpenCaptureDB(copyPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+
+	return migrated, copyPath, func() { migrated.Close(); os.RemoveAll(dir) }, nil
+}
+
+// Run a query against a capture, printing each row as JSON
+func AnalyseQuery(db *sql.DB, query string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for idx := range values {
+			ptrs[idx] = &values[idx]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+
+		row := map[string]interface{}{}
+		for idx, col := range cols {
+			// sqlite returns text as bytes
+			if bytes, ok := values[idx].([]byte); ok {
+				row[col] = string(bytes)
+			} else {
+				row[col] = values[idx]
+			}
+		}
+
+		bytes, err := json.MarshalIndent(row, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+	}
+
+	return rows.Err()
+}
+
+// Reconstruct the process-tree stored in a capture, with traffic rolled up to ancestors
+func ReadProcessTree(db *sql.DB) (*ProcessTree, error) {
+	parents := map[ProcessId][]ProcessId{}
+
+	rows, err := db.Query(PROCESS_PARENTS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id, parent ProcessId
+		var level int
+
+		if err := rows.Scan(&id.Pid, &id.StartTime, &parent.Pid, &parent.StartTime, &level); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		parents[id] = append(parents[id], parent)
+	}
+	rows.Close()
+
+	rows, err = db.Query(DEFAULT_ANALYSE_QUERY)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	tree := NewProcessTree()
+
+	for rows.Next() {
+		var id ProcessId
+		var command string
+		var connections, bytes int
+
+		if err := rows.Scan(&id.Pid, &id.StartTime, &command, &connections, &bytes); err != nil {
+			return nil, err
+		}
+
+		tree.Add(id, command, bytes, connections, parents[id])
+	}
+
+	// ancestors without sockets were never named in the capture
+	for _, node := range tree.nodes {
+		if len(node.Command) == 0 {
+			node.Command = "?"
+		}
+	}
+
+	tree.Finish()
+	return tree, rows.Err()
+}
+
+// Analyse a puffin capture, using a query from the command-line or a file
+func Analyse(dbPath string, query string, queryFile string, tree bool, maxDepth int) error {
+	db, err := OpenCaptureDB(dbPath)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if tree {
+		procTree, err := ReadProcessTree(db)
+		if err != nil {
+			return err
+		}
+
+		RenderProcessTree(os.Stdout, procTree, maxDepth, map[int]bool{})
+		return nil
+	}
+
+	if len(queryFile) > 0 {
+		content, err := ioutil.ReadFile(queryFile)
+		if err != nil {
+			return err
+		}
+
+		query = string(content)
+	}
+
+	if len(query) == 0 {
+		query = DEFAULT_ANALYSE_QUERY
+	}
+
+	return AnalyseQuery(db, query)
+}
+
+// Match a capture's connections whose ends were both captured, printing the graph of services as JSON
+func AnalyseDependencies(dbPath string, nat *AddressMap) error {
+	source, err := OpenCaptureSource(dbPath)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.MarshalIndent(BuildDependencyGraph(snapshot.connections, nat), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// Print a capture's graph of which processes, commands, containers or hosts talk to which
+func AnalyseGraph(dbPath string, group string, format string, nat *AddressMap) error {
+	source, err := OpenCaptureSource(dbPath)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	return WriteTrafficGraph(os.Stdout, BuildTrafficGraph(snapshot, group, nat), format)
+}
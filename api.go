@@ -0,0 +1,950 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	API_DEFAULT_LISTEN = "127.0.0.1:7070"
+	API_DEFAULT_WINDOW = time.Minute
+	API_MAX_WINDOW     = 5 * time.Minute // packets are kept at least this long while the API is served
+	API_DEFAULT_LIMIT  = 10
+	API_DEFAULT_STEP   = time.Second
+	API_MAX_STEPS      = 1000
+	API_HEADER_TIMEOUT = 10 * time.Second
+	API_SOCKET_UMASK   = 0177 // live state is as sensitive as the capture, so only its owner may connect
+)
+
+// Where to serve the API: a unix socket (unix:///path or unix:path), or a loopback host:port
+func ParseListenAddress(addr string) (string, string, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		fpath := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+		if len(fpath) == 0 {
+			return "", "", fmt.Errorf("--listen: a unix socket needs a path")
+		}
+		return "unix", fpath, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("--listen: %v", err)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", "", fmt.Errorf("--listen: %s is not a loopback address; use localhost, 127.0.0.1, ::1 or a unix socket", host)
+	}
+
+	return "tcp", addr, nil
+}
+
+// A process and its traffic
+type APIProcess struct {
+	Host            string      `json:"host,omitempty"` // set by a collector, or for a capture of several hosts
+	Pid             int         `json:"pid"`
+	StartTime       uint64      `json:"start_time"`
+	Command         string      `json:"command"`
+	CommandLine     string      `json:"command_line"`
+	UserName        string      `json:"username"`
+	Cgroup          string      `json:"cgroup"`
+	Parents         []ProcessId `json:"parent_pids"`
+	ConnectionCount int         `json:"connection_count"`
+	OpenConnections int         `json:"open_connections"`
+	BytesOut        int         `json:"bytes_out"`
+	BytesIn         int         `json:"bytes_in"`
+	PacketsOut      int         `json:"packets_out"`
+	PacketsIn       int         `json:"packets_in"`
+}
+
+// A process-socket over its lifetime, and its traffic
+type APIConnection struct {
+	Host        string        `json:"host,omitempty"`
+	Pid         int           `json:"pid"`
+	StartTime   uint64        `json:"start_time"`
+	Command     string        `json:"command"`
+	Protocol    string        `json:"protocol"`
+	LocalAddr   string        `json:"local_addr"`
+	LocalPort   uint64        `json:"local_port"`
+	RemAddr     string        `json:"rem_addr"`
+	RemPort     uint64        `json:"rem_port"`
+	Inode       uint64        `json:"inode"`
+	State       string        `json:"state,omitempty"`
+	Open        bool          `json:"open"`
+	Opened      time.Time     `json:"opened"`
+	Closed      *time.Time    `json:"closed"`
+	BytesOut    int           `json:"bytes_out"`
+	BytesIn     int           `json:"bytes_in"`
+	PacketsOut  int           `json:"packets_out"`
+	PacketsIn   int           `json:"packets_in"`
+	FirstPacket *time.Time    `json:"first_packet"`
+	LastPacket  *time.Time    `json:"last_packet"`
+	TCPFlow     *TCPFlowStats `json:"tcp_flow,omitempty"`
+}
+
+// A network device, and the traffic captured on it
+type APIDevice struct {
+	Host        string     `json:"host,omitempty"`
+	Name        string     `json:"name"`
+	Flows       int        `json:"flows"`
+	Packets     int        `json:"packets"`
+	Bytes       int        `json:"bytes"`
+	FirstPacket *time.Time `json:"first_packet"`
+	LastPacket  *time.Time `json:"last_packet"`
+}
+
+// A process, remote address or connection's traffic within a window
+type APITalker struct {
+	Group      string `json:"group"`
+	Host       string `json:"host,omitempty"`
+	Pid        int    `json:"pid,omitempty"`
+	StartTime  uint64 `json:"start_time,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Remote     string `json:"remote,omitempty"`
+	Bytes      int    `json:"bytes"`
+	BytesOut   int    `json:"bytes_out"`
+	BytesIn    int    `json:"bytes_in"`
+	PacketsOut int    `json:"packets_out"`
+	PacketsIn  int    `json:"packets_in"`
+}
+
+type APITopTalkers struct {
+	By      string      `json:"by"`
+	Window  string      `json:"window"`
+	Since   time.Time   `json:"since"`
+	Talkers []APITalker `json:"talkers"`
+}
+
+// A process, with each of its connections
+type APIProcessDetail struct {
+	APIProcess
+	Connections []APIConnection `json:"connections"`
+}
+
+type APIStatus struct {
+	Live        bool      `json:"live"`
+	Source      string    `json:"source"` // "live", or the capture database served
+	Start       time.Time `json:"start"`
+	Now         time.Time `json:"now"` // the latest moment a saved capture covers
+	Processes   int       `json:"processes"`
+	Connections int       `json:"connections"`
+	Open        int       `json:"open_connections"`
+	Devices     int       `json:"devices"`
+	Flows       int       `json:"flows"`
+}
+
+// A device's traffic in each step, oldest first
+type APIDeviceTimeline struct {
+	Name     string  `json:"name"`
+	BytesOut []int64 `json:"bytes_out"`
+	BytesIn  []int64 `json:"bytes_in"`
+}
+
+type APITimeline struct {
+	Since   time.Time           `json:"since"`
+	Step    string              `json:"step"`
+	Devices []APIDeviceTimeline `json:"devices"`
+
+	step    time.Duration
+	steps   int
+	devices map[string]int
+}
+
+func newAPITimeline(since time.Time, step time.Duration, steps int) *APITimeline {
+	return &APITimeline{since, step.String(), []APIDeviceTimeline{}, step, steps, map[string]int{}}
+}
+
+// Add traffic at a time to its device's step; traffic outside the timeline is ignored
+func (timeline *APITimeline) add(device string, direction string, nanos int64, bytes int64) {
+	offset := nanos - timeline.Since.UnixNano()
+	if offset < 0 || offset >= int64(timeline.steps)*int64(timeline.step) {
+		return
+	}
+
+	idx, ok := timeline.devices[device]
+	if !ok {
+		idx = len(timeline.Devices)
+		timeline.devices[device] = idx
+		timeline.Devices = append(timeline.Devices, APIDeviceTimeline{device, make([]int64, timeline.steps), make([]int64, timeline.steps)})
+	}
+
+	step := offset / int64(timeline.step)
+	if directionIndex(direction) == 0 {
+		timeline.Devices[idx].BytesOut[step] += bytes
+	} else {
+		timeline.Devices[idx].BytesIn[step] += bytes
+	}
+}
+
+// Devices by name
+func (timeline *APITimeline) finish() APITimeline {
+	sort.Slice(timeline.Devices, func(i, j int) bool {
+		return timeline.Devices[i].Name < timeline.Devices[j].Name
+	})
+
+	return *timeline
+}
+
+func apiTime(nanos int) *time.Time {
+	if nanos == 0 {
+		return nil
+	}
+
+	when := time.Unix(0, int64(nanos)).UTC()
+	return &when
+}
+
+// Processes, connections and devices as of one moment
+type apiSnapshot struct {
+	processes   []APIProcess
+	connections []APIConnection
+	devices     []APIDevice
+	flows       int
+	processIdx  map[string]int // by host & process id
+}
+
+func newAPISnapshot() apiSnapshot {
+	return apiSnapshot{[]APIProcess{}, []APIConnection{}, []APIDevice{}, 0, map[string]int{}}
+}
+
+// Identifies a process among those of several hosts
+func apiProcessKey(host string, id ProcessId) string {
+	return host + " " + id.String()
+}
+
+// Add a process's connection, and sum its traffic into the process. Processes are listed in the
+// order they were first seen
+func (snapshot *apiSnapshot) addConnection(process APIProcess, conn APIConnection) {
+	snapshot.connections = append(snapshot.connections, conn)
+
+	id := apiProcessKey(process.Host, ProcessId{process.Pid, process.StartTime})
+	idx, ok := snapshot.processIdx[id]
+	if !ok {
+		idx = len(snapshot.processes)
+		snapshot.processIdx[id] = idx
+		snapshot.processes = append(snapshot.processes, process)
+	}
+
+	total := &snapshot.processes[idx]
+	total.ConnectionCount++
+	if conn.Open {
+		total.OpenConnections++
+	}
+	total.BytesOut += conn.BytesOut
+	total.BytesIn += conn.BytesIn
+	total.PacketsOut += conn.PacketsOut
+	total.PacketsIn += conn.PacketsIn
+}
+
+// Read processes, connections & devices from the store; the caller holds the store lock
+func buildAPISnapshot(conns *ConnectionTable, store MachineNetworkStorage) apiSnapshot {
+	flows := attributeFlows(conns, store)
+	traffic := sumConnectionTraffic(flows)
+	snapshot := newAPISnapshot()
+	snapshot.flows = len(flows)
+
+	for _, tracked := range conns.Tracked() {
+		pidConn := tracked.ProcessSocket
+		conn := pidConn.Connection
+		total, ok := traffic[tracked]
+		if !ok {
+			total = &connectionTraffic{}
+		}
+
+		apiConn := APIConnection{
+			Pid: pidConn.Pid, StartTime: pidConn.StartTime, Command: pidConn.Command, Protocol: conn.GetType(),
+			LocalAddr: conn.GetLocalAddr().String(), LocalPort: conn.GetLocalPort(), RemAddr: conn.GetRemAddr().String(), RemPort: conn.GetRemPort(),
+			Inode: conn.GetInode(), Open: tracked.IsOpen(), Opened: tracked.Lifetime.Start, Closed: tracked.Lifetime.End,
+			BytesOut: total.bytes[0], BytesIn: total.bytes[1], PacketsOut: total.packets[0], PacketsIn: total.packets[1],
+			FirstPacket: apiTime(total.first), LastPacket: apiTime(total.last),
+		}
+
+		if tcp, ok := conn.(TCPConnection); ok {
+			tcpFlow := total.tcpFlow
+			apiConn.State, apiConn.TCPFlow = tcp.GetStateName(), &tcpFlow
+		}
+
+		snapshot.addConnection(APIProcess{
+			Pid: pidConn.Pid, StartTime: pidConn.StartTime, Command: pidConn.Command, CommandLine: pidConn.CommandLine,
+			UserName: pidConn.UserName, Cgroup: pidConn.Cgroup, Parents: pidConn.PidParents,
+		}, apiConn)
+	}
+
+	deviceIdx := map[string]int{}
+	for _, flow := range flows {
+		idx, ok := deviceIdx[flow.device]
+		if !ok {
+			idx = len(snapshot.devices)
+			deviceIdx[flow.device] = idx
+			snapshot.devices = append(snapshot.devices, APIDevice{Name: flow.device, FirstPacket: apiTime(flow.data.From), LastPacket: apiTime(flow.data.To)})
+		}
+
+		device := &snapshot.devices[idx]
+		device.Flows++
+		device.Packets += flow.data.Count
+		device.Bytes += flow.data.Size
+
+		if first := apiTime(flow.data.From); first != nil && (device.FirstPacket == nil || first.Before(*device.FirstPacket)) {
+			device.FirstPacket = first
+		}
+		if last := apiTime(flow.data.To); last != nil && (device.LastPacket == nil || last.After(*device.LastPacket)) {
+			device.LastPacket = last
+		}
+	}
+
+	return snapshot
+}
+
+// Identifies a process's connection among top talkers
+func apiConnectionKey(id ProcessId, protocol string, localAddr string, localPort uint64, remAddr string, remPort uint64) string {
+	return fmt.Sprintf("%s/%s %s:%d->%s:%d", id, protocol, localAddr, localPort, remAddr, remPort)
+}
+
+// Traffic summed by process, remote address or connection
+type apiTalkers struct {
+	by      string
+	talkers map[string]*APITalker
+}
+
+func newAPITalkers(by string) *apiTalkers {
+	return &apiTalkers{by, map[string]*APITalker{}}
+}
+
+// Add a connection's traffic in one direction to the talker it is grouped into
+func (talkers *apiTalkers) add(id ProcessId, command string, connKey string, remote string, direction string, bytes int, packets int) {
+	var key string
+	talker := APITalker{}
+
+	switch talkers.by {
+	case "remote":
+		key = remote
+		talker.Remote = remote
+	case "connection":
+		key = connKey
+		talker = APITalker{Pid: id.Pid, StartTime: id.StartTime, Command: command, Remote: remote}
+	default:
+		key = id.String()
+		talker = APITalker{Pid: id.Pid, StartTime: id.StartTime, Command: command}
+	}
+
+	total, ok := talkers.talkers[key]
+	if !ok {
+		talker.Group = key
+		total = &talker
+		talkers.talkers[key] = total
+	}
+
+	total.Bytes += bytes
+	if direction == "in" {
+		total.BytesIn += bytes
+		total.PacketsIn += packets
+	} else {
+		total.BytesOut += bytes
+		total.PacketsOut += packets
+	}
+}
+
+// The largest talkers, largest first
+func (talkers *apiTalkers) top(limit int) []APITalker {
+	top := []APITalker{}
+	for _, talker := range talkers.talkers {
+		top = append(top, *talker)
+	}
+
+	return rankTalkers(top, limit)
+}
+
+// Sort talkers largest first, keeping at most limit
+func rankTalkers(top []APITalker, limit int) []APITalker {
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		return top[i].Group < top[j].Group
+	})
+
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	return top
+}
+
+// Calls fn with each sample of a flow's traffic: when it was seen, and its bytes & packets
+type flowSamples func(flow *attributedFlow, fn func(timestamp int64, bytes int, packets int))
+
+// A flow's stored packets, one sample each
+func storedPackets(flow *attributedFlow, fn func(timestamp int64, bytes int, packets int)) {
+	for _, pkt := range flow.data.Packets {
+		fn(pkt.Timestamp, pkt.Size, 1)
+	}
+}
+
+// Sum attributed traffic since a time by process, remote address or connection, largest first
+func buildTopTalkers(conns *ConnectionTable, store MachineNetworkStorage, samples flowSamples, by string, since time.Time, limit int) []APITalker {
+	talkers := newAPITalkers(by)
+
+	for _, flow := range attributeFlows(conns, store) {
+		if flow.tracked == nil {
+			continue
+		}
+
+		bytes, packets := 0, 0
+		samples(&flow, func(timestamp int64, size int, count int) {
+			if timestamp >= since.UnixNano() {
+				bytes += size
+				packets += count
+			}
+		})
+		if packets == 0 {
+			continue
+		}
+
+		pidConn := flow.tracked.ProcessSocket
+		conn := pidConn.Connection
+		remote := conn.GetRemAddr().String()
+		connKey := apiConnectionKey(pidConn.GetProcessId(), conn.GetType(), conn.GetLocalAddr().String(), conn.GetLocalPort(), remote, conn.GetRemPort())
+
+		talkers.add(pidConn.GetProcessId(), pidConn.Command, connKey, remote, flow.direction, bytes, packets)
+	}
+
+	return talkers.top(limit)
+}
+
+// Sum each device's stored traffic into steps, since a time; the caller holds the store lock
+func buildTimeline(conns *ConnectionTable, store MachineNetworkStorage, samples flowSamples, since time.Time, step time.Duration, steps int) APITimeline {
+	timeline := newAPITimeline(since, step, steps)
+
+	for _, flow := range attributeFlows(conns, store) {
+		samples(&flow, func(timestamp int64, size int, count int) {
+			timeline.add(flow.device, flow.direction, timestamp, int64(size))
+		})
+	}
+
+	return timeline.finish()
+}
+
+// Where the API reads processes, connections & traffic from: the running capture, or a saved one
+type APISource interface {
+	Name() string
+	Span() (time.Time, time.Time, error) // when the capture started, and the latest moment it covers
+	MaxWindow() time.Duration            // how far back traffic can be summed
+	Snapshot() (apiSnapshot, error)
+	TopTalkers(by string, since time.Time, limit int) ([]APITalker, error)
+	Timeline(since time.Time, step time.Duration, steps int) (APITimeline, error)
+}
+
+// Reads from the capture loop's store. Every read holds the store lock, so each response is
+// consistent with a single moment of the capture
+type liveSource struct {
+	storeLock *sync.Mutex
+	conns     *ConnectionTable
+	store     MachineNetworkStorage
+	start     time.Time
+}
+
+func NewLiveSource(storeLock *sync.Mutex, conns *ConnectionTable, store MachineNetworkStorage, start time.Time) APISource {
+	return &liveSource{storeLock, conns, store, start}
+}
+
+func (source *liveSource) Name() string {
+	return "live"
+}
+
+func (source *liveSource) Span() (time.Time, time.Time, error) {
+	return source.start, time.Now(), nil
+}
+
+func (source *liveSource) MaxWindow() time.Duration {
+	return API_MAX_WINDOW
+}
+
+func (source *liveSource) Snapshot() (apiSnapshot, error) {
+	source.storeLock.Lock()
+	defer source.storeLock.Unlock()
+
+	return buildAPISnapshot(source.conns, source.store), nil
+}
+
+func (source *liveSource) TopTalkers(by string, since time.Time, limit int) ([]APITalker, error) {
+	source.storeLock.Lock()
+	defer source.storeLock.Unlock()
+
+	return buildTopTalkers(source.conns, source.store, storedPackets, by, since, limit), nil
+}
+
+func (source *liveSource) Timeline(since time.Time, step time.Duration, steps int) (APITimeline, error) {
+	source.storeLock.Lock()
+	defer source.storeLock.Unlock()
+
+	return buildTimeline(source.conns, source.store, storedPackets, since, step, steps), nil
+}
+
+// Serves processes, connections & devices as JSON, from a live or saved capture. Live captures
+// also stream updates, and the web UI can be served alongside
+type APIServer struct {
+	Network      string
+	Address      string
+	Translations *AddressMap // used to stitch connections across hosts
+	source       APISource
+	hub          *LiveHub
+	listener     net.Listener
+	server       *http.Server
+}
+
+// Listen for API requests. Without a hub, nothing is streamed
+func NewAPIServer(listen string, source APISource, hub *LiveHub, ui bool) (*APIServer, error) {
+	network, address, err := ParseListenAddress(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	var listener net.Listener
+
+	if network == "unix" {
+		// a socket left by an earlier run would stop us binding, but anything else is not ours to remove
+		if info, err := os.Lstat(address); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("--listen: %s exists and is not a socket", address)
+			}
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		// create the socket owner-only, rather than restricting it once others could connect
+		mask := syscall.Umask(API_SOCKET_UMASK)
+		listener, err = net.Listen(network, address)
+		syscall.Umask(mask)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	api := &APIServer{network, address, nil, source, hub, listener, nil}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", api.handleStatus)
+	mux.HandleFunc("/api/processes", api.handleProcesses)
+	mux.HandleFunc("/api/processes/", api.handleProcess)
+	mux.HandleFunc("/api/connections", api.handleConnections)
+	mux.HandleFunc("/api/devices", api.handleDevices)
+	mux.HandleFunc("/api/top", api.handleTop)
+	mux.HandleFunc("/api/timeline", api.handleTimeline)
+	mux.HandleFunc("/api/dependencies", api.handleDependencies)
+	mux.HandleFunc("/api/graph", api.handleGraph)
+
+	if hub != nil {
+		mux.HandleFunc("/api/stream", hub.ServeSSE)
+		mux.HandleFunc("/api/ws", hub.ServeWebSocket)
+	}
+	if ui {
+		mux.Handle("/", UIHandler())
+	}
+
+	api.server = &http.Server{Handler: api.checkHost(mux), ReadHeaderTimeout: API_HEADER_TIMEOUT}
+	return api, nil
+}
+
+// Whether a request's Host names the API: a loopback name or address, or the address it listens on.
+// A page whose own domain resolves to 127.0.0.1 (DNS rebinding) sends that domain instead
+func (api *APIServer) allowedHost(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if listenHost, _, err := net.SplitHostPort(api.Address); err == nil && strings.EqualFold(host, listenHost) {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+
+	return strings.EqualFold(host, "localhost")
+}
+
+// Refuse TCP requests for other hosts, so browsers can't be turned against the API
+func (api *APIServer) checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if api.Network == "tcp" && !api.allowedHost(req.Host) {
+			writeAPIError(res, http.StatusForbidden, "unexpected Host header")
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+// Where the API is served, as a URL
+func (api *APIServer) URL() string {
+	if api.Network == "unix" {
+		return "unix://" + api.Address
+	}
+	return "http://" + api.listener.Addr().String()
+}
+
+// Serve until closed
+func (api *APIServer) Serve() {
+	if err := api.server.Serve(api.listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("API server on %s stopped: %v", api.Address, err)
+	}
+}
+
+func (api *APIServer) Close() error {
+	err := api.server.Close()
+	if api.Network == "unix" {
+		os.Remove(api.Address)
+	}
+
+	return err
+}
+
+func writeAPIJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+
+	if err := json.NewEncoder(res).Encode(body); err != nil {
+		log.Printf("could not write API response: %v", err)
+	}
+}
+
+func writeAPIError(res http.ResponseWriter, status int, message string) {
+	writeAPIJSON(res, status, map[string]string{"error": message})
+}
+
+// Only GET is served; returns false after responding otherwise
+func allowGet(res http.ResponseWriter, req *http.Request) bool {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return true
+	}
+
+	res.Header().Set("Allow", "GET, HEAD")
+	writeAPIError(res, http.StatusMethodNotAllowed, "only GET is supported")
+	return false
+}
+
+// Log a failure to read the source, and respond without its details
+func (api *APIServer) sourceError(res http.ResponseWriter, err error) {
+	log.Printf("could not read %s capture: %v", api.source.Name(), err)
+	writeAPIError(res, http.StatusInternalServerError, "could not read the capture")
+}
+
+// Read a snapshot from the source, responding with an error if it can't be read
+func (api *APIServer) snapshot(res http.ResponseWriter) (apiSnapshot, bool) {
+	snapshot, err := api.source.Snapshot()
+	if err != nil {
+		api.sourceError(res, err)
+		return snapshot, false
+	}
+
+	return snapshot, true
+}
+
+func (api *APIServer) handleStatus(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	start, now, err := api.source.Span()
+	if err != nil {
+		api.sourceError(res, err)
+		return
+	}
+
+	snapshot, ok := api.snapshot(res)
+	if !ok {
+		return
+	}
+
+	status := APIStatus{
+		Live:        api.hub != nil,
+		Source:      api.source.Name(),
+		Start:       start,
+		Now:         now,
+		Processes:   len(snapshot.processes),
+		Connections: len(snapshot.connections),
+		Devices:     len(snapshot.devices),
+		Flows:       snapshot.flows,
+	}
+	for _, conn := range snapshot.connections {
+		if conn.Open {
+			status.Open++
+		}
+	}
+
+	writeAPIJSON(res, http.StatusOK, status)
+}
+
+func (api *APIServer) handleProcesses(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	if snapshot, ok := api.snapshot(res); ok {
+		writeAPIJSON(res, http.StatusOK, snapshot.processes)
+	}
+}
+
+// Connections, optionally only those of a pid (?pid=) or only open ones (?open=true)
+func (api *APIServer) handleConnections(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	query := req.URL.Query()
+	pid, openOnly := -1, query.Get("open") == "true"
+
+	if str := query.Get("pid"); len(str) > 0 {
+		parsed, err := strconv.Atoi(str)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, "pid must be a number")
+			return
+		}
+		pid = parsed
+	}
+
+	snapshot, ok := api.snapshot(res)
+	if !ok {
+		return
+	}
+
+	conns := []APIConnection{}
+	for _, conn := range snapshot.connections {
+		if (pid < 0 || conn.Pid == pid) && (!openOnly || conn.Open) {
+			conns = append(conns, conn)
+		}
+	}
+
+	writeAPIJSON(res, http.StatusOK, conns)
+}
+
+func (api *APIServer) handleDevices(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	if snapshot, ok := api.snapshot(res); ok {
+		writeAPIJSON(res, http.StatusOK, snapshot.devices)
+	}
+}
+
+// A single pid's process and connections. A pid reused during the capture refers to its latest process
+func (api *APIServer) handleProcess(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	pid, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/api/processes/"))
+	if err != nil {
+		writeAPIError(res, http.StatusBadRequest, "expected /api/processes/<pid>")
+		return
+	}
+
+	snapshot, ok := api.snapshot(res)
+	if !ok {
+		return
+	}
+
+	var detail *APIProcessDetail
+	for _, process := range snapshot.processes {
+		if process.Pid == pid && (detail == nil || process.StartTime > detail.StartTime) {
+			detail = &APIProcessDetail{process, []APIConnection{}}
+		}
+	}
+
+	if detail == nil {
+		writeAPIError(res, http.StatusNotFound, fmt.Sprintf("no connections seen for pid %d", pid))
+		return
+	}
+
+	for _, conn := range snapshot.connections {
+		if conn.Pid == pid && conn.StartTime == detail.StartTime {
+			detail.Connections = append(detail.Connections, conn)
+		}
+	}
+
+	writeAPIJSON(res, http.StatusOK, detail)
+}
+
+// Read ?window= as a duration the source can answer for, responding with an error if it is invalid
+func (api *APIServer) window(res http.ResponseWriter, req *http.Request) (time.Duration, bool) {
+	str := req.URL.Query().Get("window")
+	if len(str) == 0 {
+		return API_DEFAULT_WINDOW, true
+	}
+
+	window, err := time.ParseDuration(str)
+	if maxWindow := api.source.MaxWindow(); err != nil || window <= 0 || window > maxWindow {
+		writeAPIError(res, http.StatusBadRequest, fmt.Sprintf("window must be a duration up to %s, e.g. 30s", maxWindow))
+		return 0, false
+	}
+
+	return window, true
+}
+
+// The moment a window ends: now, or the end of a saved capture
+func (api *APIServer) windowEnd(res http.ResponseWriter) (time.Time, bool) {
+	_, end, err := api.source.Span()
+	if err != nil {
+		api.sourceError(res, err)
+		return end, false
+	}
+
+	return end, true
+}
+
+// The largest talkers over a recent window: ?window=1m&by=process|remote|connection&limit=10
+func (api *APIServer) handleTop(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	query := req.URL.Query()
+	limit, by := API_DEFAULT_LIMIT, query.Get("by")
+
+	window, ok := api.window(res, req)
+	if !ok {
+		return
+	}
+
+	if str := query.Get("limit"); len(str) > 0 {
+		parsed, err := strconv.Atoi(str)
+		if err != nil || parsed <= 0 {
+			writeAPIError(res, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = parsed
+	}
+
+	switch by {
+	case "":
+		by = "process"
+	case "process", "remote", "connection":
+	default:
+		writeAPIError(res, http.StatusBadRequest, "by must be process, remote or connection")
+		return
+	}
+
+	end, ok := api.windowEnd(res)
+	if !ok {
+		return
+	}
+
+	since := end.Add(-window)
+	talkers, err := api.source.TopTalkers(by, since, limit)
+	if err != nil {
+		api.sourceError(res, err)
+		return
+	}
+
+	writeAPIJSON(res, http.StatusOK, APITopTalkers{by, window.String(), since, talkers})
+}
+
+// Each device's traffic over a recent window, in steps: ?window=1m&step=1s
+func (api *APIServer) handleTimeline(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	window, ok := api.window(res, req)
+	if !ok {
+		return
+	}
+
+	step := API_DEFAULT_STEP
+	if str := req.URL.Query().Get("step"); len(str) > 0 {
+		parsed, err := time.ParseDuration(str)
+		if err != nil || parsed <= 0 {
+			writeAPIError(res, http.StatusBadRequest, "step must be a duration, e.g. 1s")
+			return
+		}
+		step = parsed
+	}
+
+	steps := int((window + step - 1) / step)
+	if steps > API_MAX_STEPS {
+		writeAPIError(res, http.StatusBadRequest, fmt.Sprintf("a window can have at most %d steps", API_MAX_STEPS))
+		return
+	}
+
+	end, ok := api.windowEnd(res)
+	if !ok {
+		return
+	}
+
+	// whole steps, so a live timeline's steps line up from one request to the next
+	since := end.Add(-window).Truncate(step)
+	timeline, err := api.source.Timeline(since, step, steps+1)
+	if err != nil {
+		api.sourceError(res, err)
+		return
+	}
+
+	writeAPIJSON(res, http.StatusOK, timeline)
+}
+
+// Connections whose ends were both captured, e.g. by agents on two hosts, as a graph of services
+func (api *APIServer) handleDependencies(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	if snapshot, ok := api.snapshot(res); ok {
+		writeAPIJSON(res, http.StatusOK, BuildDependencyGraph(snapshot.connections, api.Translations))
+	}
+}
+
+// A graph of which processes talk to which: ?group=process|command|container|host&format=json|dot|mermaid
+func (api *APIServer) handleGraph(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	query := req.URL.Query()
+	group, format := query.Get("group"), query.Get("format")
+	if len(group) == 0 {
+		group = GRAPH_GROUP_PROCESS
+	}
+	if len(format) == 0 {
+		format = "json"
+	}
+
+	if err := ValidateGraphOptions(group, format); err != nil {
+		writeAPIError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	snapshot, ok := api.snapshot(res)
+	if !ok {
+		return
+	}
+
+	graph := BuildTrafficGraph(snapshot, group, api.Translations)
+
+	switch format {
+	case "json":
+		writeAPIJSON(res, http.StatusOK, graph)
+	case "dot":
+		res.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		WriteTrafficGraph(res, graph, format)
+	default:
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteTrafficGraph(res, graph, format)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAPIServer(t *testing.T, listen string) (*APIServer, error) {
+	var lock sync.Mutex
+	source := NewLiveSource(&lock, NewConnectionTable(), MachineNetworkStorage{}, time.Now())
+
+	api, err := NewAPIServer(listen, source, nil, false)
+	if err == nil {
+		go api.Serve()
+		t.Cleanup(func() { api.Close() })
+	}
+
+	return api, err
+}
+
+func TestAPIRejectsForeignHosts(t *testing.T) {
+	api, err := newTestAPIServer(t, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := api.listener.Addr().(*net.TCPAddr).Port
+	expected := map[string]int{
+		fmt.Sprintf("127.0.0.1:%d", port):           http.StatusOK,
+		fmt.Sprintf("localhost:%d", port):           http.StatusOK,
+		fmt.Sprintf("[::1]:%d", port):               http.StatusOK,
+		"localhost":                                 http.StatusOK,
+		fmt.Sprintf("rebound.example.com:%d", port): http.StatusForbidden,
+		"127.0.0.1.nip.io":                          http.StatusForbidden,
+		"localhost.example.com":                     http.StatusForbidden,
+	}
+
+	for host, status := range expected {
+		req, err := http.NewRequest(http.MethodGet, api.URL()+"/api/status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != status {
+			t.Errorf("Host %s: responded %d, expected %d", req.Host, res.StatusCode, status)
+		}
+	}
+}
+
+func TestAPIUnixSocketIsOwnerOnly(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "puffin.sock")
+
+	// a stale socket is replaced
+	for idx := 0; idx < 2; idx++ {
+		api, err := newTestAPIServer(t, "unix:"+fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Lstat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("socket has mode %o, expected 600", mode)
+		}
+
+		// leave the socket behind, as a crashed run would
+		api.listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		api.server.Close()
+	}
+}
+
+func TestAPIKeepsFilesAtSocketPath(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "capture.db")
+	if err := os.WriteFile(fpath, []byte("not a socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTestAPIServer(t, "unix:"+fpath); err == nil {
+		t.Fatal("listened in place of a regular file")
+	}
+
+	if content, err := os.ReadFile(fpath); err != nil || string(content) != "not a socket" {
+		t.Errorf("file at the socket path was changed: %q, %v", content, err)
+	}
+}
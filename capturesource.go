@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Every process's connection, with its owner and host
+const CAPTURE_CONNECTIONS_QUERY = `select s.hostname, p.pid, p.startTime, coalesce(p.command, ''), coalesce(p.commandLine, ''), coalesce(p.cgroup, ''), coalesce(u.username, ''),
+	c.id, c.protocol, c.localAddr, c.localPort, c.remAddr, c.remPort, c.inode, coalesce(c.state, ''),
+	coalesce(pc.opened, pc.time, 0), pc.closed
+from process_connection pc
+join process p on p.id = pc.process_id
+join session s on s.id = p.session_id
+join connection c on c.id = pc.connection_id
+left join users u on u.session_id = c.session_id and u.uid = c.uid
+order by coalesce(pc.opened, pc.time), p.id, c.id`
+
+// Each connection's traffic by direction, summed over every flush
+const CAPTURE_TRAFFIC_QUERY = `select connection_id, direction, sum(size), coalesce(min(start), 0), coalesce(max(end), 0),
+	coalesce(sum(retransmissions), 0), coalesce(sum(outOfOrder), 0), coalesce(sum(duplicateAcks), 0), coalesce(sum(zeroWindows), 0), coalesce(max(handshakeRtt), 0)
+from conn_summary
+group by connection_id, direction`
+
+const CAPTURE_PACKETS_QUERY = `select connection_id, direction, count(*) from packet group by connection_id, direction`
+
+const CAPTURE_DEVICES_QUERY = `select h.hostname, d.name, count(*), sum(s.size), coalesce(min(s.start), 0), coalesce(max(s.end), 0),
+	(select count(*) from packet p where p.device_id = d.id)
+from conn_summary s
+join device d on d.id = s.device_id
+join session h on h.id = d.session_id
+group by d.id
+order by h.hostname, d.name`
+
+// Attributed traffic since a time, by process, connection & direction
+const CAPTURE_TALKERS_QUERY = `select p.pid, p.startTime, coalesce(p.command, ''), c.protocol, c.localAddr, c.localPort, c.remAddr, c.remPort, k.direction, sum(k.size), count(*)
+from packet k
+join connection c on c.id = k.connection_id
+join process_connection pc on pc.connection_id = c.id
+join process p on p.id = pc.process_id
+where k.time >= ?
+group by p.id, c.id, k.direction`
+
+// Each device's traffic by direction, in steps from a time
+const CAPTURE_TIMELINE_QUERY = `select d.name, k.direction, k.time - (k.time - ?) % ?, sum(k.size)
+from packet k
+join device d on d.id = k.device_id
+where k.time >= ? and k.time < ?
+group by d.id, k.direction, (k.time - ?) / ?`
+
+// Reads from a saved capture database, without changing it; windows end where the capture does
+type captureSource struct {
+	fpath string
+	db    *sql.DB
+	close func()
+}
+
+func OpenCaptureSource(fpath string) (*captureSource, error) {
+	db, _, closeDB, err := OpenCaptureDBReadOnly(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &captureSource{fpath, db, closeDB}, nil
+}
+
+func (source *captureSource) Close() error {
+	source.close()
+	return nil
+}
+
+func (source *captureSource) Name() string {
+	return source.fpath
+}
+
+func (source *captureSource) Span() (time.Time, time.Time, error) {
+	var start, end int64
+	err := source.db.QueryRow("select coalesce(min(start), 0), coalesce(max(coalesce(end, start)), 0) from session").Scan(&start, &end)
+
+	return time.Unix(0, start).UTC(), time.Unix(0, end).UTC(), err
+}
+
+// The whole capture can be summed over
+func (source *captureSource) MaxWindow() time.Duration {
+	start, end, err := source.Span()
+	if err != nil || end.Sub(start) < API_MAX_WINDOW {
+		return API_MAX_WINDOW
+	}
+
+	return end.Sub(start).Truncate(time.Second) + time.Second
+}
+
+// Whether the capture holds sessions from several hosts, e.g. written by a collector
+func (source *captureSource) multiHost() (bool, error) {
+	var hosts int
+	err := source.db.QueryRow("select count(distinct hostname) from session").Scan(&hosts)
+
+	return hosts > 1, err
+}
+
+// The host a capture was taken on; one of them, for a capture of several hosts
+func (source *captureSource) hostname() (string, error) {
+	var hostname string
+	err := source.db.QueryRow("select coalesce(max(hostname), '') from session").Scan(&hostname)
+
+	return hostname, err
+}
+
+// Each process's ancestors, nearest first
+func (source *captureSource) parents() (map[ProcessId][]ProcessId, error) {
+	rows, err := source.db.Query(PROCESS_PARENTS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	parents := map[ProcessId][]ProcessId{}
+
+	for rows.Next() {
+		var child, parent ProcessId
+		var level int
+
+		if err := rows.Scan(&child.Pid, &child.StartTime, &parent.Pid, &parent.StartTime, &level); err != nil {
+			return nil, err
+		}
+		parents[child] = append(parents[child], parent)
+	}
+
+	return parents, rows.Err()
+}
+
+// Each connection's traffic, by connection id
+func (source *captureSource) traffic() (map[int64]*connectionTraffic, error) {
+	traffic := map[int64]*connectionTraffic{}
+	get := func(id int64) *connectionTraffic {
+		total, ok := traffic[id]
+		if !ok {
+			total = &connectionTraffic{}
+			traffic[id] = total
+		}
+		return total
+	}
+
+	rows, err := source.db.Query(CAPTURE_TRAFFIC_QUERY)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var direction string
+		var size, first, last int
+		var flow TCPFlowStats
+
+		if err := rows.Scan(&id, &direction, &size, &first, &last, &flow.Retransmissions, &flow.OutOfOrder, &flow.DuplicateAcks, &flow.ZeroWindows, &flow.HandshakeRTT); err != nil {
+			return nil, err
+		}
+
+		total := get(id)
+		total.bytes[directionIndex(direction)] += size
+		if first > 0 && (total.first == 0 || first < total.first) {
+			total.first = first
+		}
+		if last > total.last {
+			total.last = last
+		}
+
+		total.tcpFlow.Add(flow)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	packets, err := source.db.Query(CAPTURE_PACKETS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+
+	defer packets.Close()
+
+	for packets.Next() {
+		var id int64
+		var direction string
+		var count int
+
+		if err := packets.Scan(&id, &direction, &count); err != nil {
+			return nil, err
+		}
+		get(id).packets[directionIndex(direction)] += count
+	}
+
+	return traffic, packets.Err()
+}
+
+func (source *captureSource) Snapshot() (apiSnapshot, error) {
+	snapshot := newAPISnapshot()
+
+	multiHost, err := source.multiHost()
+	if err != nil {
+		return snapshot, err
+	}
+
+	parents, err := source.parents()
+	if err != nil {
+		return snapshot, err
+	}
+
+	traffic, err := source.traffic()
+	if err != nil {
+		return snapshot, err
+	}
+
+	rows, err := source.db.Query(CAPTURE_CONNECTIONS_QUERY)
+	if err != nil {
+		return snapshot, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var process APIProcess
+		var conn APIConnection
+		var host string
+		var connId, opened int64
+		var closed sql.NullInt64
+
+		err := rows.Scan(&host, &process.Pid, &process.StartTime, &process.Command, &process.CommandLine, &process.Cgroup, &process.UserName,
+			&connId, &conn.Protocol, &conn.LocalAddr, &conn.LocalPort, &conn.RemAddr, &conn.RemPort, &conn.Inode, &conn.State, &opened, &closed)
+		if err != nil {
+			return snapshot, err
+		}
+
+		process.Parents = parents[ProcessId{process.Pid, process.StartTime}]
+		if process.Parents == nil {
+			process.Parents = []ProcessId{}
+		}
+
+		if multiHost {
+			process.Host, conn.Host = host, host
+		}
+
+		conn.Pid, conn.StartTime, conn.Command = process.Pid, process.StartTime, process.Command
+		conn.Opened, conn.Open = time.Unix(0, opened).UTC(), !closed.Valid
+		if closed.Valid {
+			conn.Closed = apiTime(int(closed.Int64))
+		}
+
+		total, ok := traffic[connId]
+		if !ok {
+			total = &connectionTraffic{}
+		}
+
+		conn.BytesOut, conn.BytesIn, conn.PacketsOut, conn.PacketsIn = total.bytes[0], total.bytes[1], total.packets[0], total.packets[1]
+		conn.FirstPacket, conn.LastPacket = apiTime(total.first), apiTime(total.last)
+
+		if conn.Protocol == "TCP" {
+			tcpFlow := total.tcpFlow
+			conn.TCPFlow = &tcpFlow
+		} else {
+			conn.State = ""
+		}
+
+		snapshot.addConnection(process, conn)
+	}
+
+	if err := rows.Err(); err != nil {
+		return snapshot, err
+	}
+
+	devices, err := source.db.Query(CAPTURE_DEVICES_QUERY)
+	if err != nil {
+		return snapshot, err
+	}
+
+	defer devices.Close()
+
+	for devices.Next() {
+		var device APIDevice
+		var first, last int
+
+		if err := devices.Scan(&device.Host, &device.Name, &device.Flows, &device.Bytes, &first, &last, &device.Packets); err != nil {
+			return snapshot, err
+		}
+
+		device.FirstPacket, device.LastPacket = apiTime(first), apiTime(last)
+		snapshot.flows += device.Flows
+		snapshot.devices = append(snapshot.devices, device)
+	}
+
+	return snapshot, devices.Err()
+}
+
+func (source *captureSource) TopTalkers(by string, since time.Time, limit int) ([]APITalker, error) {
+	rows, err := source.db.Query(CAPTURE_TALKERS_QUERY, since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	talkers := newAPITalkers(by)
+
+	for rows.Next() {
+		var id ProcessId
+		var command, protocol, localAddr, remAddr, direction string
+		var localPort, remPort uint64
+		var bytes, packets int
+
+		if err := rows.Scan(&id.Pid, &id.StartTime, &command, &protocol, &localAddr, &localPort, &remAddr, &remPort, &direction, &bytes, &packets); err != nil {
+			return nil, err
+		}
+
+		connKey := apiConnectionKey(id, protocol, localAddr, localPort, remAddr, remPort)
+		talkers.add(id, command, connKey, remAddr, direction, bytes, packets)
+	}
+
+	return talkers.top(limit), rows.Err()
+}
+
+func (source *captureSource) Timeline(since time.Time, step time.Duration, steps int) (APITimeline, error) {
+	timeline := newAPITimeline(since, step, steps)
+	from, width := since.UnixNano(), int64(step)
+
+	rows, err := source.db.Query(CAPTURE_TIMELINE_QUERY, from, width, from, from+int64(steps)*width, from, width)
+	if err != nil {
+		return APITimeline{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var device, direction string
+		var nanos, bytes int64
+
+		if err := rows.Scan(&device, &direction, &nanos, &bytes); err != nil {
+			return APITimeline{}, err
+		}
+		timeline.add(device, direction, nanos, bytes)
+	}
+
+	return timeline.finish(), rows.Err()
+}
+
+// Serve a saved capture's API, and optionally the web UI, until interrupted
+func ServeCapture(fpath string, listen string, ui bool, translations *AddressMap) error {
+	source, err := OpenCaptureSource(fpath)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	api, err := NewAPIServer(listen, source, nil, ui)
+	if err != nil {
+		return err
+	}
+	api.Translations = translations
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		<-stop
+		api.Close()
+	}()
+
+	log.Printf("serving %s on %s", fpath, api.URL())
+	api.Serve()
+
+	return nil
+}
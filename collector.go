@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	COLLECTOR_DEFAULT_BIND   = ":7071"
+	COLLECTOR_IDLE_TIMEOUT   = 5 * time.Minute  // agents that send nothing for this long are disconnected, and reconnect when they next report
+	COLLECTOR_WRITE_TIMEOUT  = 10 * time.Second // to acknowledge a report
+	COLLECTOR_VIEW_INTERVAL  = time.Second
+	COLLECTOR_HOST_SEPARATOR = "/" // between a host and its device or service
+)
+
+// Options for collecting agents' reports, parsed from the command-line
+type CollectorOptions struct {
+	Bind         string
+	Token        string         // agents must send this, from $PUFFIN_AGENT_TOKEN
+	Daemon       *DaemonOptions // where & how often collected traffic is written
+	Listen       string         // serve a JSON API across hosts
+	UI           bool
+	Translations *AddressMap // used to stitch connections across hosts
+	Interactive  bool        // show every host's traffic live
+	Tree         bool
+	Depth        int
+}
+
+// One agent's capture session, as collected since the last flush
+type collectedHost struct {
+	Name       string
+	Remote     string // the agent's address
+	LastReport time.Time
+	session    CaptureSession
+	sequence   uint64 // the last report merged, so reports resent after a lost acknowledgement are ignored
+	conns      *ConnectionTable
+	store      MachineNetworkStorage
+	reports    map[string][]agentSample // each report's traffic by device & flow, for the API
+}
+
+// One report's traffic on a flow
+type agentSample struct {
+	time    int64
+	bytes   int
+	packets int
+}
+
+// A flow's reported traffic, one sample per report
+func (host *collectedHost) samples(flow *attributedFlow, fn func(timestamp int64, bytes int, packets int)) {
+	for _, sample := range host.reports[flow.device+"/"+flow.flowId] {
+		fn(sample.time, sample.bytes, sample.packets)
+	}
+}
+
+// Forget samples older than the API can query
+func (host *collectedHost) pruneReports(before int64) {
+	for key, samples := range host.reports {
+		kept := []agentSample{}
+		for _, sample := range samples {
+			if sample.time >= before {
+				kept = append(kept, sample)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(host.reports, key)
+		} else {
+			host.reports[key] = kept
+		}
+	}
+}
+
+// Merges reports from many agents. Each host's connections & traffic are kept apart, since
+// their 4-tuples mirror one another, and are written to the database as sessions of their own
+type Collector struct {
+	token     string
+	lock      sync.Mutex
+	hosts     map[string]*collectedHost
+	retired   []*collectedHost // sessions of restarted agents, written at the next flush
+	lastFlush time.Time
+}
+
+func NewCollector(token string, start time.Time) *Collector {
+	return &Collector{token: token, hosts: map[string]*collectedHost{}, retired: []*collectedHost{}, lastFlush: start}
+}
+
+// Every host that has reported, by name; the caller holds the lock
+func (collector *Collector) sortedHosts() []*collectedHost {
+	hosts := []*collectedHost{}
+	for _, host := range collector.hosts {
+		hosts = append(hosts, host)
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+
+	return hosts
+}
+
+// The host a report belongs to. A report from a new session means its agent restarted
+func (collector *Collector) host(report *AgentReport) *collectedHost {
+	host, ok := collector.hosts[report.Host]
+	if ok && host.session.Start.UnixNano() == report.SessionStart {
+		return host
+	}
+
+	if ok {
+		collector.retired = append(collector.retired, host)
+	}
+
+	host = &collectedHost{
+		Name:    report.Host,
+		session: CaptureSession{time.Unix(0, report.SessionStart), report.Host},
+		conns:   NewConnectionTable(),
+		store:   MachineNetworkStorage{},
+		reports: map[string][]agentSample{},
+	}
+	collector.hosts[report.Host] = host
+
+	return host
+}
+
+// Add a row's traffic to a host's store, oriented as the agent stored it. Agents send totals
+// rather than packets, so the store holds no packets; totals are written to conn_summary, and
+// each report is kept as a sample for the API
+func (host *collectedHost) mergeTraffic(row *AgentRow) {
+	store := host.store
+
+	localAddr, localPort, remAddr, remPort := row.LocalAddr, row.LocalPort, row.RemAddr, row.RemPort
+	if row.Direction == "in" {
+		localAddr, localPort, remAddr, remPort = remAddr, remPort, localAddr, localPort
+	}
+
+	if _, ok := store[row.Device]; !ok {
+		store[row.Device] = map[string]StoredConnectionData{}
+	}
+
+	id := localAddr.String() + fmt.Sprint(localPort) + remAddr.String() + fmt.Sprint(remPort)
+	data, ok := store[row.Device][id]
+	if !ok {
+		data = StoredConnectionData{LocalAddr: localAddr, LocalPort: localPort, RemAddr: remAddr, RemPort: remPort, From: int(row.First), To: int(row.Last)}
+	}
+
+	data.Size += int(row.Bytes)
+	data.Count += int(row.Packets)
+	if int(row.First) < data.From {
+		data.From = int(row.First)
+	}
+	if int(row.Last) > data.To {
+		data.To = int(row.Last)
+	}
+
+	data.TCPFlow.Retransmissions += row.TCPFlow.Retransmissions
+	data.TCPFlow.OutOfOrder += row.TCPFlow.OutOfOrder
+	data.TCPFlow.DuplicateAcks += row.TCPFlow.DuplicateAcks
+	data.TCPFlow.ZeroWindows += row.TCPFlow.ZeroWindows
+	if data.TCPFlow.HandshakeRTT == 0 {
+		data.TCPFlow.HandshakeRTT = row.TCPFlow.HandshakeRTT
+	}
+
+	store[row.Device][id] = data
+
+	key := row.Device + "/" + id
+	host.reports[key] = append(host.reports[key], agentSample{row.Last, int(row.Bytes), int(row.Packets)})
+}
+
+// Merge a report into its host's connections & traffic
+func (collector *Collector) Merge(report *AgentReport, remote string) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	host := collector.host(report)
+	if report.Sequence <= host.sequence {
+		return
+	}
+
+	now := time.Unix(0, report.Time)
+	host.sequence, host.Remote, host.LastReport = report.Sequence, remote, now
+
+	for idx := range report.Rows {
+		row := &report.Rows[idx]
+
+		if conn := row.connection(); conn != nil {
+			pidConn := PidSocket{row.UserName, row.Command, row.CommandLine, row.Pid, row.StartTime, row.Parents, row.Cgroup, conn, now}
+			lifetime := ConnectionLifetime{Start: time.Unix(0, row.Opened)}
+			if row.Closed > 0 {
+				end := time.Unix(0, row.Closed)
+				lifetime.End = &end
+			}
+
+			host.conns.Merge(pidConn, lifetime)
+		}
+
+		if len(row.Device) > 0 {
+			host.mergeTraffic(row)
+		}
+	}
+
+	host.pruneReports(now.Add(-API_MAX_WINDOW).UnixNano())
+}
+
+// Read reports from an agent until it disconnects, acknowledging each once merged
+func (collector *Collector) serveAgent(conn net.Conn) {
+	defer conn.Close()
+
+	remote := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+
+	// authenticate with a small hello, so unauthenticated peers can't make us allocate a large report
+	conn.SetReadDeadline(time.Now().Add(COLLECTOR_IDLE_TIMEOUT))
+
+	body, err := readAgentFrame(reader, AGENT_MAX_HELLO)
+	if err != nil {
+		log.Printf("agent %s sent no hello: %v", remote, err)
+		return
+	}
+
+	hello, err := UnmarshalAgentHello(body)
+	if err != nil {
+		log.Printf("agent %s sent an invalid hello: %v", remote, err)
+		return
+	}
+
+	if len(collector.token) > 0 && subtle.ConstantTimeCompare([]byte(hello.Token), []byte(collector.token)) != 1 {
+		log.Printf("agent %s (%s) sent the wrong token", remote, hello.Host)
+		return
+	}
+
+	ack := make([]byte, 8)
+	conn.SetWriteDeadline(time.Now().Add(COLLECTOR_WRITE_TIMEOUT))
+	if _, err := conn.Write(ack); err != nil {
+		log.Printf("could not acknowledge agent %s: %v", remote, err)
+		return
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(COLLECTOR_IDLE_TIMEOUT))
+
+		body, err := readAgentFrame(reader, AGENT_MAX_FRAME)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("agent %s disconnected: %v", remote, err)
+			}
+			return
+		}
+
+		report, err := UnmarshalAgentReport(body)
+		if err != nil {
+			log.Printf("agent %s sent an invalid report: %v", remote, err)
+			return
+		}
+
+		// the token was checked for the hello's host only
+		if report.Host != hello.Host {
+			log.Printf("agent %s (%s) sent a report for %s", remote, hello.Host, report.Host)
+			return
+		}
+
+		collector.Merge(report, remote)
+
+		binary.BigEndian.PutUint64(ack, report.Sequence)
+
+		conn.SetWriteDeadline(time.Now().Add(COLLECTOR_WRITE_TIMEOUT))
+		if _, err := conn.Write(ack); err != nil {
+			log.Printf("could not acknowledge agent %s: %v", remote, err)
+			return
+		}
+	}
+}
+
+// Accept agents until the listener is closed
+func (collector *Collector) Accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go collector.serveAgent(conn)
+	}
+}
+
+// Write every host's collected traffic to the current database, then forget it. A host that
+// can't be written is kept for the next flush
+func (collector *Collector) Flush(opts *DaemonOptions, rot *CaptureRotator, now time.Time) error {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	fpath := rot.Path(now)
+	retired := []*collectedHost{}
+	var flushErr error
+
+	for _, host := range append(collector.retired, collector.sortedHosts()...) {
+		if err := FlushDBNetwork(fpath, host.session, host.conns, host.store, TCPStateStore{}); err != nil {
+			if collector.hosts[host.Name] != host {
+				retired = append(retired, host)
+			}
+			if flushErr == nil {
+				flushErr = fmt.Errorf("%s: %v", host.Name, err)
+			}
+			continue
+		}
+
+		for device := range host.store {
+			delete(host.store, device)
+		}
+		host.conns.Flush()
+	}
+
+	collector.retired = retired
+	collector.lastFlush = now
+
+	if flushErr != nil {
+		return flushErr
+	}
+	return EnforceRetention(opts, fpath, now)
+}
+
+// The collector serves the API across hosts, from what was collected since the last flush
+func (collector *Collector) Name() string {
+	return "collector"
+}
+
+func (collector *Collector) Span() (time.Time, time.Time, error) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	return collector.lastFlush, time.Now(), nil
+}
+
+func (collector *Collector) MaxWindow() time.Duration {
+	start, end, _ := collector.Span()
+	if end.Sub(start) < API_MAX_WINDOW {
+		return API_MAX_WINDOW
+	}
+
+	return end.Sub(start).Truncate(time.Second) + time.Second
+}
+
+func (collector *Collector) Snapshot() (apiSnapshot, error) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	snapshot := newAPISnapshot()
+
+	for _, host := range collector.sortedHosts() {
+		hostSnapshot := buildAPISnapshot(host.conns, host.store)
+
+		for _, process := range hostSnapshot.processes {
+			process.Host = host.Name
+			snapshot.processes = append(snapshot.processes, process)
+		}
+		for _, conn := range hostSnapshot.connections {
+			conn.Host = host.Name
+			snapshot.connections = append(snapshot.connections, conn)
+		}
+		for _, device := range hostSnapshot.devices {
+			device.Host = host.Name
+			snapshot.devices = append(snapshot.devices, device)
+		}
+		snapshot.flows += hostSnapshot.flows
+	}
+
+	return snapshot, nil
+}
+
+func (collector *Collector) TopTalkers(by string, since time.Time, limit int) ([]APITalker, error) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	talkers := []APITalker{}
+
+	for _, host := range collector.sortedHosts() {
+		for _, talker := range buildTopTalkers(host.conns, host.store, host.samples, by, since, limit) {
+			talker.Host, talker.Group = host.Name, host.Name+" "+talker.Group
+			talkers = append(talkers, talker)
+		}
+	}
+
+	return rankTalkers(talkers, limit), nil
+}
+
+func (collector *Collector) Timeline(since time.Time, step time.Duration, steps int) (APITimeline, error) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	timeline := newAPITimeline(since, step, steps)
+
+	for _, host := range collector.sortedHosts() {
+		for _, device := range buildTimeline(host.conns, host.store, host.samples, since, step, steps).Devices {
+			device.Name = host.Name + COLLECTOR_HOST_SEPARATOR + device.Name
+			timeline.Devices = append(timeline.Devices, device)
+		}
+	}
+
+	return timeline.finish(), nil
+}
+
+// Redraw every host's per-process traffic to the terminal. Ancestors are those the agents saw,
+// as they can't be named from this machine's /proc
+func CollectorView(collector *Collector, tree bool, maxDepth int) {
+	state := &LiveViewState{tree: tree, maxDepth: maxDepth, collapsed: map[int]bool{}}
+	go LiveViewInput(state)
+
+	for {
+		collector.lock.Lock()
+		state.lock.Lock()
+
+		fmt.Print(CLEAR_STRING)
+		for _, host := range collector.sortedHosts() {
+			pidConns := host.conns.PidSockets()
+			procTree := BuildProcessTree(&pidConns, host.store, nil, state.tree)
+
+			fmt.Printf("%s (%s, last reported %s ago)\n", host.Name, host.Remote, time.Since(host.LastReport).Round(time.Second))
+			RenderProcessTree(os.Stdout, procTree, state.maxDepth, state.collapsed)
+			fmt.Println()
+		}
+		collector.lock.Unlock()
+
+		printLiveViewHelp(state)
+		state.lock.Unlock()
+
+		time.Sleep(COLLECTOR_VIEW_INTERVAL)
+	}
+}
+
+// Collect reports from agents until signalled, flushing them to rotating databases
+func Collect(opts *CollectorOptions) error {
+	start := time.Now()
+	collector := NewCollector(opts.Token, start)
+
+	if err := os.MkdirAll(opts.Daemon.Dir, 0755); err != nil {
+		return err
+	}
+	rot := &CaptureRotator{Dir: opts.Daemon.Dir, Period: opts.Daemon.Rotate, MaxSize: opts.Daemon.MaxSize}
+
+	listener, err := net.Listen("tcp", opts.Bind)
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+	go collector.Accept(listener)
+
+	if len(opts.Listen) > 0 {
+		api, err := NewAPIServer(opts.Listen, collector, nil, opts.UI)
+		if err != nil {
+			return err
+		}
+		api.Translations = opts.Translations
+
+		defer api.Close()
+		go api.Serve()
+
+		log.Printf("serving collected traffic on %s", api.URL())
+	}
+
+	if opts.Interactive {
+		go CollectorView(collector, opts.Tree, opts.Depth)
+	} else {
+		log.Printf("collecting from agents on %s", listener.Addr())
+	}
+
+	flushTicker := time.NewTicker(opts.Daemon.Interval)
+	defer flushTicker.Stop()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	for {
+		select {
+		case now := <-flushTicker.C:
+			if err := collector.Flush(opts.Daemon, rot, now); err != nil {
+				log.Printf("could not flush collected traffic: %v", err)
+			}
+
+		case sig := <-stop:
+			log.Printf("received %v, flushing collected traffic", sig)
+			listener.Close()
+
+			return collector.Flush(opts.Daemon, rot, time.Now())
+		}
+	}
+}
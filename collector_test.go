@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connect to a collector over an in-memory pipe
+func connectTestAgent(t *testing.T, collector *Collector) net.Conn {
+	server, client := net.Pipe()
+	go collector.serveAgent(server)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func expectDisconnect(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if _, err := io.ReadFull(conn, make([]byte, 8)); err != io.EOF {
+		t.Fatalf("expected the collector to disconnect, got %v", err)
+	}
+}
+
+func TestCollectorRefusesLargeFramesBeforeHello(t *testing.T) {
+	conn := connectTestAgent(t, NewCollector("secret", time.Now()))
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, AGENT_MAX_FRAME)
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	expectDisconnect(t, conn)
+}
+
+func TestCollectorRefusesWrongToken(t *testing.T) {
+	conn := connectTestAgent(t, NewCollector("secret", time.Now()))
+
+	hello := AgentHello{"web-1", "guess"}
+	if err := writeAgentFrame(conn, hello.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	expectDisconnect(t, conn)
+}
+
+func TestCollectorKeepsReportTotals(t *testing.T) {
+	now := time.Now()
+	collector := NewCollector("secret", now)
+	conn := connectTestAgent(t, collector)
+
+	hello := AgentHello{"web-1", "secret"}
+	if err := writeAgentFrame(conn, hello.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+		t.Fatalf("hello was not acknowledged: %v", err)
+	}
+
+	row := AgentRow{
+		Device: "eth0", Direction: "out", Bytes: 1000, Packets: 10, First: now.UnixNano(), Last: now.UnixNano(),
+		Protocol: "TCP", LocalAddr: net.ParseIP("10.0.0.1"), LocalPort: 40000, RemAddr: net.ParseIP("10.0.0.2"), RemPort: 443,
+		Inode: 1234, St: 1, Pid: 42, StartTime: 100, Command: "curl", UserName: "alice", Opened: now.UnixNano(),
+	}
+
+	for sequence := uint64(1); sequence <= 2; sequence++ {
+		report := AgentReport{"web-1", now.UnixNano(), now.UnixNano(), sequence, []AgentRow{row}}
+		if err := writeAgentFrame(conn, report.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+
+		ack := make([]byte, 8)
+		if _, err := io.ReadFull(conn, ack); err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint64(ack) != sequence {
+			t.Fatalf("acknowledged report %d, expected %d", binary.BigEndian.Uint64(ack), sequence)
+		}
+	}
+
+	collector.lock.Lock()
+	for _, data := range collector.hosts["web-1"].store["eth0"] {
+		if data.Size != 2000 || data.Count != 20 || len(data.Packets) != 0 {
+			t.Errorf("stored %d bytes, %d packets & %d packet samples; expected 2000, 20 & none", data.Size, data.Count, len(data.Packets))
+		}
+	}
+	collector.lock.Unlock()
+
+	talkers, err := collector.TopTalkers("process", now.Add(-time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(talkers) != 1 || talkers[0].BytesOut != 2000 || talkers[0].PacketsOut != 20 {
+		t.Errorf("unexpected top talkers %+v", talkers)
+	}
+}
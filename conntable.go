@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	CONN_OPEN  = "open"
+	CONN_CLOSE = "close"
+)
+
+// A process-socket opening or closing, detected by diffing /proc snapshots
+type ConnectionEvent struct {
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	ProcessSocket PidSocket `json:"process_socket"`
+}
+
+// When a process-socket was first and last seen. Sockets already open when
+// the capture starts are given the capture's start time
+type ConnectionLifetime struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end"` // nil while the connection is still open
+}
+
+// A process-socket tracked over its lifetime; closed sockets are kept so
+// their packets can still be attributed at report-time
+type TrackedConnection struct {
+	ProcessSocket PidSocket
+	Lifetime      ConnectionLifetime
+}
+
+func (tracked *TrackedConnection) IsOpen() bool {
+	return tracked.Lifetime.End == nil
+}
+
+// Tracks every process-socket seen during a session
+type ConnectionTable struct {
+	open    map[string]*TrackedConnection // open connections, by process-socket key
+	history []*TrackedConnection          // every connection, open or closed, in order seen
+	Events  []ConnectionEvent
+}
+
+func NewConnectionTable() *ConnectionTable {
+	return &ConnectionTable{
+		open:    map[string]*TrackedConnection{},
+		history: []*TrackedConnection{},
+		Events:  []ConnectionEvent{},
+	}
+}
+
+// Identify a process-socket; the inode distinguishes a 4-tuple reused by a later socket
+func pidSocketKey(pidConn *PidSocket) string {
+	return pidConn.GetProcessId().String() + "/" + pidConn.Connection.GetType() + "/" + pidConn.GetId() + "/" + fmt.Sprint(pidConn.Connection.GetInode())
+}
+
+// Diff a full snapshot of one protocol's process-sockets against the table,
+// returning the open and close events it implies
+func (table *ConnectionTable) Update(protocol string, pidConns *[]PidSocket, now time.Time) []ConnectionEvent {
+	events := []ConnectionEvent{}
+	seen := map[string]bool{}
+
+	for _, pidConn := range *pidConns {
+		key := pidSocketKey(&pidConn)
+		seen[key] = true
+
+		if tracked, ok := table.open[key]; ok {
+			// keep the latest socket information (queues, state, ...)
+			tracked.ProcessSocket = pidConn
+			continue
+		}
+
+		tracked := &TrackedConnection{pidConn, ConnectionLifetime{Start: now}}
+		table.open[key] = tracked
+		table.history = append(table.history, tracked)
+		events = append(events, ConnectionEvent{CONN_OPEN, now, pidConn})
+	}
+
+	// anything of this protocol missing from the snapshot has closed
+	for key, tracked := range table.open {
+		if tracked.ProcessSocket.Connection.GetType() != protocol || seen[key] {
+			continue
+		}
+
+		end := now
+		tracked.Lifetime.End = &end
+		delete(table.open, key)
+		events = append(events, ConnectionEvent{CONN_CLOSE, now, tracked.ProcessSocket})
+	}
+
+	table.Events = append(table.Events, events...)
+
+	return events
+}
+
+// Add process-sockets seen outside of a full snapshot (e.g. by process-event tracing).
+// Nothing is closed; that is left to the next full snapshot of the protocol
+func (table *ConnectionTable) Observe(pidConns *[]PidSocket, now time.Time) []ConnectionEvent {
+	events := []ConnectionEvent{}
+
+	for _, pidConn := range *pidConns {
+		key := pidSocketKey(&pidConn)
+
+		if _, ok := table.open[key]; ok {
+			continue
+		}
+
+		tracked := &TrackedConnection{pidConn, ConnectionLifetime{Start: now}}
+		table.open[key] = tracked
+		table.history = append(table.history, tracked)
+		events = append(events, ConnectionEvent{CONN_OPEN, now, pidConn})
+	}
+
+	table.Events = append(table.Events, events...)
+
+	return events
+}
+
+// Add or update a process-socket tracked elsewhere (e.g. by an agent), keeping the lifetime it
+// was seen with there
+func (table *ConnectionTable) Merge(pidConn PidSocket, lifetime ConnectionLifetime) []ConnectionEvent {
+	events := []ConnectionEvent{}
+	key := pidSocketKey(&pidConn)
+
+	tracked, ok := table.open[key]
+	if !ok {
+		tracked = &TrackedConnection{pidConn, ConnectionLifetime{Start: lifetime.Start}}
+		table.open[key] = tracked
+		table.history = append(table.history, tracked)
+		events = append(events, ConnectionEvent{CONN_OPEN, lifetime.Start, pidConn})
+	}
+
+	tracked.ProcessSocket = pidConn
+
+	if lifetime.End != nil {
+		end := *lifetime.End
+		tracked.Lifetime.End = &end
+		delete(table.open, key)
+		events = append(events, ConnectionEvent{CONN_CLOSE, end, pidConn})
+	}
+
+	table.Events = append(table.Events, events...)
+
+	return events
+}
+
+// Every process-socket seen this session, including closed ones
+func (table *ConnectionTable) PidSockets() []PidSocket {
+	pidConns := make([]PidSocket, len(table.history))
+
+	for idx, tracked := range table.history {
+		pidConns[idx] = tracked.ProcessSocket
+	}
+
+	return pidConns
+}
+
+// Only the process-sockets that are currently open
+func (table *ConnectionTable) Active() []PidSocket {
+	pidConns := []PidSocket{}
+
+	for _, tracked := range table.history {
+		if tracked.IsOpen() {
+			pidConns = append(pidConns, tracked.ProcessSocket)
+		}
+	}
+
+	return pidConns
+}
+
+// Every tracked connection, including closed ones, in the order first seen
+func (table *ConnectionTable) Tracked() []*TrackedConnection {
+	return table.history
+}
+
+// Forget events and closed connections once they have been written out,
+// so a long-running capture does not grow without bound
+func (table *ConnectionTable) Flush() {
+	open := []*TrackedConnection{}
+
+	for _, tracked := range table.history {
+		if tracked.IsOpen() {
+			open = append(open, tracked)
+		}
+	}
+
+	table.history = open
+	table.Events = []ConnectionEvent{}
+}
+
+// Traffic stored for a device and 4-tuple, along with the connection (if any) it belongs to
+type attributedFlow struct {
+	device    string
+	flowId    string
+	data      StoredConnectionData
+	tracked   *TrackedConnection
+	direction string // out when the flow was sent by the local side of the connection
+}
+
+// Attribute stored traffic to tracked connections, in either direction; the latest lifetime of a 4-tuple wins
+func attributeFlows(conns *ConnectionTable, store MachineNetworkStorage) []attributedFlow {
+	byId := map[string]*TrackedConnection{}
+	for _, tracked := range conns.Tracked() {
+		byId[tracked.ProcessSocket.GetId()] = tracked
+	}
+
+	flows := []attributedFlow{}
+
+	for device, deviceConns := range store {
+		for flowId, connData := range deviceConns {
+			flow := attributedFlow{device, flowId, connData, nil, "out"}
+			reverseId := connData.RemAddr.String() + fmt.Sprint(connData.RemPort) + connData.LocalAddr.String() + fmt.Sprint(connData.LocalPort)
+
+			if tracked, ok := byId[flowId]; ok {
+				flow.tracked = tracked
+			} else if tracked, ok := byId[reverseId]; ok {
+				flow.tracked = tracked
+				flow.direction = "in"
+			}
+
+			flows = append(flows, flow)
+		}
+	}
+
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].device != flows[j].device {
+			return flows[i].device < flows[j].device
+		}
+		return flows[i].flowId < flows[j].flowId
+	})
+
+	return flows
+}
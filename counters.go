@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sort"
+)
+
+// Bytes & packets, indexed by direction (see directionIndex)
+type TrafficCounter struct {
+	Bytes   [2]int64
+	Packets [2]int64
+}
+
+func (counter *TrafficCounter) add(direction string, bytes int, packets int) {
+	idx := directionIndex(direction)
+	counter.Bytes[idx] += int64(bytes)
+	counter.Packets[idx] += int64(packets)
+}
+
+// Cumulative traffic by device, process, connection and remote address. Counters are updated from
+// the store as it grows, so they outlive packet pruning and daemon flushes
+type TrafficCounters struct {
+	devices     map[string]*TrafficCounter
+	processes   map[ProcessId]*TrafficCounter
+	connections map[*TrackedConnection]*TrafficCounter
+	remotes     map[string]*TrafficCounter
+	seen        map[string][2]int // stored bytes & packets already counted, by device & 4-tuple
+}
+
+func NewTrafficCounters() *TrafficCounters {
+	return &TrafficCounters{
+		devices:     map[string]*TrafficCounter{},
+		processes:   map[ProcessId]*TrafficCounter{},
+		connections: map[*TrackedConnection]*TrafficCounter{},
+		remotes:     map[string]*TrafficCounter{},
+		seen:        map[string][2]int{},
+	}
+}
+
+func addTraffic[K comparable](counters map[K]*TrafficCounter, key K, direction string, bytes int, packets int) {
+	counter, ok := counters[key]
+	if !ok {
+		counter = &TrafficCounter{}
+		counters[key] = counter
+	}
+
+	counter.add(direction, bytes, packets)
+}
+
+// Count traffic stored since the last update, attributed to connections, processes and remote addresses
+func (counters *TrafficCounters) Update(conns *ConnectionTable, store MachineNetworkStorage) {
+	seen := map[string][2]int{}
+
+	for _, flow := range attributeFlows(conns, store) {
+		key := flow.device + "/" + flow.flowId
+		last := counters.seen[key]
+		seen[key] = [2]int{flow.data.Size, flow.data.Count}
+
+		bytes, packets := flow.data.Size-last[0], flow.data.Count-last[1]
+		if packets <= 0 {
+			continue
+		}
+
+		addTraffic(counters.devices, flow.device, flow.direction, bytes, packets)
+
+		if flow.tracked == nil {
+			continue
+		}
+
+		pidConn := flow.tracked.ProcessSocket
+		addTraffic(counters.connections, flow.tracked, flow.direction, bytes, packets)
+		addTraffic(counters.processes, pidConn.GetProcessId(), flow.direction, bytes, packets)
+		addTraffic(counters.remotes, pidConn.Connection.GetRemAddr().String(), flow.direction, bytes, packets)
+	}
+
+	// flows no longer stored needn't be remembered
+	counters.seen = seen
+}
+
+// Count from zero once the store is emptied
+func (counters *TrafficCounters) Reset() {
+	counters.seen = map[string][2]int{}
+}
+
+// Forget connections, processes and remote addresses that are no longer tracked
+func (counters *TrafficCounters) Prune(conns *ConnectionTable) {
+	tracked := map[*TrackedConnection]bool{}
+	processes := map[ProcessId]bool{}
+	remotes := map[string]bool{}
+
+	for _, conn := range conns.Tracked() {
+		tracked[conn] = true
+		processes[conn.ProcessSocket.GetProcessId()] = true
+		remotes[conn.ProcessSocket.Connection.GetRemAddr().String()] = true
+	}
+
+	for conn := range counters.connections {
+		if !tracked[conn] {
+			delete(counters.connections, conn)
+		}
+	}
+	for id := range counters.processes {
+		if !processes[id] {
+			delete(counters.processes, id)
+		}
+	}
+	for addr := range counters.remotes {
+		if !remotes[addr] {
+			delete(counters.remotes, addr)
+		}
+	}
+}
+
+func counterOf[K comparable](counters map[K]*TrafficCounter, key K) TrafficCounter {
+	if counter, ok := counters[key]; ok {
+		return *counter
+	}
+	return TrafficCounter{}
+}
+
+func (counters *TrafficCounters) Device(name string) TrafficCounter {
+	return counterOf(counters.devices, name)
+}
+
+func (counters *TrafficCounters) Process(id ProcessId) TrafficCounter {
+	return counterOf(counters.processes, id)
+}
+
+func (counters *TrafficCounters) Connection(conn *TrackedConnection) TrafficCounter {
+	return counterOf(counters.connections, conn)
+}
+
+func (counters *TrafficCounters) Remote(addr string) TrafficCounter {
+	return counterOf(counters.remotes, addr)
+}
+
+// Devices that have seen traffic, by name
+func (counters *TrafficCounters) Devices() []string {
+	names := []string{}
+	for name := range counters.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Remote addresses that have seen traffic, in order
+func (counters *TrafficCounters) Remotes() []string {
+	addrs := []string{}
+	for addr := range counters.remotes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// Group tracked connections by process, in the order processes were first tracked
+func trackedByProcess(conns *ConnectionTable) ([]ProcessId, map[ProcessId][]*TrackedConnection) {
+	ids := []ProcessId{}
+	byProcess := map[ProcessId][]*TrackedConnection{}
+
+	for _, conn := range conns.Tracked() {
+		id := conn.ProcessSocket.GetProcessId()
+		if _, ok := byProcess[id]; !ok {
+			ids = append(ids, id)
+		}
+		byProcess[id] = append(byProcess[id], conn)
+	}
+
+	return ids, byProcess
+}
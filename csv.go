@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A table of rows for delimited export, with a fixed column order
+type CSVTable struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+}
+
+var PROCESS_CSV_HEADER = []string{"pid", "start_time", "username", "command", "command_line", "cgroup", "connections", "bytes_out", "bytes_in", "packets_out", "packets_in"}
+
+var CONNECTION_CSV_HEADER = []string{"pid", "start_time", "command", "protocol", "local_addr", "local_port", "rem_addr", "rem_port", "inode", "state", "opened", "closed",
+	"bytes_out", "bytes_in", "packets_out", "packets_in", "first_packet", "last_packet", "retransmissions", "out_of_order", "duplicate_acks", "zero_windows", "handshake_rtt"}
+
+var PACKET_CSV_HEADER = []string{"device", "time", "direction", "local_addr", "local_port", "rem_addr", "rem_port", "size", "pid", "start_time"}
+
+var DEVICE_CSV_HEADER = []string{"device", "flows", "packets", "bytes", "first_packet", "last_packet"}
+
+// One packet per row, with its connection and process
+var DENORMALISED_CSV_HEADER = []string{"device", "time", "direction", "size", "protocol", "local_addr", "local_port", "rem_addr", "rem_port", "inode", "state",
+	"pid", "start_time", "username", "command", "command_line", "cgroup"}
+
+func formatCSVTime(nanos int64) string {
+	if nanos == 0 {
+		return ""
+	}
+
+	return time.Unix(0, nanos).UTC().Format(time.RFC3339Nano)
+}
+
+func formatCSVUint(value uint64) string {
+	return strconv.FormatUint(value, 10)
+}
+
+// Per-connection traffic totals, by direction
+type connectionTraffic struct {
+	bytes   [2]int
+	packets [2]int
+	first   int
+	last    int
+	tcpFlow TCPFlowStats
+}
+
+func directionIndex(direction string) int {
+	if direction == "in" {
+		return 1
+	}
+	return 0
+}
+
+// Sum the traffic of each tracked connection, over every device it was seen on
+func sumConnectionTraffic(flows []attributedFlow) map[*TrackedConnection]*connectionTraffic {
+	traffic := map[*TrackedConnection]*connectionTraffic{}
+
+	for _, flow := range flows {
+		if flow.tracked == nil {
+			continue
+		}
+
+		total, ok := traffic[flow.tracked]
+		if !ok {
+			total = &connectionTraffic{first: flow.data.From, last: flow.data.To}
+			traffic[flow.tracked] = total
+		}
+
+		idx := directionIndex(flow.direction)
+		total.bytes[idx] += flow.data.Size
+		total.packets[idx] += flow.data.Count
+		total.tcpFlow.Add(flow.data.TCPFlow)
+
+		if flow.data.From < total.first {
+			total.first = flow.data.From
+		}
+		if flow.data.To > total.last {
+			total.last = flow.data.To
+		}
+	}
+
+	return traffic
+}
+
+// Build per-process, per-connection, per-packet and per-device tables
+func BuildCSVTables(conns *ConnectionTable, store MachineNetworkStorage) []CSVTable {
+	flows := attributeFlows(conns, store)
+	traffic := sumConnectionTraffic(flows)
+
+	packets := CSVTable{"packets", PACKET_CSV_HEADER, [][]string{}}
+	devices := map[string]*[5]int{} // flows, packets, bytes, first, last
+
+	for _, flow := range flows {
+		pid, startTime := "", ""
+		if flow.tracked != nil {
+			pidConn := flow.tracked.ProcessSocket
+			pid, startTime = strconv.Itoa(pidConn.Pid), formatCSVUint(pidConn.StartTime)
+		}
+
+		device, ok := devices[flow.device]
+		if !ok {
+			device = &[5]int{0, 0, 0, flow.data.From, flow.data.To}
+			devices[flow.device] = device
+		}
+
+		device[0]++
+		device[1] += flow.data.Count
+		device[2] += flow.data.Size
+		if flow.data.From < device[3] {
+			device[3] = flow.data.From
+		}
+		if flow.data.To > device[4] {
+			device[4] = flow.data.To
+		}
+
+		for _, pkt := range flow.data.Packets {
+			packets.Rows = append(packets.Rows, []string{
+				flow.device, formatCSVTime(pkt.Timestamp), flow.direction,
+				flow.data.LocalAddr.String(), formatCSVUint(flow.data.LocalPort), flow.data.RemAddr.String(), formatCSVUint(flow.data.RemPort),
+				strconv.Itoa(pkt.Size), pid, startTime,
+			})
+		}
+	}
+
+	connections := CSVTable{"connections", CONNECTION_CSV_HEADER, [][]string{}}
+	processes := CSVTable{"processes", PROCESS_CSV_HEADER, [][]string{}}
+	processIds := []ProcessId{}
+	processRows := map[ProcessId][]string{}
+	processTotals := map[ProcessId]*[5]int{} // connections, bytes out & in, packets out & in
+
+	for _, tracked := range conns.Tracked() {
+		pidConn := tracked.ProcessSocket
+		conn := pidConn.Connection
+		total, ok := traffic[tracked]
+		if !ok {
+			total = &connectionTraffic{}
+		}
+
+		state, closed := "", ""
+		if tcp, ok := conn.(TCPConnection); ok {
+			state = tcp.GetStateName()
+		}
+		if !tracked.IsOpen() {
+			closed = formatCSVTime(tracked.Lifetime.End.UnixNano())
+		}
+
+		connections.Rows = append(connections.Rows, []string{
+			strconv.Itoa(pidConn.Pid), formatCSVUint(pidConn.StartTime), pidConn.Command, conn.GetType(),
+			conn.GetLocalAddr().String(), formatCSVUint(conn.GetLocalPort()), conn.GetRemAddr().String(), formatCSVUint(conn.GetRemPort()),
+			formatCSVUint(conn.GetInode()), state, formatCSVTime(tracked.Lifetime.Start.UnixNano()), closed,
+			strconv.Itoa(total.bytes[0]), strconv.Itoa(total.bytes[1]), strconv.Itoa(total.packets[0]), strconv.Itoa(total.packets[1]),
+			formatCSVTime(int64(total.first)), formatCSVTime(int64(total.last)),
+			strconv.Itoa(total.tcpFlow.Retransmissions), strconv.Itoa(total.tcpFlow.OutOfOrder), strconv.Itoa(total.tcpFlow.DuplicateAcks),
+			strconv.Itoa(total.tcpFlow.ZeroWindows), strconv.FormatInt(total.tcpFlow.HandshakeRTT, 10),
+		})
+
+		id := pidConn.GetProcessId()
+		if _, ok := processRows[id]; !ok {
+			processIds = append(processIds, id)
+			processRows[id] = []string{strconv.Itoa(id.Pid), formatCSVUint(id.StartTime), pidConn.UserName, pidConn.Command, pidConn.CommandLine, pidConn.Cgroup}
+			processTotals[id] = &[5]int{}
+		}
+
+		totals := processTotals[id]
+		totals[0]++
+		totals[1] += total.bytes[0]
+		totals[2] += total.bytes[1]
+		totals[3] += total.packets[0]
+		totals[4] += total.packets[1]
+	}
+
+	for _, id := range processIds {
+		row := processRows[id]
+		for _, total := range processTotals[id] {
+			row = append(row, strconv.Itoa(total))
+		}
+		processes.Rows = append(processes.Rows, row)
+	}
+
+	devicesTable := CSVTable{"devices", DEVICE_CSV_HEADER, [][]string{}}
+	names := []string{}
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		device := devices[name]
+		devicesTable.Rows = append(devicesTable.Rows, []string{
+			name, strconv.Itoa(device[0]), strconv.Itoa(device[1]), strconv.Itoa(device[2]), formatCSVTime(int64(device[3])), formatCSVTime(int64(device[4])),
+		})
+	}
+
+	return []CSVTable{processes, connections, packets, devicesTable}
+}
+
+// Build a single table with a row per packet, repeating its connection and process
+func BuildDenormalisedCSVTable(conns *ConnectionTable, store MachineNetworkStorage) CSVTable {
+	table := CSVTable{"puffin", DENORMALISED_CSV_HEADER, [][]string{}}
+
+	for _, flow := range attributeFlows(conns, store) {
+		connColumns := []string{"", "", "", "", "", "", "", "", "", "", "", "", ""}
+
+		if flow.tracked != nil {
+			pidConn := flow.tracked.ProcessSocket
+			conn := pidConn.Connection
+
+			state := ""
+			if tcp, ok := conn.(TCPConnection); ok {
+				state = tcp.GetStateName()
+			}
+
+			connColumns = []string{
+				conn.GetType(), conn.GetLocalAddr().String(), formatCSVUint(conn.GetLocalPort()), conn.GetRemAddr().String(), formatCSVUint(conn.GetRemPort()),
+				formatCSVUint(conn.GetInode()), state,
+				strconv.Itoa(pidConn.Pid), formatCSVUint(pidConn.StartTime), pidConn.UserName, pidConn.Command, pidConn.CommandLine, pidConn.Cgroup,
+			}
+		} else {
+			// without a socket, only the packet's own addresses are known
+			connColumns[1], connColumns[2] = flow.data.LocalAddr.String(), formatCSVUint(flow.data.LocalPort)
+			connColumns[3], connColumns[4] = flow.data.RemAddr.String(), formatCSVUint(flow.data.RemPort)
+		}
+
+		for _, pkt := range flow.data.Packets {
+			row := []string{flow.device, formatCSVTime(pkt.Timestamp), flow.direction, strconv.Itoa(pkt.Size)}
+			table.Rows = append(table.Rows, append(row, connColumns...))
+		}
+	}
+
+	return table
+}
+
+// Write a table to a file, quoted as RFC 4180 describes; TSV uses tabs in place of commas
+func WriteCSVTable(fpath string, table CSVTable, comma rune) error {
+	file, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	// records end with \n rather than RFC 4180's \r\n, since the csv package would otherwise
+	// also rewrite newlines inside quoted fields (e.g. command-lines) as \r\n
+	writer := csv.NewWriter(file)
+	writer.Comma = comma
+
+	if err := writer.Write(table.Header); err != nil {
+		return err
+	}
+
+	if err := writer.WriteAll(table.Rows); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// Report network information as CSV or TSV files in a directory; either a file per
+// entity, or a single denormalised file
+func ReportCSVNetwork(conns *ConnectionTable, store MachineNetworkStorage, format string, outDir string, denormalised bool) error {
+	comma := ','
+	if format == "tsv" {
+		comma = '\t'
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	tables := []CSVTable{}
+	if denormalised {
+		tables = append(tables, BuildDenormalisedCSVTable(conns, store))
+	} else {
+		tables = BuildCSVTables(conns, store)
+	}
+
+	for _, table := range tables {
+		if err := WriteCSVTable(filepath.Join(outDir, table.Name+"."+format), table, comma); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
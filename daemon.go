@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+const CAPTURE_PREFIX = "puffin-"
+
+// The names the rotator gives databases: a period's date (and time, for periods shorter than a
+// day), then a part number once a period's database is full. Other files are never removed
+var CAPTURE_NAME_PATTERN = regexp.MustCompile(`^` + CAPTURE_PREFIX + `\d{4}-\d{2}-\d{2}(T\d{2}-\d{2})?(\.\d+)?\.db$`)
+
+// Options for running puffin as a long-running daemon
+type DaemonOptions struct {
+	Dir      string        // where capture databases are written
+	Interval time.Duration // how often aggregates are flushed to the current database
+	Rotate   time.Duration // start a new database each period (e.g. 24h)
+	MaxSize  int64         // start a new database once the current one reaches this size; zero for no limit
+	Retain   time.Duration // delete databases older than this; zero to keep them
+	MaxDisk  int64         // delete the oldest databases while all of them exceed this size; zero for no limit
+}
+
+// Read daemon options from the command-line
+func ParseDaemonOptions(opts docopt.Opts) (*DaemonOptions, error) {
+	dir, _ := opts.String("--dir")
+	interval, _ := opts.Int("--interval")
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("--interval must be a positive number of seconds")
+	}
+
+	daemonOpts := &DaemonOptions{Dir: dir, Interval: time.Duration(interval) * time.Second}
+
+	rotate, _ := opts.String("--rotate")
+	period, err := time.ParseDuration(rotate)
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("--rotate: invalid duration %q", rotate)
+	}
+	daemonOpts.Rotate = period
+
+	if retain, _ := opts.String("--retain"); len(retain) > 0 {
+		if daemonOpts.Retain, err = time.ParseDuration(retain); err != nil {
+			return nil, fmt.Errorf("--retain: %v", err)
+		}
+	}
+
+	if maxSize, _ := opts.String("--max-size"); len(maxSize) > 0 {
+		size, err := ParseByteSize(maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("--max-size: %v", err)
+		}
+		daemonOpts.MaxSize = int64(size)
+	}
+
+	if maxDisk, _ := opts.String("--max-disk"); len(maxDisk) > 0 {
+		size, err := ParseByteSize(maxDisk)
+		if err != nil {
+			return nil, fmt.Errorf("--max-disk: %v", err)
+		}
+		daemonOpts.MaxDisk = int64(size)
+	}
+
+	return daemonOpts, nil
+}
+
+// Chooses which database a flush is written to. Databases are named after the period they
+// cover (e.g. puffin-2026-10-17.db), with a numeric suffix once a period's database is full
+type CaptureRotator struct {
+	Dir     string
+	Period  time.Duration
+	MaxSize int64
+	period  string
+	part    int
+}
+
+// The name of the period containing a time. Periods of a day or longer start at local
+// midnight and are named by date
+func (rot *CaptureRotator) periodName(now time.Time) string {
+	days := int(rot.Period / (24 * time.Hour))
+	if days == 0 {
+		return now.Truncate(rot.Period).Format("2006-01-02T15-04")
+	}
+
+	year, month, day := now.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	offset := int(midnight.Unix()/86400) % days
+
+	return midnight.AddDate(0, 0, -offset).Format("2006-01-02")
+}
+
+func (rot *CaptureRotator) partPath() string {
+	name := CAPTURE_PREFIX + rot.period
+	if rot.part > 0 {
+		name += fmt.Sprintf(".%d", rot.part)
+	}
+
+	return filepath.Join(rot.Dir, name+".db")
+}
+
+// The database to write to now
+func (rot *CaptureRotator) Path(now time.Time) string {
+	if period := rot.periodName(now); period != rot.period {
+		rot.period = period
+		rot.part = 0
+	}
+
+	for rot.MaxSize > 0 {
+		size, err := captureSize(rot.partPath())
+		if err != nil || size < rot.MaxSize {
+			break
+		}
+
+		rot.part++
+	}
+
+	return rot.partPath()
+}
+
+// The size of a database, including its write-ahead log, which holds recent flushes until
+// they are checkpointed
+func captureSize(fpath string) (int64, error) {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	if wal, err := os.Stat(fpath + "-wal"); err == nil {
+		size += wal.Size()
+	}
+
+	return size, nil
+}
+
+// Remove a capture database, along with its write-ahead log and shared-memory index
+func RemoveCaptureDB(fpath string) error {
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		if err := os.Remove(fpath + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete capture databases older than the retention period, then the oldest remaining
+// ones until the total size is within the limit. The current database is never deleted
+func EnforceRetention(opts *DaemonOptions, current string, now time.Time) error {
+	fpaths, err := filepath.Glob(filepath.Join(opts.Dir, CAPTURE_PREFIX+"*.db"))
+	if err != nil {
+		return err
+	}
+
+	type capture struct {
+		fpath string
+		info  os.FileInfo
+		size  int64
+	}
+
+	captures := []capture{}
+	var total int64
+
+	for _, fpath := range fpaths {
+		if !CAPTURE_NAME_PATTERN.MatchString(filepath.Base(fpath)) {
+			continue
+		}
+
+		info, err := os.Stat(fpath)
+		if err != nil {
+			continue
+		}
+
+		size, err := captureSize(fpath)
+		if err != nil {
+			continue
+		}
+
+		captures = append(captures, capture{fpath, info, size})
+		total += size
+	}
+
+	// oldest first
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].info.ModTime().Before(captures[j].info.ModTime())
+	})
+
+	for _, capt := range captures {
+		if capt.fpath == current {
+			continue
+		}
+
+		expired := opts.Retain > 0 && now.Sub(capt.info.ModTime()) > opts.Retain
+		oversized := opts.MaxDisk > 0 && total > opts.MaxDisk
+
+		if !expired && !oversized {
+			continue
+		}
+
+		if err := RemoveCaptureDB(capt.fpath); err != nil {
+			return err
+		}
+
+		log.Printf("removed capture %s", capt.fpath)
+		total -= capt.size
+	}
+
+	return nil
+}
+
+// Forget what has been flushed: stored traffic, closed connections and finished TCP analysis
+func ForgetFlushed(conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore, tcpFlows TCPFlowStore, lastFlush time.Time) {
+	// the store is shared with rule evaluation, so empty it in-place
+	for device := range store {
+		delete(store, device)
+	}
+
+	conns.Flush()
+	DrainTCPStates(tcpStates, lastFlush)
+	ExpireTCPFlows(tcpFlows, lastFlush.UnixNano())
+}
+
+// Flush everything captured since the last flush to the database packets are streaming to,
+// then forget what was written so memory use stays bounded. Returns the stream to use next,
+// which moves to a new database when it is time to rotate
+func FlushDaemon(opts *DaemonOptions, rot *CaptureRotator, stream *PacketStream, session CaptureSession, conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore, tcpFlows TCPFlowStore, lastFlush time.Time, now time.Time) (*PacketStream, error) {
+	if err := stream.Sync(); err != nil {
+		return stream, err
+	}
+
+	if err := FlushDBNetwork(stream.Path, session, conns, store, tcpStates); err != nil {
+		return stream, err
+	}
+
+	ForgetFlushed(conns, store, tcpStates, tcpFlows, lastFlush)
+
+	// rotate only after a flush, so streamed packets are attributed in the database they were written to
+	if fpath := rot.Path(now); fpath != stream.Path {
+		if err := stream.Close(); err != nil {
+			log.Printf("could not close capture %s: %v", stream.Path, err)
+		}
+
+		next, err := OpenPacketStream(fpath)
+		if err != nil {
+			return nil, err
+		}
+		stream = next
+	}
+
+	return stream, EnforceRetention(opts, stream.Path, now)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, fpath string, size int) {
+	if err := os.WriteFile(fpath, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatorCountsWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	rot := &CaptureRotator{Dir: dir, Period: 24 * time.Hour, MaxSize: 1000}
+
+	first := rot.Path(now)
+	if filepath.Base(first) != "puffin-2026-10-17.db" {
+		t.Fatalf("unexpected database %s", first)
+	}
+
+	// most of a flush is in the log until it is checkpointed
+	writeTestFile(t, first, 100)
+	writeTestFile(t, first+"-wal", 900)
+
+	if next := rot.Path(now); filepath.Base(next) != "puffin-2026-10-17.1.db" {
+		t.Errorf("kept writing to %s once it reached its maximum size", next)
+	}
+}
+
+func TestRetentionOnlyRemovesRotatedCaptures(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	rotated := []string{"puffin-2026-10-01.db", "puffin-2026-10-01.2.db", "puffin-2026-10-01T06-00.db"}
+	kept := []string{"puffin-merged.db", "puffin-2026-10-01-backup.db", "puffin-.db"}
+
+	for _, name := range append(rotated, kept...) {
+		fpath := filepath.Join(dir, name)
+		writeTestFile(t, fpath, 10)
+		if err := os.Chtimes(fpath, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := EnforceRetention(&DaemonOptions{Dir: dir, Retain: 24 * time.Hour}, "", now); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range rotated {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("expired capture %s was kept", name)
+		}
+	}
+
+	for _, name := range kept {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed, but puffin did not write it", name)
+		}
+	}
+}
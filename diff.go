@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	DIFF_OUT = "out" // the process connected to the remote
+	DIFF_IN  = "in"  // the remote connected to the process
+)
+
+// A process talking to a remote address, in one capture
+type DiffPair struct {
+	Host        string `json:"host"`
+	Command     string `json:"command"`
+	Direction   string `json:"direction"` // out or in
+	Protocol    string `json:"protocol"`
+	Remote      string `json:"remote"`
+	Port        uint64 `json:"port"` // the remote's port, or the process's for a connection in
+	Connections int    `json:"connections"`
+	Bytes       int    `json:"bytes"`
+}
+
+func (pair *DiffPair) key() string {
+	return fmt.Sprintf("%s %s %s %s %s %d", pair.Host, pair.Command, pair.Direction, pair.Protocol, pair.Remote, pair.Port)
+}
+
+func (pair *DiffPair) String() string {
+	arrow := "->"
+	if pair.Direction == DIFF_IN {
+		arrow = "<-"
+	}
+	return fmt.Sprintf("%s %s %s %s", serviceId(pair.Host, pair.Command), arrow, pair.Remote, graphPort(pair.Protocol, pair.Port))
+}
+
+// A port a process listened on
+type DiffListener struct {
+	Host     string `json:"host"`
+	Command  string `json:"command"`
+	Protocol string `json:"protocol"`
+	Port     uint64 `json:"port"`
+}
+
+// A process's or host's traffic, in bytes per second of each capture
+type DiffRate struct {
+	Host    string  `json:"host"`
+	Command string  `json:"command,omitempty"` // empty for a host's total
+	Before  float64 `json:"before"`
+	After   float64 `json:"after"`
+	Factor  float64 `json:"factor"` // after / before, each at least the minimum rate
+}
+
+// When a capture ran
+type DiffCapture struct {
+	Path    string    `json:"path"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Seconds float64   `json:"seconds"`
+}
+
+// What changed from one capture to another
+type CaptureDiff struct {
+	Before         DiffCapture    `json:"before"`
+	After          DiffCapture    `json:"after"`
+	NewPairs       []DiffPair     `json:"new_pairs"`
+	GonePairs      []DiffPair     `json:"gone_pairs"`
+	NewListeners   []DiffListener `json:"new_listeners"`
+	GoneListeners  []DiffListener `json:"gone_listeners"`
+	ProcessChanges []DiffRate     `json:"process_changes"`
+	HostChanges    []DiffRate     `json:"host_changes"`
+}
+
+// A capture's pairs, listeners & traffic
+type diffSummary struct {
+	capture   DiffCapture
+	pairs     map[string]DiffPair
+	listeners map[string]DiffListener
+	processes map[[2]string]int // bytes, by host & command
+	hosts     map[string]int
+}
+
+func loadDiffSummary(fpath string) (*diffSummary, error) {
+	source, err := OpenCaptureSource(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer source.Close()
+
+	start, end, err := source.Span()
+	if err != nil {
+		return nil, err
+	}
+
+	// a single host's capture doesn't name the host of each connection
+	hostname, err := source.hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// a capture shorter than a second is counted as one, so rates stay finite
+	seconds := math.Max(end.Sub(start).Seconds(), 1)
+	summary := &diffSummary{DiffCapture{fpath, start, end, seconds}, map[string]DiffPair{}, map[string]DiffListener{}, map[[2]string]int{}, map[string]int{}}
+
+	conns := snapshot.connections
+	listening := findListeningPorts(conns)
+
+	for idx := range conns {
+		conn := &conns[idx]
+		host := conn.Host
+		if len(host) == 0 {
+			host = hostname
+		}
+
+		bytes := conn.BytesOut + conn.BytesIn
+		summary.processes[[2]string{host, conn.Command}] += bytes
+		summary.hosts[host] += bytes
+
+		if conn.RemPort == 0 {
+			listener := DiffListener{host, conn.Command, conn.Protocol, conn.LocalPort}
+			summary.listeners[fmt.Sprintf("%s %s %s %d", host, conn.Command, conn.Protocol, conn.LocalPort)] = listener
+			continue
+		}
+
+		pair := DiffPair{host, conn.Command, DIFF_OUT, conn.Protocol, conn.RemAddr, conn.RemPort, 0, 0}
+		if listening.accepted(conn) {
+			pair.Direction, pair.Port = DIFF_IN, conn.LocalPort
+		}
+
+		key := pair.key()
+		if existing, ok := summary.pairs[key]; ok {
+			pair = existing
+		}
+
+		pair.Connections++
+		pair.Bytes += bytes
+		summary.pairs[key] = pair
+	}
+
+	return summary, nil
+}
+
+// The pairs in one capture but not another, largest first
+func diffPairs(from map[string]DiffPair, to map[string]DiffPair) []DiffPair {
+	pairs := []DiffPair{}
+	for key, pair := range from {
+		if _, ok := to[key]; !ok {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Bytes != pairs[j].Bytes {
+			return pairs[i].Bytes > pairs[j].Bytes
+		}
+		return pairs[i].key() < pairs[j].key()
+	})
+
+	return pairs
+}
+
+func diffListeners(from map[string]DiffListener, to map[string]DiffListener) []DiffListener {
+	listeners := []DiffListener{}
+	for key, listener := range from {
+		if _, ok := to[key]; !ok {
+			listeners = append(listeners, listener)
+		}
+	}
+
+	sort.Slice(listeners, func(i, j int) bool {
+		left, right := listeners[i], listeners[j]
+		if left.Host != right.Host {
+			return left.Host < right.Host
+		}
+		if left.Port != right.Port {
+			return left.Port < right.Port
+		}
+		return left.Protocol < right.Protocol
+	})
+
+	return listeners
+}
+
+// Rates that changed by at least a factor, largest change first. Rates below the minimum count as
+// the minimum, so quiet processes starting or stopping are not reported as infinite changes
+func diffRates(rates []DiffRate, threshold float64, minRate float64) []DiffRate {
+	changed := []DiffRate{}
+
+	for _, rate := range rates {
+		if rate.Before < minRate && rate.After < minRate {
+			continue
+		}
+
+		rate.Factor = math.Max(rate.After, minRate) / math.Max(rate.Before, minRate)
+		if rate.Factor >= threshold || rate.Factor <= 1/threshold {
+			changed = append(changed, rate)
+		}
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		return math.Abs(math.Log(changed[i].Factor)) > math.Abs(math.Log(changed[j].Factor))
+	})
+
+	return changed
+}
+
+// Compare two captures: pairs & listeners that appeared or disappeared, and processes & hosts whose
+// bytes per second changed by at least a factor
+func DiffCaptures(beforePath string, afterPath string, threshold float64, minRate float64) (*CaptureDiff, error) {
+	if threshold <= 1 {
+		return nil, fmt.Errorf("--threshold must be greater than 1")
+	}
+
+	before, err := loadDiffSummary(beforePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", beforePath, err)
+	}
+
+	after, err := loadDiffSummary(afterPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", afterPath, err)
+	}
+
+	processes := map[[2]string]*DiffRate{}
+	hosts := map[string]*DiffRate{}
+	for idx, summary := range []*diffSummary{before, after} {
+		for key, bytes := range summary.processes {
+			if _, ok := processes[key]; !ok {
+				processes[key] = &DiffRate{Host: key[0], Command: key[1]}
+			}
+			if idx == 0 {
+				processes[key].Before = float64(bytes) / summary.capture.Seconds
+			} else {
+				processes[key].After = float64(bytes) / summary.capture.Seconds
+			}
+		}
+
+		for host, bytes := range summary.hosts {
+			if _, ok := hosts[host]; !ok {
+				hosts[host] = &DiffRate{Host: host}
+			}
+			if idx == 0 {
+				hosts[host].Before = float64(bytes) / summary.capture.Seconds
+			} else {
+				hosts[host].After = float64(bytes) / summary.capture.Seconds
+			}
+		}
+	}
+
+	processRates, hostRates := []DiffRate{}, []DiffRate{}
+	for _, rate := range processes {
+		processRates = append(processRates, *rate)
+	}
+	for _, rate := range hosts {
+		hostRates = append(hostRates, *rate)
+	}
+
+	return &CaptureDiff{
+		Before:         before.capture,
+		After:          after.capture,
+		NewPairs:       diffPairs(after.pairs, before.pairs),
+		GonePairs:      diffPairs(before.pairs, after.pairs),
+		NewListeners:   diffListeners(after.listeners, before.listeners),
+		GoneListeners:  diffListeners(before.listeners, after.listeners),
+		ProcessChanges: diffRates(processRates, threshold, minRate),
+		HostChanges:    diffRates(hostRates, threshold, minRate),
+	}, nil
+}
+
+func formatRate(rate float64) string {
+	return FormatBytes(int(math.Round(rate))) + "/s"
+}
+
+// Write each kind of change as a table
+func (diff *CaptureDiff) WriteTable(writer io.Writer) {
+	for _, capture := range []struct {
+		name    string
+		capture DiffCapture
+	}{{"before", diff.Before}, {"after", diff.After}} {
+		fmt.Fprintf(writer, "%-7s %s, %s to %s (%.0fs)\n", capture.name+":", capture.capture.Path,
+			capture.capture.Start.Format(time.RFC3339), capture.capture.End.Format(time.RFC3339), capture.capture.Seconds)
+	}
+
+	writePairs := func(title string, pairs []DiffPair) {
+		fmt.Fprintf(writer, "\n%s\n", title)
+		if len(pairs) == 0 {
+			fmt.Fprintln(writer, "  none")
+		}
+		for _, pair := range pairs {
+			fmt.Fprintf(writer, "  %-12s %-6d %s\n", FormatBytes(pair.Bytes), pair.Connections, pair.String())
+		}
+	}
+
+	writeListeners := func(title string, listeners []DiffListener) {
+		fmt.Fprintf(writer, "\n%s\n", title)
+		if len(listeners) == 0 {
+			fmt.Fprintln(writer, "  none")
+		}
+		for _, listener := range listeners {
+			fmt.Fprintf(writer, "  %-12s %s\n", graphPort(listener.Protocol, listener.Port), serviceId(listener.Host, listener.Command))
+		}
+	}
+
+	writeRates := func(title string, rates []DiffRate) {
+		fmt.Fprintf(writer, "\n%s\n", title)
+		if len(rates) == 0 {
+			fmt.Fprintln(writer, "  none")
+			return
+		}
+
+		fmt.Fprintf(writer, "  %-12s %-12s %-8s %s\n", "BEFORE", "AFTER", "FACTOR", "NAME")
+		for _, rate := range rates {
+			name := rate.Host
+			if len(rate.Command) > 0 {
+				name = serviceId(rate.Host, rate.Command)
+			}
+			fmt.Fprintf(writer, "  %-12s %-12s %-8s %s\n", formatRate(rate.Before), formatRate(rate.After), fmt.Sprintf("x%.2f", rate.Factor), name)
+		}
+	}
+
+	writePairs("NEW PROCESS-REMOTE PAIRS (BYTES, CONNS)", diff.NewPairs)
+	writePairs("DISAPPEARED PROCESS-REMOTE PAIRS (BYTES, CONNS)", diff.GonePairs)
+	writeListeners("NEW LISTENING PORTS", diff.NewListeners)
+	writeListeners("CLOSED LISTENING PORTS", diff.GoneListeners)
+	writeRates("PROCESS TRAFFIC CHANGES", diff.ProcessChanges)
+	writeRates("HOST TRAFFIC CHANGES", diff.HostChanges)
+}
+
+// Compare two captures, printing the changes as tables or JSON
+func AnalyseDiff(beforePath string, afterPath string, threshold float64, minRate float64, asJSON bool) error {
+	diff, err := DiffCaptures(beforePath, afterPath, threshold, minRate)
+	if err != nil {
+		return err
+	}
+
+	if !asJSON {
+		diff.WriteTable(os.Stdout)
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(bytes))
+	return nil
+}
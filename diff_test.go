@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a capture of one connection sending size bytes. When version is below the latest, the
+// capture is downgraded as if written by an older puffin
+func writeTestCapture(t *testing.T, fpath string, size int, version int) {
+	start := time.Now()
+	local, rem := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	pidConns := []PidSocket{{"alice", "curl", "curl https://example.com", 42, 100, nil, "/user.slice", &TCPConnection{1, local, 40000, rem, 443, 1, 0, 0, 1000, 1234}, start}}
+	conns := NewConnectionTable()
+	conns.Update("TCP", &pidConns, start)
+
+	store := MachineNetworkStorage{}
+	AssociatePacket(store, &pidConns, PacketData{"eth0", start.UnixNano(), local, 40000, rem, 443, size, IPPROTO_TCP, nil})
+
+	if err := FlushDBNetwork(fpath, CaptureSession{start, "web-1"}, conns, store, TCPStateStore{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if version == MIGRATIONS[len(MIGRATIONS)-1].Version {
+		return
+	}
+
+	// only the session_origin table is newer than version 3
+	if version != 3 {
+		t.Fatalf("can't write a capture at schema version %d", version)
+	}
+
+	db, err := sql.Open("sqlite3", fpath+SQLITE_OPTIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{"drop table session_origin", "delete from schema_version where version > 3", "pragma wal_checkpoint(truncate)"} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFile(t *testing.T, fpath string) []byte {
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestDiffLeavesInputsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	before, after := filepath.Join(dir, "before.db"), filepath.Join(dir, "after.db")
+
+	// the older capture must be migrated to be read, but only a copy of it
+	writeTestCapture(t, before, 1000, 3)
+	writeTestCapture(t, after, 50000, MIGRATIONS[len(MIGRATIONS)-1].Version)
+
+	inputs := map[string][]byte{}
+	for _, fpath := range []string{before, after} {
+		if err := os.Chmod(fpath, 0444); err != nil {
+			t.Fatal(err)
+		}
+		inputs[fpath] = readTestFile(t, fpath)
+	}
+
+	diff, err := DiffCaptures(before, after, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff.ProcessChanges) != 1 || diff.ProcessChanges[0].Command != "curl" {
+		t.Errorf("unexpected process changes %+v", diff.ProcessChanges)
+	}
+
+	for fpath, content := range inputs {
+		if !bytes.Equal(readTestFile(t, fpath), content) {
+			t.Errorf("%s was modified", fpath)
+		}
+		if _, err := os.Stat(fpath + "-wal"); err == nil && len(readTestFile(t, fpath+"-wal")) > 0 {
+			t.Errorf("%s was written to", fpath)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+before+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Errorf("the older capture was migrated to version %d", version)
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/prometheus/procfs"
+)
+
+// Byte-counts from the eBPF backend are not tied to a network device
+const EBPF_DEVICE = "ebpf"
+
+// How often the eBPF counters are read and turned into packet-data
+const EBPF_POLL_INTERVAL = time.Second
+
+// How long a socket is remembered after its last traffic, before it is reported again
+const EBPF_SOCKET_EXPIRY = 5 * time.Minute
+
+// The uid of sockets whose process exited before /proc was read; (uid_t)-1 is never a real user
+const UNKNOWN_UID = 1<<32 - 1
+
+// statfs's filesystem type for cgroup2
+const CGROUP2_SUPER_MAGIC = 0x63677270
+
+// Offsets of function arguments & return-value in x86-64's struct pt_regs
+const (
+	PT_REGS_PARM1 = 112 // di
+	PT_REGS_PARM2 = 104 // si
+	PT_REGS_PARM3 = 96  // dx
+	PT_REGS_RC    = 80  // ax
+)
+
+const (
+	IPPROTO_TCP = 6
+	IPPROTO_UDP = 17
+	AF_INET     = 2
+	AF_INET6    = 10
+	BPF_NOEXIST = 1
+)
+
+// Where struct sock_common keeps skc_v6_daddr, followed by skc_v6_rcv_saddr, on kernels
+// without BTF to look it up
+const SOCK_COMMON_V6_OFFSET = 56
+
+// Byte-counters are keyed by (socket, pid, protocol, cgroup, peer). Unconnected UDP sockets
+// name their peer in each message, as a struct sockaddr_in or sockaddr_in6; the peer is
+// zero for every other socket
+type ebpfSocketKey struct {
+	Socket   uint64
+	Pid      uint32
+	Protocol uint32
+	Cgroup   uint64
+	Peer     [32]byte
+}
+
+// Sent & received bytes, the head of the kernel's struct sock_common, which has kept its
+// layout (daddr, rcv_saddr, hash, dport, num, family) since before eBPF existed, and the
+// socket's IPv6 addresses (daddr, rcv_saddr)
+type ebpfSocketValue struct {
+	Sent     uint64
+	Received uint64
+	Sock     [24]byte
+	V6       [32]byte
+}
+
+// Stack offsets of the key & value built by the eBPF programs
+const (
+	EBPF_KEY_OFFSET   = -56
+	EBPF_PEER_OFFSET  = -32
+	EBPF_VALUE_OFFSET = -128
+	EBPF_SOCK_OFFSET  = -112
+	EBPF_V6_OFFSET    = -88
+)
+
+// Find skc_v6_daddr in the running kernel's struct sock_common
+func sockCommonV6Offset() int16 {
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return SOCK_COMMON_V6_OFFSET
+	}
+
+	var sockCommon *btf.Struct
+	if err := spec.TypeByName("sock_common", &sockCommon); err != nil {
+		return SOCK_COMMON_V6_OFFSET
+	}
+
+	for _, member := range sockCommon.Members {
+		if member.Name == "skc_v6_daddr" {
+			return int16(member.Offset.Bytes())
+		}
+	}
+
+	return SOCK_COMMON_V6_OFFSET
+}
+
+// Bytes counted against a single socket by the eBPF backend
+type SocketBytes struct {
+	Pid       int
+	Cgroup    uint64
+	Protocol  string
+	Family    uint16
+	LocalAddr net.IP
+	LocalPort uint64
+	RemAddr   net.IP
+	RemPort   uint64
+	Sent      uint64
+	Received  uint64
+}
+
+// Copy the peer named by the struct msghdr in r9 (if any) into the key. Only the family, port
+// & address are kept, so a peer's messages share one counter
+func readMessagePeer() asm.Instructions {
+	return asm.Instructions{
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+16, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+24, 0, asm.DWord),
+		asm.JEq.Imm(asm.R9, 0, "keyed"),
+
+		// msg->msg_name, which the kernel has already copied from (or will copy to) userspace
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, EBPF_PEER_OFFSET),
+		asm.Mov.Imm(asm.R2, 8),
+		asm.Mov.Reg(asm.R3, asm.R9),
+		asm.FnProbeRead.Call(),
+		asm.LoadMem(asm.R3, asm.RFP, EBPF_PEER_OFFSET, asm.DWord),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET, 0, asm.DWord),
+		asm.JEq.Imm(asm.R3, 0, "keyed"),
+
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, EBPF_PEER_OFFSET),
+		asm.Mov.Imm(asm.R2, 28),
+		asm.FnProbeRead.Call(),
+
+		asm.LoadMem(asm.R1, asm.RFP, EBPF_PEER_OFFSET, asm.Half),
+		asm.JEq.Imm(asm.R1, AF_INET6, "peer6"),
+		asm.JEq.Imm(asm.R1, AF_INET, "peer4"),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET, 0, asm.DWord),
+
+		// sockaddr_in: family, port, address, then padding
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+8, 0, asm.DWord).WithSymbol("peer4"),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+16, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+24, 0, asm.DWord),
+		asm.Ja.Label("keyed"),
+
+		// sockaddr_in6: family, port, flow-info, address, scope
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+4, 0, asm.Word).WithSymbol("peer6"),
+		asm.StoreImm(asm.RFP, EBPF_PEER_OFFSET+28, 0, asm.Word),
+	}
+}
+
+// Add the byte-count in r7 to the sent or received counter for the socket in r8, sent to or
+// received from the peer named by the struct msghdr in r9 (if any)
+func countSocketBytes(counters *ebpf.Map, protocol int64, valueOffset int32, v6Offset int16) asm.Instructions {
+	insns := readMessagePeer()
+
+	return append(insns, asm.Instructions{
+		// key: socket, pid, protocol, cgroup, peer
+		asm.StoreMem(asm.RFP, EBPF_KEY_OFFSET, asm.R8, asm.DWord).WithSymbol("keyed"),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, EBPF_KEY_OFFSET+8, asm.R0, asm.Word),
+		asm.StoreImm(asm.RFP, EBPF_KEY_OFFSET+12, protocol, asm.Word),
+		asm.FnGetCurrentCgroupId.Call(),
+		asm.StoreMem(asm.RFP, EBPF_KEY_OFFSET+16, asm.R0, asm.DWord),
+
+		asm.LoadMapPtr(asm.R1, counters.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, EBPF_KEY_OFFSET),
+		asm.FnMapLookupElem.Call(),
+		asm.JNE.Imm(asm.R0, 0, "add"),
+
+		// first time we've seen this key; zero the counters and copy the socket's addresses
+		asm.StoreImm(asm.RFP, EBPF_VALUE_OFFSET, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, EBPF_VALUE_OFFSET+8, 0, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, EBPF_SOCK_OFFSET),
+		asm.Mov.Imm(asm.R2, 24),
+		asm.Mov.Reg(asm.R3, asm.R8),
+		asm.FnProbeRead.Call(),
+
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, EBPF_V6_OFFSET),
+		asm.Mov.Imm(asm.R2, 32),
+		asm.Mov.Reg(asm.R3, asm.R8),
+		asm.Add.Imm(asm.R3, int32(v6Offset)),
+		asm.FnProbeRead.Call(),
+
+		asm.LoadMapPtr(asm.R1, counters.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, EBPF_KEY_OFFSET),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, EBPF_VALUE_OFFSET),
+		asm.Mov.Imm(asm.R4, BPF_NOEXIST),
+		asm.FnMapUpdateElem.Call(),
+
+		asm.LoadMapPtr(asm.R1, counters.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, EBPF_KEY_OFFSET),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+
+		asm.Add.Imm(asm.R0, valueOffset).WithSymbol("add"),
+		asm.StoreXAdd(asm.R0, asm.R7, asm.DWord),
+
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	}...)
+}
+
+// A kprobe counting bytes for a function taking (struct sock *sk, ..., size) arguments, and
+// optionally the struct msghdr naming the peer. With a family, sockets of other families are
+// skipped, as udpv6_sendmsg passes IPv6 sockets sending to IPv4 peers on to udp_sendmsg
+func socketArgProgram(counters *ebpf.Map, protocol int64, sizeArg int16, msgArg int16, family int32, valueOffset int32, v6Offset int16) asm.Instructions {
+	prologue := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R8, asm.R6, PT_REGS_PARM1, asm.DWord),
+		asm.LoadMem(asm.R7, asm.R6, sizeArg, asm.DWord),
+		asm.Mov.Imm(asm.R9, 0),
+
+		// sizes may be ints; sign-extend, and ignore anything non-positive
+		asm.LSh.Imm(asm.R7, 32),
+		asm.ArSh.Imm(asm.R7, 32),
+		asm.JSLE.Imm(asm.R7, 0, "exit"),
+	}
+
+	if msgArg != 0 {
+		prologue = append(prologue, asm.LoadMem(asm.R9, asm.R6, msgArg, asm.DWord))
+	}
+
+	if family != 0 {
+		prologue = append(prologue,
+			// sk->__sk_common.skc_family
+			asm.StoreImm(asm.RFP, -8, 0, asm.DWord),
+			asm.Mov.Reg(asm.R1, asm.RFP),
+			asm.Add.Imm(asm.R1, -8),
+			asm.Mov.Imm(asm.R2, 2),
+			asm.Mov.Reg(asm.R3, asm.R8),
+			asm.Add.Imm(asm.R3, 16),
+			asm.FnProbeRead.Call(),
+			asm.LoadMem(asm.R1, asm.RFP, -8, asm.Half),
+			asm.JNE.Imm(asm.R1, family, "exit"),
+		)
+	}
+
+	return append(prologue, countSocketBytes(counters, protocol, valueOffset, v6Offset)...)
+}
+
+// A kprobe remembering the socket & message passed to udp_recvmsg, keyed by thread
+func udpRecvEntryProgram(pending *ebpf.Map) asm.Instructions {
+	return asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+		asm.LoadMem(asm.R8, asm.R6, PT_REGS_PARM1, asm.DWord),
+		asm.StoreMem(asm.RFP, -24, asm.R8, asm.DWord),
+		asm.LoadMem(asm.R9, asm.R6, PT_REGS_PARM2, asm.DWord),
+		asm.StoreMem(asm.RFP, -16, asm.R9, asm.DWord),
+
+		asm.LoadMapPtr(asm.R1, pending.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, -24),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnMapUpdateElem.Call(),
+
+		asm.Mov.Imm(asm.R0, 0),
+		asm.Return(),
+	}
+}
+
+// A kretprobe counting the bytes udp_recvmsg returned, against the socket it was called with
+// and the peer it filled in
+func udpRecvReturnProgram(counters *ebpf.Map, pending *ebpf.Map, v6Offset int16) asm.Instructions {
+	prologue := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.StoreMem(asm.RFP, -8, asm.R0, asm.DWord),
+
+		asm.LoadMapPtr(asm.R1, pending.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.LoadMem(asm.R8, asm.R0, 0, asm.DWord),
+		asm.LoadMem(asm.R9, asm.R0, 8, asm.DWord),
+
+		asm.LoadMapPtr(asm.R1, pending.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -8),
+		asm.FnMapDeleteElem.Call(),
+
+		asm.LoadMem(asm.R7, asm.R6, PT_REGS_RC, asm.DWord),
+		asm.LSh.Imm(asm.R7, 32),
+		asm.ArSh.Imm(asm.R7, 32),
+		asm.JSLE.Imm(asm.R7, 0, "exit"),
+	}
+
+	return append(prologue, countSocketBytes(counters, IPPROTO_UDP, 8, v6Offset)...)
+}
+
+// Counts bytes per (socket, pid, cgroup, peer) in the kernel, using kprobes on the
+// TCP & UDP send and receive paths
+type EBPFBackend struct {
+	counters *ebpf.Map
+	pending  *ebpf.Map
+	programs []*ebpf.Program
+	links    []link.Link
+}
+
+func (backend *EBPFBackend) Close() {
+	for _, probe := range backend.links {
+		probe.Close()
+	}
+
+	for _, prog := range backend.programs {
+		prog.Close()
+	}
+
+	if backend.pending != nil {
+		backend.pending.Close()
+	}
+
+	if backend.counters != nil {
+		backend.counters.Close()
+	}
+}
+
+func (backend *EBPFBackend) attach(symbol string, insns asm.Instructions, ret bool) error {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "puffin_" + symbol,
+		Type:         ebpf.Kprobe,
+		Instructions: insns,
+		License:      "GPL",
+	})
+
+	if err != nil {
+		return fmt.Errorf("loading %s probe: %v", symbol, err)
+	}
+
+	backend.programs = append(backend.programs, prog)
+
+	var probe link.Link
+	if ret {
+		probe, err = link.Kretprobe(symbol, prog, nil)
+	} else {
+		probe, err = link.Kprobe(symbol, prog, nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("attaching %s probe: %v", symbol, err)
+	}
+
+	backend.links = append(backend.links, probe)
+	return nil
+}
+
+// The map of byte-counters the eBPF programs add to
+func newSocketCounters() (*ebpf.Map, error) {
+	return ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "puffin_bytes",
+		Type:       ebpf.Hash,
+		KeySize:    uint32(binary.Size(ebpfSocketKey{})),
+		ValueSize:  uint32(binary.Size(ebpfSocketValue{})),
+		MaxEntries: 65536,
+	})
+}
+
+// Load and attach the eBPF programs. An error means eBPF is unavailable (no privileges,
+// an unsupported architecture or an old kernel), and the caller should fall back to pcap
+func OpenEBPFBackend() (*EBPFBackend, error) {
+	if runtime.GOARCH != "amd64" {
+		return nil, fmt.Errorf("the eBPF backend only supports amd64, not %s", runtime.GOARCH)
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, err
+	}
+
+	backend := &EBPFBackend{}
+	var err error
+
+	backend.counters, err = newSocketCounters()
+	if err != nil {
+		return nil, err
+	}
+
+	// counters are read & removed in one step, which hash maps support from Linux 5.14
+	var probeKey ebpfSocketKey
+	var probeValue ebpfSocketValue
+	if err := backend.counters.LookupAndDelete(&probeKey, &probeValue); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		backend.Close()
+		return nil, fmt.Errorf("the eBPF backend needs atomic lookup-and-delete (Linux 5.14 or later): %v", err)
+	}
+
+	backend.pending, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "puffin_udp_recv",
+		Type:       ebpf.Hash,
+		KeySize:    8,
+		ValueSize:  16,
+		MaxEntries: 10240,
+	})
+
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	v6Offset := sockCommonV6Offset()
+
+	// TCP's functions serve both families; UDP has its own for IPv6, which may be a module
+	probes := []struct {
+		symbol   string
+		insns    asm.Instructions
+		ret      bool
+		optional bool
+	}{
+		{"tcp_sendmsg", socketArgProgram(backend.counters, IPPROTO_TCP, PT_REGS_PARM3, 0, 0, 0, v6Offset), false, false},
+		{"tcp_cleanup_rbuf", socketArgProgram(backend.counters, IPPROTO_TCP, PT_REGS_PARM2, 0, 0, 8, v6Offset), false, false},
+		{"udp_sendmsg", socketArgProgram(backend.counters, IPPROTO_UDP, PT_REGS_PARM3, PT_REGS_PARM2, AF_INET, 0, v6Offset), false, false},
+		{"udp_recvmsg", udpRecvEntryProgram(backend.pending), false, false},
+		{"udp_recvmsg", udpRecvReturnProgram(backend.counters, backend.pending, v6Offset), true, false},
+		{"udpv6_sendmsg", socketArgProgram(backend.counters, IPPROTO_UDP, PT_REGS_PARM3, PT_REGS_PARM2, 0, 0, v6Offset), false, true},
+		{"udpv6_recvmsg", udpRecvEntryProgram(backend.pending), false, true},
+		{"udpv6_recvmsg", udpRecvReturnProgram(backend.counters, backend.pending, v6Offset), true, true},
+	}
+
+	for _, probe := range probes {
+		err := backend.attach(probe.symbol, probe.insns, probe.ret)
+		if err != nil && probe.optional {
+			log.Printf("eBPF backend: %v; IPv6 UDP traffic will not be counted", err)
+			continue
+		}
+		if err != nil {
+			backend.Close()
+			return nil, err
+		}
+	}
+
+	return backend, nil
+}
+
+// Read the byte-counts for every socket since the last read. Entries are removed once read,
+// so the map stays small and a socket-pointer reused by the kernel gets fresh addresses
+func (backend *EBPFBackend) Read() ([]SocketBytes, error) {
+	keys := []ebpfSocketKey{}
+
+	var key ebpfSocketKey
+	var value ebpfSocketValue
+
+	entries := backend.counters.Iterate()
+	for entries.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+
+	if err := entries.Err(); err != nil {
+		return nil, err
+	}
+
+	sockets := []SocketBytes{}
+
+	for _, key := range keys {
+		// take an entry's counts and remove it in one step, so bytes counted in between are
+		// left for the next read rather than lost
+		err := backend.counters.LookupAndDelete(&key, &value)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			continue
+		}
+		if err != nil {
+			return sockets, err
+		}
+
+		sock := SocketBytes{
+			Pid:       int(key.Pid),
+			Cgroup:    key.Cgroup,
+			Protocol:  "TCP",
+			Family:    binary.LittleEndian.Uint16(value.Sock[16:18]),
+			RemPort:   uint64(binary.BigEndian.Uint16(value.Sock[12:14])),
+			LocalPort: uint64(binary.LittleEndian.Uint16(value.Sock[14:16])),
+			Sent:      value.Sent,
+			Received:  value.Received,
+		}
+
+		if sock.Family == AF_INET6 {
+			sock.RemAddr = net.IP(append([]byte{}, value.V6[0:16]...))
+			sock.LocalAddr = net.IP(append([]byte{}, value.V6[16:32]...))
+		} else {
+			sock.RemAddr = net.IP(append([]byte{}, value.Sock[0:4]...))
+			sock.LocalAddr = net.IP(append([]byte{}, value.Sock[4:8]...))
+		}
+
+		// an unconnected UDP socket's peer is the one its messages named
+		switch binary.LittleEndian.Uint16(key.Peer[0:2]) {
+		case AF_INET:
+			sock.RemAddr = net.IP(append([]byte{}, key.Peer[4:8]...))
+			sock.RemPort = uint64(binary.BigEndian.Uint16(key.Peer[2:4]))
+		case AF_INET6:
+			sock.RemAddr = net.IP(append([]byte{}, key.Peer[8:24]...))
+			sock.RemPort = uint64(binary.BigEndian.Uint16(key.Peer[2:4]))
+		}
+
+		if key.Protocol == IPPROTO_UDP {
+			sock.Protocol = "UDP"
+		}
+
+		sockets = append(sockets, sock)
+	}
+
+	return sockets, nil
+}
+
+func (sock *SocketBytes) GetId() string {
+	return sock.LocalAddr.String() + fmt.Sprint(sock.LocalPort) + sock.RemAddr.String() + fmt.Sprint(sock.RemPort)
+}
+
+// Find the /proc/net connection for a socket, or describe it from the eBPF data if it has gone.
+// A socket that has gone has no known owner
+func socketConnection(sock *SocketBytes, conns []Connection) Connection {
+	for _, conn := range conns {
+		if conn.GetType() == sock.Protocol && conn.GetId() == sock.GetId() {
+			return conn
+		}
+	}
+
+	if sock.Protocol == "UDP" {
+		return UDPConnection{localAddr: sock.LocalAddr, localPort: sock.LocalPort, remAddr: sock.RemAddr, remPort: sock.RemPort, uid: UNKNOWN_UID}
+	}
+
+	return TCPConnection{localAddr: sock.LocalAddr, localPort: sock.LocalPort, remAddr: sock.RemAddr, remPort: sock.RemPort, uid: UNKNOWN_UID}
+}
+
+// Resolves the kernel's cgroup ids to paths, as /proc/<pid>/cgroup names them. A cgroup's id is
+// its directory's inode number in the cgroup2 filesystem, so outlives the processes in it
+type cgroupPaths struct {
+	root    string // where cgroup2 is mounted, or empty if it isn't
+	paths   map[uint64]string
+	scanned time.Time
+}
+
+func newCgroupPaths() *cgroupPaths {
+	cgroups := &cgroupPaths{paths: map[uint64]string{}}
+
+	// hybrid hierarchies mount cgroup2 beneath the v1 controllers
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(root, &stat); err == nil && stat.Type == CGROUP2_SUPER_MAGIC {
+			cgroups.root = root
+			break
+		}
+	}
+
+	return cgroups
+}
+
+// List every cgroup, dropping those since removed
+func (cgroups *cgroupPaths) scan() {
+	paths := map[uint64]string{}
+
+	filepath.WalkDir(cgroups.root, func(fpath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			rel, _ := filepath.Rel(cgroups.root, fpath)
+			paths[stat.Ino] = filepath.Clean("/" + rel)
+		}
+
+		return nil
+	})
+
+	cgroups.paths = paths
+	cgroups.scanned = time.Now()
+}
+
+// The path of a cgroup, rescanning (at most once per poll) for cgroups created since the last scan
+func (cgroups *cgroupPaths) Path(id uint64) (string, bool) {
+	if len(cgroups.root) == 0 {
+		return "", false
+	}
+
+	if path, ok := cgroups.paths[id]; ok {
+		return path, true
+	}
+
+	if time.Since(cgroups.scanned) >= EBPF_POLL_INTERVAL {
+		cgroups.scan()
+	}
+
+	path, ok := cgroups.paths[id]
+	return path, ok
+}
+
+// Attribute an eBPF-counted socket to its process. The kernel told us the pid & cgroup, so there
+// is no inode correlation; if the process has already exited, its command & parents are unknown
+func socketPidSocket(pfs *procfs.FS, sock *SocketBytes, conns []Connection, uidToUsername map[uint64]string, cgroups *cgroupPaths) PidSocket {
+	conn := socketConnection(sock, conns)
+
+	if conn.GetUID() == UNKNOWN_UID {
+		uidToUsername[UNKNOWN_UID] = "?"
+	}
+
+	if _, ok := uidToUsername[conn.GetUID()]; !ok {
+		userName, _ := LookupUsername(conn.GetUID())
+		if len(userName) == 0 {
+			userName = "?"
+		}
+		uidToUsername[conn.GetUID()] = userName
+	}
+
+	var startTime uint64
+	if proc, err := pfs.Proc(sock.Pid); err == nil {
+		if stat, err := proc.Stat(); err == nil {
+			startTime = stat.Starttime
+		}
+	}
+
+	cgroup, ok := cgroups.Path(sock.Cgroup)
+	if !ok {
+		cgroup = PidToCgroup(pfs, sock.Pid)
+	}
+
+	return PidSocket{
+		uidToUsername[conn.GetUID()],
+		PidToCommand(pfs, sock.Pid),
+		PidToCommandline(pfs, sock.Pid),
+		sock.Pid,
+		startTime,
+		ReadProcessParents(pfs, sock.Pid),
+		cgroup,
+		conn,
+		time.Now(),
+	}
+}
+
+// Periodically read the eBPF counters, emitting the bytes sent and received since the last
+// read as packet-data, and newly seen sockets as process-sockets
+func EBPFWatcher(pfs *procfs.FS, backend *EBPFBackend, packetChan chan *PacketData, sockChan chan *[]PidSocket) {
+	seen := map[string]time.Time{} // when each socket last had traffic
+	uidToUsername := map[uint64]string{}
+	cgroups := newCgroupPaths()
+
+	for {
+		time.Sleep(EBPF_POLL_INTERVAL)
+
+		sockets, err := backend.Read()
+		if err != nil {
+			continue
+		}
+
+		readTime := time.Now()
+		now := readTime.UnixNano()
+		pidSockets := []PidSocket{}
+		var conns []Connection
+
+		for idx := range sockets {
+			sock := sockets[idx]
+
+			if sock.Family != AF_INET && sock.Family != AF_INET6 {
+				continue
+			}
+
+			key := fmt.Sprint(sock.Pid) + "/" + sock.Protocol + "/" + sock.GetId()
+			if _, ok := seen[key]; !ok {
+				if conns == nil {
+					conns = append(ReadTCPConnections(pfs), ReadUDPConnections(pfs)...)
+				}
+
+				pidSockets = append(pidSockets, socketPidSocket(pfs, &sock, conns, uidToUsername, cgroups))
+			}
+			seen[key] = readTime
+
+			protocol := uint8(IPPROTO_TCP)
+			if sock.Protocol == "UDP" {
+				protocol = IPPROTO_UDP
+			}
+
+			if sock.Sent > 0 {
+				packetChan <- &PacketData{EBPF_DEVICE, now, sock.LocalAddr, sock.LocalPort, sock.RemAddr, sock.RemPort, int(sock.Sent), protocol, nil}
+			}
+
+			if sock.Received > 0 {
+				packetChan <- &PacketData{EBPF_DEVICE, now, sock.RemAddr, sock.RemPort, sock.LocalAddr, sock.LocalPort, int(sock.Received), protocol, nil}
+			}
+		}
+
+		for key, last := range seen {
+			if readTime.Sub(last) > EBPF_SOCKET_EXPIRY {
+				delete(seen, key)
+			}
+		}
+
+		if len(pidSockets) > 0 {
+			sockChan <- &pidSockets
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// Loading kprobes needs root (or CAP_BPF & CAP_PERFMON) on amd64, so skip where that is missing
+func openTestEBPFBackend(t *testing.T) *EBPFBackend {
+	backend, err := OpenEBPFBackend()
+	if err != nil {
+		t.Skipf("eBPF backend unavailable: %v", err)
+	}
+
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestEBPFCountsLoopbackTraffic(t *testing.T) {
+	backend := openTestEBPFBackend(t)
+
+	// drop anything counted before the connection, so only its traffic is read below
+	if _, err := backend.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	const size = 64 * 1024
+	received := make(chan int, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer conn.Close()
+
+		count, _ := io.Copy(io.Discard, conn)
+		received <- int(count)
+	}()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case count := <-received:
+		if count != size {
+			t.Fatalf("server read %d bytes, expected %d", count, size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server to read")
+	}
+
+	sockets, err := backend.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPort := uint64(client.LocalAddr().(*net.TCPAddr).Port)
+	serverPort := uint64(listener.Addr().(*net.TCPAddr).Port)
+	sent, recv := uint64(0), uint64(0)
+	var cgroup uint64
+
+	for _, sock := range sockets {
+		if sock.Pid != os.Getpid() || sock.Protocol != "TCP" {
+			continue
+		}
+		if sock.LocalPort == clientPort && sock.RemPort == serverPort {
+			sent += sock.Sent
+			cgroup = sock.Cgroup
+		}
+		if sock.LocalPort == serverPort && sock.RemPort == clientPort {
+			recv += sock.Received
+		}
+	}
+
+	if sent != size {
+		t.Errorf("counted %d bytes sent, expected %d", sent, size)
+	}
+	if recv != size {
+		t.Errorf("counted %d bytes received, expected %d", recv, size)
+	}
+
+	// counters are removed as they are read, so nothing is counted twice
+	again, err := backend.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sock := range again {
+		if sock.Pid == os.Getpid() && (sock.LocalPort == clientPort || sock.LocalPort == serverPort) {
+			t.Errorf("socket %s read twice: %+v", sock.GetId(), sock)
+		}
+	}
+
+	// the kernel's cgroup id names the same cgroup /proc does
+	cgroups := newCgroupPaths()
+	if path, ok := cgroups.Path(cgroup); ok {
+		pfs, err := procfs.NewFS("/proc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := PidToCgroup(&pfs, os.Getpid()); path != expected {
+			t.Errorf("cgroup %d resolved to %q, expected %q", cgroup, path, expected)
+		}
+	}
+}
+
+func TestEBPFExitedSocketHasUnknownUser(t *testing.T) {
+	sock := &SocketBytes{Pid: 1, Protocol: "TCP", Family: AF_INET, LocalAddr: net.ParseIP("10.0.0.1"), LocalPort: 40000, RemAddr: net.ParseIP("10.0.0.2"), RemPort: 443}
+
+	conn := socketConnection(sock, []Connection{})
+	if conn.GetUID() != UNKNOWN_UID {
+		t.Fatalf("socket without a /proc entry has uid %d, expected %d", conn.GetUID(), UNKNOWN_UID)
+	}
+}
+
+// Counters as the kernel programs would write them, for a connected TCP socket over IPv6 and an
+// unconnected UDP socket sending to a peer named in its messages
+func TestEBPFReadsIPv6AndMessagePeers(t *testing.T) {
+	counters, err := newSocketCounters()
+	if err != nil {
+		t.Skipf("eBPF maps unavailable: %v", err)
+	}
+
+	backend := &EBPFBackend{counters: counters}
+	defer backend.Close()
+
+	tcpKey := ebpfSocketKey{Socket: 1, Pid: 42, Protocol: IPPROTO_TCP}
+	tcpValue := ebpfSocketValue{Sent: 100, Received: 50}
+	binary.BigEndian.PutUint16(tcpValue.Sock[12:], 443)
+	binary.LittleEndian.PutUint16(tcpValue.Sock[14:], 40000)
+	binary.LittleEndian.PutUint16(tcpValue.Sock[16:], AF_INET6)
+	copy(tcpValue.V6[0:], net.ParseIP("2001:db8::2"))
+	copy(tcpValue.V6[16:], net.ParseIP("2001:db8::1"))
+
+	// the socket itself is unconnected, so has no remote address
+	udpKey := ebpfSocketKey{Socket: 2, Pid: 43, Protocol: IPPROTO_UDP}
+	binary.LittleEndian.PutUint16(udpKey.Peer[0:], AF_INET)
+	binary.BigEndian.PutUint16(udpKey.Peer[2:], 53)
+	copy(udpKey.Peer[4:], net.ParseIP("192.0.2.53").To4())
+	udpValue := ebpfSocketValue{Sent: 60}
+	binary.LittleEndian.PutUint16(udpValue.Sock[14:], 50000)
+	binary.LittleEndian.PutUint16(udpValue.Sock[16:], AF_INET)
+
+	for key, value := range map[ebpfSocketKey]ebpfSocketValue{tcpKey: tcpValue, udpKey: udpValue} {
+		if err := counters.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sockets, err := backend.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int]string{
+		42: "2001:db8::140000" + "2001:db8::2443",
+		43: "0.0.0.050000" + "192.0.2.5353",
+	}
+
+	if len(sockets) != len(expected) {
+		t.Fatalf("read %d sockets, expected %d", len(sockets), len(expected))
+	}
+
+	for _, sock := range sockets {
+		if id := sock.GetId(); id != expected[sock.Pid] {
+			t.Errorf("pid %d's socket has id %s, expected %s", sock.Pid, id, expected[sock.Pid])
+		}
+	}
+}
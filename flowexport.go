@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	FLOW_EXPORT_INTERVAL    = time.Second // how often flows are checked for timeouts
+	FLOW_TEMPLATE_REFRESH   = time.Minute // resend templates this often, so restarted collectors can decode records
+	FLOW_MAX_DATAGRAM       = 1400        // keep export datagrams within a typical MTU
+	FLOW_ENTERPRISE_NUMBER  = 32473       // the private enterprise number puffin's own information elements are under
+	FLOW_VARIABLE_LENGTH    = 65535       // an IPFIX field whose length is given in each record
+	FLOW_OBSERVATION_DOMAIN = 0           // the observation domain (or NetFlow v9 source) id
+	IPFIX_VERSION           = 10          // RFC 7011
+	IPFIX_TEMPLATE_SET      = 2           // the set id of IPFIX template sets
+	IPFIX_HEADER_SIZE       = 16          // version, length, export time, sequence number & domain
+	NETFLOW9_VERSION        = 9           // RFC 3954
+	NETFLOW9_TEMPLATE_SET   = 0           // the flowset id of NetFlow v9 template flowsets
+	NETFLOW9_HEADER_SIZE    = 20          // version, count, uptime, export time, sequence number & source id
+	FLOW_TEMPLATE_IPV4      = 256         // data records for IPv4 flows
+	FLOW_TEMPLATE_IPV6      = 257         // data records for IPv6 flows
+	FLOW_END_IDLE           = 1           // flowEndReason: idle timeout
+	FLOW_END_ACTIVE         = 2           // flowEndReason: active timeout
+	FLOW_END_FORCED         = 4           // flowEndReason: the capture ended
+	IPFIX_DEFAULT_PORT      = "4739"
+	NETFLOW9_DEFAULT_PORT   = "2055"
+)
+
+// Options for exporting flows to a collector
+type FlowExportOptions struct {
+	Version int    // IPFIX_VERSION or NETFLOW9_VERSION
+	Address string // the collector's UDP address
+	Active  time.Duration
+	Idle    time.Duration
+}
+
+// Read flow-export options from the command-line; nil when no collector was given
+func ParseFlowExportOptions(opts docopt.Opts) (*FlowExportOptions, error) {
+	target, _ := opts.String("--flow-export")
+	if len(target) == 0 {
+		return nil, nil
+	}
+
+	collector, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("--flow-export: %v", err)
+	}
+
+	exportOpts := &FlowExportOptions{}
+	port := ""
+
+	switch collector.Scheme {
+	case "ipfix":
+		exportOpts.Version, port = IPFIX_VERSION, IPFIX_DEFAULT_PORT
+	case "netflow9":
+		exportOpts.Version, port = NETFLOW9_VERSION, NETFLOW9_DEFAULT_PORT
+	default:
+		return nil, fmt.Errorf("--flow-export: unknown protocol %q; expected ipfix://host:port or netflow9://host:port", collector.Scheme)
+	}
+
+	if len(collector.Port()) > 0 {
+		port = collector.Port()
+	}
+	exportOpts.Address = net.JoinHostPort(collector.Hostname(), port)
+
+	active, _ := opts.Int("--active-timeout")
+	idle, _ := opts.Int("--idle-timeout")
+
+	if active <= 0 || idle <= 0 {
+		return nil, fmt.Errorf("--active-timeout and --idle-timeout must be a positive number of seconds")
+	}
+
+	exportOpts.Active = time.Duration(active) * time.Second
+	exportOpts.Idle = time.Duration(idle) * time.Second
+
+	return exportOpts, nil
+}
+
+// A unidirectional flow's traffic since it was last exported
+type FlowRecord struct {
+	Device    string
+	SrcAddr   net.IP
+	SrcPort   uint64
+	DstAddr   net.IP
+	DstPort   uint64
+	Protocol  uint8 // 6 for TCP, 17 for UDP, or zero when unknown
+	Bytes     uint64
+	Packets   uint64
+	Start     int64 // the first packet, in nanoseconds
+	End       int64 // the last packet, in nanoseconds
+	EndReason uint8
+	Process   *PidSocket // the socket the flow belongs to; nil when unattributed
+}
+
+// A field of a flow template. Enterprise fields are puffin's own information elements
+type flowField struct {
+	Name       string
+	Id         uint16
+	Length     uint16
+	Enterprise bool
+}
+
+// Addresses lead each template, and are numbered alike in IPFIX & NetFlow v9
+var FLOW_IPV4_FIELDS = []flowField{{"src_addr", 8, 4, false}, {"dst_addr", 12, 4, false}}
+var FLOW_IPV6_FIELDS = []flowField{{"src_addr", 27, 16, false}, {"dst_addr", 28, 16, false}}
+
+var IPFIX_FIELDS = []flowField{
+	{"src_port", 7, 2, false},
+	{"dst_port", 11, 2, false},
+	{"protocol", 4, 1, false},
+	{"bytes", 1, 8, false},
+	{"packets", 2, 8, false},
+	{"start_ms", 152, 8, false},
+	{"end_ms", 153, 8, false},
+	{"end_reason", 136, 1, false},
+	{"device", 82, FLOW_VARIABLE_LENGTH, false},
+	{"command", 1, FLOW_VARIABLE_LENGTH, true},
+	{"pid", 2, 4, true},
+	{"username", 3, FLOW_VARIABLE_LENGTH, true},
+	{"cgroup", 4, FLOW_VARIABLE_LENGTH, true},
+}
+
+// NetFlow v9 has no variable-length or enterprise fields, so strings are fixed-length and
+// puffin's fields use the vendor-proprietary range (25000 - 35000)
+var NETFLOW9_FIELDS = []flowField{
+	{"src_port", 7, 2, false},
+	{"dst_port", 11, 2, false},
+	{"protocol", 4, 1, false},
+	{"bytes", 1, 8, false},
+	{"packets", 2, 8, false},
+	{"start_uptime", 22, 4, false},
+	{"end_uptime", 21, 4, false},
+	{"device", 82, 16, false},
+	{"command", 25001, 16, false},
+	{"pid", 25002, 4, false},
+	{"username", 25003, 32, false},
+	{"cgroup", 25004, 128, false},
+}
+
+// Encodes flow records as IPFIX or NetFlow v9 messages
+type FlowEncoder struct {
+	Version       int
+	boot          time.Time // NetFlow v9 times are relative to when the exporter started
+	sequence      uint32
+	templatesSent time.Time
+}
+
+func NewFlowEncoder(version int, now time.Time) *FlowEncoder {
+	return &FlowEncoder{Version: version, boot: now}
+}
+
+func (enc *FlowEncoder) templates() map[uint16][]flowField {
+	fields := NETFLOW9_FIELDS
+	if enc.Version == IPFIX_VERSION {
+		fields = IPFIX_FIELDS
+	}
+
+	return map[uint16][]flowField{
+		FLOW_TEMPLATE_IPV4: append(append([]flowField{}, FLOW_IPV4_FIELDS...), fields...),
+		FLOW_TEMPLATE_IPV6: append(append([]flowField{}, FLOW_IPV6_FIELDS...), fields...),
+	}
+}
+
+func (enc *FlowEncoder) headerSize() int {
+	if enc.Version == IPFIX_VERSION {
+		return IPFIX_HEADER_SIZE
+	}
+	return NETFLOW9_HEADER_SIZE
+}
+
+// Milliseconds since the exporter started, as NetFlow v9 expects
+func (enc *FlowEncoder) uptime(nanos int64) uint64 {
+	if nanos < enc.boot.UnixNano() {
+		return 0
+	}
+	return uint64((nanos - enc.boot.UnixNano()) / int64(time.Millisecond))
+}
+
+// A field's value for a record: an unsigned integer, an address or a string
+func (enc *FlowEncoder) value(rec *FlowRecord, name string) interface{} {
+	switch name {
+	case "src_addr":
+		return rec.SrcAddr
+	case "dst_addr":
+		return rec.DstAddr
+	case "src_port":
+		return rec.SrcPort
+	case "dst_port":
+		return rec.DstPort
+	case "protocol":
+		return uint64(rec.Protocol)
+	case "bytes":
+		return rec.Bytes
+	case "packets":
+		return rec.Packets
+	case "start_ms":
+		return uint64(rec.Start / int64(time.Millisecond))
+	case "end_ms":
+		return uint64(rec.End / int64(time.Millisecond))
+	case "start_uptime":
+		return enc.uptime(rec.Start)
+	case "end_uptime":
+		return enc.uptime(rec.End)
+	case "end_reason":
+		return uint64(rec.EndReason)
+	case "device":
+		return rec.Device
+	}
+
+	if rec.Process == nil {
+		if name == "pid" {
+			return uint64(0)
+		}
+		return ""
+	}
+
+	switch name {
+	case "command":
+		return rec.Process.Command
+	case "pid":
+		return uint64(rec.Process.Pid)
+	case "username":
+		return rec.Process.UserName
+	case "cgroup":
+		return rec.Process.Cgroup
+	}
+
+	panic("unknown flow field " + name)
+}
+
+// Append a record's fields, in template order
+func (enc *FlowEncoder) appendRecord(buf []byte, rec *FlowRecord, fields []flowField) []byte {
+	for _, field := range fields {
+		switch value := enc.value(rec, field.Name).(type) {
+		case uint64:
+			for shift := int(field.Length-1) * 8; shift >= 0; shift -= 8 {
+				buf = append(buf, byte(value>>uint(shift)))
+			}
+
+		case net.IP:
+			if field.Length == net.IPv4len {
+				value = value.To4()
+			} else {
+				value = value.To16()
+			}
+			if value == nil {
+				value = make(net.IP, field.Length)
+			}
+			buf = append(buf, value...)
+
+		case string:
+			if field.Length != FLOW_VARIABLE_LENGTH {
+				// fixed-length, truncated or padded with zeroes
+				str := make([]byte, field.Length)
+				copy(str, value)
+				buf = append(buf, str...)
+			} else if len(value) < 255 {
+				buf = append(append(buf, byte(len(value))), value...)
+			} else {
+				if len(value) > FLOW_VARIABLE_LENGTH {
+					value = value[:FLOW_VARIABLE_LENGTH]
+				}
+				buf = append(binary.BigEndian.AppendUint16(append(buf, 255), uint16(len(value))), value...)
+			}
+		}
+	}
+
+	return buf
+}
+
+// Append a template set containing every template
+func (enc *FlowEncoder) appendTemplates(buf []byte) ([]byte, int) {
+	setId := uint16(IPFIX_TEMPLATE_SET)
+	if enc.Version == NETFLOW9_VERSION {
+		setId = NETFLOW9_TEMPLATE_SET
+	}
+
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(setId)<<16)
+
+	templates := enc.templates()
+	for _, id := range []uint16{FLOW_TEMPLATE_IPV4, FLOW_TEMPLATE_IPV6} {
+		buf = binary.BigEndian.AppendUint16(buf, id)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(templates[id])))
+
+		for _, field := range templates[id] {
+			if field.Enterprise {
+				buf = binary.BigEndian.AppendUint16(buf, field.Id|0x8000)
+				buf = binary.BigEndian.AppendUint16(buf, field.Length)
+				buf = binary.BigEndian.AppendUint32(buf, FLOW_ENTERPRISE_NUMBER)
+			} else {
+				buf = binary.BigEndian.AppendUint16(buf, field.Id)
+				buf = binary.BigEndian.AppendUint16(buf, field.Length)
+			}
+		}
+	}
+
+	return enc.endSet(buf, start), len(templates)
+}
+
+// Fill in a set's length, padding NetFlow v9 flowsets to a 32-bit boundary
+func (enc *FlowEncoder) endSet(buf []byte, start int) []byte {
+	if enc.Version == NETFLOW9_VERSION {
+		for (len(buf)-start)%4 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+
+	binary.BigEndian.PutUint16(buf[start+2:], uint16(len(buf)-start))
+	return buf
+}
+
+// Fill in a message's header
+func (enc *FlowEncoder) endMessage(buf []byte, records int, dataRecords int, now time.Time) []byte {
+	if enc.Version == IPFIX_VERSION {
+		binary.BigEndian.PutUint16(buf[0:], IPFIX_VERSION)
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+		binary.BigEndian.PutUint32(buf[4:], uint32(now.Unix()))
+		// the number of data records sent before this message
+		binary.BigEndian.PutUint32(buf[8:], enc.sequence)
+		binary.BigEndian.PutUint32(buf[12:], FLOW_OBSERVATION_DOMAIN)
+
+		enc.sequence += uint32(dataRecords)
+		return buf
+	}
+
+	binary.BigEndian.PutUint16(buf[0:], NETFLOW9_VERSION)
+	binary.BigEndian.PutUint16(buf[2:], uint16(records))
+	binary.BigEndian.PutUint32(buf[4:], uint32(enc.uptime(now.UnixNano())))
+	binary.BigEndian.PutUint32(buf[8:], uint32(now.Unix()))
+	// the number of export packets sent before this one
+	binary.BigEndian.PutUint32(buf[12:], enc.sequence)
+	binary.BigEndian.PutUint32(buf[16:], FLOW_OBSERVATION_DOMAIN)
+
+	enc.sequence++
+	return buf
+}
+
+// Encode records into as many messages as they need, leading with the templates when they
+// are due to be resent. Templates are sent even when there are no records
+func (enc *FlowEncoder) Encode(records []FlowRecord, now time.Time) [][]byte {
+	templates := enc.templates()
+	messages := [][]byte{}
+
+	var buf []byte
+	count, dataCount := 0, 0
+	setId, setStart := uint16(0), 0
+
+	begin := func() {
+		buf = make([]byte, enc.headerSize(), FLOW_MAX_DATAGRAM)
+		count, dataCount, setId = 0, 0, 0
+
+		if now.Sub(enc.templatesSent) >= FLOW_TEMPLATE_REFRESH {
+			buf, count = enc.appendTemplates(buf)
+			enc.templatesSent = now
+		}
+	}
+
+	finish := func() {
+		if setId != 0 {
+			buf = enc.endSet(buf, setStart)
+		}
+		messages = append(messages, enc.endMessage(buf, count, dataCount, now))
+		buf = nil
+	}
+
+	if now.Sub(enc.templatesSent) >= FLOW_TEMPLATE_REFRESH {
+		begin()
+	}
+
+	for idx := range records {
+		rec := &records[idx]
+
+		id := uint16(FLOW_TEMPLATE_IPV6)
+		if rec.SrcAddr.To4() != nil {
+			id = FLOW_TEMPLATE_IPV4
+		}
+
+		encoded := enc.appendRecord(nil, rec, templates[id])
+
+		if buf == nil {
+			begin()
+		}
+
+		// 4 bytes for a set header, and 3 for padding
+		if dataCount > 0 && len(buf)+len(encoded)+4+3 > FLOW_MAX_DATAGRAM {
+			finish()
+			begin()
+		}
+
+		if id != setId {
+			if setId != 0 {
+				buf = enc.endSet(buf, setStart)
+			}
+
+			setId, setStart = id, len(buf)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(id)<<16)
+		}
+
+		buf = append(buf, encoded...)
+		count++
+		dataCount++
+	}
+
+	if buf != nil {
+		finish()
+	}
+
+	return messages
+}
+
+// Traffic counted for one direction of a device & 4-tuple, but not yet exported
+type flowState struct {
+	device      string
+	flowId      string
+	data        StoredConnectionData // addresses & ports; packets are not kept
+	seenBytes   int                  // the stored totals when last collected
+	seenPackets int
+	bytes       int
+	packets     int
+	start       int64
+	end         int64
+}
+
+// Builds flows from stored traffic, exporting them to a collector over UDP once they have been
+// idle for the idle timeout, or open for the active timeout
+type FlowExporter struct {
+	Options *FlowExportOptions
+	conn    net.Conn
+	encoder *FlowEncoder
+	flows   map[string]*flowState // by device & 4-tuple
+}
+
+func NewFlowExporter(opts *FlowExportOptions, now time.Time) (*FlowExporter, error) {
+	conn, err := net.Dial("udp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FlowExporter{opts, conn, NewFlowEncoder(opts.Version, now), map[string]*flowState{}}, nil
+}
+
+// The earliest stored packet after a time, or the latest packet when earlier ones were pruned
+func firstPacketAfter(connData *StoredConnectionData, after int64) int64 {
+	idx := sort.Search(len(connData.Packets), func(idx int) bool {
+		return connData.Packets[idx].Timestamp > after
+	})
+
+	if idx < len(connData.Packets) {
+		return connData.Packets[idx].Timestamp
+	}
+
+	return int64(connData.To)
+}
+
+// Count traffic stored since the last collection
+func (exporter *FlowExporter) Update(store MachineNetworkStorage) {
+	for device, deviceConns := range store {
+		for flowId, connData := range deviceConns {
+			key := device + "/" + flowId
+			state, ok := exporter.flows[key]
+			if !ok {
+				state = &flowState{device: device, flowId: flowId}
+				exporter.flows[key] = state
+			}
+
+			state.data = connData
+			state.data.Packets = nil
+
+			bytes, packets := connData.Size-state.seenBytes, connData.Count-state.seenPackets
+			state.seenBytes, state.seenPackets = connData.Size, connData.Count
+
+			if packets <= 0 {
+				continue
+			}
+
+			if state.packets == 0 {
+				if state.end == 0 {
+					state.start = int64(connData.From)
+				} else {
+					state.start = firstPacketAfter(&connData, state.end)
+				}
+			}
+
+			state.bytes += bytes
+			state.packets += packets
+			state.end = int64(connData.To)
+		}
+	}
+}
+
+// Export a flow's pending traffic as a record
+func (exporter *FlowExporter) record(state *flowState, reason uint8, sockets map[string]*PidSocket) FlowRecord {
+	rec := FlowRecord{
+		Device:    state.device,
+		SrcAddr:   state.data.LocalAddr,
+		SrcPort:   state.data.LocalPort,
+		DstAddr:   state.data.RemAddr,
+		DstPort:   state.data.RemPort,
+		Protocol:  state.data.Protocol,
+		Bytes:     uint64(state.bytes),
+		Packets:   uint64(state.packets),
+		Start:     state.start,
+		End:       state.end,
+		EndReason: reason,
+	}
+
+	// packets received by a socket are attributed to it too
+	reverseId := state.data.RemAddr.String() + fmt.Sprint(state.data.RemPort) + state.data.LocalAddr.String() + fmt.Sprint(state.data.LocalPort)
+
+	if pidConn, ok := sockets[state.flowId]; ok {
+		rec.Process = pidConn
+	} else if pidConn, ok := sockets[reverseId]; ok {
+		rec.Process = pidConn
+	}
+
+	state.bytes, state.packets = 0, 0
+	return rec
+}
+
+// Collect flows that have timed out, or every flow with traffic pending when finishing
+func (exporter *FlowExporter) collect(store MachineNetworkStorage, pidConns []PidSocket, now time.Time, finish bool) []FlowRecord {
+	exporter.Update(store)
+
+	sockets := map[string]*PidSocket{}
+	for idx := range pidConns {
+		sockets[pidConns[idx].GetId()] = &pidConns[idx]
+	}
+
+	records := []FlowRecord{}
+	nanos := now.UnixNano()
+
+	for key, state := range exporter.flows {
+		idle := nanos-state.end >= int64(exporter.Options.Idle)
+
+		if state.packets == 0 {
+			// forget idle flows once they are no longer stored
+			if _, stored := store[state.device][state.flowId]; idle && !stored {
+				delete(exporter.flows, key)
+			}
+			continue
+		}
+
+		switch {
+		case finish:
+			records = append(records, exporter.record(state, FLOW_END_FORCED, sockets))
+		case idle:
+			records = append(records, exporter.record(state, FLOW_END_IDLE, sockets))
+		case nanos-state.start >= int64(exporter.Options.Active):
+			records = append(records, exporter.record(state, FLOW_END_ACTIVE, sockets))
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Start < records[j].Start
+	})
+
+	return records
+}
+
+// Collect flows that have been idle or active long enough to export
+func (exporter *FlowExporter) Collect(store MachineNetworkStorage, pidConns []PidSocket, now time.Time) []FlowRecord {
+	return exporter.collect(store, pidConns, now, false)
+}
+
+// Collect every flow with traffic pending, as the capture is ending
+func (exporter *FlowExporter) Finish(store MachineNetworkStorage, pidConns []PidSocket, now time.Time) []FlowRecord {
+	return exporter.collect(store, pidConns, now, true)
+}
+
+// Count from zero once the store is emptied; traffic already counted stays pending
+func (exporter *FlowExporter) Reset() {
+	for _, state := range exporter.flows {
+		state.seenBytes, state.seenPackets = 0, 0
+	}
+}
+
+// Send records to the collector
+func (exporter *FlowExporter) Send(records []FlowRecord, now time.Time) error {
+	for _, message := range exporter.encoder.Encode(records, now) {
+		if _, err := exporter.conn.Write(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (exporter *FlowExporter) Close() error {
+	return exporter.conn.Close()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// A template field, as a collector reads it
+type collectedField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+// A data record's fields, by id ("enterprise/id" for enterprise fields)
+type collectedRecord map[string][]byte
+
+func (rec collectedRecord) uint(key string) uint64 {
+	var value uint64
+	for _, octet := range rec[key] {
+		value = value<<8 | uint64(octet)
+	}
+	return value
+}
+
+func (rec collectedRecord) string(key string) string {
+	return string(bytes.TrimRight(rec[key], "\x00"))
+}
+
+// A minimal IPFIX (RFC 7011) & NetFlow v9 (RFC 3954) collector, which remembers templates across
+// messages as a real collector does
+type flowCollector struct {
+	t         *testing.T
+	version   int
+	templates map[uint16][]collectedField
+}
+
+func (collector *flowCollector) decode(msg []byte) []collectedRecord {
+	t := collector.t
+	t.Helper()
+
+	records := []collectedRecord{}
+	if version := int(binary.BigEndian.Uint16(msg)); version != collector.version {
+		t.Fatalf("message has version %d, expected %d", version, collector.version)
+	}
+
+	offset, templateSet := NETFLOW9_HEADER_SIZE, uint16(NETFLOW9_TEMPLATE_SET)
+	if collector.version == IPFIX_VERSION {
+		offset, templateSet = IPFIX_HEADER_SIZE, IPFIX_TEMPLATE_SET
+
+		if length := int(binary.BigEndian.Uint16(msg[2:])); length != len(msg) {
+			t.Fatalf("IPFIX header has length %d, but the message has %d bytes", length, len(msg))
+		}
+	}
+
+	count := 0
+	for offset < len(msg) {
+		setId := binary.BigEndian.Uint16(msg[offset:])
+		setEnd := offset + int(binary.BigEndian.Uint16(msg[offset+2:]))
+		if setEnd > len(msg) || setEnd <= offset {
+			t.Fatalf("set %d at %d overruns the message", setId, offset)
+		}
+		if collector.version == NETFLOW9_VERSION && (setEnd-offset)%4 != 0 {
+			t.Fatalf("flowset %d is not padded to 32 bits", setId)
+		}
+
+		pos := offset + 4
+		if setId == templateSet {
+			for pos+4 <= setEnd {
+				templateId, fieldCount := binary.BigEndian.Uint16(msg[pos:]), int(binary.BigEndian.Uint16(msg[pos+2:]))
+				pos += 4
+
+				fields := []collectedField{}
+				for idx := 0; idx < fieldCount; idx++ {
+					field := collectedField{binary.BigEndian.Uint16(msg[pos:]), binary.BigEndian.Uint16(msg[pos+2:]), 0}
+					pos += 4
+
+					if collector.version == IPFIX_VERSION && field.id&0x8000 != 0 {
+						field.id &= 0x7fff
+						field.enterprise = binary.BigEndian.Uint32(msg[pos:])
+						pos += 4
+					}
+					fields = append(fields, field)
+				}
+
+				collector.templates[templateId] = fields
+				count++
+			}
+		} else {
+			fields, ok := collector.templates[setId]
+			if !ok {
+				t.Fatalf("data set %d arrived before its template", setId)
+			}
+
+			// the smallest record, with every variable-length field empty
+			minimum := 0
+			for _, field := range fields {
+				if field.length == FLOW_VARIABLE_LENGTH {
+					minimum++
+				} else {
+					minimum += int(field.length)
+				}
+			}
+
+			for setEnd-pos >= minimum {
+				rec := collectedRecord{}
+				for _, field := range fields {
+					length := int(field.length)
+					if field.length == FLOW_VARIABLE_LENGTH {
+						length = int(msg[pos])
+						pos++
+						if length == 255 {
+							length = int(binary.BigEndian.Uint16(msg[pos:]))
+							pos += 2
+						}
+					}
+
+					key := fmt.Sprint(field.id)
+					if field.enterprise != 0 {
+						key = fmt.Sprintf("%d/%d", field.enterprise, field.id)
+					}
+					rec[key] = msg[pos : pos+length]
+					pos += length
+				}
+
+				records = append(records, rec)
+				count++
+			}
+		}
+
+		offset = setEnd
+	}
+
+	// a NetFlow v9 header counts every template & data record
+	if collector.version == NETFLOW9_VERSION {
+		if header := int(binary.BigEndian.Uint16(msg[2:])); header != count {
+			t.Fatalf("NetFlow v9 header counts %d records, but the message has %d", header, count)
+		}
+	}
+
+	return records
+}
+
+// Export a TCP connection over IPv4 and a UDP socket over IPv6 to a local collector
+func exportTestFlows(t *testing.T, version int, extra int) []collectedRecord {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	start := time.Now()
+	exporter, err := NewFlowExporter(&FlowExportOptions{version, listener.LocalAddr().String(), time.Minute, time.Minute}, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+
+	local4, rem4 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	local6, rem6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	pidConns := []PidSocket{
+		{"alice", "curl", "curl https://example.com", 42, 100, nil, "/user.slice", &TCPConnection{1, local4, 40000, rem4, 443, 1, 0, 0, 1000, 1234}, start},
+		{"bob", "dig", "dig example.com", 43, 101, nil, "/user.slice", &UDPConnection{2, local6, 50000, rem6, 53, 7, 0, 0, 1001, 1235}, start},
+	}
+
+	store := MachineNetworkStorage{}
+	nanos := start.UnixNano()
+
+	for idx := 0; idx < 3; idx++ {
+		AssociatePacket(store, &pidConns, PacketData{"eth0", nanos + int64(idx), local4, 40000, rem4, 443, 100, IPPROTO_TCP, nil})
+	}
+	for idx := 0; idx < 2; idx++ {
+		AssociatePacket(store, &pidConns, PacketData{"eth0", nanos + int64(idx), rem4, 443, local4, 40000, 50, IPPROTO_TCP, nil})
+	}
+	AssociatePacket(store, &pidConns, PacketData{"wlan0", nanos, local6, 50000, rem6, 53, 60, IPPROTO_UDP, nil})
+
+	// unattributed flows, to fill several datagrams
+	for idx := 0; idx < extra; idx++ {
+		AssociatePacket(store, &pidConns, PacketData{"eth0", nanos, local4, uint64(10000 + idx), rem4, 80, 10, IPPROTO_TCP, nil})
+	}
+
+	records := exporter.Finish(store, pidConns, start.Add(time.Second))
+	if err := exporter.Send(records, start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := &flowCollector{t, version, map[uint16][]collectedField{}}
+	collected := []collectedRecord{}
+	buf := make([]byte, 64*1024)
+
+	for len(collected) < len(records) {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		count, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d of %d records: %v", len(collected), len(records), err)
+		}
+		if count > FLOW_MAX_DATAGRAM {
+			t.Errorf("received a %d byte datagram; the limit is %d", count, FLOW_MAX_DATAGRAM)
+		}
+
+		// records slice the message, so it must outlive the next read
+		collected = append(collected, collector.decode(append([]byte{}, buf[:count]...))...)
+	}
+
+	return collected
+}
+
+// Find the record sent from a port
+func findFlow(t *testing.T, records []collectedRecord, srcPort uint64) collectedRecord {
+	t.Helper()
+
+	for _, rec := range records {
+		if rec.uint("7") == srcPort {
+			return rec
+		}
+	}
+
+	t.Fatalf("no flow from port %d", srcPort)
+	return nil
+}
+
+func TestFlowExportIPFIX(t *testing.T) {
+	records := exportTestFlows(t, IPFIX_VERSION, 0)
+	if len(records) != 3 {
+		t.Fatalf("collected %d records, expected 3", len(records))
+	}
+
+	sent := findFlow(t, records, 40000)
+	if !net.IP(sent["8"]).Equal(net.ParseIP("10.0.0.1")) || !net.IP(sent["12"]).Equal(net.ParseIP("10.0.0.2")) || sent.uint("11") != 443 {
+		t.Errorf("unexpected addresses in %v", sent)
+	}
+	if sent.uint("1") != 300 || sent.uint("2") != 3 || sent.uint("4") != 6 || sent.uint("136") != FLOW_END_FORCED {
+		t.Errorf("unexpected counters in %v", sent)
+	}
+	if sent.string("82") != "eth0" || sent.string("32473/1") != "curl" || sent.uint("32473/2") != 42 || sent.string("32473/3") != "alice" || sent.string("32473/4") != "/user.slice" {
+		t.Errorf("unexpected process fields in %v", sent)
+	}
+
+	// received traffic is its own flow, attributed to the same socket
+	received := findFlow(t, records, 443)
+	if received.uint("1") != 100 || received.uint("2") != 2 || received.uint("32473/2") != 42 {
+		t.Errorf("unexpected received flow %v", received)
+	}
+
+	udp := findFlow(t, records, 50000)
+	if !net.IP(udp["27"]).Equal(net.ParseIP("2001:db8::1")) || !net.IP(udp["28"]).Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("unexpected IPv6 addresses in %v", udp)
+	}
+	if udp.uint("4") != 17 || udp.uint("1") != 60 || udp.string("82") != "wlan0" || udp.string("32473/1") != "dig" {
+		t.Errorf("unexpected IPv6 flow %v", udp)
+	}
+}
+
+func TestFlowExportNetFlow9(t *testing.T) {
+	records := exportTestFlows(t, NETFLOW9_VERSION, 0)
+	if len(records) != 3 {
+		t.Fatalf("collected %d records, expected 3", len(records))
+	}
+
+	sent := findFlow(t, records, 40000)
+	if !net.IP(sent["8"]).Equal(net.ParseIP("10.0.0.1")) || sent.uint("11") != 443 || sent.uint("1") != 300 || sent.uint("2") != 3 || sent.uint("4") != 6 {
+		t.Errorf("unexpected flow %v", sent)
+	}
+	if sent.string("82") != "eth0" || sent.string("25001") != "curl" || sent.uint("25002") != 42 || sent.string("25003") != "alice" {
+		t.Errorf("unexpected process fields in %v", sent)
+	}
+	if sent.uint("21") < sent.uint("22") {
+		t.Errorf("flow ends (%d) before it starts (%d)", sent.uint("21"), sent.uint("22"))
+	}
+
+	udp := findFlow(t, records, 50000)
+	if !net.IP(udp["27"]).Equal(net.ParseIP("2001:db8::1")) || udp.uint("4") != 17 || udp.string("25001") != "dig" {
+		t.Errorf("unexpected IPv6 flow %v", udp)
+	}
+}
+
+func TestFlowExportSplitsDatagrams(t *testing.T) {
+	for _, version := range []int{IPFIX_VERSION, NETFLOW9_VERSION} {
+		records := exportTestFlows(t, version, 200)
+		if len(records) != 203 {
+			t.Errorf("version %d: collected %d records, expected 203", version, len(records))
+		}
+
+		// flows without a socket still carry their packets' protocol
+		if unattributed := findFlow(t, records, 10000); unattributed.uint("4") != 6 {
+			t.Errorf("version %d: unattributed flow has protocol %d, expected 6", version, unattributed.uint("4"))
+		}
+	}
+}
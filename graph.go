@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// What a graph's local nodes are: processes, every process running a command, containers
+// (processes outside one are grouped by command), or hosts
+const (
+	GRAPH_GROUP_PROCESS   = "process"
+	GRAPH_GROUP_COMMAND   = "command"
+	GRAPH_GROUP_CONTAINER = "container"
+	GRAPH_GROUP_HOST      = "host"
+)
+
+var GRAPH_GROUPS = []string{GRAPH_GROUP_PROCESS, GRAPH_GROUP_COMMAND, GRAPH_GROUP_CONTAINER, GRAPH_GROUP_HOST}
+
+var GRAPH_FORMATS = []string{"dot", "mermaid", "json"}
+
+const (
+	GRAPH_REMOTE     = "remote"
+	GRAPH_LOCAL_HOST = "local" // names the host of a single-host capture
+	GRAPH_MAX_WIDTH  = 8       // the DOT pen-width of the heaviest edge
+)
+
+// A process, command, container or host, or a remote address no capture covered
+type GraphNode struct {
+	Id    string `json:"id"`
+	Kind  string `json:"kind"` // the grouping level, or remote
+	Label string `json:"label"`
+	Host  string `json:"host,omitempty"`
+}
+
+// Connections from one node to another; edges run from the end that made the connections
+type GraphEdge struct {
+	Source      string   `json:"source"`
+	Target      string   `json:"target"`
+	Bytes       int      `json:"bytes"`     // in both directions, the edge's weight
+	BytesOut    int      `json:"bytes_out"` // source to target
+	BytesIn     int      `json:"bytes_in"`
+	Connections int      `json:"connections"`
+	Ports       []string `json:"ports"` // the target's, e.g. TCP/443
+}
+
+// A weighted, directed graph of traffic, in node-link form
+type TrafficGraph struct {
+	Directed bool        `json:"directed"`
+	Group    string      `json:"group"`
+	Nodes    []GraphNode `json:"nodes"`
+	Links    []GraphEdge `json:"links"`
+
+	nodes map[string]bool
+	edges map[string]*GraphEdge
+	ports map[string]map[string]bool
+}
+
+func newTrafficGraph(group string) *TrafficGraph {
+	return &TrafficGraph{true, group, []GraphNode{}, []GraphEdge{}, map[string]bool{}, map[string]*GraphEdge{}, map[string]map[string]bool{}}
+}
+
+// Add a node if it is new, returning its id
+func (graph *TrafficGraph) node(node GraphNode) string {
+	if !graph.nodes[node.Id] {
+		graph.nodes[node.Id] = true
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	return node.Id
+}
+
+// Add a connection's traffic to the edge between two nodes
+func (graph *TrafficGraph) link(source string, target string, port string, bytesOut int, bytesIn int) {
+	key := source + "\x00" + target
+
+	edge, ok := graph.edges[key]
+	if !ok {
+		edge = &GraphEdge{Source: source, Target: target, Ports: []string{}}
+		graph.edges[key] = edge
+		graph.ports[key] = map[string]bool{}
+	}
+
+	if !graph.ports[key][port] {
+		graph.ports[key][port] = true
+		edge.Ports = append(edge.Ports, port)
+	}
+
+	edge.Connections++
+	edge.BytesOut += bytesOut
+	edge.BytesIn += bytesIn
+	edge.Bytes += bytesOut + bytesIn
+}
+
+// Nodes by id, and edges heaviest first
+func (graph *TrafficGraph) finish() TrafficGraph {
+	for _, edge := range graph.edges {
+		sort.Strings(edge.Ports)
+		graph.Links = append(graph.Links, *edge)
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].Id < graph.Nodes[j].Id
+	})
+	sort.Slice(graph.Links, func(i, j int) bool {
+		left, right := graph.Links[i], graph.Links[j]
+		if left.Bytes != right.Bytes {
+			return left.Bytes > right.Bytes
+		}
+		return left.Source+"\x00"+left.Target < right.Source+"\x00"+right.Target
+	})
+
+	return *graph
+}
+
+// The node a process is grouped into
+func graphProcessNode(group string, process APIProcess) GraphNode {
+	host := process.Host
+
+	switch group {
+	case GRAPH_GROUP_HOST:
+		if len(host) == 0 {
+			return GraphNode{"host:" + GRAPH_LOCAL_HOST, group, GRAPH_LOCAL_HOST, host}
+		}
+		return GraphNode{"host:" + host, group, host, host}
+	case GRAPH_GROUP_CONTAINER:
+		if id := containerId(process.Cgroup); len(id) > 0 {
+			return GraphNode{"container:" + serviceId(host, id), group, serviceId(host, id[:12]), host}
+		}
+		fallthrough
+	case GRAPH_GROUP_COMMAND:
+		return GraphNode{"command:" + serviceId(host, process.Command), GRAPH_GROUP_COMMAND, serviceId(host, process.Command), host}
+	default:
+		id := ProcessId{process.Pid, process.StartTime}
+		return GraphNode{"process:" + serviceId(host, id.String()), GRAPH_GROUP_PROCESS, fmt.Sprintf("%s (%d)", serviceId(host, process.Command), process.Pid), host}
+	}
+}
+
+func graphPort(protocol string, port uint64) string {
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+// Build a graph of which processes (or commands, containers or hosts) talk to which. Connections
+// captured at both ends link their two processes; others link a process to its remote address
+func BuildTrafficGraph(snapshot apiSnapshot, group string, nat *AddressMap) TrafficGraph {
+	graph := newTrafficGraph(group)
+
+	processes := map[string]APIProcess{}
+	for _, process := range snapshot.processes {
+		processes[apiProcessKey(process.Host, ProcessId{process.Pid, process.StartTime})] = process
+	}
+
+	processNode := func(host string, pid int, startTime uint64, command string) string {
+		process, ok := processes[apiProcessKey(host, ProcessId{pid, startTime})]
+		if !ok {
+			process = APIProcess{Host: host, Pid: pid, StartTime: startTime, Command: command}
+		}
+		return graph.node(graphProcessNode(group, process))
+	}
+
+	conns := snapshot.connections
+	stitched, matched := stitchConnections(conns, nat)
+	listening := findListeningPorts(conns)
+
+	for _, link := range stitched {
+		client := processNode(link.Client.Host, link.Client.Pid, link.Client.StartTime, link.Client.Command)
+		server := processNode(link.Server.Host, link.Server.Pid, link.Server.StartTime, link.Server.Command)
+		graph.link(client, server, graphPort(link.Protocol, link.Server.Port), link.BytesOut, link.BytesIn)
+	}
+
+	for idx := range conns {
+		conn := &conns[idx]
+		if conn.RemPort == 0 || matched[idx] {
+			continue
+		}
+
+		local := processNode(conn.Host, conn.Pid, conn.StartTime, conn.Command)
+		remote := graph.node(GraphNode{GRAPH_REMOTE + ":" + conn.RemAddr, GRAPH_REMOTE, conn.RemAddr, ""})
+
+		if listening.accepted(conn) {
+			graph.link(remote, local, graphPort(conn.Protocol, conn.LocalPort), conn.BytesIn, conn.BytesOut)
+		} else {
+			graph.link(local, remote, graphPort(conn.Protocol, conn.RemPort), conn.BytesOut, conn.BytesIn)
+		}
+	}
+
+	return graph.finish()
+}
+
+// An edge's ports, traffic & connection-count
+func (edge *GraphEdge) label() []string {
+	conns := "conns"
+	if edge.Connections == 1 {
+		conns = "conn"
+	}
+
+	return []string{
+		strings.Join(edge.Ports, ", "),
+		fmt.Sprintf("%s, %d %s", FormatBytes(edge.Bytes), edge.Connections, conns),
+	}
+}
+
+func dotEscape(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(str)
+}
+
+func dotQuote(str string) string {
+	return `"` + dotEscape(str) + `"`
+}
+
+// Render as Graphviz DOT; heavier edges are drawn wider
+func (graph *TrafficGraph) DOT() string {
+	var builder strings.Builder
+
+	builder.WriteString("digraph puffin {\n\trankdir=LR;\n\tnode [shape=box];\n")
+
+	for _, node := range graph.Nodes {
+		if node.Kind == GRAPH_REMOTE {
+			fmt.Fprintf(&builder, "\t%s [label=%s, shape=ellipse];\n", dotQuote(node.Id), dotQuote(node.Label))
+		} else {
+			fmt.Fprintf(&builder, "\t%s [label=%s];\n", dotQuote(node.Id), dotQuote(node.Label))
+		}
+	}
+
+	heaviest := 1
+	for _, edge := range graph.Links {
+		if edge.Bytes > heaviest {
+			heaviest = edge.Bytes
+		}
+	}
+
+	for _, edge := range graph.Links {
+		lines := edge.label()
+		for idx := range lines {
+			lines[idx] = dotEscape(lines[idx])
+		}
+
+		width := 1 + float64(GRAPH_MAX_WIDTH-1)*float64(edge.Bytes)/float64(heaviest)
+		fmt.Fprintf(&builder, "\t%s -> %s [label=\"%s\", penwidth=%.1f];\n", dotQuote(edge.Source), dotQuote(edge.Target), strings.Join(lines, `\n`), width)
+	}
+
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// Mermaid labels are quoted, with entities for characters it would otherwise interpret
+func mermaidEscape(str string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(str)
+}
+
+// Render as a Mermaid flowchart. Mermaid ids can't hold addresses, so nodes are numbered
+func (graph *TrafficGraph) Mermaid() string {
+	var builder strings.Builder
+	ids := map[string]string{}
+
+	builder.WriteString("flowchart LR\n")
+
+	for idx, node := range graph.Nodes {
+		ids[node.Id] = fmt.Sprintf("n%d", idx)
+
+		if node.Kind == GRAPH_REMOTE {
+			fmt.Fprintf(&builder, "\t%s([\"%s\"])\n", ids[node.Id], mermaidEscape(node.Label))
+		} else {
+			fmt.Fprintf(&builder, "\t%s[\"%s\"]\n", ids[node.Id], mermaidEscape(node.Label))
+		}
+	}
+
+	for _, edge := range graph.Links {
+		lines := edge.label()
+		for idx := range lines {
+			lines[idx] = mermaidEscape(lines[idx])
+		}
+
+		fmt.Fprintf(&builder, "\t%s -->|\"%s\"| %s\n", ids[edge.Source], strings.Join(lines, "<br/>"), ids[edge.Target])
+	}
+
+	return builder.String()
+}
+
+// Write a graph as DOT, Mermaid or JSON
+func WriteTrafficGraph(writer io.Writer, graph TrafficGraph, format string) error {
+	switch format {
+	case "dot":
+		_, err := io.WriteString(writer, graph.DOT())
+		return err
+	case "mermaid":
+		_, err := io.WriteString(writer, graph.Mermaid())
+		return err
+	case "json":
+		bytes, err := json.MarshalIndent(graph, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(writer, string(bytes))
+		return err
+	default:
+		return fmt.Errorf("unknown graph format %q; expected %s", format, strings.Join(GRAPH_FORMATS, ", "))
+	}
+}
+
+func isOneOf(value string, known []string) bool {
+	for _, candidate := range known {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a grouping level & output format are known
+func ValidateGraphOptions(group string, format string) error {
+	if !isOneOf(group, GRAPH_GROUPS) {
+		return fmt.Errorf("unknown graph grouping %q; expected %s", group, strings.Join(GRAPH_GROUPS, ", "))
+	}
+	if !isOneOf(format, GRAPH_FORMATS) {
+		return fmt.Errorf("unknown graph format %q; expected %s", format, strings.Join(GRAPH_FORMATS, ", "))
+	}
+
+	return nil
+}
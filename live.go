@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// State for the interactive view, changed by commands typed on stdin
+type LiveViewState struct {
+	lock      sync.Mutex
+	tree      bool
+	maxDepth  int
+	collapsed map[int]bool
+}
+
+// Apply a command typed into the live view; a pid toggles whether that process is collapsed
+func (state *LiveViewState) Command(line string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	switch line = strings.TrimSpace(line); line {
+	case "t":
+		state.tree = !state.tree
+	case "+":
+		state.maxDepth++
+	case "-":
+		if state.maxDepth > 0 {
+			state.maxDepth--
+		}
+	default:
+		if pid, err := strconv.Atoi(line); err == nil {
+			state.collapsed[pid] = !state.collapsed[pid]
+		}
+	}
+}
+
+// Read live-view commands from stdin, one per line
+func LiveViewInput(state *LiveViewState) {
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for scanner.Scan() {
+		state.Command(scanner.Text())
+	}
+}
+
+// List the live view's commands; the caller holds the state lock
+func printLiveViewHelp(state *LiveViewState) {
+	if state.tree {
+		fmt.Printf("[t] flat view  [+/-] depth %d  [<pid>] expand/collapse  (then press enter)\n", state.maxDepth)
+	} else {
+		fmt.Println("[t] tree view  (then press enter)")
+	}
+}
+
+// Copy the traffic totals in a store, without their packets
+func copyTrafficTotals(store MachineNetworkStorage) MachineNetworkStorage {
+	totals := MachineNetworkStorage{}
+
+	for device, deviceConns := range store {
+		totals[device] = make(map[string]StoredConnectionData, len(deviceConns))
+		for connId, connData := range deviceConns {
+			connData.Packets = nil
+			totals[device][connId] = connData
+		}
+	}
+
+	return totals
+}
+
+// Redraw per-process traffic to the terminal every second. In tree mode, traffic from
+// child processes is rolled up into their ancestors
+func LiveView(storeLock *sync.Mutex, conns *ConnectionTable, store MachineNetworkStorage, pfs *procfs.FS, tree bool, maxDepth int) {
+	state := &LiveViewState{tree: tree, maxDepth: maxDepth, collapsed: map[int]bool{}}
+	go LiveViewInput(state)
+
+	for {
+		// building the tree reads /proc for each ancestor, so work from a copy of the store
+		storeLock.Lock()
+		pidConns := conns.PidSockets()
+		traffic := copyTrafficTotals(store)
+		storeLock.Unlock()
+
+		state.lock.Lock()
+		procTree := BuildProcessTree(&pidConns, traffic, pfs, state.tree)
+
+		fmt.Print(CLEAR_STRING)
+		RenderProcessTree(os.Stdout, procTree, state.maxDepth, state.collapsed)
+		fmt.Println()
+
+		printLiveViewHelp(state)
+		state.lock.Unlock()
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	LIVE_INTERVAL      = time.Second
+	LIVE_BUFFER_SIZE   = 64               // messages queued per subscriber before new ones are dropped
+	LIVE_WRITE_TIMEOUT = 10 * time.Second // a subscriber that cannot take a message this quickly is disconnected
+	LIVE_KEEPALIVE     = 15 * time.Second // SSE comments & WebSocket pings keep idle streams open through proxies
+	LIVE_MAX_FILTER    = 4096             // bytes; the largest filter message a WebSocket client may send
+)
+
+// A device's traffic over the last interval
+type LiveDevice struct {
+	Name       string `json:"name"`
+	BytesOut   int64  `json:"bytes_out"`
+	BytesIn    int64  `json:"bytes_in"`
+	PacketsOut int64  `json:"packets_out"`
+	PacketsIn  int64  `json:"packets_in"`
+}
+
+// A process's traffic over the last interval
+type LiveProcess struct {
+	Pid        int    `json:"pid"`
+	StartTime  uint64 `json:"start_time"`
+	Command    string `json:"command"`
+	UserName   string `json:"username"`
+	BytesOut   int64  `json:"bytes_out"`
+	BytesIn    int64  `json:"bytes_in"`
+	PacketsOut int64  `json:"packets_out"`
+	PacketsIn  int64  `json:"packets_in"`
+}
+
+// Traffic over the last interval, for each device and process that saw any
+type LiveUpdate struct {
+	Type      string        `json:"type"`
+	Time      time.Time     `json:"time"`
+	Interval  string        `json:"interval"`
+	Devices   []LiveDevice  `json:"devices"`
+	Processes []LiveProcess `json:"processes"`
+}
+
+// A connection opening or closing
+type LiveConnectionEvent struct {
+	Type      string    `json:"type"`
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Pid       int       `json:"pid"`
+	StartTime uint64    `json:"start_time"`
+	Command   string    `json:"command"`
+	UserName  string    `json:"username"`
+	Protocol  string    `json:"protocol"`
+	LocalAddr string    `json:"local_addr"`
+	LocalPort uint64    `json:"local_port"`
+	RemAddr   string    `json:"rem_addr"`
+	RemPort   uint64    `json:"rem_port"`
+}
+
+// Sent in place of messages a slow subscriber missed
+type LiveDropped struct {
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+}
+
+// What a subscriber wants to receive. Empty fields match everything
+type LiveFilter struct {
+	Process string `json:"process"` // a regular expression against the process command
+	Pid     int    `json:"pid"`
+	Device  string `json:"device"` // limits the devices in updates
+
+	process *regexp.Regexp
+}
+
+func (filter *LiveFilter) compile() error {
+	if len(filter.Process) == 0 {
+		filter.process = nil
+		return nil
+	}
+
+	pattern, err := regexp.Compile(filter.Process)
+	if err != nil {
+		return fmt.Errorf("process: %v", err)
+	}
+	filter.process = pattern
+
+	return nil
+}
+
+func (filter *LiveFilter) matchesProcess(pid int, command string) bool {
+	return (filter.Pid == 0 || filter.Pid == pid) && (filter.process == nil || filter.process.MatchString(command))
+}
+
+// Read a filter from query parameters: ?process=<regex>&pid=<pid>&device=<name>
+func ParseLiveFilter(req *http.Request) (*LiveFilter, error) {
+	query := req.URL.Query()
+	filter := &LiveFilter{Process: query.Get("process"), Device: query.Get("device")}
+
+	if str := query.Get("pid"); len(str) > 0 {
+		pid, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("pid must be a number")
+		}
+		filter.Pid = pid
+	}
+
+	return filter, filter.compile()
+}
+
+// An encoded message, and its type
+type liveMessage struct {
+	kind string
+	body []byte
+}
+
+// A client of the stream, with a bounded queue of messages. The capture loop never waits on it;
+// messages that don't fit are dropped and counted instead
+type liveSubscriber struct {
+	messages chan liveMessage
+	dropped  int64
+	lock     sync.Mutex
+	filter   *LiveFilter
+}
+
+func (sub *liveSubscriber) Filter() *LiveFilter {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	return sub.filter
+}
+
+func (sub *liveSubscriber) SetFilter(filter *LiveFilter) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.filter = filter
+}
+
+func (sub *liveSubscriber) offer(kind string, message interface{}) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("could not encode live message: %v", err)
+		return
+	}
+
+	select {
+	case sub.messages <- liveMessage{kind, body}:
+	default:
+		atomic.AddInt64(&sub.dropped, 1)
+	}
+}
+
+// The next message to send, preceded by a count of any that were dropped
+func (sub *liveSubscriber) next(message liveMessage) []liveMessage {
+	dropped := atomic.SwapInt64(&sub.dropped, 0)
+	if dropped == 0 {
+		return []liveMessage{message}
+	}
+
+	notice, _ := json.Marshal(LiveDropped{"dropped", dropped})
+	return []liveMessage{{"dropped", notice}, message}
+}
+
+// Fans per-second updates & connection events out to stream subscribers
+type LiveHub struct {
+	lock        sync.Mutex
+	subscribers map[*liveSubscriber]bool
+	counters    *TrafficCounters
+	devices     map[string]TrafficCounter    // counters as of the last update
+	processes   map[ProcessId]TrafficCounter // counters as of the last update
+}
+
+func NewLiveHub() *LiveHub {
+	return &LiveHub{
+		subscribers: map[*liveSubscriber]bool{},
+		counters:    NewTrafficCounters(),
+		devices:     map[string]TrafficCounter{},
+		processes:   map[ProcessId]TrafficCounter{},
+	}
+}
+
+func (hub *LiveHub) subscribe(filter *LiveFilter) *liveSubscriber {
+	sub := &liveSubscriber{messages: make(chan liveMessage, LIVE_BUFFER_SIZE), filter: filter}
+
+	hub.lock.Lock()
+	hub.subscribers[sub] = true
+	hub.lock.Unlock()
+
+	return sub
+}
+
+func (hub *LiveHub) unsubscribe(sub *liveSubscriber) {
+	hub.lock.Lock()
+	delete(hub.subscribers, sub)
+	hub.lock.Unlock()
+}
+
+func (hub *LiveHub) each(fn func(sub *liveSubscriber)) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	for sub := range hub.subscribers {
+		fn(sub)
+	}
+}
+
+func counterDelta(now TrafficCounter, last TrafficCounter) TrafficCounter {
+	delta := TrafficCounter{}
+	for idx := range now.Bytes {
+		delta.Bytes[idx] = now.Bytes[idx] - last.Bytes[idx]
+		delta.Packets[idx] = now.Packets[idx] - last.Packets[idx]
+	}
+
+	return delta
+}
+
+// Publish traffic since the last update; the caller holds the store lock
+func (hub *LiveHub) Update(conns *ConnectionTable, store MachineNetworkStorage, now time.Time) {
+	hub.counters.Update(conns, store)
+	hub.counters.Prune(conns)
+
+	update := LiveUpdate{"update", now, LIVE_INTERVAL.String(), []LiveDevice{}, []LiveProcess{}}
+	devices := map[string]TrafficCounter{}
+	processes := map[ProcessId]TrafficCounter{}
+
+	for _, name := range hub.counters.Devices() {
+		devices[name] = hub.counters.Device(name)
+
+		delta := counterDelta(devices[name], hub.devices[name])
+		if delta.Packets[0]+delta.Packets[1] > 0 {
+			update.Devices = append(update.Devices, LiveDevice{name, delta.Bytes[0], delta.Bytes[1], delta.Packets[0], delta.Packets[1]})
+		}
+	}
+
+	processIds, processConns := trackedByProcess(conns)
+	for _, id := range processIds {
+		processes[id] = hub.counters.Process(id)
+
+		delta := counterDelta(processes[id], hub.processes[id])
+		if delta.Packets[0]+delta.Packets[1] > 0 {
+			pidConn := processConns[id][len(processConns[id])-1].ProcessSocket
+			update.Processes = append(update.Processes, LiveProcess{
+				id.Pid, id.StartTime, pidConn.Command, pidConn.UserName, delta.Bytes[0], delta.Bytes[1], delta.Packets[0], delta.Packets[1],
+			})
+		}
+	}
+
+	hub.devices, hub.processes = devices, processes
+
+	hub.each(func(sub *liveSubscriber) {
+		filter := sub.Filter()
+		filtered := LiveUpdate{update.Type, update.Time, update.Interval, []LiveDevice{}, []LiveProcess{}}
+
+		for _, device := range update.Devices {
+			if len(filter.Device) == 0 || filter.Device == device.Name {
+				filtered.Devices = append(filtered.Devices, device)
+			}
+		}
+		for _, process := range update.Processes {
+			if filter.matchesProcess(process.Pid, process.Command) {
+				filtered.Processes = append(filtered.Processes, process)
+			}
+		}
+
+		sub.offer("update", filtered)
+	})
+}
+
+// Count traffic before the store is emptied, so the next update includes it
+func (hub *LiveHub) Count(conns *ConnectionTable, store MachineNetworkStorage) {
+	hub.counters.Update(conns, store)
+}
+
+// Count from zero once the store is emptied
+func (hub *LiveHub) Reset() {
+	hub.counters.Reset()
+}
+
+// Publish connections opening & closing
+func (hub *LiveHub) PublishEvents(events []ConnectionEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	messages := []LiveConnectionEvent{}
+	for _, event := range events {
+		pidConn := event.ProcessSocket
+		conn := pidConn.Connection
+
+		messages = append(messages, LiveConnectionEvent{
+			"connection", event.Type, event.Time, pidConn.Pid, pidConn.StartTime, pidConn.Command, pidConn.UserName,
+			conn.GetType(), conn.GetLocalAddr().String(), conn.GetLocalPort(), conn.GetRemAddr().String(), conn.GetRemPort(),
+		})
+	}
+
+	hub.each(func(sub *liveSubscriber) {
+		filter := sub.Filter()
+		for _, message := range messages {
+			if filter.matchesProcess(message.Pid, message.Command) {
+				sub.offer("connection", message)
+			}
+		}
+	})
+}
+
+// Stream messages as Server-Sent Events, named by message type
+func (hub *LiveHub) ServeSSE(res http.ResponseWriter, req *http.Request) {
+	if !allowGet(res, req) {
+		return
+	}
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		writeAPIError(res, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	filter, err := ParseLiveFilter(req)
+	if err != nil {
+		writeAPIError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sub := hub.subscribe(filter)
+	defer hub.unsubscribe(sub)
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(LIVE_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case queued := <-sub.messages:
+			for _, message := range sub.next(queued) {
+				if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", message.kind, message.body); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Browsers send an Origin header; only pages served from the API itself may connect, so another site
+// can't read live traffic through the user's browser
+var LIVE_UPGRADER = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// Stream messages over a WebSocket. Clients may send a JSON LiveFilter at any time to replace their filter
+func (hub *LiveHub) ServeWebSocket(res http.ResponseWriter, req *http.Request) {
+	filter, err := ParseLiveFilter(req)
+	if err != nil {
+		writeAPIError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, err := LIVE_UPGRADER.Upgrade(res, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sub := hub.subscribe(filter)
+	defer hub.unsubscribe(sub)
+
+	closed := make(chan bool)
+	go hub.readFilters(conn, sub, closed)
+
+	keepalive := time.NewTicker(LIVE_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(LIVE_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+
+		case queued := <-sub.messages:
+			for _, message := range sub.next(queued) {
+				conn.SetWriteDeadline(time.Now().Add(LIVE_WRITE_TIMEOUT))
+				if err := conn.WriteMessage(websocket.TextMessage, message.body); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Read filter changes from a WebSocket client until it disconnects. Invalid filters are reported
+// to the client, and the previous filter kept
+func (hub *LiveHub) readFilters(conn *websocket.Conn, sub *liveSubscriber, closed chan bool) {
+	defer close(closed)
+	conn.SetReadLimit(LIVE_MAX_FILTER)
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		filter := &LiveFilter{}
+		err = json.Unmarshal(body, filter)
+		if err == nil {
+			err = filter.compile()
+		}
+
+		if err != nil {
+			sub.offer("error", map[string]string{"type": "error", "error": err.Error()})
+			continue
+		}
+
+		sub.SetFilter(filter)
+	}
+}
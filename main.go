@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
 	"os/user"
 	"strconv"
 	"strings"
@@ -41,11 +43,13 @@ func LookupUsername(uid uint64) (string, error) {
 	return userData.Username, nil
 }
 
-// List pids by reading /proc/<id> folders
-func ListPids(pfs *procfs.FS) (map[uint64][]int, map[int]int, error) {
+// List pids by reading /proc/<id> folders. Processes are identified by pid and start-time,
+// so a pid reused by a later process is never confused with the original
+func ListPids(pfs *procfs.FS) (map[uint64][]ProcessId, map[ProcessId]ProcessId, error) {
 	info, _ := ioutil.ReadDir("/proc/")
-	pidsForInode := make(map[uint64][]int)
-	pidsToParent := make(map[int]int)
+	pidsForInode := make(map[uint64][]ProcessId)
+	idsByPid := make(map[int]ProcessId)
+	ppids := make(map[ProcessId]int)
 
 	// list every file in /proc
 	for _, file := range info {
@@ -56,11 +60,17 @@ func ListPids(pfs *procfs.FS) (map[uint64][]int, map[int]int, error) {
 			proc, _ := pfs.Proc(pid)
 			info, _ := proc.FileDescriptors()
 
-			// get the parent pid, so we can reconstruct a pid-tree (may not work correctly over-time if IDs are replaced)
-			stat, _ := proc.Stat()
+			// the process may have exited since we listed /proc; skip it if so
+			stat, err := proc.Stat()
+			if err != nil {
+				continue
+			}
+
+			id := ProcessId{pid, stat.Starttime}
+			idsByPid[pid] = id
 
 			if stat.PPID > 0 {
-				pidsToParent[pid] = stat.PPID
+				ppids[id] = stat.PPID
 			}
 
 			// for every file descriptor in this process...
@@ -72,16 +82,25 @@ func ListPids(pfs *procfs.FS) (map[uint64][]int, map[int]int, error) {
 				// register that this inode also uses this pid
 				if inode > 0 {
 					if pids, ok := pidsForInode[inode]; ok {
-						pidsForInode[inode] = append(pids, pid)
+						pidsForInode[inode] = append(pids, id)
 					} else {
-						pidsForInode[inode] = []int{pid}
+						pidsForInode[inode] = []ProcessId{id}
 					}
 				}
 			}
 		}
 	}
 
-	return pidsForInode, pidsToParent, nil
+	// get the parent process, so we can reconstruct a process-tree. Orphans are re-parented
+	// by the kernel, so a live child's ppid always refers to its current parent
+	idsToParent := make(map[ProcessId]ProcessId)
+	for id, ppid := range ppids {
+		if parent, ok := idsByPid[ppid]; ok {
+			idsToParent[id] = parent
+		}
+	}
+
+	return pidsForInode, idsToParent, nil
 }
 
 func PidToCommand(pfs *procfs.FS, pid int) string {
@@ -116,9 +135,32 @@ func PidToCommandline(pfs *procfs.FS, pid int) string {
 	return strings.Join(comm, " ")
 }
 
-// Given a pid, recursively find its parents
-func PidParents(pid int, parents map[int]int) []int {
-	pids := []int{}
+// Given a pid, find its control-group; the unified (v2) hierarchy is preferred
+func PidToCgroup(pfs *procfs.FS, pid int) string {
+	pidFs, err := pfs.Proc(pid)
+
+	if err != nil {
+		return "?"
+	}
+
+	cgroups, err := pidFs.Cgroups()
+
+	if err != nil || len(cgroups) == 0 {
+		return "?"
+	}
+
+	for _, cgroup := range cgroups {
+		if cgroup.HierarchyID == 0 {
+			return cgroup.Path
+		}
+	}
+
+	return cgroups[0].Path
+}
+
+// Given a process, recursively find its parents
+func PidParents(pid ProcessId, parents map[ProcessId]ProcessId) []ProcessId {
+	pids := []ProcessId{}
 
 	currPid := pid
 	for {
@@ -147,7 +189,7 @@ func AssociateProcesses(pfs *procfs.FS, conns []Connection) *[]PidSocket {
 		conn := conn.(Connection)
 
 		if pids, ok := pidsForInode[conn.GetInode()]; ok {
-			for _, pid := range pids {
+			for _, id := range pids {
 				dt := time.Now()
 
 				// associate uids to user-names, with a fallback value when this fails
@@ -164,10 +206,12 @@ func AssociateProcesses(pfs *procfs.FS, conns []Connection) *[]PidSocket {
 
 				sock := PidSocket{
 					uidToUsername[conn.GetUID()],
-					PidToCommand(pfs, pid),
-					PidToCommandline(pfs, pid),
-					pid,
-					PidParents(pid, pidParents),
+					PidToCommand(pfs, id.Pid),
+					PidToCommandline(pfs, id.Pid),
+					id.Pid,
+					id.StartTime,
+					PidParents(id, pidParents),
+					PidToCgroup(pfs, id.Pid),
 					conn,
 					dt,
 				}
@@ -180,9 +224,45 @@ func AssociateProcesses(pfs *procfs.FS, conns []Connection) *[]PidSocket {
 	return &pidSockets
 }
 
+// Options for a capture, parsed from the command-line
+type CaptureOptions struct {
+	JSON    bool // output JSON after Seconds
+	DB      bool // output an SQLite database after Seconds
+	Tree    bool // roll traffic up into ancestor processes
+	Depth   int  // collapse the process-tree below this depth (unlimited when zero)
+	Seconds int
+
+	Format       string // output "csv", "tsv" or "parquet" files after Seconds
+	Out          string // the directory csv, tsv or parquet files are written to
+	Denormalised bool   // write a single delimited file, with a row per packet
+
+	ProcEvents bool   // trace process exec & exit to attribute short-lived processes
+	Backend    string // count traffic with "pcap" or "ebpf"
+	Rules      string // a YAML file of alert rules
+
+	Daemon       *DaemonOptions     // run until signalled, flushing to rotating databases
+	Agent        *AgentOptions      // run until signalled, reporting to a collector
+	FlowExport   *FlowExportOptions // export flows to an IPFIX or NetFlow v9 collector
+	OTLP         *OTLPOptions       // push metrics & logs to an OpenTelemetry collector
+	TimeSeries   *TimeSeriesOptions // report counters as InfluxDB line protocol or Graphite plaintext
+	Listen       string             // serve a JSON API of live state on a loopback address or unix socket
+	Serve        bool               // run until interrupted, serving the API rather than showing traffic
+	UI           bool               // serve the web UI alongside the API
+	Translations *AddressMap        // used to stitch connections in the API's dependency graph
+}
+
+// Where capture --db writes its database
+const CAPTURE_DB_PATH = "./puffin.db"
+
+// Does this capture write a report once Seconds have passed?
+func (opts *CaptureOptions) Reports() bool {
+	return opts.JSON || opts.DB || len(opts.Format) > 0
+}
+
 // Main application
-func Puffin(json bool, seconds int) int {
+func Puffin(opts CaptureOptions) int {
 	start := time.Now()
+	session := NewCaptureSession(start)
 
 	pfs, err := procfs.NewDefaultFS()
 	if err != nil {
@@ -190,38 +270,445 @@ func Puffin(json bool, seconds int) int {
 		return 1
 	}
 
-	pidConnChan := make(chan *[]PidSocket)
+	pidConnChan := make(chan *PidSocketSnapshot)
+	procSockChan := make(chan *[]PidSocket)
 	packetChan := make(chan *PacketData)
 
+	conns := NewConnectionTable()
 	pidConns := []PidSocket{}
-	packets := []PacketData{}
 
-	go NetworkWatcher(&pfs, packetChan, pidConnChan)
+	// prefer eBPF when asked for, but fall back to packet-capture if it can't be loaded
+	var bpf *EBPFBackend
+	if opts.Backend == "ebpf" {
+		bpf, err = OpenEBPFBackend()
+
+		if err != nil {
+			log.Printf("eBPF backend unavailable, falling back to pcap: %v", err)
+			bpf = nil
+		} else {
+			defer bpf.Close()
+		}
+	}
+
+	go NetworkWatcher(&pfs, packetChan, pidConnChan, procSockChan, bpf)
+
+	if opts.ProcEvents {
+		go func() {
+			if err := ProcEventWatcher(&pfs, procSockChan); err != nil {
+				log.Printf("process-event tracing disabled: %v", err)
+			}
+		}()
+	}
 	var storeLock sync.Mutex
 
 	store := map[string]map[string]StoredConnectionData{}
+	tcpStates := TCPStateStore{}
+	tcpFlows := TCPFlowStore{}
+
+	// evaluate alert rules periodically, if any were provided
+	var rules *RuleEngine
+	var sinks *AlertDispatcher
+	var ruleTick <-chan time.Time
+
+	if len(opts.Rules) > 0 {
+		rules, err = LoadRules(opts.Rules)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+
+		sinks, err = NewAlertDispatcher(rules.Sinks)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+
+		ruleTicker := time.NewTicker(RULE_INTERVAL)
+		defer ruleTicker.Stop()
+		ruleTick = ruleTicker.C
+	}
+
+	// export flows to a collector as they time out
+	var exporter *FlowExporter
+	var exportTick <-chan time.Time
+
+	if opts.FlowExport != nil {
+		exporter, err = NewFlowExporter(opts.FlowExport, start)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+		defer exporter.Close()
+
+		exportTicker := time.NewTicker(FLOW_EXPORT_INTERVAL)
+		defer exportTicker.Stop()
+		exportTick = exportTicker.C
+	}
+
+	// push metrics & logs to an OpenTelemetry collector periodically
+	var otlp *OTLPExporter
+	var otlpTick <-chan time.Time
+
+	if opts.OTLP != nil {
+		otlp, err = NewOTLPExporter(opts.OTLP, start)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+
+		otlpTicker := time.NewTicker(opts.OTLP.Interval)
+		defer otlpTicker.Stop()
+		otlpTick = otlpTicker.C
+	}
+
+	// report traffic counters to InfluxDB or Graphite periodically
+	var series *TimeSeriesReporter
+	var seriesTick <-chan time.Time
+
+	if opts.TimeSeries != nil {
+		series, err = NewTimeSeriesReporter(opts.TimeSeries)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+
+		seriesTicker := time.NewTicker(opts.TimeSeries.Interval)
+		defer seriesTicker.Stop()
+		seriesTick = seriesTicker.C
+	}
+
+	// as a daemon, flush periodically and once more on SIGTERM
+	var rot *CaptureRotator
+	var flushTick <-chan time.Time
+	stop := make(chan os.Signal, 1)
+	lastFlush := start
+
+	if opts.Daemon != nil {
+		if err := os.MkdirAll(opts.Daemon.Dir, 0755); err != nil {
+			log.Fatal(err)
+			return 1
+		}
+
+		rot = &CaptureRotator{Dir: opts.Daemon.Dir, Period: opts.Daemon.Rotate, MaxSize: opts.Daemon.MaxSize}
+
+		flushTicker := time.NewTicker(opts.Daemon.Interval)
+		defer flushTicker.Stop()
+		flushTick = flushTicker.C
+
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	}
+
+	// as an agent, report to the collector periodically, and once more on SIGTERM
+	var agent *Agent
+
+	if opts.Agent != nil {
+		agent = NewAgent(opts.Agent, start)
+
+		flushTicker := time.NewTicker(opts.Agent.Interval)
+		defer flushTicker.Stop()
+		flushTick = flushTicker.C
+
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	}
+
+	// when writing a database or parquet files, stream packets to them during capture rather than
+	// holding them in memory; only those needed to evaluate rate rules are kept
+	var stream *PacketStream
+	var pqStream *ParquetStream
+	var pruneTick <-chan time.Time
+
+	if opts.DB || opts.Daemon != nil {
+		fpath := CAPTURE_DB_PATH
+		if opts.Daemon != nil {
+			fpath = rot.Path(start)
+		} else if err := RemoveCaptureDB(fpath); err != nil {
+			log.Fatal(err)
+			return 1
+		}
+
+		stream, err = OpenPacketStream(fpath)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+	} else if opts.Format == "parquet" {
+		pqStream, err = OpenParquetStream(opts.Out)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+	}
+
+	if stream != nil || pqStream != nil {
+		pruneTicker := time.NewTicker(PACKET_STREAM_INTERVAL)
+		defer pruneTicker.Stop()
+		pruneTick = pruneTicker.C
+	}
+
+	// serve live state to other tools, and stream updates each second; packets are kept long
+	// enough to answer top-talker queries
+	var hub *LiveHub
+	var liveTick <-chan time.Time
+	pruneWindow := rules.Window()
+
+	if len(opts.Listen) > 0 {
+		hub = NewLiveHub()
+
+		api, err := NewAPIServer(opts.Listen, NewLiveSource(&storeLock, conns, store, start), hub, opts.UI)
+		if err != nil {
+			log.Fatal(err)
+			return 1
+		}
+		api.Translations = opts.Translations
+		defer api.Close()
+
+		if opts.Serve {
+			log.Printf("serving live capture on %s", api.URL())
+		}
+
+		go api.Serve()
+		if pruneWindow < API_MAX_WINDOW {
+			pruneWindow = API_MAX_WINDOW
+		}
+
+		liveTicker := time.NewTicker(LIVE_INTERVAL)
+		defer liveTicker.Stop()
+		liveTick = liveTicker.C
+	}
+
+	// without an output format, show traffic live
+	if !opts.Reports() && opts.Daemon == nil && opts.Agent == nil && !opts.Serve {
+		go LiveView(&storeLock, conns, store, &pfs, opts.Tree, opts.Depth)
+	}
 
 	for {
 		select {
-		case tmp := <-pidConnChan:
-			// full is returned each time, append
+		case snapshot := <-pidConnChan:
+			// a full snapshot is returned each time; diff it into open & close events,
+			// keeping closed connections so late packets can still be attributed
+			now := time.Now()
 
 			storeLock.Lock()
-			pidConns = []PidSocket{}
-			pidConns = append(pidConns, *tmp...)
+			events := conns.Update(snapshot.Protocol, snapshot.PidSockets, now)
+			pidConns = conns.PidSockets()
+			TrackTCPStates(tcpStates, snapshot.PidSockets, now)
+
+			if otlp != nil {
+				otlp.LogEvents(events)
+			}
+			if hub != nil {
+				hub.PublishEvents(events)
+			}
 			storeLock.Unlock()
 
+			if pqStream != nil {
+				pqStream.Attribute(pidConns)
+			}
+
+		case pidSockets := <-procSockChan:
+			// sockets seen between two snapshots, by process-event tracing or eBPF
+			storeLock.Lock()
+			events := conns.Observe(pidSockets, time.Now())
+			pidConns = conns.PidSockets()
+
+			if otlp != nil {
+				otlp.LogEvents(events)
+			}
+			if hub != nil {
+				hub.PublishEvents(events)
+			}
+			storeLock.Unlock()
+
+			if pqStream != nil {
+				pqStream.Attribute(pidConns)
+			}
+
+		case now := <-ruleTick:
+			storeLock.Lock()
+			alerts := rules.Evaluate(pidConns, store, now)
+
+			if otlp != nil {
+				otlp.LogAlerts(alerts)
+			}
+			storeLock.Unlock()
+
+			sinks.Dispatch(alerts, now)
+
+		case now := <-exportTick:
+			storeLock.Lock()
+			flows := exporter.Collect(store, pidConns, now)
+			storeLock.Unlock()
+
+			if err := exporter.Send(flows, now); err != nil {
+				log.Printf("could not export flows: %v", err)
+			}
+
+		case now := <-otlpTick:
+			storeLock.Lock()
+			otlp.Update(conns, store)
+			otlp.Push(conns, now)
+			storeLock.Unlock()
+
+		case now := <-seriesTick:
+			storeLock.Lock()
+			series.Update(conns, store)
+			series.Push(conns, now)
+			storeLock.Unlock()
+
+		case now := <-liveTick:
+			storeLock.Lock()
+			hub.Update(conns, store, now)
+			storeLock.Unlock()
+
+		case now := <-pruneTick:
+			storeLock.Lock()
+			PrunePackets(store, now.Add(-pruneWindow).UnixNano())
+			storeLock.Unlock()
+
+		case now := <-flushTick:
+			storeLock.Lock()
+			// count flows' traffic before the flush empties the store
+			if exporter != nil {
+				exporter.Update(store)
+			}
+			// closed connections are forgotten by the flush, so push their final traffic first
+			if otlp != nil {
+				otlp.Update(conns, store)
+				otlp.Push(conns, now)
+			}
+			if series != nil {
+				series.Update(conns, store)
+				series.Push(conns, now)
+			}
+			if hub != nil {
+				hub.Count(conns, store)
+			}
+			rules.Update(store, now)
+
+			if opts.Daemon != nil {
+				stream, err = FlushDaemon(opts.Daemon, rot, stream, session, conns, store, tcpStates, tcpFlows, lastFlush, now)
+			} else {
+				agent.Report(conns, store, now)
+				ForgetFlushed(conns, store, tcpStates, tcpFlows, lastFlush)
+			}
+			pidConns = conns.PidSockets()
+
+			if exporter != nil {
+				exporter.Reset()
+			}
+			if otlp != nil {
+				otlp.Reset()
+			}
+			if series != nil {
+				series.Reset()
+			}
+			if hub != nil {
+				hub.Reset()
+			}
+			storeLock.Unlock()
+
+			if opts.Daemon != nil && stream == nil {
+				log.Fatal(err)
+				return 1
+			}
+
+			if err != nil {
+				log.Printf("could not flush capture: %v", err)
+			}
+			lastFlush = now
+
+		case sig := <-stop:
+			log.Printf("received %v, flushing capture", sig)
+			now := time.Now()
+
+			storeLock.Lock()
+			FinishTCPStates(tcpStates, now)
+
+			if exporter != nil {
+				if err := exporter.Send(exporter.Finish(store, pidConns, now), now); err != nil {
+					log.Printf("could not export flows: %v", err)
+				}
+			}
+			if otlp != nil {
+				if err := otlp.Close(conns, store, now); err != nil {
+					log.Printf("could not close OTLP exporter: %v", err)
+				}
+			}
+			if series != nil {
+				if err := series.Close(conns, store, now); err != nil {
+					log.Printf("could not close metric reporter: %v", err)
+				}
+			}
+
+			if opts.Daemon != nil {
+				stream, err = FlushDaemon(opts.Daemon, rot, stream, session, conns, store, tcpStates, tcpFlows, lastFlush, now)
+			} else {
+				agent.Report(conns, store, now)
+			}
+			storeLock.Unlock()
+
+			if agent != nil {
+				err = agent.Close()
+			} else if err == nil {
+				err = stream.Close()
+			}
+
+			if err != nil {
+				log.Printf("could not flush capture: %v", err)
+				return 1
+			}
+
+			return 0
+
 		case pkt := <-packetChan:
-			packets = append(packets, *pkt)
+			if stream != nil {
+				stream.Write(*pkt)
+			}
+			if pqStream != nil {
+				pqStream.Write(*pkt)
+			}
 
 			storeLock.Lock()
 			AssociatePacket(store, &pidConns, *pkt)
+			TrackTCPFlow(tcpFlows, store, *pkt)
 			storeLock.Unlock()
 		}
 
-		if json && time.Since(start) > time.Second*time.Duration(seconds) {
+		if opts.Reports() && time.Since(start) > time.Second*time.Duration(opts.Seconds) {
 			storeLock.Lock()
-			err := ReportNetwork(&pidConns, store, false) // TODO
+
+			if exporter != nil {
+				now := time.Now()
+				if err := exporter.Send(exporter.Finish(store, pidConns, now), now); err != nil {
+					log.Printf("could not export flows: %v", err)
+				}
+			}
+			if otlp != nil {
+				if err := otlp.Close(conns, store, time.Now()); err != nil {
+					log.Printf("could not close OTLP exporter: %v", err)
+				}
+			}
+			if series != nil {
+				if err := series.Close(conns, store, time.Now()); err != nil {
+					log.Printf("could not close metric reporter: %v", err)
+				}
+			}
+
+			var err error
+			if opts.JSON && opts.Tree {
+				procTree := BuildProcessTree(&pidConns, store, &pfs, true)
+				err = ReportJSONProcessTree(procTree, opts.Depth)
+			} else if pqStream != nil {
+				err = ReportParquetNetwork(pqStream, conns, store)
+			} else if len(opts.Format) > 0 {
+				err = ReportCSVNetwork(conns, store, opts.Format, opts.Out, opts.Denormalised)
+			} else {
+				err = ReportNetwork(session, stream, conns, store, tcpStates, opts.JSON)
+			}
+
+			if err == nil && stream != nil {
+				err = stream.Close()
+			}
 
 			if err != nil {
 				log.Fatal(err)
@@ -237,9 +724,17 @@ func Puffin(json bool, seconds int) int {
 func main() {
 	usage := `
 Usage:
-  puffin
-  puffin capture [(-j|--json)|(-d|--db)] [-s <seconds|--seconds <seconds>]
-	puffin analyse <db> [-q <str>|--query <str>] [-f <fpath>|--file <fpath>]
+  puffin [-i|--interactive] [-t|--tree] [--depth <n>] [-e|--proc-events] [-b <name>|--backend <name>] [-r <fpath>|--rules <fpath>] [--flow-export <url>] [--active-timeout <seconds>] [--idle-timeout <seconds>] [--otlp <url>] [--otlp-interval <seconds>] [--influx <dest>|--graphite <addr>] [--metric-interval <seconds>] [--metric-prefix <prefix>] [--metric-tags <tags>] [--graphite-path <template>] [--listen <addr>]
+  puffin capture [(-j|--json)|(-d|--db)|--format <fmt>] [-o <path>|--out <path>] [--denormalised] [-t|--tree] [--depth <n>] [-e|--proc-events] [-b <name>|--backend <name>] [-r <fpath>|--rules <fpath>] [--flow-export <url>] [--active-timeout <seconds>] [--idle-timeout <seconds>] [--otlp <url>] [--otlp-interval <seconds>] [--influx <dest>|--graphite <addr>] [--metric-interval <seconds>] [--metric-prefix <prefix>] [--metric-tags <tags>] [--graphite-path <template>] [--listen <addr>] [-s <seconds>|--seconds <seconds>]
+  puffin daemon [--dir <path>] [--interval <seconds>] [--rotate <duration>] [--max-size <size>] [--retain <duration>] [--max-disk <size>] [-e|--proc-events] [-b <name>|--backend <name>] [-r <fpath>|--rules <fpath>] [--flow-export <url>] [--active-timeout <seconds>] [--idle-timeout <seconds>] [--otlp <url>] [--otlp-interval <seconds>] [--influx <dest>|--graphite <addr>] [--metric-interval <seconds>] [--metric-prefix <prefix>] [--metric-tags <tags>] [--graphite-path <template>] [--listen <addr>]
+	puffin agent --collector <addr> [--host <name>] [--report-interval <seconds>] [--agent-buffer <n>] [-e|--proc-events] [-b <name>|--backend <name>] [-r <fpath>|--rules <fpath>] [--listen <addr>]
+	puffin collector [--bind <addr>] [--dir <path>] [--interval <seconds>] [--rotate <duration>] [--max-size <size>] [--retain <duration>] [--max-disk <size>] [--listen <addr>] [--ui] [--nat <fpath>] [-i|--interactive] [-t|--tree] [--depth <n>]
+	puffin serve [--ui] [--listen <addr>] [--nat <fpath>] [-e|--proc-events] [-b <name>|--backend <name>] [-r <fpath>|--rules <fpath>] [<db>]
+	puffin analyse <db> [-q <str>|--query <str>] [-f <fpath>|--file <fpath>] [-t|--tree] [--depth <n>]
+	puffin analyse <db> --dependencies [--nat <fpath>]
+	puffin analyse <db> --graph [--group <level>] [--graph-format <fmt>] [--nat <fpath>]
+	puffin [analyse] diff <before> <after> [-j|--json] [--threshold <factor>] [--min-rate <size>]
+	puffin analyse merge <merged> <captures>...
 	puffin (-h|--help)
 
 Description:
@@ -249,6 +744,15 @@ Description:
 
 Modes:
   capture: Capture network traffic and identify processes, connections, protocols, devices, and packets with ongoing networking
+	daemon: Capture continuously, flushing to SQLite databases that are rotated by time or size, and removed once past retention.
+	agent: Capture continuously, reporting traffic to a collector rather than keeping it.
+	collector: Collect agents' reports from many hosts, flushing them to rotating SQLite databases with a session per host, and
+	           serving the JSON API, web dashboard and (with -i) live view across every host.
+	serve: Serve the JSON API, and with --ui a web dashboard, of a live capture or of a saved capture database.
+	diff: Compare two captures, e.g. from before and after a deploy: process-remote pairs and listening ports that appeared or
+	      disappeared, and processes and hosts whose bytes per second of capture changed by --threshold or more.
+	merge: Merge capture databases, e.g. a daemon's rotated files or a collector's hosts, into <merged> so analyse can query
+	       them at once. A session split across files is merged back into one, and rows already in <merged> are skipped.
 	analyse: Analyse a puffin trace using SQL to identify top-talkers, total network-traffic, processes using the network, total-connections, or
 	             anything else helpful.
 
@@ -262,9 +766,60 @@ Protocols:
 
 Options:
 	-i, --interactive                    start in interactive mode.
-  -j, --json                           output aggregated connection-information JSON.
+  -j, --json                           output aggregated connection-information JSON, or a diff as JSON.
 	-d, --db                             output aggregated connection-information to a SQLITE database.
+	--format <fmt>                       output json, db, csv or tsv files of processes, connections, packets and devices, or parquet files of packets and connections.
+	-o <path>, --out <path>              the directory csv, tsv or parquet files are written to [default: .].
+	--denormalised                       write a single csv or tsv file, with a row per packet.
 	-s <seconds>, --seconds <seconds>    how mnay seconds should it run for?
+	-t, --tree                           roll traffic from child processes up into their parents.
+	--depth <n>                          collapse the process-tree below this depth [default: 0].
+	-e, --proc-events                    trace process exec & exit, to attribute processes that exit between polls.
+	-b <name>, --backend <name>          count traffic using pcap or ebpf; ebpf falls back to pcap if unavailable [default: pcap].
+	-r <fpath>, --rules <fpath>          a YAML file of alert rules, evaluated continuously. Alerts go to the file's sinks, or stderr as JSON.
+	--flow-export <url>                  export flows over UDP to an IPFIX or NetFlow v9 collector, e.g. ipfix://host:4739 or netflow9://host:2055.
+	--active-timeout <seconds>           export long-lived flows at least this often [default: 60].
+	--idle-timeout <seconds>             export flows once they have been idle this long [default: 15].
+	--otlp <url>                         push metrics & logs to an OpenTelemetry collector, e.g. grpc://host:4317, grpcs://host:4317 or http://host:4318.
+	--otlp-interval <seconds>            how often metrics are pushed to the collector [default: 10].
+	--influx <dest>                      write process, remote-host and device counters as InfluxDB line protocol to - (stdout), a file, or an HTTP write URL,
+	                                     e.g. http://host:8086/write?db=puffin. $INFLUX_TOKEN is sent as an authorization token, if set.
+	--graphite <addr>                    send process, remote-host and device counters as Graphite plaintext over TCP, e.g. host:2003.
+	--metric-interval <seconds>          how often counters are written [default: 10].
+	--metric-prefix <prefix>             prefixes InfluxDB measurements and Graphite paths [default: puffin].
+	--metric-tags <tags>                 tags added to every series, e.g. dc=eu,role=web. A host tag is added unless given.
+	--graphite-path <template>           the Graphite path of each series, before its field name. Placeholders are {prefix}, {kind}, {name} and any tag [default: {prefix}.{host}.{kind}.{name}].
+	--listen <addr>                      serve a JSON API of live processes, connections, devices and top talkers, on a loopback
+	                                     address or unix socket, e.g. 127.0.0.1:7070 or unix:///run/puffin.sock. Per-second updates
+	                                     and connection events stream from /api/stream (SSE) and /api/ws (WebSocket).
+	--ui                                 serve a web dashboard of per-process bandwidth, processes' remote hosts, connections and devices.
+	                                     puffin serve listens on 127.0.0.1:7070 unless --listen is given.
+	--collector <addr>                   the collector an agent reports to, e.g. collector.internal:7071. Reports are length-prefixed protobuf
+	                                     over TCP, sent with $PUFFIN_AGENT_TOKEN if set; they are not encrypted, so use a trusted network or tunnel.
+	--host <name>                        how an agent's machine is known to the collector; defaults to its hostname.
+	--report-interval <seconds>          how often an agent reports to its collector [default: 10].
+	--agent-buffer <n>                   reports an agent keeps while its collector is unreachable, dropping the oldest beyond this [default: 360].
+	--bind <addr>                        the address a collector accepts agents on [default: :7071]. If $PUFFIN_AGENT_TOKEN is set, agents must send it.
+	--dir <path>                         the directory daemon databases are written to [default: .].
+	--interval <seconds>                 how often the daemon or collector flushes to its database [default: 60].
+	--rotate <duration>                  start a new database each period, e.g. 1h or 24h [default: 24h].
+	--max-size <size>                    also start a new database once the current one reaches a size, e.g. 500MB.
+	--retain <duration>                  delete databases last written longer ago than this, e.g. 168h.
+	--max-disk <size>                    delete the oldest databases while all of them exceed a size, e.g. 10GB.
+	-q <str>, --query <str>              an SQL query to run against the capture.
+	-f <fpath>, --file <fpath>           a file containing an SQL query to run against the capture.
+	--dependencies                       match connections whose ends were both captured, e.g. by agents on different hosts, and print
+	                                     the services that call each other as JSON. The API serves the same graph from /api/dependencies.
+	--nat <fpath>                        a YAML map of addresses as one host sees them to addresses its peers see, e.g. a load-balancer
+	                                     or port-forward's address to its backend's, so connections through NAT are matched too.
+	--graph                              print a directed graph of which processes talk to which, weighted by bytes and labelled with
+	                                     ports and connection counts. The API serves the same graph from /api/graph?group=&format=.
+	--group <level>                      the graph's nodes: process, command, container or host [default: process]. Remote addresses
+	                                     are nodes of their own, unless the other end was captured too.
+	--graph-format <fmt>                 dot (Graphviz), mermaid, or json (node-link) [default: dot].
+	--threshold <factor>                 report traffic that grew or shrank by at least this factor [default: 2].
+	--min-rate <size>                    traffic below this many bytes per second counts as this much, so quiet processes are not
+	                                     reported as changing wildly [default: 1KB].
 
 See Also:
   nethogs, ss, lsof -i
@@ -283,8 +838,202 @@ License:
 
 	opts, _ := docopt.ParseDoc(usage)
 	json, _ := opts.Bool("--json")
+	db, _ := opts.Bool("--db")
+	tree, _ := opts.Bool("--tree")
+	procEvents, _ := opts.Bool("--proc-events")
+	backend, _ := opts.String("--backend")
+	rules, _ := opts.String("--rules")
+	format, _ := opts.String("--format")
+	out, _ := opts.String("--out")
+	denormalised, _ := opts.Bool("--denormalised")
+	listen, _ := opts.String("--listen")
+
+	switch format {
+	case "json":
+		json, format = true, ""
+	case "db":
+		db, format = true, ""
+	case "", "csv", "tsv", "parquet":
+	default:
+		log.Fatalf("unknown format %q; expected json, db, csv, tsv or parquet", format)
+	}
 
 	seconds, _ := opts.Int("--seconds")
+	depth, _ := opts.Int("--depth")
+	serve, _ := opts.Bool("serve")
+	ui, _ := opts.Bool("--ui")
+
+	if serve && len(listen) == 0 {
+		listen = API_DEFAULT_LISTEN
+	}
+
+	var translations *AddressMap
+	if natPath, _ := opts.String("--nat"); len(natPath) > 0 {
+		loaded, err := LoadAddressMap(natPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		translations = loaded
+	}
+
+	if dbPath, _ := opts.String("<db>"); serve && len(dbPath) > 0 {
+		if err := ServeCapture(dbPath, listen, ui, translations); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if diff, _ := opts.Bool("diff"); diff {
+		before, _ := opts.String("<before>")
+		after, _ := opts.String("<after>")
+		threshold, err := opts.Float64("--threshold")
+		if err != nil {
+			log.Fatalf("--threshold: %v", err)
+		}
+
+		minRateStr, _ := opts.String("--min-rate")
+		minRate, err := ParseByteSize(minRateStr)
+		if err != nil {
+			log.Fatalf("--min-rate: %v", err)
+		}
+
+		if err := AnalyseDiff(before, after, threshold, float64(minRate), json); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if merge, _ := opts.Bool("merge"); merge {
+		merged, _ := opts.String("<merged>")
+		captures, _ := opts["<captures>"].([]string)
+
+		if err := MergeCaptures(merged, captures); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if analyse, _ := opts.Bool("analyse"); analyse {
+		dbPath, _ := opts.String("<db>")
+		query, _ := opts.String("--query")
+		queryFile, _ := opts.String("--file")
+
+		if graph, _ := opts.Bool("--graph"); graph {
+			group, _ := opts.String("--group")
+			graphFormat, _ := opts.String("--graph-format")
+
+			if err := ValidateGraphOptions(group, graphFormat); err != nil {
+				log.Fatal(err)
+			}
+			if err := AnalyseGraph(dbPath, group, graphFormat, translations); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		if dependencies, _ := opts.Bool("--dependencies"); dependencies {
+			if err := AnalyseDependencies(dbPath, translations); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		if err := Analyse(dbPath, query, queryFile, tree, depth); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if collector, _ := opts.Bool("collector"); collector {
+		daemonOpts, err := ParseDaemonOptions(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bind, _ := opts.String("--bind")
+		interactive, _ := opts.Bool("--interactive")
+
+		err = Collect(&CollectorOptions{
+			Bind:         bind,
+			Token:        os.Getenv("PUFFIN_AGENT_TOKEN"),
+			Daemon:       daemonOpts,
+			Listen:       listen,
+			UI:           ui,
+			Translations: translations,
+			Interactive:  interactive,
+			Tree:         tree,
+			Depth:        depth,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	var agentOpts *AgentOptions
+	if agent, _ := opts.Bool("agent"); agent {
+		parsed, err := ParseAgentOptions(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		agentOpts = parsed
+	}
+
+	var daemonOpts *DaemonOptions
+	if daemon, _ := opts.Bool("daemon"); daemon {
+		parsed, err := ParseDaemonOptions(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		daemonOpts = parsed
+	}
+
+	flowExport, err := ParseFlowExportOptions(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	otlpOpts, err := ParseOTLPOptions(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timeSeries, err := ParseTimeSeriesOptions(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	Puffin(json, seconds)
+	Puffin(CaptureOptions{
+		JSON:         json,
+		DB:           db,
+		Tree:         tree,
+		Depth:        depth,
+		Seconds:      seconds,
+		ProcEvents:   procEvents,
+		Backend:      backend,
+		Rules:        rules,
+		Daemon:       daemonOpts,
+		Agent:        agentOpts,
+		FlowExport:   flowExport,
+		OTLP:         otlpOpts,
+		TimeSeries:   timeSeries,
+		Listen:       listen,
+		Serve:        serve,
+		UI:           ui,
+		Translations: translations,
+
+		Format:       format,
+		Out:          out,
+		Denormalised: denormalised,
+	})
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Copy an attached capture (src) into the main capture. Ids are remapped through temporary tables,
+// matching rows by what makes them unique: a session by its start & host, so rotated files of one
+// session are merged back into it, a device or user by its session & name or uid, a process by its
+// session, pid & start-time, and a connection by its session, protocol, 4-tuple & inode. Rows
+// already present, e.g. from overlapping or repeated inputs, are not copied again. Packets still
+// staged in packet_stream belong to no session, so they are left behind
+var MERGE_CAPTURE = []string{
+	`insert or ignore into main.session (start, end, hostname)
+	select start, end, hostname from src.session`,
+
+	`create temporary table merge_session as
+	select s.id as src_id, d.id as dst_id
+	from src.session s
+	join main.session d on d.start = s.start and d.hostname = s.hostname`,
+
+	// a session split across rotated files ends when the last of them does
+	`update main.session set end = max(coalesce(session.end, s.end), coalesce(s.end, session.end))
+	from temp.merge_session m
+	join src.session s on s.id = m.src_id
+	where session.id = m.dst_id`,
+
+	`insert or ignore into main.device (session_id, name)
+	select m.dst_id, s.name
+	from src.device s
+	join temp.merge_session m on m.src_id = s.session_id`,
+
+	`create temporary table merge_device as
+	select s.id as src_id, d.id as dst_id
+	from src.device s
+	join temp.merge_session m on m.src_id = s.session_id
+	join main.device d on d.session_id = m.dst_id and d.name = s.name`,
+
+	`insert or ignore into main.users (session_id, uid, username)
+	select m.dst_id, u.uid, u.username
+	from src.users u
+	join temp.merge_session m on m.src_id = u.session_id`,
+
+	`insert or ignore into main.process (session_id, pid, startTime, command, commandLine, cgroup)
+	select m.dst_id, p.pid, p.startTime, p.command, p.commandLine, p.cgroup
+	from src.process p
+	join temp.merge_session m on m.src_id = p.session_id`,
+
+	`create temporary table merge_process as
+	select p.id as src_id, d.id as dst_id
+	from src.process p
+	join temp.merge_session m on m.src_id = p.session_id
+	join main.process d on d.session_id = m.dst_id and d.pid = p.pid and d.startTime = p.startTime`,
+
+	// ancestors without sockets are stored unnamed, and may be named in another file
+	`update main.process set
+		command     = coalesce(process.command, p.command),
+		commandLine = coalesce(process.commandLine, p.commandLine),
+		cgroup      = coalesce(process.cgroup, p.cgroup)
+	from temp.merge_process m
+	join src.process p on p.id = m.src_id
+	where process.id = m.dst_id`,
+
+	`insert or ignore into main.process_parent (process_id, parent_id, level)
+	select mp.dst_id, ma.dst_id, pp.level
+	from src.process_parent pp
+	join temp.merge_process mp on mp.src_id = pp.process_id
+	join temp.merge_process ma on ma.src_id = pp.parent_id`,
+
+	`insert or ignore into main.connection (session_id, protocol, localAddr, localPort, remAddr, remPort, inode, uid, sl, st, state, txQueue, rxQueue)
+	select m.dst_id, c.protocol, c.localAddr, c.localPort, c.remAddr, c.remPort, c.inode, c.uid, c.sl, c.st, c.state, c.txQueue, c.rxQueue
+	from src.connection c
+	join temp.merge_session m on m.src_id = c.session_id`,
+
+	`create temporary table merge_connection as
+	select c.id as src_id, d.id as dst_id
+	from src.connection c
+	join temp.merge_session m on m.src_id = c.session_id
+	join main.connection d on d.session_id = m.dst_id and d.protocol = c.protocol
+		and d.localAddr = c.localAddr and d.localPort = c.localPort and d.remAddr = c.remAddr and d.remPort = c.remPort and d.inode = c.inode`,
+
+	// a connection seen in several files was opened at its earliest sighting, and closed at its last
+	`insert into main.process_connection (process_id, connection_id, time, opened, closed)
+	select mp.dst_id, mc.dst_id, pc.time, pc.opened, pc.closed
+	from src.process_connection pc
+	join temp.merge_process mp on mp.src_id = pc.process_id
+	join temp.merge_connection mc on mc.src_id = pc.connection_id
+	where true
+	on conflict (process_id, connection_id) do update set
+		time   = max(coalesce(time, excluded.time), coalesce(excluded.time, time)),
+		opened = min(coalesce(opened, excluded.opened), coalesce(excluded.opened, opened)),
+		closed = max(coalesce(closed, excluded.closed), coalesce(excluded.closed, closed))`,
+
+	`insert into main.conn_event (process_id, connection_id, type, time)
+	select mp.dst_id, mc.dst_id, e.type, e.time
+	from src.conn_event e
+	join temp.merge_process mp on mp.src_id = e.process_id
+	join temp.merge_connection mc on mc.src_id = e.connection_id
+	where not exists (
+		select 1 from main.conn_event d
+		where d.process_id = mp.dst_id and d.connection_id = mc.dst_id and d.type = e.type and d.time = e.time)`,
+
+	`insert into main.conn_summary (connection_id, device_id, direction, size, start, end, retransmissions, outOfOrder, duplicateAcks, zeroWindows, handshakeRtt)
+	select mc.dst_id, md.dst_id, s.direction, s.size, s.start, s.end, s.retransmissions, s.outOfOrder, s.duplicateAcks, s.zeroWindows, s.handshakeRtt
+	from src.conn_summary s
+	join temp.merge_connection mc on mc.src_id = s.connection_id
+	join temp.merge_device md on md.src_id = s.device_id
+	where not exists (
+		select 1 from main.conn_summary d
+		where d.connection_id = mc.dst_id and d.device_id = md.dst_id and d.direction = s.direction
+			and d.size = s.size and d.start is s.start and d.end is s.end)`,
+
+	`insert into main.packet (connection_id, device_id, direction, size, time)
+	select mc.dst_id, md.dst_id, p.direction, p.size, p.time
+	from src.packet p
+	join temp.merge_connection mc on mc.src_id = p.connection_id
+	join temp.merge_device md on md.src_id = p.device_id
+	where not exists (
+		select 1 from main.packet d
+		where d.connection_id = mc.dst_id and d.time = p.time and d.device_id = md.dst_id and d.direction = p.direction and d.size = p.size)`,
+
+	`insert into main.tcp_state_transition (connection_id, fromState, toState, time)
+	select mc.dst_id, t.fromState, t.toState, t.time
+	from src.tcp_state_transition t
+	join temp.merge_connection mc on mc.src_id = t.connection_id
+	where not exists (
+		select 1 from main.tcp_state_transition d
+		where d.connection_id = mc.dst_id and d.time = t.time and d.fromState is t.fromState and d.toState is t.toState)`,
+
+	`insert into main.tcp_queue_stall (connection_id, queue, start, end, maxBytes, flagged)
+	select mc.dst_id, t.queue, t.start, t.end, t.maxBytes, t.flagged
+	from src.tcp_queue_stall t
+	join temp.merge_connection mc on mc.src_id = t.connection_id
+	where not exists (
+		select 1 from main.tcp_queue_stall d
+		where d.connection_id = mc.dst_id and d.queue = t.queue and d.start = t.start)`,
+
+	`insert into main.process_tcp_state (process_id, time, state, count)
+	select mp.dst_id, t.time, t.state, t.count
+	from src.process_tcp_state t
+	join temp.merge_process mp on mp.src_id = t.process_id
+	where not exists (
+		select 1 from main.process_tcp_state d
+		where d.process_id = mp.dst_id and d.time = t.time and d.state = t.state)`,
+
+	`insert into main.process_tcp_flow (process_id, time, connections, retransmissions, outOfOrder, duplicateAcks, zeroWindows, meanHandshakeRtt, maxHandshakeRtt)
+	select mp.dst_id, t.time, t.connections, t.retransmissions, t.outOfOrder, t.duplicateAcks, t.zeroWindows, t.meanHandshakeRtt, t.maxHandshakeRtt
+	from src.process_tcp_flow t
+	join temp.merge_process mp on mp.src_id = t.process_id
+	where not exists (
+		select 1 from main.process_tcp_flow d
+		where d.process_id = mp.dst_id and d.time = t.time)`,
+}
+
+// Record which file each of the input's sessions came from
+const MERGE_SESSION_ORIGIN = `insert or replace into main.session_origin (session_id, path, merged)
+select dst_id, ?, ? from temp.merge_session`
+
+var MERGE_CLEANUP = []string{
+	`drop table temp.merge_session`,
+	`drop table temp.merge_device`,
+	`drop table temp.merge_process`,
+	`drop table temp.merge_connection`,
+}
+
+// Copy one capture into the open output, returning how many sessions it held
+func mergeCapture(db *sql.DB, fpath string) (int, error) {
+	// inputs are left unchanged: older captures are migrated in a temporary copy, so every
+	// table being copied exists, and current ones are attached read-only
+	_, src, closeInput, err := OpenCaptureDBReadOnly(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer closeInput()
+
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.Exec("attach database ? as src", src); err != nil {
+		return 0, err
+	}
+
+	defer db.Exec("detach database src")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	for _, statement := range MERGE_CAPTURE {
+		if _, err := tx.Exec(statement); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(MERGE_SESSION_ORIGIN, abs, time.Now().UnixNano()); err != nil {
+		return 0, err
+	}
+
+	var sessions int
+	if err := tx.QueryRow("select count(*) from temp.merge_session").Scan(&sessions); err != nil {
+		return 0, err
+	}
+
+	for _, statement := range MERGE_CLEANUP {
+		if _, err := tx.Exec(statement); err != nil {
+			return 0, err
+		}
+	}
+
+	return sessions, tx.Commit()
+}
+
+// Merge capture databases into one, created if it does not exist, so queries and reports can span
+// many rotated files or hosts. Each session keeps its host, and session_origin records the files
+// it was merged from
+func MergeCaptures(outPath string, inputs []string) error {
+	outAbs, err := filepath.Abs(outPath)
+	if err != nil {
+		return err
+	}
+
+	// check every input before creating the output
+	for _, input := range inputs {
+		if _, err := os.Stat(input); err != nil {
+			return err
+		}
+
+		inputAbs, err := filepath.Abs(input)
+		if err != nil {
+			return err
+		}
+		if inputAbs == outAbs {
+			return fmt.Errorf("can't merge %s into itself", input)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", outPath+SQLITE_OPTIONS)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	// attached databases belong to a connection, so every statement must share one
+	db.SetMaxOpenConns(1)
+
+	if err := MigrateCaptureDB(db); err != nil {
+		return err
+	}
+
+	for _, input := range inputs {
+		sessions, err := mergeCapture(db, input)
+		if err != nil {
+			return fmt.Errorf("%s: %v", input, err)
+		}
+
+		fmt.Printf("merged %d sessions from %s\n", sessions, input)
+	}
+
+	return nil
+}
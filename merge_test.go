@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeLeavesInputsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	older, current := filepath.Join(dir, "older.db"), filepath.Join(dir, "current.db")
+
+	writeTestCapture(t, older, 1000, 3)
+	writeTestCapture(t, current, 2000, MIGRATIONS[len(MIGRATIONS)-1].Version)
+
+	inputs := map[string][]byte{older: readTestFile(t, older), current: readTestFile(t, current)}
+
+	out := filepath.Join(dir, "merged.db")
+	if err := MergeCaptures(out, []string{older, current}); err != nil {
+		t.Fatal(err)
+	}
+
+	for fpath, content := range inputs {
+		if !bytes.Equal(readTestFile(t, fpath), content) {
+			t.Errorf("%s was modified", fpath)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", out+SQLITE_OPTIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var sessions, origins, bytes, devices, users int
+	if err := db.QueryRow("select count(*) from session").Scan(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select count(distinct path) from session_origin").Scan(&origins); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select sum(size) from conn_summary").Scan(&bytes); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions != 2 || origins != 2 || bytes != 3000 {
+		t.Errorf("merged %d sessions from %d files with %d bytes; expected 2, 2 & 3000", sessions, origins, bytes)
+	}
+
+	// each session keeps its own devices & users, as they may be different hosts
+	if err := db.QueryRow("select count(*) from device").Scan(&devices); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select count(*) from users").Scan(&users); err != nil {
+		t.Fatal(err)
+	}
+
+	if devices != 2 || users != 2 {
+		t.Errorf("merged %d devices & %d users; expected one of each per session", devices, users)
+	}
+}
@@ -21,22 +21,26 @@ func ListNetworkDevices(pfs *procfs.FS) ([]string, error) {
 }
 
 // Watch network traffic and /proc information about network-devices
-// and connections.
-func NetworkWatcher(pfs *procfs.FS, packetChan chan *PacketData, pidConnChan chan *[]PidSocket) {
+// and connections. Traffic is counted by eBPF if a backend is given, otherwise by pcap
+func NetworkWatcher(pfs *procfs.FS, packetChan chan *PacketData, pidConnChan chan *PidSocketSnapshot, sockChan chan *[]PidSocket, bpf *EBPFBackend) {
 	tcpChan := make(chan []Connection)
 	udpChan := make(chan []Connection)
 
 	go NetTCPWatcher(tcpChan, pfs)
 	go NetUDPWatcher(udpChan, pfs)
-	go PacketWatcher(packetChan, pfs)
+
+	if bpf != nil {
+		go EBPFWatcher(pfs, bpf, packetChan, sockChan)
+	} else {
+		go PacketWatcher(packetChan, pfs)
+	}
 
 	for {
 		select {
 		case tcp := <-tcpChan:
-
-			pidConnChan <- AssociateProcesses(pfs, tcp)
+			pidConnChan <- &PidSocketSnapshot{"TCP", AssociateProcesses(pfs, tcp)}
 		case udp := <-udpChan:
-			pidConnChan <- AssociateProcesses(pfs, udp)
+			pidConnChan <- &PidSocketSnapshot{"UDP", AssociateProcesses(pfs, udp)}
 		}
 	}
 }
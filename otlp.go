@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	OTLP_QUEUE_SIZE  = 16               // exports buffered before new ones are dropped
+	OTLP_TIMEOUT     = 10 * time.Second // per export request
+	OTLP_MAX_LOGS    = 10000            // log records held between exports before new ones are dropped
+	OTLP_SCOPE       = "puffin"
+	OTLP_SERVICE     = "puffin"
+	OTLP_CONTENT     = "application/x-protobuf"
+	OTLP_METRICS_URL = "/v1/metrics"
+	OTLP_LOGS_URL    = "/v1/logs"
+)
+
+// Container runtimes name a container's cgroup after its 64-character id
+var CONTAINER_ID_PATTERN = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// Options for pushing to an OpenTelemetry collector
+type OTLPOptions struct {
+	Protocol string // grpc or http
+	Endpoint string // host:port for gRPC, or a base URL for HTTP
+	Insecure bool   // gRPC without TLS
+	Interval time.Duration
+}
+
+// Read OTLP options from the command-line; nil when no collector was given
+func ParseOTLPOptions(opts docopt.Opts) (*OTLPOptions, error) {
+	target, _ := opts.String("--otlp")
+	if len(target) == 0 {
+		return nil, nil
+	}
+
+	endpoint, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("--otlp: %v", err)
+	}
+
+	otlpOpts := &OTLPOptions{}
+
+	switch endpoint.Scheme {
+	case "grpc", "grpcs":
+		otlpOpts.Protocol, otlpOpts.Endpoint, otlpOpts.Insecure = "grpc", endpoint.Host, endpoint.Scheme == "grpc"
+	case "http", "https":
+		otlpOpts.Protocol, otlpOpts.Endpoint = "http", strings.TrimSuffix(target, "/")
+	default:
+		return nil, fmt.Errorf("--otlp: unknown protocol %q; expected grpc://, grpcs://, http:// or https://", endpoint.Scheme)
+	}
+
+	interval, _ := opts.Int("--otlp-interval")
+	if interval <= 0 {
+		return nil, fmt.Errorf("--otlp-interval must be a positive number of seconds")
+	}
+	otlpOpts.Interval = time.Duration(interval) * time.Second
+
+	return otlpOpts, nil
+}
+
+// Sends export requests to a collector
+type otlpClient interface {
+	ExportMetrics(ctx context.Context, req *colmetrics.ExportMetricsServiceRequest) error
+	ExportLogs(ctx context.Context, req *collogs.ExportLogsServiceRequest) error
+	Close() error
+}
+
+type otlpGRPCClient struct {
+	conn    *grpc.ClientConn
+	metrics colmetrics.MetricsServiceClient
+	logs    collogs.LogsServiceClient
+}
+
+func (client *otlpGRPCClient) ExportMetrics(ctx context.Context, req *colmetrics.ExportMetricsServiceRequest) error {
+	_, err := client.metrics.Export(ctx, req)
+	return err
+}
+
+func (client *otlpGRPCClient) ExportLogs(ctx context.Context, req *collogs.ExportLogsServiceRequest) error {
+	_, err := client.logs.Export(ctx, req)
+	return err
+}
+
+func (client *otlpGRPCClient) Close() error {
+	return client.conn.Close()
+}
+
+// POSTs binary protobuf requests, as OTLP/HTTP describes
+type otlpHTTPClient struct {
+	Endpoint string
+	client   *http.Client
+}
+
+func (client *otlpHTTPClient) post(ctx context.Context, path string, msg proto.Message) error {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", OTLP_CONTENT)
+
+	res, err := client.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", client.Endpoint+path, res.Status)
+	}
+
+	return nil
+}
+
+func (client *otlpHTTPClient) ExportMetrics(ctx context.Context, req *colmetrics.ExportMetricsServiceRequest) error {
+	return client.post(ctx, OTLP_METRICS_URL, req)
+}
+
+func (client *otlpHTTPClient) ExportLogs(ctx context.Context, req *collogs.ExportLogsServiceRequest) error {
+	return client.post(ctx, OTLP_LOGS_URL, req)
+}
+
+func (client *otlpHTTPClient) Close() error {
+	return nil
+}
+
+func newOTLPClient(opts *OTLPOptions) (otlpClient, error) {
+	if opts.Protocol == "http" {
+		return &otlpHTTPClient{opts.Endpoint, &http.Client{Timeout: OTLP_TIMEOUT}}, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if !opts.Insecure {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	conn, err := grpc.NewClient(opts.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &otlpGRPCClient{conn, colmetrics.NewMetricsServiceClient(conn), collogs.NewLogsServiceClient(conn)}, nil
+}
+
+func otlpString(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func otlpInt(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+// Semantic-convention names for a traffic direction
+func otlpDirection(direction string) string {
+	if direction == "in" {
+		return "receive"
+	}
+	return "transmit"
+}
+
+// The host's resource attributes, which every process's resource includes too
+func otlpHostAttributes() []*commonpb.KeyValue {
+	hostname, _ := os.Hostname()
+
+	return []*commonpb.KeyValue{
+		otlpString("service.name", OTLP_SERVICE),
+		otlpString("host.name", hostname),
+		otlpString("os.type", "linux"),
+	}
+}
+
+// A process's resource, along with the container it runs in if its cgroup names one
+func otlpProcessResource(host []*commonpb.KeyValue, pidConn *PidSocket) *resourcepb.Resource {
+	attrs := append([]*commonpb.KeyValue{}, host...)
+	attrs = append(attrs,
+		otlpInt("process.pid", int64(pidConn.Pid)),
+		otlpString("process.executable.name", pidConn.Command),
+		otlpString("process.command_line", pidConn.CommandLine),
+		otlpString("process.owner", pidConn.UserName),
+	)
+
+	if id := containerId(pidConn.Cgroup); len(id) > 0 {
+		attrs = append(attrs, otlpString("container.id", id))
+	}
+
+	return &resourcepb.Resource{Attributes: attrs}
+}
+
+// Semantic-convention attributes for a connection's addresses and transport
+func otlpConnectionAttributes(conn Connection) []*commonpb.KeyValue {
+	networkType := "ipv6"
+	if conn.GetLocalAddr().To4() != nil {
+		networkType = "ipv4"
+	}
+
+	return []*commonpb.KeyValue{
+		otlpString("network.transport", strings.ToLower(conn.GetType())),
+		otlpString("network.type", networkType),
+		otlpString("network.local.address", conn.GetLocalAddr().String()),
+		otlpInt("network.local.port", int64(conn.GetLocalPort())),
+		otlpString("network.peer.address", conn.GetRemAddr().String()),
+		otlpInt("network.peer.port", int64(conn.GetRemPort())),
+	}
+}
+
+// A log record, and the process it concerns (if any)
+type otlpLog struct {
+	pidConn *PidSocket
+	record  *logspb.LogRecord
+}
+
+type otlpRequest struct {
+	metrics *colmetrics.ExportMetricsServiceRequest
+	logs    *collogs.ExportLogsServiceRequest
+}
+
+// Pushes traffic metrics, connection events and alerts to an OpenTelemetry collector. Traffic is
+// counted from the store as it grows, and reported as cumulative sums from when puffin started
+type OTLPExporter struct {
+	Options  *OTLPOptions
+	client   otlpClient
+	start    time.Time
+	host     []*commonpb.KeyValue
+	counters *TrafficCounters
+	logs     []otlpLog
+	requests chan otlpRequest
+	done     chan bool
+}
+
+func NewOTLPExporter(opts *OTLPOptions, now time.Time) (*OTLPExporter, error) {
+	client, err := newOTLPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter := &OTLPExporter{
+		Options:  opts,
+		client:   client,
+		start:    now,
+		host:     otlpHostAttributes(),
+		counters: NewTrafficCounters(),
+		logs:     []otlpLog{},
+		requests: make(chan otlpRequest, OTLP_QUEUE_SIZE),
+		done:     make(chan bool),
+	}
+
+	go exporter.send()
+	return exporter, nil
+}
+
+func (exporter *OTLPExporter) send() {
+	for req := range exporter.requests {
+		ctx, cancel := context.WithTimeout(context.Background(), OTLP_TIMEOUT)
+
+		if err := exporter.client.ExportMetrics(ctx, req.metrics); err != nil {
+			log.Printf("could not export metrics to %s: %v", exporter.Options.Endpoint, err)
+		}
+
+		if req.logs != nil {
+			if err := exporter.client.ExportLogs(ctx, req.logs); err != nil {
+				log.Printf("could not export logs to %s: %v", exporter.Options.Endpoint, err)
+			}
+		}
+
+		cancel()
+	}
+
+	exporter.done <- true
+}
+
+// Count traffic stored since the last update
+func (exporter *OTLPExporter) Update(conns *ConnectionTable, store MachineNetworkStorage) {
+	exporter.counters.Update(conns, store)
+}
+
+// Count from zero once the store is emptied
+func (exporter *OTLPExporter) Reset() {
+	exporter.counters.Reset()
+}
+
+func (exporter *OTLPExporter) queueLog(pidConn *PidSocket, record *logspb.LogRecord) {
+	if len(exporter.logs) >= OTLP_MAX_LOGS {
+		return
+	}
+
+	exporter.logs = append(exporter.logs, otlpLog{pidConn, record})
+}
+
+// Log connections opening and closing
+func (exporter *OTLPExporter) LogEvents(events []ConnectionEvent) {
+	for idx := range events {
+		event := &events[idx]
+		pidConn := event.ProcessSocket
+		conn := pidConn.Connection
+
+		attrs := append(otlpConnectionAttributes(conn), otlpString("event.name", "puffin.connection."+event.Type))
+		if tcp, ok := conn.(TCPConnection); ok {
+			attrs = append(attrs, otlpString("puffin.tcp.state", tcp.GetStateName()))
+		}
+
+		body := fmt.Sprintf("%s connection %s: %s:%d -> %s:%d", pidConn.Command, event.Type,
+			conn.GetLocalAddr(), conn.GetLocalPort(), conn.GetRemAddr(), conn.GetRemPort())
+
+		exporter.queueLog(&pidConn, &logspb.LogRecord{
+			TimeUnixNano:         uint64(event.Time.UnixNano()),
+			ObservedTimeUnixNano: uint64(event.Time.UnixNano()),
+			SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+			SeverityText:         "INFO",
+			Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: body}},
+			Attributes:           attrs,
+		})
+	}
+}
+
+// Log alerts raised by rules
+func (exporter *OTLPExporter) LogAlerts(alerts []AlertEvent) {
+	for idx := range alerts {
+		alert := &alerts[idx]
+
+		var pidConn *PidSocket
+		if alert.ProcessSocket.Connection != nil {
+			pidConn = &alert.ProcessSocket
+		}
+
+		exporter.queueLog(pidConn, &logspb.LogRecord{
+			TimeUnixNano:         uint64(alert.Time.UnixNano()),
+			ObservedTimeUnixNano: uint64(alert.Time.UnixNano()),
+			SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+			SeverityText:         "WARN",
+			Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: alert.Description}},
+			Attributes: []*commonpb.KeyValue{
+				otlpString("event.name", "puffin.alert"),
+				otlpString("puffin.rule", alert.Rule),
+				otlpString("puffin.group_by", alert.GroupBy),
+				otlpString("puffin.group", alert.Group),
+				otlpInt("puffin.bytes", int64(alert.Bytes)),
+				otlpInt("puffin.window_bytes", int64(alert.WindowBytes)),
+				otlpInt("puffin.connections", int64(alert.Connections)),
+			},
+		})
+	}
+}
+
+// A cumulative, monotonic sum of bytes or packets
+func (exporter *OTLPExporter) sum(name string, description string, unit string, points []*metricspb.NumberDataPoint) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name:        name,
+		Description: description,
+		Unit:        unit,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			DataPoints:             points,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}},
+	}
+}
+
+// Data points for a counter's bytes & packets in each direction
+func (exporter *OTLPExporter) points(counter TrafficCounter, attrs []*commonpb.KeyValue, now time.Time) ([]*metricspb.NumberDataPoint, []*metricspb.NumberDataPoint) {
+	bytes, packets := []*metricspb.NumberDataPoint{}, []*metricspb.NumberDataPoint{}
+
+	for idx, direction := range []string{"out", "in"} {
+		pointAttrs := append(append([]*commonpb.KeyValue{}, attrs...), otlpString("network.io.direction", otlpDirection(direction)))
+
+		bytes = append(bytes, &metricspb.NumberDataPoint{
+			Attributes:        pointAttrs,
+			StartTimeUnixNano: uint64(exporter.start.UnixNano()),
+			TimeUnixNano:      uint64(now.UnixNano()),
+			Value:             &metricspb.NumberDataPoint_AsInt{AsInt: counter.Bytes[idx]},
+		})
+		packets = append(packets, &metricspb.NumberDataPoint{
+			Attributes:        pointAttrs,
+			StartTimeUnixNano: uint64(exporter.start.UnixNano()),
+			TimeUnixNano:      uint64(now.UnixNano()),
+			Value:             &metricspb.NumberDataPoint_AsInt{AsInt: counter.Packets[idx]},
+		})
+	}
+
+	return bytes, packets
+}
+
+func (exporter *OTLPExporter) scope(metrics ...*metricspb.Metric) []*metricspb.ScopeMetrics {
+	return []*metricspb.ScopeMetrics{{Scope: &commonpb.InstrumentationScope{Name: OTLP_SCOPE}, Metrics: metrics}}
+}
+
+// Device traffic under the host's resource, then process & connection traffic under each process's
+func (exporter *OTLPExporter) buildMetrics(conns *ConnectionTable, now time.Time) *colmetrics.ExportMetricsServiceRequest {
+	deviceBytes, devicePackets := []*metricspb.NumberDataPoint{}, []*metricspb.NumberDataPoint{}
+
+	for _, name := range exporter.counters.Devices() {
+		bytes, packets := exporter.points(exporter.counters.Device(name), []*commonpb.KeyValue{otlpString("network.interface.name", name)}, now)
+		deviceBytes, devicePackets = append(deviceBytes, bytes...), append(devicePackets, packets...)
+	}
+
+	resources := []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: exporter.host},
+		ScopeMetrics: exporter.scope(
+			exporter.sum("system.network.io", "Bytes captured per network device", "By", deviceBytes),
+			exporter.sum("system.network.packets", "Packets captured per network device", "{packet}", devicePackets),
+		),
+	}}
+
+	exporter.counters.Prune(conns)
+	processIds, processConns := trackedByProcess(conns)
+
+	for _, id := range processIds {
+		processBytes, processPackets := exporter.points(exporter.counters.Process(id), nil, now)
+		connBytes, connPackets := []*metricspb.NumberDataPoint{}, []*metricspb.NumberDataPoint{}
+		open := int64(0)
+
+		for _, conn := range processConns[id] {
+			if conn.IsOpen() {
+				open++
+			}
+
+			bytes, packets := exporter.points(exporter.counters.Connection(conn), otlpConnectionAttributes(conn.ProcessSocket.Connection), now)
+			connBytes, connPackets = append(connBytes, bytes...), append(connPackets, packets...)
+		}
+
+		openConns := &metricspb.Metric{
+			Name:        "puffin.process.connections",
+			Description: "Connections the process has open",
+			Unit:        "{connection}",
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{{
+				TimeUnixNano: uint64(now.UnixNano()),
+				Value:        &metricspb.NumberDataPoint_AsInt{AsInt: open},
+			}}}},
+		}
+
+		latest := processConns[id][len(processConns[id])-1].ProcessSocket
+		resources = append(resources, &metricspb.ResourceMetrics{
+			Resource: otlpProcessResource(exporter.host, &latest),
+			ScopeMetrics: exporter.scope(
+				exporter.sum("process.network.io", "Bytes the process sent & received", "By", processBytes),
+				exporter.sum("puffin.process.network.packets", "Packets the process sent & received", "{packet}", processPackets),
+				openConns,
+				exporter.sum("puffin.connection.io", "Bytes sent & received on each connection", "By", connBytes),
+				exporter.sum("puffin.connection.packets", "Packets sent & received on each connection", "{packet}", connPackets),
+			),
+		})
+	}
+
+	return &colmetrics.ExportMetricsServiceRequest{ResourceMetrics: resources}
+}
+
+// Group pending log records by process, taking them from the queue
+func (exporter *OTLPExporter) buildLogs() *collogs.ExportLogsServiceRequest {
+	if len(exporter.logs) == 0 {
+		return nil
+	}
+
+	resources := []*logspb.ResourceLogs{}
+	byProcess := map[ProcessId]*logspb.ScopeLogs{}
+
+	for _, entry := range exporter.logs {
+		id := ProcessId{}
+		if entry.pidConn != nil {
+			id = entry.pidConn.GetProcessId()
+		}
+
+		scope, ok := byProcess[id]
+		if !ok {
+			resource := &resourcepb.Resource{Attributes: exporter.host}
+			if entry.pidConn != nil {
+				resource = otlpProcessResource(exporter.host, entry.pidConn)
+			}
+
+			scope = &logspb.ScopeLogs{Scope: &commonpb.InstrumentationScope{Name: OTLP_SCOPE}}
+			byProcess[id] = scope
+			resources = append(resources, &logspb.ResourceLogs{Resource: resource, ScopeLogs: []*logspb.ScopeLogs{scope}})
+		}
+
+		scope.LogRecords = append(scope.LogRecords, entry.record)
+	}
+
+	exporter.logs = []otlpLog{}
+	return &collogs.ExportLogsServiceRequest{ResourceLogs: resources}
+}
+
+// Queue metrics and pending logs for export, without blocking. Exports are dropped if the collector falls behind
+func (exporter *OTLPExporter) Push(conns *ConnectionTable, now time.Time) {
+	req := otlpRequest{exporter.buildMetrics(conns, now), exporter.buildLogs()}
+
+	select {
+	case exporter.requests <- req:
+	default:
+		log.Printf("OTLP export queue full, dropping export")
+	}
+}
+
+// Push a final export, and wait for queued exports to be sent
+func (exporter *OTLPExporter) Close(conns *ConnectionTable, store MachineNetworkStorage, now time.Time) error {
+	exporter.Update(conns, store)
+	exporter.Push(conns, now)
+
+	close(exporter.requests)
+	<-exporter.done
+
+	return exporter.client.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Records the export requests a collector stand-in receives
+type otlpRecorder struct {
+	lock    sync.Mutex
+	metrics []*colmetrics.ExportMetricsServiceRequest
+	logs    []*collogs.ExportLogsServiceRequest
+}
+
+type otlpMetricsService struct {
+	colmetrics.UnimplementedMetricsServiceServer
+	recorder *otlpRecorder
+}
+
+func (service *otlpMetricsService) Export(ctx context.Context, req *colmetrics.ExportMetricsServiceRequest) (*colmetrics.ExportMetricsServiceResponse, error) {
+	service.recorder.lock.Lock()
+	defer service.recorder.lock.Unlock()
+
+	service.recorder.metrics = append(service.recorder.metrics, req)
+	return &colmetrics.ExportMetricsServiceResponse{}, nil
+}
+
+type otlpLogsService struct {
+	collogs.UnimplementedLogsServiceServer
+	recorder *otlpRecorder
+}
+
+func (service *otlpLogsService) Export(ctx context.Context, req *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+	service.recorder.lock.Lock()
+	defer service.recorder.lock.Unlock()
+
+	service.recorder.logs = append(service.recorder.logs, req)
+	return &collogs.ExportLogsServiceResponse{}, nil
+}
+
+// Export a connection's traffic, its open event and an alert, then close the exporter so every
+// request has been delivered
+func exportTestOTLP(t *testing.T, opts *OTLPOptions) {
+	start := time.Now()
+
+	exporter, err := NewOTLPExporter(opts, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, rem := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	pidConns := []PidSocket{{"alice", "curl", "curl https://example.com", 42, 100, nil, "/user.slice", &TCPConnection{1, local, 40000, rem, 443, 1, 0, 0, 1000, 1234}, start}}
+
+	conns := NewConnectionTable()
+	exporter.LogEvents(conns.Update("TCP", &pidConns, start))
+
+	store := MachineNetworkStorage{}
+	nanos := start.UnixNano()
+
+	for idx := 0; idx < 3; idx++ {
+		AssociatePacket(store, &pidConns, PacketData{"eth0", nanos + int64(idx), local, 40000, rem, 443, 100, IPPROTO_TCP, nil})
+	}
+	AssociatePacket(store, &pidConns, PacketData{"eth0", nanos, rem, 443, local, 40000, 50, IPPROTO_TCP, nil})
+
+	exporter.LogAlerts([]AlertEvent{{Type: "alert", Rule: "large-upload", Description: "sent a lot", Time: start, Bytes: 350, ProcessSocket: pidConns[0]}})
+
+	if err := exporter.Close(conns, store, start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func otlpAttribute(attrs []*commonpb.KeyValue, key string) *commonpb.AnyValue {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+// The transmitted & received values of a sum
+func otlpSum(metrics []*metricspb.ScopeMetrics, name string) (int64, int64, bool) {
+	for _, scope := range metrics {
+		for _, metric := range scope.Metrics {
+			if metric.Name != name {
+				continue
+			}
+
+			var sent, received int64
+			for _, point := range metric.GetSum().DataPoints {
+				switch otlpAttribute(point.Attributes, "network.io.direction").GetStringValue() {
+				case "transmit":
+					sent += point.GetAsInt()
+				case "receive":
+					received += point.GetAsInt()
+				}
+			}
+			return sent, received, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+func checkOTLPExport(t *testing.T, recorder *otlpRecorder) {
+	t.Helper()
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if len(recorder.metrics) != 1 || len(recorder.logs) != 1 {
+		t.Fatalf("collector received %d metric & %d log exports, expected one of each", len(recorder.metrics), len(recorder.logs))
+	}
+
+	foundHost, foundProcess := false, false
+	for _, resource := range recorder.metrics[0].ResourceMetrics {
+		attrs := resource.Resource.Attributes
+		if otlpAttribute(attrs, "service.name").GetStringValue() != OTLP_SERVICE {
+			t.Errorf("resource %v has no service name", attrs)
+		}
+
+		if pid := otlpAttribute(attrs, "process.pid"); pid == nil {
+			sent, received, ok := otlpSum(resource.ScopeMetrics, "system.network.io")
+			foundHost = ok
+			if sent != 300 || received != 50 {
+				t.Errorf("device traffic is %d sent, %d received; expected 300 & 50", sent, received)
+			}
+		} else if pid.GetIntValue() == 42 {
+			sent, received, ok := otlpSum(resource.ScopeMetrics, "process.network.io")
+			foundProcess = ok
+			if sent != 300 || received != 50 {
+				t.Errorf("process traffic is %d sent, %d received; expected 300 & 50", sent, received)
+			}
+			if command := otlpAttribute(attrs, "process.executable.name").GetStringValue(); command != "curl" {
+				t.Errorf("process resource names %q", command)
+			}
+		}
+	}
+
+	if !foundHost || !foundProcess {
+		t.Errorf("missing host (%v) or process (%v) traffic", foundHost, foundProcess)
+	}
+
+	events := map[string]bool{}
+	for _, resource := range recorder.logs[0].ResourceLogs {
+		for _, scope := range resource.ScopeLogs {
+			for _, record := range scope.LogRecords {
+				events[otlpAttribute(record.Attributes, "event.name").GetStringValue()] = true
+			}
+		}
+	}
+
+	if !events["puffin.connection.open"] || !events["puffin.alert"] {
+		t.Errorf("logged events %v, expected a connection opening and an alert", events)
+	}
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &otlpRecorder{}
+	server := grpc.NewServer()
+	colmetrics.RegisterMetricsServiceServer(server, &otlpMetricsService{recorder: recorder})
+	collogs.RegisterLogsServiceServer(server, &otlpLogsService{recorder: recorder})
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exportTestOTLP(t, &OTLPOptions{"grpc", listener.Addr().String(), true, time.Second})
+	checkOTLPExport(t, recorder)
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	recorder := &otlpRecorder{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != OTLP_CONTENT {
+			http.Error(res, "expected a protobuf POST", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		recorder.lock.Lock()
+		defer recorder.lock.Unlock()
+
+		switch req.URL.Path {
+		case OTLP_METRICS_URL:
+			msg := &colmetrics.ExportMetricsServiceRequest{}
+			err = proto.Unmarshal(body, msg)
+			recorder.metrics = append(recorder.metrics, msg)
+		case OTLP_LOGS_URL:
+			msg := &collogs.ExportLogsServiceRequest{}
+			err = proto.Unmarshal(body, msg)
+			recorder.logs = append(recorder.logs, msg)
+		default:
+			http.NotFound(res, req)
+			return
+		}
+
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	exportTestOTLP(t, &OTLPOptions{"http", server.URL, false, time.Second})
+	checkOTLPExport(t, recorder)
+}
@@ -18,10 +18,12 @@ func ExtractPacketData(device string, pkt gopacket.Packet) *PacketData {
 		ipv4 := layer.(*layers.IPv4)
 		pckData.LocalAddr = ipv4.SrcIP
 		pckData.RemAddr = ipv4.DstIP
+		pckData.Protocol = uint8(ipv4.Protocol)
 	} else if layer := pkt.Layer(layers.LayerTypeIPv6); layer != nil {
 		ipv6 := layer.(*layers.IPv6)
 		pckData.LocalAddr = ipv6.SrcIP
 		pckData.RemAddr = ipv6.DstIP
+		pckData.Protocol = uint8(ipv6.NextHeader)
 	}
 
 	// Decode TPC layer if present
@@ -29,9 +31,28 @@ func ExtractPacketData(device string, pkt gopacket.Packet) *PacketData {
 		tcp := tcpLayer.(*layers.TCP)
 		pckData.LocalPort = uint64(tcp.SrcPort)
 		pckData.RemPort = uint64(tcp.DstPort)
+		pckData.Protocol = IPPROTO_TCP
+		pckData.TCP = &TCPSegment{
+			Seq:        tcp.Seq,
+			Ack:        tcp.Ack,
+			SYN:        tcp.SYN,
+			ACK:        tcp.ACK,
+			FIN:        tcp.FIN,
+			RST:        tcp.RST,
+			Window:     tcp.Window,
+			PayloadLen: len(tcp.Payload),
+		}
+	}
+
+	// Decode UDP layer if present
+	if udpLayer := pkt.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp := udpLayer.(*layers.UDP)
+		pckData.LocalPort = uint64(udp.SrcPort)
+		pckData.RemPort = uint64(udp.DstPort)
+		pckData.Protocol = IPPROTO_UDP
 	}
 
-	// TODO UDP or other layer
+	// TODO other layers
 	pckData.Size = len(pkt.Data())
 
 	return &pckData
@@ -87,6 +108,8 @@ func AssociatePacket(store MachineNetworkStorage, pidConns *[]PidSocket, pkt Pac
 			From:      int(pkt.Timestamp),
 			To:        int(pkt.Timestamp),
 			Packets:   packets,
+			Count:     1,
+			Protocol:  pkt.Protocol,
 		}
 	} else {
 		// update the connection
@@ -115,6 +138,27 @@ func AssociatePacket(store MachineNetworkStorage, pidConns *[]PidSocket, pkt Pac
 			tgt.From,
 			tgt.To,
 			tgt.Packets,
+			tgt.Count + 1,
+			tgt.Protocol,
+			tgt.TCPFlow,
+		}
+	}
+}
+
+// Drop stored packets older than a timestamp, once they are streamed to disk. Their
+// bytes are still counted in each connection's size
+func PrunePackets(store MachineNetworkStorage, before int64) {
+	for _, deviceConns := range store {
+		for id, connData := range deviceConns {
+			kept := []StoredPacketData{}
+			for _, pkt := range connData.Packets {
+				if pkt.Timestamp >= before {
+					kept = append(kept, pkt)
+				}
+			}
+
+			connData.Packets = kept
+			deviceConns[id] = connData
 		}
 	}
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	PARQUET_ROW_GROUP_SIZE = 64 * 1024 * 1024 // buffer roughly this many bytes of rows before writing a row group
+	PARQUET_PARALLELISM    = 4                // goroutines used to encode each row group
+)
+
+// A captured packet, attributed to the process-socket known when it was captured. Times are
+// microseconds since the epoch, which both DuckDB and Spark read as UTC timestamps
+type ParquetPacketRow struct {
+	Device    string  `parquet:"name=device, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Time      int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MICROS, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS"`
+	Direction string  `parquet:"name=direction, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	LocalAddr string  `parquet:"name=local_addr, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	LocalPort int32   `parquet:"name=local_port, type=INT32"`
+	RemAddr   string  `parquet:"name=rem_addr, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	RemPort   int32   `parquet:"name=rem_port, type=INT32"`
+	Size      int32   `parquet:"name=size, type=INT32"`
+	Protocol  *string `parquet:"name=protocol, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Pid       *int32  `parquet:"name=pid, type=INT32, repetitiontype=OPTIONAL"`
+	StartTime *int64  `parquet:"name=start_time, type=INT64, repetitiontype=OPTIONAL"`
+	Command   *string `parquet:"name=command, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Username  *string `parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+}
+
+// A process-socket's lifetime and traffic totals, by direction
+type ParquetConnectionRow struct {
+	Pid             int32   `parquet:"name=pid, type=INT32"`
+	StartTime       int64   `parquet:"name=start_time, type=INT64"`
+	Command         string  `parquet:"name=command, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	CommandLine     string  `parquet:"name=command_line, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Username        string  `parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Cgroup          string  `parquet:"name=cgroup, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Protocol        string  `parquet:"name=protocol, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	LocalAddr       string  `parquet:"name=local_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	LocalPort       int32   `parquet:"name=local_port, type=INT32"`
+	RemAddr         string  `parquet:"name=rem_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RemPort         int32   `parquet:"name=rem_port, type=INT32"`
+	Inode           int64   `parquet:"name=inode, type=INT64"`
+	State           *string `parquet:"name=state, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL"`
+	Opened          int64   `parquet:"name=opened, type=INT64, convertedtype=TIMESTAMP_MICROS, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS"`
+	Closed          *int64  `parquet:"name=closed, type=INT64, convertedtype=TIMESTAMP_MICROS, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS, repetitiontype=OPTIONAL"`
+	BytesOut        int64   `parquet:"name=bytes_out, type=INT64"`
+	BytesIn         int64   `parquet:"name=bytes_in, type=INT64"`
+	PacketsOut      int64   `parquet:"name=packets_out, type=INT64"`
+	PacketsIn       int64   `parquet:"name=packets_in, type=INT64"`
+	FirstPacket     *int64  `parquet:"name=first_packet, type=INT64, convertedtype=TIMESTAMP_MICROS, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS, repetitiontype=OPTIONAL"`
+	LastPacket      *int64  `parquet:"name=last_packet, type=INT64, convertedtype=TIMESTAMP_MICROS, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS, repetitiontype=OPTIONAL"`
+	Retransmissions int32   `parquet:"name=retransmissions, type=INT32"`
+	OutOfOrder      int32   `parquet:"name=out_of_order, type=INT32"`
+	DuplicateAcks   int32   `parquet:"name=duplicate_acks, type=INT32"`
+	ZeroWindows     int32   `parquet:"name=zero_windows, type=INT32"`
+	HandshakeRTT    *int64  `parquet:"name=handshake_rtt_ns, type=INT64, repetitiontype=OPTIONAL"`
+}
+
+// Convert a nanosecond timestamp to parquet microseconds; zero is unknown
+func parquetTime(nanos int64) *int64 {
+	if nanos == 0 {
+		return nil
+	}
+
+	micros := nanos / 1000
+	return &micros
+}
+
+// A Parquet file of rows, written a row group at a time
+type parquetFile struct {
+	Path   string
+	file   source.ParquetFile
+	writer *writer.ParquetWriter
+}
+
+func createParquetFile(fpath string, row interface{}) (*parquetFile, error) {
+	file, err := local.NewLocalFileWriter(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	pw, err := writer.NewParquetWriter(file, row, PARQUET_PARALLELISM)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	pw.RowGroupSize = PARQUET_ROW_GROUP_SIZE
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	return &parquetFile{fpath, file, pw}, nil
+}
+
+func (pf *parquetFile) Write(row interface{}) error {
+	return pf.writer.Write(row)
+}
+
+// Write the last row group and the footer
+func (pf *parquetFile) Close() error {
+	err := pf.writer.WriteStop()
+
+	if closeErr := pf.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Streams packets to packets.parquet as they are captured, from a background goroutine. Each
+// packet is attributed to a process-socket as it arrives, so the whole capture need not be held
+// in memory; packets seen before their socket is first listed are left unattributed
+type ParquetStream struct {
+	Dir     string
+	packets *parquetFile
+	rows    chan ParquetPacketRow
+	done    chan error
+	sockets map[string]*PidSocket // process-sockets, by 4-tuple
+}
+
+func OpenParquetStream(dir string) (*ParquetStream, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	packets, err := createParquetFile(filepath.Join(dir, "packets.parquet"), new(ParquetPacketRow))
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &ParquetStream{
+		Dir:     dir,
+		packets: packets,
+		rows:    make(chan ParquetPacketRow, PACKET_STREAM_BUFFER),
+		done:    make(chan error),
+		sockets: map[string]*PidSocket{},
+	}
+
+	go stream.run()
+	return stream, nil
+}
+
+func (stream *ParquetStream) run() {
+	var err error
+
+	for row := range stream.rows {
+		if err != nil {
+			continue
+		}
+
+		if err = stream.packets.Write(row); err != nil {
+			log.Printf("could not write packets to %s: %v", stream.packets.Path, err)
+		}
+	}
+
+	if closeErr := stream.packets.Close(); err == nil {
+		err = closeErr
+	}
+
+	stream.done <- err
+}
+
+// Attribute packets written from now on to these process-sockets; later sockets for a 4-tuple win
+func (stream *ParquetStream) Attribute(pidConns []PidSocket) {
+	sockets := map[string]*PidSocket{}
+
+	for idx := range pidConns {
+		sockets[pidConns[idx].GetId()] = &pidConns[idx]
+	}
+
+	stream.sockets = sockets
+}
+
+// Queue a packet to be written
+func (stream *ParquetStream) Write(pkt PacketData) {
+	id := pkt.GetId()
+
+	row := ParquetPacketRow{
+		Device:    pkt.Device,
+		Time:      pkt.Timestamp / 1000,
+		Direction: "out",
+		LocalAddr: pkt.LocalAddr.String(),
+		LocalPort: int32(pkt.LocalPort),
+		RemAddr:   pkt.RemAddr.String(),
+		RemPort:   int32(pkt.RemPort),
+		Size:      int32(pkt.Size),
+	}
+
+	pidConn, ok := stream.sockets[id]
+	if !ok {
+		reverseId := pkt.RemAddr.String() + fmt.Sprint(pkt.RemPort) + pkt.LocalAddr.String() + fmt.Sprint(pkt.LocalPort)
+		if pidConn, ok = stream.sockets[reverseId]; ok {
+			row.Direction = "in"
+		}
+	}
+
+	if ok {
+		protocol, pid, startTime := pidConn.Connection.GetType(), int32(pidConn.Pid), int64(pidConn.StartTime)
+		row.Protocol, row.Pid, row.StartTime = &protocol, &pid, &startTime
+		row.Command, row.Username = &pidConn.Command, &pidConn.UserName
+	}
+
+	stream.rows <- row
+}
+
+// Write every queued packet, and close packets.parquet
+func (stream *ParquetStream) Close() error {
+	close(stream.rows)
+	return <-stream.done
+}
+
+// Summarise each connection from stored traffic; stored packets are pruned during the capture,
+// so only their counts remain
+func BuildParquetConnections(conns *ConnectionTable, store MachineNetworkStorage) []ParquetConnectionRow {
+	traffic := sumConnectionTraffic(attributeFlows(conns, store))
+
+	rows := []ParquetConnectionRow{}
+
+	for _, tracked := range conns.Tracked() {
+		pidConn := tracked.ProcessSocket
+		conn := pidConn.Connection
+		total, ok := traffic[tracked]
+		if !ok {
+			total = &connectionTraffic{}
+		}
+
+		row := ParquetConnectionRow{
+			Pid:             int32(pidConn.Pid),
+			StartTime:       int64(pidConn.StartTime),
+			Command:         pidConn.Command,
+			CommandLine:     pidConn.CommandLine,
+			Username:        pidConn.UserName,
+			Cgroup:          pidConn.Cgroup,
+			Protocol:        conn.GetType(),
+			LocalAddr:       conn.GetLocalAddr().String(),
+			LocalPort:       int32(conn.GetLocalPort()),
+			RemAddr:         conn.GetRemAddr().String(),
+			RemPort:         int32(conn.GetRemPort()),
+			Inode:           int64(conn.GetInode()),
+			Opened:          tracked.Lifetime.Start.UnixNano() / 1000,
+			BytesOut:        int64(total.bytes[0]),
+			BytesIn:         int64(total.bytes[1]),
+			PacketsOut:      int64(total.packets[0]),
+			PacketsIn:       int64(total.packets[1]),
+			FirstPacket:     parquetTime(int64(total.first)),
+			LastPacket:      parquetTime(int64(total.last)),
+			Retransmissions: int32(total.tcpFlow.Retransmissions),
+			OutOfOrder:      int32(total.tcpFlow.OutOfOrder),
+			DuplicateAcks:   int32(total.tcpFlow.DuplicateAcks),
+			ZeroWindows:     int32(total.tcpFlow.ZeroWindows),
+		}
+
+		if tcp, ok := conn.(TCPConnection); ok {
+			state := tcp.GetStateName()
+			row.State = &state
+		}
+		if !tracked.IsOpen() {
+			row.Closed = parquetTime(tracked.Lifetime.End.UnixNano())
+		}
+		if total.tcpFlow.HandshakeRTT > 0 {
+			rtt := total.tcpFlow.HandshakeRTT
+			row.HandshakeRTT = &rtt
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// Finish packets.parquet, and write connections.parquet alongside it
+func ReportParquetNetwork(stream *ParquetStream, conns *ConnectionTable, store MachineNetworkStorage) error {
+	if err := stream.Close(); err != nil {
+		return err
+	}
+
+	connections, err := createParquetFile(filepath.Join(stream.Dir, "connections.parquet"), new(ParquetConnectionRow))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range BuildParquetConnections(conns, store) {
+		if err := connections.Write(row); err != nil {
+			connections.Close()
+			return err
+		}
+	}
+
+	return connections.Close()
+}
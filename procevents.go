@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// Constants from the kernel's include/uapi/linux/cn_proc.h and connector.h
+const (
+	CN_IDX_PROC          = 0x1
+	CN_VAL_PROC          = 0x1
+	PROC_CN_MCAST_LISTEN = 0x1
+	PROC_EVENT_EXEC      = 0x2
+	PROC_EVENT_EXIT      = 0x80000000
+)
+
+const (
+	NLMSG_HDR_LEN       = 16
+	CN_MSG_HDR_LEN      = 20
+	PROC_EVENT_HDR_LEN  = 16
+	YOUNG_PROCESS_POLL  = 20 * time.Millisecond
+	YOUNG_PROCESS_AGE   = 5 * time.Second // how long to keep polling a new process's file-descriptors
+	PROC_EVENT_BUF_SIZE = 4096
+	PROC_EVENT_WARN_GAP = time.Second // how often to warn that events were dropped
+)
+
+// An exec or exit event from the proc connector
+type ProcEvent struct {
+	What uint32
+	Pid  int // the thread-group id, i.e. the process-id userspace sees
+}
+
+// Process metadata, captured as soon as a process execs. Once its sockets are reported, the
+// connection-table keeps them (and this metadata) after the process exits
+type ProcessInfo struct {
+	Id          ProcessId
+	Command     string
+	CommandLine string
+	Parents     []ProcessId
+	Cgroup      string
+	Exec        time.Time
+	Exited      time.Time       // zero while the process is running
+	Inodes      map[uint64]bool // socket inodes already reported for this process
+}
+
+// Subscribe to process exec & exit events via the netlink proc connector (requires CAP_NET_ADMIN)
+func OpenProcConnector() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM, syscall.NETLINK_CONNECTOR)
+	if err != nil {
+		return -1, err
+	}
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: CN_IDX_PROC, Pid: uint32(os.Getpid())}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	// nlmsghdr, then cn_msg, then the listen operation
+	msg := make([]byte, NLMSG_HDR_LEN+CN_MSG_HDR_LEN+4)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)
+	binary.LittleEndian.PutUint32(msg[12:], uint32(os.Getpid()))
+	binary.LittleEndian.PutUint32(msg[16:], CN_IDX_PROC)
+	binary.LittleEndian.PutUint32(msg[20:], CN_VAL_PROC)
+	binary.LittleEndian.PutUint16(msg[32:], 4)
+	binary.LittleEndian.PutUint32(msg[36:], PROC_CN_MCAST_LISTEN)
+
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+// Parse the exec & exit events from a netlink datagram, ignoring other proc events
+func ParseProcEvents(buf []byte) []ProcEvent {
+	events := []ProcEvent{}
+
+	for len(buf) >= NLMSG_HDR_LEN {
+		msgLen := int(binary.LittleEndian.Uint32(buf[0:]))
+		if msgLen < NLMSG_HDR_LEN || msgLen > len(buf) {
+			break
+		}
+
+		body := buf[NLMSG_HDR_LEN:msgLen]
+		if len(body) >= CN_MSG_HDR_LEN+PROC_EVENT_HDR_LEN+8 {
+			event := body[CN_MSG_HDR_LEN:]
+			what := binary.LittleEndian.Uint32(event[0:])
+
+			// both exec and exit events begin with (pid, tgid)
+			if what == PROC_EVENT_EXEC || what == PROC_EVENT_EXIT {
+				tgid := binary.LittleEndian.Uint32(event[PROC_EVENT_HDR_LEN+4:])
+				pid := binary.LittleEndian.Uint32(event[PROC_EVENT_HDR_LEN:])
+
+				// ignore threads exiting; only whole processes
+				if what == PROC_EVENT_EXEC || pid == tgid {
+					events = append(events, ProcEvent{what, int(tgid)})
+				}
+			}
+		}
+
+		// messages are 4-byte aligned
+		buf = buf[(msgLen+3)&^3:]
+	}
+
+	return events
+}
+
+// Read proc events until the socket fails. The kernel drops events when exec/exit bursts overrun
+// the socket's buffer, reporting ENOBUFS; the socket is still usable, so reading carries on
+func ReadProcEvents(fd int, eventChan chan ProcEvent) {
+	buf := make([]byte, PROC_EVENT_BUF_SIZE)
+	var lastWarn time.Time
+
+	for {
+		count, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			if time.Since(lastWarn) >= PROC_EVENT_WARN_GAP {
+				log.Printf("proc connector: %v; some short-lived processes may be missed", err)
+				lastWarn = time.Now()
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("proc connector: %v", err)
+			close(eventChan)
+			return
+		}
+
+		for _, event := range ParseProcEvents(buf[:count]) {
+			eventChan <- event
+		}
+	}
+}
+
+// Given a pid, walk /proc/<pid>/stat to find its ancestors (nearest first)
+func ReadProcessParents(pfs *procfs.FS, pid int) []ProcessId {
+	parents := []ProcessId{}
+
+	currPid := pid
+	for len(parents) <= 20 {
+		proc, err := pfs.Proc(currPid)
+		if err != nil {
+			break
+		}
+
+		stat, err := proc.Stat()
+		if err != nil || stat.PPID <= 0 {
+			break
+		}
+
+		parent, err := pfs.Proc(stat.PPID)
+		if err != nil {
+			break
+		}
+
+		pstat, err := parent.Stat()
+		if err != nil {
+			break
+		}
+
+		parents = append(parents, ProcessId{stat.PPID, pstat.Starttime})
+		currPid = stat.PPID
+	}
+
+	return parents
+}
+
+// Capture a process's identity the moment it execs
+func ReadProcessInfo(pfs *procfs.FS, pid int, now time.Time) (*ProcessInfo, error) {
+	proc, err := pfs.Proc(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := proc.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProcessInfo{
+		Id:          ProcessId{pid, stat.Starttime},
+		Command:     PidToCommand(pfs, pid),
+		CommandLine: PidToCommandline(pfs, pid),
+		Parents:     ReadProcessParents(pfs, pid),
+		Cgroup:      PidToCgroup(pfs, pid),
+		Exec:        now,
+		Inodes:      map[uint64]bool{},
+	}, nil
+}
+
+// List socket inodes for a process that we have not yet reported
+func newSocketInodes(info *ProcessInfo) []uint64 {
+	inodes := []uint64{}
+	dir := "/proc/" + strconv.Itoa(info.Id.Pid) + "/fd/"
+
+	fds, err := os.ReadDir(dir)
+	if err != nil {
+		return inodes
+	}
+
+	for _, fd := range fds {
+		link, err := os.Readlink(dir + fd.Name())
+		if err != nil || len(link) < 8 || link[:8] != "socket:[" {
+			continue
+		}
+
+		fpath := dir + fd.Name()
+		inode := GetInode(&fpath)
+
+		if inode > 0 && !info.Inodes[inode] {
+			info.Inodes[inode] = true
+			inodes = append(inodes, inode)
+		}
+	}
+
+	return inodes
+}
+
+// Read every TCP & UDP connection, indexed by inode
+func ConnectionsByInode(pfs *procfs.FS) map[uint64]Connection {
+	byInode := map[uint64]Connection{}
+
+	for _, conn := range ReadTCPConnections(pfs) {
+		byInode[conn.GetInode()] = conn
+	}
+
+	for _, conn := range ReadUDPConnections(pfs) {
+		byInode[conn.GetInode()] = conn
+	}
+
+	return byInode
+}
+
+// Associate newly opened sockets of young processes with their connections
+func AssociateYoungProcesses(pfs *procfs.FS, young map[int]*ProcessInfo, uidToUsername map[uint64]string) []PidSocket {
+	pidSockets := []PidSocket{}
+	var byInode map[uint64]Connection
+
+	for _, info := range young {
+		// the pid may have been reused since the process exited
+		if !info.Exited.IsZero() {
+			continue
+		}
+
+		for _, inode := range newSocketInodes(info) {
+			// only read the connection tables when there is something to look up
+			if byInode == nil {
+				byInode = ConnectionsByInode(pfs)
+			}
+
+			// not connected yet; look again on the next poll
+			conn, ok := byInode[inode]
+			if !ok || (conn.GetType() == "TCP" && conn.GetRemPort() == 0) {
+				delete(info.Inodes, inode)
+				continue
+			}
+
+			if _, ok := uidToUsername[conn.GetUID()]; !ok {
+				userName, _ := LookupUsername(conn.GetUID())
+				if len(userName) == 0 {
+					userName = "?"
+				}
+				uidToUsername[conn.GetUID()] = userName
+			}
+
+			pidSockets = append(pidSockets, PidSocket{
+				uidToUsername[conn.GetUID()],
+				info.Command,
+				info.CommandLine,
+				info.Id.Pid,
+				info.Id.StartTime,
+				info.Parents,
+				info.Cgroup,
+				conn,
+				time.Now(),
+			})
+		}
+	}
+
+	return pidSockets
+}
+
+// Watch process exec and exit events, so short-lived processes that open a socket between
+// two /proc polls are still attributed. New processes have their file-descriptors polled
+// rapidly for their first few seconds, or until they exit, when they are read a final time
+func ProcEventWatcher(pfs *procfs.FS, sockChan chan *[]PidSocket) error {
+	fd, err := OpenProcConnector()
+	if err != nil {
+		return fmt.Errorf("could not subscribe to process events: %v", err)
+	}
+
+	eventChan := make(chan ProcEvent, 256)
+	go ReadProcEvents(fd, eventChan)
+
+	young := map[int]*ProcessInfo{}
+	uidToUsername := map[uint64]string{}
+	ticker := time.NewTicker(YOUNG_PROCESS_POLL)
+
+	for {
+		select {
+		case event, ok := <-eventChan:
+			if !ok {
+				ticker.Stop()
+				return fmt.Errorf("process event source closed")
+			}
+
+			now := time.Now()
+
+			switch event.What {
+			case PROC_EVENT_EXEC:
+				if info, err := ReadProcessInfo(pfs, event.Pid, now); err == nil {
+					young[event.Pid] = info
+				}
+			case PROC_EVENT_EXIT:
+				info, ok := young[event.Pid]
+				if !ok || !info.Exited.IsZero() {
+					break
+				}
+
+				// exit events arrive before the process is reaped, so sockets opened since the
+				// last poll can still be read
+				if pidSockets := AssociateYoungProcesses(pfs, map[int]*ProcessInfo{event.Pid: info}, uidToUsername); len(pidSockets) > 0 {
+					sockChan <- &pidSockets
+				}
+
+				// the pid may now be reused, so stop polling it, but keep its metadata until
+				// it would have aged out
+				info.Exited = now
+			}
+
+		case now := <-ticker.C:
+			if pidSockets := AssociateYoungProcesses(pfs, young, uidToUsername); len(pidSockets) > 0 {
+				sockChan <- &pidSockets
+			}
+
+			for pid, info := range young {
+				if now.Sub(info.Exec) > YOUNG_PROCESS_AGE {
+					delete(young, pid)
+				}
+			}
+		}
+	}
+}
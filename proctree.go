@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+// A process in the process-tree. Traffic from descendants is rolled up into TotalBytes
+type ProcessNode struct {
+	Pid         int            `json:"pid"`
+	StartTime   uint64         `json:"start_time"`
+	Command     string         `json:"command"`
+	Bytes       int            `json:"bytes"`       // traffic from this process's own sockets
+	TotalBytes  int            `json:"total_bytes"` // traffic from this process and all its descendants
+	Connections int            `json:"connections"`
+	Children    []*ProcessNode `json:"children,omitempty"`
+	parent      *ProcessNode
+}
+
+func (node *ProcessNode) GetProcessId() ProcessId {
+	return ProcessId{node.Pid, node.StartTime}
+}
+
+// A forest of processes, rooted at the oldest known ancestors
+type ProcessTree struct {
+	nodes map[ProcessId]*ProcessNode
+	Roots []*ProcessNode
+}
+
+func NewProcessTree() *ProcessTree {
+	return &ProcessTree{map[ProcessId]*ProcessNode{}, []*ProcessNode{}}
+}
+
+func (tree *ProcessTree) node(id ProcessId) *ProcessNode {
+	node, ok := tree.nodes[id]
+	if !ok {
+		node = &ProcessNode{Pid: id.Pid, StartTime: id.StartTime}
+		tree.nodes[id] = node
+	}
+
+	return node
+}
+
+// Add traffic for a process, given its ancestors (nearest first, as returned by PidParents)
+func (tree *ProcessTree) Add(id ProcessId, command string, bytes int, connections int, parents []ProcessId) {
+	node := tree.node(id)
+	node.Bytes += bytes
+	node.Connections += connections
+
+	if len(command) > 0 {
+		node.Command = command
+	}
+
+	// link each process to its parent, unless already linked
+	child := node
+	for _, ppid := range parents {
+		if child.parent != nil {
+			break
+		}
+
+		parent := tree.node(ppid)
+		child.parent = parent
+		parent.Children = append(parent.Children, child)
+		child = parent
+	}
+}
+
+// Roll up traffic into ancestors, find the roots, and order children by traffic
+func (tree *ProcessTree) Finish() {
+	tree.Roots = []*ProcessNode{}
+
+	for _, node := range tree.nodes {
+		if node.parent == nil {
+			tree.Roots = append(tree.Roots, node)
+		}
+	}
+
+	var rollup func(node *ProcessNode) int
+	rollup = func(node *ProcessNode) int {
+		node.TotalBytes = node.Bytes
+		for _, child := range node.Children {
+			node.TotalBytes += rollup(child)
+		}
+
+		sortProcessNodes(node.Children)
+		return node.TotalBytes
+	}
+
+	for _, root := range tree.Roots {
+		rollup(root)
+	}
+
+	sortProcessNodes(tree.Roots)
+}
+
+func sortProcessNodes(nodes []*ProcessNode) {
+	sort.SliceStable(nodes, func(idx, jdx int) bool {
+		if nodes[idx].TotalBytes != nodes[jdx].TotalBytes {
+			return nodes[idx].TotalBytes > nodes[jdx].TotalBytes
+		}
+
+		return nodes[idx].Pid < nodes[jdx].Pid
+	})
+}
+
+// Name ancestors that own no sockets themselves, checking the start-time so a reused pid
+// is not mistaken for the original process
+func (tree *ProcessTree) NameAncestors(pfs *procfs.FS) {
+	for id, node := range tree.nodes {
+		if len(node.Command) > 0 {
+			continue
+		}
+
+		node.Command = "?"
+		proc, err := pfs.Proc(id.Pid)
+		if err != nil {
+			continue
+		}
+
+		if stat, err := proc.Stat(); err == nil && stat.Starttime == id.StartTime {
+			node.Command = stat.Comm
+		}
+	}
+}
+
+// Copy the tree, collapsing nodes deeper than maxDepth (unlimited when zero or less) and any
+// pid in collapsed. Collapsed nodes keep their rolled-up totals but lose their children
+func (tree *ProcessTree) Collapse(maxDepth int, collapsed map[int]bool) []*ProcessNode {
+	var prune func(node *ProcessNode, depth int) *ProcessNode
+	prune = func(node *ProcessNode, depth int) *ProcessNode {
+		copied := *node
+		copied.Children = nil
+
+		if (maxDepth > 0 && depth >= maxDepth) || collapsed[node.Pid] {
+			return &copied
+		}
+
+		for _, child := range node.Children {
+			copied.Children = append(copied.Children, prune(child, depth+1))
+		}
+
+		return &copied
+	}
+
+	roots := make([]*ProcessNode, len(tree.Roots))
+	for idx, root := range tree.Roots {
+		roots[idx] = prune(root, 1)
+	}
+
+	return roots
+}
+
+// Write a collapsible text rendering of the tree
+func RenderProcessTree(writer io.Writer, tree *ProcessTree, maxDepth int, collapsed map[int]bool) {
+	fmt.Fprintf(writer, "%-12s %-12s %-6s %s\n", "TOTAL", "OWN", "CONNS", "PROCESS")
+
+	var render func(node *ProcessNode, orig *ProcessNode, depth int)
+	render = func(node *ProcessNode, orig *ProcessNode, depth int) {
+		marker := "   "
+		if len(orig.Children) > 0 && len(node.Children) == 0 {
+			marker = "[+]"
+		} else if len(node.Children) > 0 {
+			marker = "[-]"
+		}
+
+		fmt.Fprintf(writer, "%-12s %-12s %-6d %s%s %d %s\n",
+			FormatBytes(node.TotalBytes), FormatBytes(node.Bytes), node.Connections,
+			strings.Repeat("  ", depth), marker, node.Pid, node.Command)
+
+		for idx, child := range node.Children {
+			render(child, orig.Children[idx], depth+1)
+		}
+	}
+
+	for idx, root := range tree.Collapse(maxDepth, collapsed) {
+		render(root, tree.Roots[idx], 0)
+	}
+}
+
+// Build a process-tree from live data. When rollup is false every process is
+// a root, giving a flat per-process view
+func BuildProcessTree(pidConns *[]PidSocket, store MachineNetworkStorage, pfs *procfs.FS, rollup bool) *ProcessTree {
+	tree := NewProcessTree()
+	seen := map[string]bool{}
+
+	for _, pidConn := range *pidConns {
+		id := pidConn.GetProcessId()
+		key := id.String() + "/" + pidConn.GetId()
+
+		// several tracked lifetimes may share a 4-tuple; count its traffic once
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		// traffic sent, and received under the reverse id
+		bytes := 0
+		for _, conns := range store {
+			for _, connId := range []string{pidConn.GetId(), pidConn.GetReverseId()} {
+				if connData, ok := conns[connId]; ok {
+					bytes += connData.Size
+				}
+			}
+		}
+
+		parents := []ProcessId{}
+		if rollup {
+			parents = pidConn.PidParents
+		}
+
+		tree.Add(id, pidConn.Command, bytes, 1, parents)
+	}
+
+	if pfs != nil {
+		tree.NameAncestors(pfs)
+	}
+
+	tree.Finish()
+	return tree
+}
+
+// Format a byte-count for display
+func FormatBytes(bytes int) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(bytes)
+
+	idx := 0
+	for size >= 1024 && idx < len(units)-1 {
+		size /= 1024
+		idx++
+	}
+
+	if idx == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[idx])
+	}
+
+	return fmt.Sprintf("%.1f%s", size, units[idx])
+}
@@ -5,261 +5,585 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func ReportJSONNetwork(pidConns *[]PidSocket, store MachineNetworkStorage) error {
-	for device, deviceConns := range store {
-		for connId, connData := range deviceConns {
-			for _, pidData := range *pidConns {
-				if pidData.GetId() == connId {
-					// add connection
-					data := OutputRow{
-						Device:        device,
-						ProcessSocket: pidData,
-						Packets:       connData.Packets,
-						TotalBytes:    connData.Size,
-						From:          connData.From,
-						To:            connData.To,
-					}
-
-					bytes, err := json.MarshalIndent(data, "", "  ")
-					if err != nil {
-						return err
-					}
-
-					fmt.Println(string(bytes))
-				}
-			}
+func ReportJSONNetwork(conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore) error {
+	pidConns := conns.PidSockets()
+	active := conns.Active()
+
+	// include closed connections, so their packets are still attributed to a process
+	for _, flow := range attributeFlows(conns, store) {
+		if flow.tracked == nil {
+			continue
+		}
+
+		pidData := flow.tracked.ProcessSocket
+
+		var tcpFlow *TCPFlowStats
+		if pidData.Connection.GetType() == "TCP" {
+			stats := flow.data.TCPFlow
+			tcpFlow = &stats
+		}
+
+		data := OutputRow{
+			Type:          JSON_CONNECTION,
+			Device:        flow.device,
+			Direction:     flow.direction,
+			ProcessSocket: pidData,
+			Packets:       flow.data.Packets,
+			TotalBytes:    flow.data.Size,
+			From:          flow.data.From,
+			To:            flow.data.To,
+			TCPState:      tcpStates[GetTCPStateKey(pidData.Connection)],
+			TCPFlow:       tcpFlow,
+			Lifetime:      flow.tracked.Lifetime,
+		}
+
+		bytes, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+	}
+
+	// summarise how many connections each process has in each TCP state
+	for _, counts := range CountProcessTCPStates(&active) {
+		bytes, err := json.MarshalIndent(counts, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+	}
+
+	// summarise retransmissions, ordering and latency for each process
+	for _, flows := range CountProcessTCPFlows(&pidConns, store) {
+		bytes, err := json.MarshalIndent(flows, "", "  ")
+		if err != nil {
+			return err
 		}
+
+		fmt.Println(string(bytes))
 	}
 
 	return nil
 }
 
-const CREATE_TCP_CONN_TABLE = `create table if not exists tcp_conn (
-	sl        integer,
-	localAddr text,
-	localPort integer,
-	remAddr   text,
-	remPort   integer,
-	st        integer,
-	txQueue   integer,
-	rxQueue   integer,
-	uid       integer,
-	inode     integer
-)`
-
-const CREATE_UDP_CONN_TABLE = `create table if not exists udp_conn (
-	sl        integer,
-	localAddr text,
-	remAddr   text,
-	st        integer,
-	txQueue   integer,
-	rxQueue   integer,
-	uid       integer,
-	inode     integer
-)`
-
-const CREATE_PROCCESS_CONN_TABLE = `create table if not exists process_conn (
-  username       text,
-	command        text,
-	commandLine    text,
-	pid            int,
-	inode          int,
-	time           int
-)`
-
-const CREATE_PID_PARENTS_TABLE = `create table if not exists parent_pid (
-  pid    int,
-	ppid   int,
-	level  int
-)`
-
-const CREATE_CONN_SUMMARY_TABLE = `create table if not exists conn_summary (
-	device  text,
-	localAddr text,
-	localPort integer,
-	remAddr   text,
-	remPort   integer,
-  size    int,
-	start   int,
-	end     int
-)`
-
-const CREATE_PACKET_TABLE = `create table if not exists packet (
-	device  text,
-	localAddr text,
-	localPort integer,
-	remAddr   text,
-	remPort   integer,
-	size      integer,
-  time      integer
-)`
-
-const CREATE_USER_TABLE = `create table if not exists users (
-	uid      integer
-	username text
-)
-`
+// Report the process-tree, with traffic rolled up to ancestors, as JSON
+func ReportJSONProcessTree(tree *ProcessTree, maxDepth int) error {
+	for _, root := range tree.Collapse(maxDepth, map[int]bool{}) {
+		bytes, err := json.MarshalIndent(root, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+	}
+
+	return nil
+}
+
+// Identifies a capture session; every flush from one run of puffin shares a session
+type CaptureSession struct {
+	Start    time.Time
+	Hostname string
+}
+
+func NewCaptureSession(start time.Time) CaptureSession {
+	hostname, _ := os.Hostname()
+	return CaptureSession{start, hostname}
+}
+
+// Either a database or a transaction
+type SQLExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Writes a capture into the normalised tables, remembering the ids of rows already
+// written so each session, process, connection and device is only inserted once
+type captureWriter struct {
+	db          SQLExecutor
+	session     int64
+	statements  map[string]*sql.Stmt
+	processes   map[ProcessId]int64
+	connections map[string]int64 // by process-socket key
+	flows       map[string]int64 // by 4-tuple, for attributing traffic
+	devices     map[string]int64
+}
+
+func (writer *captureWriter) statement(query string) (*sql.Stmt, error) {
+	if stmt, ok := writer.statements[query]; ok {
+		return stmt, nil
+	}
 
-func ReportDBNetwork(pidConns *[]PidSocket, store MachineNetworkStorage) error {
-	os.Create("./puffin.db")
-	db, err := sql.Open("sqlite3", "./puffin.db")
+	stmt, err := writer.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.statements[query] = stmt
+	return stmt, nil
+}
 
+func (writer *captureWriter) exec(query string, args ...interface{}) error {
+	stmt, err := writer.statement(query)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		db.Close()
-	}()
+	_, err = stmt.Exec(args...)
+	return err
+}
+
+// Insert a row unless it already exists, then look up its id
+func (writer *captureWriter) upsert(insert string, insertArgs []interface{}, lookup string, lookupArgs ...interface{}) (int64, error) {
+	if err := writer.exec(insert, insertArgs...); err != nil {
+		return 0, err
+	}
+
+	stmt, err := writer.statement(lookup)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = stmt.QueryRow(lookupArgs...).Scan(&id)
+	return id, err
+}
+
+func (writer *captureWriter) close() {
+	for _, stmt := range writer.statements {
+		stmt.Close()
+	}
+}
+
+func newCaptureWriter(db SQLExecutor, session CaptureSession, now time.Time) (*captureWriter, error) {
+	writer := &captureWriter{
+		db:          db,
+		statements:  map[string]*sql.Stmt{},
+		processes:   map[ProcessId]int64{},
+		connections: map[string]int64{},
+		flows:       map[string]int64{},
+		devices:     map[string]int64{},
+	}
+
+	id, err := writer.upsert(
+		"INSERT OR IGNORE INTO session (start, hostname) values (?, ?)", []interface{}{session.Start.UnixNano(), session.Hostname},
+		"SELECT id FROM session WHERE start = ? AND hostname = ?", session.Start.UnixNano(), session.Hostname)
+	if err != nil {
+		writer.close()
+		return nil, err
+	}
+
+	writer.session = id
+	if err := writer.exec("UPDATE session SET end = ? WHERE id = ?", now.UnixNano(), id); err != nil {
+		writer.close()
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// Get the id of a process, inserting it if needed. Ancestors are inserted without details
+func (writer *captureWriter) process(id ProcessId, pidConn *PidSocket) (int64, error) {
+	if rowId, ok := writer.processes[id]; ok {
+		return rowId, nil
+	}
 
-	tables := []string{
-		CREATE_TCP_CONN_TABLE,
-		CREATE_UDP_CONN_TABLE,
-		CREATE_PROCCESS_CONN_TABLE,
-		CREATE_PID_PARENTS_TABLE,
-		CREATE_CONN_SUMMARY_TABLE,
-		CREATE_PACKET_TABLE,
-		CREATE_USER_TABLE,
+	rowId, err := writer.upsert(
+		"INSERT OR IGNORE INTO process (session_id, pid, startTime) values (?, ?, ?)", []interface{}{writer.session, id.Pid, id.StartTime},
+		"SELECT id FROM process WHERE session_id = ? AND pid = ? AND startTime = ?", writer.session, id.Pid, id.StartTime)
+	if err != nil {
+		return 0, err
 	}
 
-	for _, table := range tables {
-		_, err = db.Exec(table)
+	if pidConn != nil {
+		err = writer.exec("UPDATE process SET command = ?, commandLine = ?, cgroup = ? WHERE id = ?", pidConn.Command, pidConn.CommandLine, pidConn.Cgroup, rowId)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	insert_parent_pid, err := db.Prepare("INSERT INTO parent_pid (pid, ppid, level) values (?, ?, ?)")
+	writer.processes[id] = rowId
+	return rowId, nil
+}
+
+// Get the id of a connection, inserting it if needed, and updating its socket information
+func (writer *captureWriter) connection(conn Connection) (int64, error) {
+	key := conn.GetType() + "/" + conn.GetId() + "/" + fmt.Sprint(conn.GetInode())
+	if rowId, ok := writer.connections[key]; ok {
+		return rowId, nil
+	}
+
+	localAddr, remAddr := conn.GetLocalAddr().String(), conn.GetRemAddr().String()
 
+	rowId, err := writer.upsert(
+		"INSERT OR IGNORE INTO connection (session_id, protocol, localAddr, localPort, remAddr, remPort, inode, uid) values (?, ?, ?, ?, ?, ?, ?, ?)",
+		[]interface{}{writer.session, conn.GetType(), localAddr, conn.GetLocalPort(), remAddr, conn.GetRemPort(), conn.GetInode(), conn.GetUID()},
+		"SELECT id FROM connection WHERE session_id = ? AND protocol = ? AND localAddr = ? AND localPort = ? AND remAddr = ? AND remPort = ? AND inode = ?",
+		writer.session, conn.GetType(), localAddr, conn.GetLocalPort(), remAddr, conn.GetRemPort(), conn.GetInode())
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	insert_process_conn, err := db.Prepare("INSERT INTO process_conn (username, command, commandLine, pid, inode, time) values (?, ?, ?, ?, ?, ?)")
+	switch conn := conn.(type) {
+	case TCPConnection:
+		err = writer.exec("UPDATE connection SET sl = ?, st = ?, state = ?, txQueue = ?, rxQueue = ? WHERE id = ?",
+			conn.GetSL(), conn.GetST(), conn.GetStateName(), conn.GetTxQueue(), conn.GetRxQueue(), rowId)
+	case UDPConnection:
+		err = writer.exec("UPDATE connection SET sl = ?, st = ?, txQueue = ?, rxQueue = ? WHERE id = ?",
+			conn.GetSL(), conn.GetST(), conn.GetTxQueue(), conn.GetRxQueue(), rowId)
+	}
 
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	writer.connections[key] = rowId
+	writer.flows[conn.GetId()] = rowId
+	return rowId, nil
+}
+
+// Get the connection traffic with a given 4-tuple belongs to, and its direction. Traffic no
+// socket was found for is given a connection of its own
+func (writer *captureWriter) flow(connData *StoredConnectionData) (int64, string, error) {
+	id := connData.LocalAddr.String() + fmt.Sprint(connData.LocalPort) + connData.RemAddr.String() + fmt.Sprint(connData.RemPort)
+	reverseId := connData.RemAddr.String() + fmt.Sprint(connData.RemPort) + connData.LocalAddr.String() + fmt.Sprint(connData.LocalPort)
+
+	if rowId, ok := writer.flows[id]; ok {
+		return rowId, "out", nil
+	}
+
+	if rowId, ok := writer.flows[reverseId]; ok {
+		return rowId, "in", nil
+	}
+
+	localAddr, remAddr := connData.LocalAddr.String(), connData.RemAddr.String()
+
+	// the connection may have been written by an earlier flush
+	for _, lookup := range []struct {
+		args      []interface{}
+		id        string
+		direction string
+	}{
+		{[]interface{}{writer.session, localAddr, connData.LocalPort, remAddr, connData.RemPort}, id, "out"},
+		{[]interface{}{writer.session, remAddr, connData.RemPort, localAddr, connData.LocalPort}, reverseId, "in"},
+	} {
+		stmt, err := writer.statement("SELECT max(id) FROM connection WHERE session_id = ? AND localAddr = ? AND localPort = ? AND remAddr = ? AND remPort = ?")
+		if err != nil {
+			return 0, "", err
+		}
+
+		var rowId sql.NullInt64
+		if err := stmt.QueryRow(lookup.args...).Scan(&rowId); err != nil {
+			return 0, "", err
+		}
+
+		if rowId.Valid {
+			writer.flows[lookup.id] = rowId.Int64
+			return rowId.Int64, lookup.direction, nil
+		}
+	}
+
+	rowId, err := writer.upsert(
+		"INSERT OR IGNORE INTO connection (session_id, protocol, localAddr, localPort, remAddr, remPort, inode) values (?, '', ?, ?, ?, ?, 0)",
+		[]interface{}{writer.session, localAddr, connData.LocalPort, remAddr, connData.RemPort},
+		"SELECT id FROM connection WHERE session_id = ? AND protocol = '' AND localAddr = ? AND localPort = ? AND remAddr = ? AND remPort = ? AND inode = 0",
+		writer.session, localAddr, connData.LocalPort, remAddr, connData.RemPort)
+	if err != nil {
+		return 0, "", err
 	}
 
-	insert_tcp_conn, err := db.Prepare("INSERT INTO tcp_conn (sl, localAddr, localPort, remAddr, remPort, st, txQueue, rxQueue, uid, inode) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	writer.flows[id] = rowId
+	return rowId, "out", nil
+}
+
+func (writer *captureWriter) device(name string) (int64, error) {
+	if rowId, ok := writer.devices[name]; ok {
+		return rowId, nil
+	}
+
+	rowId, err := writer.upsert(
+		"INSERT OR IGNORE INTO device (session_id, name) values (?, ?)", []interface{}{writer.session, name},
+		"SELECT id FROM device WHERE session_id = ? AND name = ?", writer.session, name)
+	if err != nil {
+		return 0, err
+	}
+
+	writer.devices[name] = rowId
+	return rowId, nil
+}
 
+// Write a capture to a database, in a single transaction, migrating its schema as needed.
+// Rows are appended, so a database can hold several flushes
+func FlushDBNetwork(fpath string, session CaptureSession, conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore) error {
+	db, err := sql.Open("sqlite3", fpath+SQLITE_OPTIONS)
 	if err != nil {
 		return err
 	}
 
-	insert_udp_conn, err := db.Prepare("INSERT INTO udp_conn (sl, localAddr, remAddr, st, txQueue, rxQueue, uid, inode) values (?, ?, ?, ?, ?, ?, ?, ?)")
+	defer db.Close()
+
+	if err := MigrateCaptureDB(db); err != nil {
+		return err
+	}
 
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 
+	if err := WriteDBNetwork(tx, session, conns, store, tcpStates); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Write the final capture, once every streamed packet is committed
+func ReportDBNetwork(session CaptureSession, stream *PacketStream, conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore) error {
+	if err := stream.Sync(); err != nil {
+		return err
+	}
+
+	return FlushDBNetwork(stream.Path, session, conns, store, tcpStates)
+}
+
+// Write processes, connections, traffic and TCP analysis to the capture tables
+func WriteDBNetwork(db SQLExecutor, session CaptureSession, conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore) error {
+	now := time.Now()
+
+	writer, err := newCaptureWriter(db, session, now)
 	if err != nil {
 		return err
 	}
 
-	for _, pidConn := range *pidConns {
-		// insert parent-pids
+	defer writer.close()
+
+	for _, tracked := range conns.Tracked() {
+		pidConn := tracked.ProcessSocket
+
+		processId, err := writer.process(pidConn.GetProcessId(), &pidConn)
+		if err != nil {
+			return err
+		}
+
+		// insert ancestors, nearest first
 		for idx, ppid := range pidConn.PidParents {
-			_, err = insert_parent_pid.Exec(pidConn.Pid, ppid, len(pidConn.PidParents)-idx)
+			parentId, err := writer.process(ppid, nil)
 			if err != nil {
 				return err
 			}
+
+			err = writer.exec("INSERT OR IGNORE INTO process_parent (process_id, parent_id, level) values (?, ?, ?)", processId, parentId, len(pidConn.PidParents)-idx)
+			if err != nil {
+				return err
+			}
+		}
+
+		conn := pidConn.Connection
+		connId, err := writer.connection(conn)
+		if err != nil {
+			return err
 		}
 
-		// insert process connections
-		_, err = insert_process_conn.Exec(pidConn.UserName, pidConn.Command, pidConn.CommandLine, pidConn.Pid, pidConn.Connection.GetInode(), pidConn.Time.UnixNano())
+		err = writer.exec("INSERT OR IGNORE INTO users (session_id, uid, username) values (?, ?, ?)", writer.session, conn.GetUID(), pidConn.UserName)
 		if err != nil {
 			return err
 		}
 
-		// TODO if tcp, use switch to handle insert
+		// open connections have no end-time
+		var closed interface{}
+		if !tracked.IsOpen() {
+			closed = tracked.Lifetime.End.UnixNano()
+		}
 
-		// insert tcp connection data
-		conn := pidConn.Connection
+		err = writer.exec("INSERT OR IGNORE INTO process_connection (process_id, connection_id, opened) values (?, ?, ?)", processId, connId, tracked.Lifetime.Start.UnixNano())
+		if err != nil {
+			return err
+		}
 
-		switch conn.GetType() {
-		case "TCP":
-			conn := conn.(TCPConnection)
-
-			// insert into TCP table
-			_, err = insert_tcp_conn.Exec(
-				conn.GetSL(),
-				conn.GetLocalAddr().String(),
-				conn.GetLocalPort(),
-				conn.GetRemAddr().String(),
-				conn.GetRemPort(),
-				conn.GetST(),
-				conn.GetTxQueue(),
-				conn.GetRxQueue(),
-				conn.GetUID(),
-				conn.GetInode())
+		err = writer.exec("UPDATE process_connection SET time = ?, closed = ? WHERE process_id = ? AND connection_id = ?", pidConn.Time.UnixNano(), closed, processId, connId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeDBConnectionEvents(writer, conns); err != nil {
+		return err
+	}
+
+	active := conns.Active()
+	if err := writeDBTCPStates(writer, &active, tcpStates, now); err != nil {
+		return err
+	}
+
+	if err := writeDBTraffic(writer, store); err != nil {
+		return err
+	}
+
+	pidConns := conns.PidSockets()
 
+	for _, flows := range CountProcessTCPFlows(&pidConns, store) {
+		processId, err := writer.process(ProcessId{flows.Pid, flows.StartTime}, nil)
+		if err != nil {
+			return err
+		}
+
+		err = writer.exec("INSERT INTO process_tcp_flow (process_id, time, connections, retransmissions, outOfOrder, duplicateAcks, zeroWindows, meanHandshakeRtt, maxHandshakeRtt) values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			processId, now.UnixNano(), flows.Connections, flows.Retransmissions, flows.OutOfOrder, flows.DuplicateAcks, flows.ZeroWindows, flows.MeanHandshakeRTT, flows.MaxHandshakeRTT)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write connection open and close events to the database
+func writeDBConnectionEvents(writer *captureWriter, conns *ConnectionTable) error {
+	for _, event := range conns.Events {
+		pidConn := event.ProcessSocket
+
+		processId, err := writer.process(pidConn.GetProcessId(), &pidConn)
+		if err != nil {
+			return err
+		}
+
+		connId, err := writer.connection(pidConn.Connection)
+		if err != nil {
+			return err
+		}
+
+		err = writer.exec("INSERT INTO conn_event (process_id, connection_id, type, time) values (?, ?, ?, ?)", processId, connId, event.Type, event.Time.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write TCP state-transitions, queue-stalls and per-process state counts to the database
+func writeDBTCPStates(writer *captureWriter, pidConns *[]PidSocket, tcpStates TCPStateStore, now time.Time) error {
+	for _, hist := range tcpStates {
+		connId, err := writer.connection(hist.Connection)
+		if err != nil {
+			return err
+		}
+
+		for _, trans := range hist.Transitions {
+			err = writer.exec("INSERT INTO tcp_state_transition (connection_id, fromState, toState, time) values (?, ?, ?, ?)", connId, trans.From, trans.To, trans.Time.UnixNano())
 			if err != nil {
 				return err
 			}
-		case "UDP":
-			conn := conn.(UDPConnection)
-
-			// insert into TCP table
-			_, err = insert_udp_conn.Exec(
-				conn.GetSL(),
-				conn.GetLocalAddr().String(),
-				conn.GetRemAddr().String(),
-				conn.GetST(),
-				conn.GetTxQueue(),
-				conn.GetRxQueue(),
-				conn.GetUID(),
-				conn.GetInode())
+		}
+
+		for _, stalls := range [][]TCPQueueStall{hist.TxStalls, hist.RxStalls} {
+			for _, stall := range stalls {
+				err = writer.exec("INSERT INTO tcp_queue_stall (connection_id, queue, start, end, maxBytes, flagged) values (?, ?, ?, ?, ?, ?)",
+					connId, stall.Queue, stall.Since.UnixNano(), stall.Until.UnixNano(), stall.MaxBytes, stall.Stalled())
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
 
+	for _, counts := range CountProcessTCPStates(pidConns) {
+		processId, err := writer.process(ProcessId{counts.Pid, counts.StartTime}, nil)
+		if err != nil {
+			return err
+		}
+
+		for state, count := range counts.States {
+			err = writer.exec("INSERT INTO process_tcp_state (process_id, time, state, count) values (?, ?, ?, ?)", processId, now.UnixNano(), state, count)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	insert_conn_summary, err := db.Prepare("INSERT INTO conn_summary (device, localAddr, localPort, remAddr, remPort, size, start, end) values (?, ?, ?, ?, ?, ?, ?, ?)")
+	return nil
+}
 
+// Write per-connection traffic summaries and packets to the database. Packets streamed
+// during capture are attributed to the same connections as their traffic summary
+func writeDBTraffic(writer *captureWriter, store MachineNetworkStorage) error {
+	_, err := writer.db.Exec(`create temporary table if not exists stream_flow (
+		device        text,
+		flowId        text,
+		connection_id integer,
+		direction     text,
+		primary key (device, flowId)
+	)`)
 	if err != nil {
 		return err
 	}
 
-	insert_packet, err := db.Prepare("INSERT INTO packet (device, localAddr, localPort, remAddr, remPort, size, time) values (?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
+	if _, err := writer.db.Exec("delete from stream_flow"); err != nil {
 		return err
 	}
 
-	// add packet information to database
-	for device, conns := range store {
-		for _, connData := range conns {
-			_, err := insert_conn_summary.Exec(device, connData.LocalAddr.String(), connData.LocalPort, connData.RemAddr.String(), connData.RemPort, connData.Size, connData.From, connData.To)
+	flows := [][]interface{}{}
+
+	for device, deviceConns := range store {
+		deviceId, err := writer.device(device)
+		if err != nil {
+			return err
+		}
 
+		for flowId, connData := range deviceConns {
+			connId, direction, err := writer.flow(&connData)
 			if err != nil {
 				return err
 			}
 
-			for _, pkt := range connData.Packets {
-				_, err := insert_packet.Exec(device, connData.LocalAddr.String(), connData.LocalPort, connData.RemAddr.String(), connData.RemPort, pkt.Size, pkt.Timestamp)
-
-				if err != nil {
-					return err
-				}
+			err = writer.exec("INSERT INTO conn_summary (connection_id, device_id, direction, size, start, end, retransmissions, outOfOrder, duplicateAcks, zeroWindows, handshakeRtt) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				connId, deviceId, direction, connData.Size, connData.From, connData.To,
+				connData.TCPFlow.Retransmissions, connData.TCPFlow.OutOfOrder, connData.TCPFlow.DuplicateAcks, connData.TCPFlow.ZeroWindows, connData.TCPFlow.HandshakeRTT)
+			if err != nil {
+				return err
 			}
+
+			flows = append(flows, []interface{}{device, flowId, connId, direction})
 		}
+	}
 
+	if err := InsertRows(writer.db, "stream_flow", []string{"device", "flowId", "connection_id", "direction"}, flows); err != nil {
+		return err
 	}
 
-	return nil
+	// packets kept in memory for rules & the API were streamed too, so packet is filled from the stream alone
+	_, err = writer.db.Exec(`insert into packet (connection_id, device_id, direction, size, time)
+	select f.connection_id, d.id, f.direction, s.size, s.time
+	from packet_stream s
+	join stream_flow f on f.device = s.device and f.flowId = s.flowId
+	join device d on d.session_id = ? and d.name = s.device`, writer.session)
+	if err != nil {
+		return err
+	}
+
+	// every streamed packet was associated with the store before this flush, so all are now attributed
+	_, err = writer.db.Exec("delete from packet_stream")
+
+	return err
 }
 
 // Report network information to the console
-func ReportNetwork(pidConns *[]PidSocket, store MachineNetworkStorage, json bool) error {
+func ReportNetwork(session CaptureSession, stream *PacketStream, conns *ConnectionTable, store MachineNetworkStorage, tcpStates TCPStateStore, json bool) error {
+	FinishTCPStates(tcpStates, time.Now())
+
 	if json {
-		return ReportJSONNetwork(pidConns, store)
+		return ReportJSONNetwork(conns, store, tcpStates)
 	} else {
-		return ReportDBNetwork(pidConns, store)
+		return ReportDBNetwork(session, stream, conns, store, tcpStates)
 	}
 }
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How often rules are evaluated against the association pipeline
+const RULE_INTERVAL = time.Second
+
+// Reverse-DNS lookups run on a few workers, and failures are retried after a while
+const (
+	HOSTNAME_WORKERS      = 4
+	HOSTNAME_QUEUE        = 256
+	HOSTNAME_CACHE_SIZE   = 4096
+	HOSTNAME_NEGATIVE_TTL = 5 * time.Minute
+)
+
+// Which sockets a rule applies to. Each set field must match (any value in a list
+// may match), and the socket must not match Not
+type RuleMatch struct {
+	Command     []string   `yaml:"command"`      // globs against the process command
+	CommandLine string     `yaml:"command_line"` // a regular expression against the full command-line
+	User        []string   `yaml:"user"`
+	Cgroup      []string   `yaml:"cgroup"`     // globs against the cgroup path
+	Remote      []string   `yaml:"remote"`     // CIDRs the remote address must fall in
+	Hostname    []string   `yaml:"hostname"`   // globs against the remote address's reverse-DNS name
+	Port        []uint64   `yaml:"port"`       // remote ports
+	LocalPort   []uint64   `yaml:"local_port"` // local ports
+	Protocol    []string   `yaml:"protocol"`   // tcp or udp
+	Not         *RuleMatch `yaml:"not"`
+
+	commandLine *regexp.Regexp
+	remotes     []*net.IPNet
+}
+
+// A byte-count, written with an optional unit (e.g. 50MB)
+type ByteSize int
+
+// A duration, written as a Go duration string (e.g. 1m)
+type RuleDuration time.Duration
+
+// A rate threshold, e.g. 50MB per 1m
+type RuleRate struct {
+	Bytes ByteSize     `yaml:"bytes"`
+	Per   RuleDuration `yaml:"per"`
+}
+
+// An alert rule. Without thresholds a rule fires once for each new match; with them, it fires
+// whenever the matching traffic (summed by GroupBy) crosses a threshold
+type Rule struct {
+	Name        string    `yaml:"name"`
+	Description string    `yaml:"description"`
+	Match       RuleMatch `yaml:"match"`
+	Bytes       ByteSize  `yaml:"bytes"`    // fire once total traffic reaches this
+	Rate        *RuleRate `yaml:"rate"`     // fire while traffic over a window exceeds this
+	GroupBy     string    `yaml:"group_by"` // connection, process (default), user, cgroup or command
+}
+
+type RuleFile struct {
+	Rules []Rule       `yaml:"rules"`
+	Sinks []SinkConfig `yaml:"sinks"` // where alerts are delivered; stderr by default
+}
+
+var BYTE_UNITS = map[string]int{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+var BYTE_SIZE_PATTERN = regexp.MustCompile(`^\s*(\d+)\s*([KMGT]?B?)\s*$`)
+
+// Parse a byte-count with an optional unit (e.g. 50MB)
+func ParseByteSize(str string) (ByteSize, error) {
+	match := BYTE_SIZE_PATTERN.FindStringSubmatch(strings.ToUpper(str))
+	if match == nil {
+		return 0, fmt.Errorf("invalid byte-size %q", str)
+	}
+
+	count, _ := strconv.Atoi(match[1])
+	unit := match[2]
+	if len(unit) == 1 && unit != "B" {
+		unit += "B"
+	}
+
+	return ByteSize(count * BYTE_UNITS[unit]), nil
+}
+
+func (size *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := ParseByteSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+
+	*size = parsed
+	return nil
+}
+
+func (dur *RuleDuration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+
+	*dur = RuleDuration(parsed)
+	return nil
+}
+
+// Compile regular-expressions and CIDRs ahead of evaluation
+func (match *RuleMatch) compile() error {
+	// connection types are matched in lower-case, so TCP matches as well as tcp
+	for idx := range match.Protocol {
+		match.Protocol[idx] = strings.ToLower(match.Protocol[idx])
+	}
+
+	if len(match.CommandLine) > 0 {
+		pattern, err := regexp.Compile(match.CommandLine)
+		if err != nil {
+			return err
+		}
+		match.commandLine = pattern
+	}
+
+	for _, cidr := range match.Remote {
+		// allow bare addresses, as well as CIDRs
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		match.remotes = append(match.remotes, network)
+	}
+
+	if match.Not != nil {
+		return match.Not.compile()
+	}
+
+	return nil
+}
+
+func matchesGlob(globs []string, value string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesPort(ports []uint64, port uint64) bool {
+	if len(ports) == 0 {
+		return true
+	}
+
+	for _, candidate := range ports {
+		if candidate == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Does a process-socket match? Hostnames are resolved through the cache, so a
+// hostname-rule may not match until the remote address has been resolved
+func (match *RuleMatch) Matches(pidConn *PidSocket, hosts *HostnameCache) bool {
+	conn := pidConn.Connection
+
+	if !matchesGlob(match.Command, pidConn.Command) ||
+		!matchesGlob(match.User, pidConn.UserName) ||
+		!matchesGlob(match.Cgroup, pidConn.Cgroup) ||
+		!matchesPort(match.Port, conn.GetRemPort()) ||
+		!matchesPort(match.LocalPort, conn.GetLocalPort()) {
+		return false
+	}
+
+	if match.commandLine != nil && !match.commandLine.MatchString(pidConn.CommandLine) {
+		return false
+	}
+
+	if len(match.Protocol) > 0 && !matchesGlob(match.Protocol, strings.ToLower(conn.GetType())) {
+		return false
+	}
+
+	if len(match.remotes) > 0 {
+		inRemotes := false
+		for _, network := range match.remotes {
+			inRemotes = inRemotes || network.Contains(conn.GetRemAddr())
+		}
+
+		if !inRemotes {
+			return false
+		}
+	}
+
+	if len(match.Hostname) > 0 && !matchesGlob(match.Hostname, hosts.Lookup(conn.GetRemAddr())) {
+		return false
+	}
+
+	return match.Not == nil || !match.Not.Matches(pidConn, hosts)
+}
+
+// The group a process-socket's traffic is summed into
+func (rule *Rule) groupKey(pidConn *PidSocket) string {
+	switch rule.GroupBy {
+	case "connection":
+		return pidConn.GetProcessId().String() + "/" + pidConn.GetId()
+	case "user":
+		return pidConn.UserName
+	case "cgroup":
+		return pidConn.Cgroup
+	case "command":
+		return pidConn.Command
+	default:
+		return pidConn.GetProcessId().String()
+	}
+}
+
+// An alert raised by a rule
+type AlertEvent struct {
+	Type          string    `json:"type"`
+	Rule          string    `json:"rule"`
+	Description   string    `json:"description"`
+	Time          time.Time `json:"time"`
+	GroupBy       string    `json:"group_by"`
+	Group         string    `json:"group"`
+	Bytes         int       `json:"bytes"`          // total matching traffic in the group
+	WindowBytes   int       `json:"window_bytes"`   // matching traffic within the rate window
+	Connections   int       `json:"connections"`    // matching connections in the group
+	ProcessSocket PidSocket `json:"process_socket"` // the first matching process-socket in the group
+}
+
+// Continuously evaluates rules, remembering which have fired so each alerts once per crossing
+type RuleEngine struct {
+	Rules   []Rule
+	Sinks   []SinkConfig
+	fired   map[string]bool
+	hosts   *HostnameCache
+	flushed map[string]*ruleFlowHistory
+}
+
+// A flow's traffic from before the last flushes, which empty the store in daemon & agent mode
+type ruleFlowHistory struct {
+	bytes   int                // all flushed traffic
+	packets []StoredPacketData // flushed packets still within the longest rate window
+}
+
+// Load rules from a YAML file
+func LoadRules(fpath string) (*RuleEngine, error) {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var file RuleFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+
+	for idx := range file.Rules {
+		rule := &file.Rules[idx]
+
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("rule-%d", idx+1)
+		}
+
+		if err := rule.Match.compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+
+		if rule.Rate != nil && rule.Rate.Per <= 0 {
+			return nil, fmt.Errorf("rule %s: a rate needs a positive 'per' duration", rule.Name)
+		}
+	}
+
+	return &RuleEngine{file.Rules, file.Sinks, map[string]bool{}, NewHostnameCache(), map[string]*ruleFlowHistory{}}, nil
+}
+
+// The longest rate window of any rule, i.e. how long packets must be kept for evaluation
+func (engine *RuleEngine) Window() time.Duration {
+	var window time.Duration
+	if engine == nil {
+		return window
+	}
+
+	for _, rule := range engine.Rules {
+		if rule.Rate != nil && time.Duration(rule.Rate.Per) > window {
+			window = time.Duration(rule.Rate.Per)
+		}
+	}
+
+	return window
+}
+
+// Remember the store's traffic before a flush forgets it, so byte thresholds, fired rules and
+// rate windows carry across flushes
+func (engine *RuleEngine) Update(store MachineNetworkStorage, now time.Time) {
+	if engine == nil {
+		return
+	}
+
+	since := now.Add(-engine.Window()).UnixNano()
+
+	for _, conns := range store {
+		for flowId, connData := range conns {
+			history, ok := engine.flushed[flowId]
+			if !ok {
+				history = &ruleFlowHistory{}
+				engine.flushed[flowId] = history
+			}
+
+			history.bytes += connData.Size
+			for _, pkt := range connData.Packets {
+				if pkt.Timestamp >= since {
+					history.packets = append(history.packets, pkt)
+				}
+			}
+		}
+	}
+}
+
+// Drop flushed packets older than every rate window, and the history of flows no
+// process-socket uses any more
+func (engine *RuleEngine) expire(pidConns []PidSocket, now time.Time) {
+	active := map[string]bool{}
+	for idx := range pidConns {
+		active[pidConns[idx].GetId()] = true
+		active[pidConns[idx].GetReverseId()] = true
+	}
+
+	since := now.Add(-engine.Window()).UnixNano()
+
+	for flowId, history := range engine.flushed {
+		packets := history.packets[:0]
+		for _, pkt := range history.packets {
+			if pkt.Timestamp >= since {
+				packets = append(packets, pkt)
+			}
+		}
+		history.packets = packets
+
+		if !active[flowId] && len(history.packets) == 0 {
+			delete(engine.flushed, flowId)
+		}
+	}
+}
+
+// Traffic per flow, summed over devices & flushes once per evaluation: in total, and since the
+// start of each rule's rate window
+type ruleTraffic struct {
+	totals map[string]int
+	recent map[int64]map[string]int
+}
+
+func (engine *RuleEngine) traffic(store MachineNetworkStorage, windows []int64) *ruleTraffic {
+	traffic := &ruleTraffic{map[string]int{}, map[int64]map[string]int{}}
+	for _, since := range windows {
+		traffic.recent[since] = map[string]int{}
+	}
+
+	add := func(flowId string, size int, packets []StoredPacketData) {
+		traffic.totals[flowId] += size
+
+		for since, recent := range traffic.recent {
+			for _, pkt := range packets {
+				if pkt.Timestamp >= since {
+					recent[flowId] += pkt.Size
+				}
+			}
+		}
+	}
+
+	for flowId, history := range engine.flushed {
+		add(flowId, history.bytes, history.packets)
+	}
+
+	for _, conns := range store {
+		for flowId, connData := range conns {
+			add(flowId, connData.Size, connData.Packets)
+		}
+	}
+
+	return traffic
+}
+
+// Sum traffic in both directions of a connection, in total and since a time
+func (traffic *ruleTraffic) connectionBytes(pidConn *PidSocket, since int64) (int, int) {
+	total, recent := 0, 0
+	for _, id := range []string{pidConn.GetId(), pidConn.GetReverseId()} {
+		total += traffic.totals[id]
+		recent += traffic.recent[since][id]
+	}
+
+	return total, recent
+}
+
+// When each rule's rate window starts; zero for rules without one
+func (engine *RuleEngine) windowStarts(now time.Time) []int64 {
+	starts := []int64{}
+	seen := map[int64]bool{}
+
+	for _, rule := range engine.Rules {
+		var since int64
+		if rule.Rate != nil {
+			since = now.Add(-time.Duration(rule.Rate.Per)).UnixNano()
+		}
+
+		if !seen[since] {
+			seen[since] = true
+			starts = append(starts, since)
+		}
+	}
+
+	return starts
+}
+
+type ruleGroup struct {
+	bytes       int
+	windowBytes int
+	connections int
+	first       PidSocket
+}
+
+// Evaluate every rule against the current process-sockets and traffic, returning new alerts
+func (engine *RuleEngine) Evaluate(pidConns []PidSocket, store MachineNetworkStorage, now time.Time) []AlertEvent {
+	alerts := []AlertEvent{}
+
+	// only firing groups are remembered, so groups that stop firing or go away are forgotten
+	fired := map[string]bool{}
+
+	engine.expire(pidConns, now)
+	traffic := engine.traffic(store, engine.windowStarts(now))
+
+	for _, rule := range engine.Rules {
+		var since int64
+		if rule.Rate != nil {
+			since = now.Add(-time.Duration(rule.Rate.Per)).UnixNano()
+		}
+
+		groups := map[string]*ruleGroup{}
+		order := []string{}
+		seen := map[string]bool{}
+
+		for idx := range pidConns {
+			pidConn := &pidConns[idx]
+			if !rule.Match.Matches(pidConn, engine.hosts) {
+				continue
+			}
+
+			key := rule.groupKey(pidConn)
+			group, ok := groups[key]
+			if !ok {
+				group = &ruleGroup{first: *pidConn}
+				groups[key] = group
+				order = append(order, key)
+			}
+
+			// closed & reopened lifetimes share a 4-tuple; count their traffic once
+			connKey := key + "/" + pidConn.GetId()
+			if seen[connKey] {
+				continue
+			}
+			seen[connKey] = true
+
+			total, recent := traffic.connectionBytes(pidConn, since)
+			group.bytes += total
+			group.windowBytes += recent
+			group.connections++
+		}
+
+		for _, key := range order {
+			group := groups[key]
+			firing := (rule.Bytes == 0 || group.bytes >= int(rule.Bytes)) &&
+				(rule.Rate == nil || group.windowBytes >= int(rule.Rate.Bytes))
+
+			firedKey := rule.Name + "/" + key
+			if firing && !engine.fired[firedKey] {
+				alerts = append(alerts, AlertEvent{
+					Type:          "alert",
+					Rule:          rule.Name,
+					Description:   rule.Description,
+					Time:          now,
+					GroupBy:       rule.GroupBy,
+					Group:         key,
+					Bytes:         group.bytes,
+					WindowBytes:   group.windowBytes,
+					Connections:   group.connections,
+					ProcessSocket: group.first,
+				})
+			}
+
+			if firing {
+				fired[firedKey] = true
+			}
+		}
+	}
+
+	engine.fired = fired
+	return alerts
+}
+
+// Caches reverse-DNS names for remote addresses. Lookups run in the background,
+// so evaluating rules never blocks on DNS
+type HostnameCache struct {
+	lock    sync.Mutex
+	entries map[string]*hostnameEntry
+	queue   chan string
+	lookup  func(addr string) ([]string, error)
+}
+
+type hostnameEntry struct {
+	name     string
+	pending  bool      // queued or being looked up
+	expires  time.Time // when a failed lookup is retried
+	lastUsed time.Time
+}
+
+func NewHostnameCache() *HostnameCache {
+	return newHostnameCache(net.LookupAddr)
+}
+
+func newHostnameCache(lookup func(addr string) ([]string, error)) *HostnameCache {
+	cache := &HostnameCache{
+		entries: map[string]*hostnameEntry{},
+		queue:   make(chan string, HOSTNAME_QUEUE),
+		lookup:  lookup,
+	}
+
+	for idx := 0; idx < HOSTNAME_WORKERS; idx++ {
+		go cache.resolve()
+	}
+
+	return cache
+}
+
+// Look up queued addresses, one at a time
+func (cache *HostnameCache) resolve() {
+	for addr := range cache.queue {
+		names, err := cache.lookup(addr)
+
+		cache.lock.Lock()
+		if entry, ok := cache.entries[addr]; ok {
+			entry.pending = false
+
+			if err == nil && len(names) > 0 {
+				entry.name = strings.TrimSuffix(names[0], ".")
+			} else {
+				entry.expires = time.Now().Add(HOSTNAME_NEGATIVE_TTL)
+			}
+		}
+		cache.lock.Unlock()
+	}
+}
+
+// Forget the least recently used address; the caller holds the lock
+func (cache *HostnameCache) evict() {
+	var oldest string
+	var oldestUsed time.Time
+
+	for addr, entry := range cache.entries {
+		if len(oldest) == 0 || entry.lastUsed.Before(oldestUsed) {
+			oldest, oldestUsed = addr, entry.lastUsed
+		}
+	}
+
+	delete(cache.entries, oldest)
+}
+
+// Get the hostname for an address, or an empty string if it is not resolved (yet)
+func (cache *HostnameCache) Lookup(ip net.IP) string {
+	addr := ip.String()
+	now := time.Now()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := cache.entries[addr]
+	if ok {
+		entry.lastUsed = now
+		if len(entry.name) > 0 || entry.pending || now.Before(entry.expires) {
+			return entry.name
+		}
+	}
+
+	// when every worker is busy, try again on a later evaluation
+	select {
+	case cache.queue <- addr:
+	default:
+		return ""
+	}
+
+	if !ok {
+		if len(cache.entries) >= HOSTNAME_CACHE_SIZE {
+			cache.evict()
+		}
+
+		entry = &hostnameEntry{lastUsed: now}
+		cache.entries[addr] = entry
+	}
+
+	entry.pending = true
+	return ""
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRuleEngineForgetsGroups(t *testing.T) {
+	start := time.Now()
+	rule := Rule{Name: "any-connection", GroupBy: "connection"}
+	engine := &RuleEngine{[]Rule{rule}, nil, map[string]bool{}, NewHostnameCache(), map[string]*ruleFlowHistory{}}
+
+	local := net.ParseIP("10.0.0.1")
+	for idx := 0; idx < 100; idx++ {
+		pidConns := []PidSocket{{"alice", "curl", "curl", 42, 100, nil, "/", &TCPConnection{1, local, uint64(40000 + idx), net.ParseIP("10.0.0.2"), 443, 1, 0, 0, 1000, 1234}, start}}
+
+		if alerts := engine.Evaluate(pidConns, MachineNetworkStorage{}, start); len(alerts) != 1 {
+			t.Fatalf("connection %d raised %d alerts, expected 1", idx, len(alerts))
+		}
+	}
+
+	if len(engine.fired) != 1 {
+		t.Errorf("remembered %d fired groups, expected only the current one", len(engine.fired))
+	}
+}
+
+func TestHostnameCacheRetriesFailures(t *testing.T) {
+	var lock sync.Mutex
+	lookups := map[string]int{}
+
+	cache := newHostnameCache(func(addr string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		lookups[addr]++
+		if addr == "10.0.0.2" {
+			return []string{"web.example.com."}, nil
+		}
+		return nil, errors.New("no such host")
+	})
+
+	// wait for the background lookup to finish
+	resolved := func(ip net.IP) string {
+		for idx := 0; idx < 1000; idx++ {
+			cache.Lookup(ip)
+
+			cache.lock.Lock()
+			entry := cache.entries[ip.String()]
+			pending := entry == nil || entry.pending
+			cache.lock.Unlock()
+
+			if !pending {
+				return cache.Lookup(ip)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		t.Fatalf("%s was never looked up", ip)
+		return ""
+	}
+
+	if name := resolved(net.ParseIP("10.0.0.2")); name != "web.example.com" {
+		t.Errorf("resolved %q, expected web.example.com", name)
+	}
+	if name := resolved(net.ParseIP("10.0.0.3")); name != "" {
+		t.Errorf("resolved %q for an address without a name", name)
+	}
+
+	// a failure is only retried once it expires
+	cache.Lookup(net.ParseIP("10.0.0.3"))
+	cache.lock.Lock()
+	cache.entries["10.0.0.3"].expires = time.Now()
+	cache.lock.Unlock()
+	resolved(net.ParseIP("10.0.0.3"))
+
+	lock.Lock()
+	if lookups["10.0.0.3"] != 2 {
+		t.Errorf("looked up a failed address %d times, expected 2", lookups["10.0.0.3"])
+	}
+	lock.Unlock()
+
+	// addresses are only cached once queued, so retry any that found the queue full
+	for idx := 0; idx < HOSTNAME_CACHE_SIZE+10; idx++ {
+		ip := net.ParseIP(fmt.Sprintf("10.1.%d.%d", idx/256, idx%256))
+
+		for cached := false; !cached; {
+			cache.Lookup(ip)
+
+			cache.lock.Lock()
+			_, cached = cache.entries[ip.String()]
+			cache.lock.Unlock()
+
+			if !cached {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	cache.lock.Lock()
+	if len(cache.entries) > HOSTNAME_CACHE_SIZE {
+		t.Errorf("cached %d addresses, the limit is %d", len(cache.entries), HOSTNAME_CACHE_SIZE)
+	}
+	cache.lock.Unlock()
+}
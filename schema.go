@@ -0,0 +1,602 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Open capture databases with foreign-key enforcement, and tuned for bulk writes: a write-ahead
+// log lets packets stream in while a capture is read, and only needs syncing at checkpoints
+const SQLITE_OPTIONS = "?_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_cache_size=-65536"
+
+// A forward migration, from the previous schema version
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sql.Tx) error
+}
+
+// Every schema change, in order. Databases are only ever migrated forward, so a capture
+// written by an older puffin can be opened by a newer one
+var MIGRATIONS = []Migration{
+	{1, "unversioned tables, as written by puffin before schema versioning", migrateLegacySchema},
+	{2, "normalised tables with surrogate ids, foreign keys and indices", migrateNormalisedSchema},
+	{3, "staging table for packets streamed during capture", migrateExecFunc(CREATE_PACKET_STREAM_TABLES...)},
+	{4, "the captures each session was merged from", migrateExecFunc(CREATE_SESSION_ORIGIN_TABLES...)},
+}
+
+// Which capture databases a session was merged from, by puffin analyse merge
+var CREATE_SESSION_ORIGIN_TABLES = []string{
+	`create table session_origin (
+	session_id integer not null references session (id) on delete cascade,
+	path       text    not null,
+	merged     integer not null,
+	primary key (session_id, path)
+)`,
+}
+
+// Packets written during capture, before they are attributed to a connection
+var CREATE_PACKET_STREAM_TABLES = []string{
+	`create table packet_stream (
+	device text    not null,
+	flowId text    not null, -- the packet's (source, destination) 4-tuple
+	size   integer not null,
+	time   integer not null
+)`,
+}
+
+const CREATE_SCHEMA_VERSION_TABLE = `create table if not exists schema_version (
+	version     integer primary key,
+	description text    not null,
+	applied     integer not null
+)`
+
+// The unversioned tables, kept so old captures can be migrated
+var LEGACY_TABLES = map[string]string{
+	"tcp_conn": `create table if not exists tcp_conn (
+	sl        integer,
+	localAddr text,
+	localPort integer,
+	remAddr   text,
+	remPort   integer,
+	st        integer,
+	state     text,
+	txQueue   integer,
+	rxQueue   integer,
+	uid       integer,
+	inode     integer
+)`,
+	"tcp_state_transition": `create table if not exists tcp_state_transition (
+	localAddr text,
+	localPort integer,
+	remAddr   text,
+	remPort   integer,
+	inode     integer,
+	fromState text,
+	toState   text,
+	time      integer
+)`,
+	"tcp_queue_stall": `create table if not exists tcp_queue_stall (
+	localAddr text,
+	localPort integer,
+	remAddr   text,
+	remPort   integer,
+	inode     integer,
+	queue     text,
+	start     integer,
+	end       integer,
+	maxBytes  integer,
+	flagged   integer
+)`,
+	"process_tcp_state": `create table if not exists process_tcp_state (
+	pid       int,
+	startTime int,
+	command   text,
+	state     text,
+	count     int
+)`,
+	"udp_conn": `create table if not exists udp_conn (
+	sl        integer,
+	localAddr text,
+	localPort integer,
+	remAddr   text,
+	remPort   integer,
+	st        integer,
+	txQueue   integer,
+	rxQueue   integer,
+	uid       integer,
+	inode     integer
+)`,
+	"process_conn": `create table if not exists process_conn (
+	username    text,
+	command     text,
+	commandLine text,
+	pid         int,
+	startTime   int,
+	cgroup      text,
+	inode       int,
+	time        int,
+	opened      int,
+	closed      int
+)`,
+	"conn_event": `create table if not exists conn_event (
+	type      text,
+	time      int,
+	pid       int,
+	startTime int,
+	command   text,
+	protocol  text,
+	localAddr text,
+	localPort integer,
+	remAddr   text,
+	remPort   integer,
+	inode     integer
+)`,
+	"parent_pid": `create table if not exists parent_pid (
+	pid        int,
+	startTime  int,
+	ppid       int,
+	pstartTime int,
+	level      int
+)`,
+	"conn_summary": `create table if not exists conn_summary (
+	device          text,
+	localAddr       text,
+	localPort       integer,
+	remAddr         text,
+	remPort         integer,
+	size            int,
+	start           int,
+	end             int,
+	retransmissions int,
+	outOfOrder      int,
+	duplicateAcks   int,
+	zeroWindows     int,
+	handshakeRtt    int
+)`,
+	"process_tcp_flow": `create table if not exists process_tcp_flow (
+	pid              int,
+	startTime        int,
+	command          text,
+	connections      int,
+	retransmissions  int,
+	outOfOrder       int,
+	duplicateAcks    int,
+	zeroWindows      int,
+	meanHandshakeRtt int,
+	maxHandshakeRtt  int
+)`,
+	"packet": `create table if not exists packet (
+	device    text,
+	localAddr text,
+	localPort integer,
+	remAddr   text,
+	remPort   integer,
+	size      integer,
+	time      integer
+)`,
+	"users": `create table if not exists users (
+	uid      integer,
+	username text
+)`,
+}
+
+// Columns added to the unversioned tables over time, missing from older captures
+var LEGACY_COLUMNS = map[string][][2]string{
+	"tcp_conn":     {{"state", "text"}},
+	"udp_conn":     {{"localPort", "integer"}, {"remPort", "integer"}},
+	"process_conn": {{"startTime", "int"}, {"cgroup", "text"}, {"opened", "int"}, {"closed", "int"}},
+	"parent_pid":   {{"startTime", "int"}, {"pstartTime", "int"}},
+	"conn_summary": {{"retransmissions", "int"}, {"outOfOrder", "int"}, {"duplicateAcks", "int"}, {"zeroWindows", "int"}, {"handshakeRtt", "int"}},
+}
+
+// The normalised schema. Sessions own processes and connections; traffic and TCP analysis
+// refer to connections, and processes are linked to connections (and ancestors) by id
+var NORMALISED_TABLES = []string{
+	`create table session (
+	id       integer primary key,
+	start    integer not null,
+	end      integer,
+	hostname text    not null default '',
+	unique (start, hostname)
+)`,
+	`create table device (
+	id         integer primary key,
+	session_id integer not null references session (id) on delete cascade,
+	name       text    not null,
+	unique (session_id, name)
+)`,
+	`create table users (
+	id         integer primary key,
+	session_id integer not null references session (id) on delete cascade,
+	uid        integer not null,
+	username   text    not null,
+	unique (session_id, uid)
+)`,
+	`create table process (
+	id          integer primary key,
+	session_id  integer not null references session (id) on delete cascade,
+	pid         integer not null,
+	startTime   integer not null,
+	command     text,
+	commandLine text,
+	cgroup      text,
+	unique (session_id, pid, startTime)
+)`,
+	`create index process_pid on process (pid)`,
+	`create table process_parent (
+	process_id integer not null references process (id) on delete cascade,
+	parent_id  integer not null references process (id) on delete cascade,
+	level      integer not null,
+	primary key (process_id, parent_id)
+)`,
+	`create table connection (
+	id         integer primary key,
+	session_id integer not null references session (id) on delete cascade,
+	protocol   text    not null, -- TCP, UDP, or empty for traffic no socket was found for
+	localAddr  text    not null,
+	localPort  integer not null,
+	remAddr    text    not null,
+	remPort    integer not null,
+	inode      integer not null,
+	uid        integer,
+	sl         integer,
+	st         integer,
+	state      text,
+	txQueue    integer,
+	rxQueue    integer,
+	unique (session_id, protocol, localAddr, localPort, remAddr, remPort, inode)
+)`,
+	`create index connection_local on connection (localAddr, localPort)`,
+	`create index connection_remote on connection (remAddr, remPort)`,
+	`create index connection_inode on connection (inode)`,
+	`create table process_connection (
+	process_id    integer not null references process (id) on delete cascade,
+	connection_id integer not null references connection (id) on delete cascade,
+	time          integer,
+	opened        integer,
+	closed        integer,
+	primary key (process_id, connection_id)
+)`,
+	`create index process_connection_connection on process_connection (connection_id)`,
+	`create index process_connection_opened on process_connection (opened)`,
+	`create table conn_event (
+	id            integer primary key,
+	process_id    integer not null references process (id) on delete cascade,
+	connection_id integer not null references connection (id) on delete cascade,
+	type          text    not null,
+	time          integer not null
+)`,
+	`create index conn_event_time on conn_event (time)`,
+	`create table conn_summary (
+	id              integer primary key,
+	connection_id   integer not null references connection (id) on delete cascade,
+	device_id       integer not null references device (id),
+	direction       text    not null, -- out (local -> remote) or in
+	size            integer not null,
+	start           integer,
+	end             integer,
+	retransmissions integer,
+	outOfOrder      integer,
+	duplicateAcks   integer,
+	zeroWindows     integer,
+	handshakeRtt    integer
+)`,
+	`create index conn_summary_connection on conn_summary (connection_id)`,
+	`create index conn_summary_start on conn_summary (start)`,
+	`create table packet (
+	id            integer primary key,
+	connection_id integer not null references connection (id) on delete cascade,
+	device_id     integer not null references device (id),
+	direction     text    not null,
+	size          integer not null,
+	time          integer not null
+)`,
+	`create index packet_time on packet (time)`,
+	`create index packet_connection on packet (connection_id)`,
+	`create table tcp_state_transition (
+	id            integer primary key,
+	connection_id integer not null references connection (id) on delete cascade,
+	fromState     text,
+	toState       text,
+	time          integer not null
+)`,
+	`create index tcp_state_transition_time on tcp_state_transition (time)`,
+	`create table tcp_queue_stall (
+	id            integer primary key,
+	connection_id integer not null references connection (id) on delete cascade,
+	queue         text    not null,
+	start         integer not null,
+	end           integer not null,
+	maxBytes      integer,
+	flagged       integer
+)`,
+	`create index tcp_queue_stall_start on tcp_queue_stall (start)`,
+	`create table process_tcp_state (
+	id         integer primary key,
+	process_id integer not null references process (id) on delete cascade,
+	time       integer not null, -- when the states were counted
+	state      text    not null,
+	count      integer not null
+)`,
+	`create index process_tcp_state_process on process_tcp_state (process_id)`,
+	`create table process_tcp_flow (
+	id               integer primary key,
+	process_id       integer not null references process (id) on delete cascade,
+	time             integer not null, -- when the flows were summarised
+	connections      integer,
+	retransmissions  integer,
+	outOfOrder       integer,
+	duplicateAcks    integer,
+	zeroWindows      integer,
+	meanHandshakeRtt integer,
+	maxHandshakeRtt  integer
+)`,
+	`create index process_tcp_flow_process on process_tcp_flow (process_id)`,
+}
+
+// Copy an unversioned capture (with tables renamed to legacy_*) into the normalised tables
+var LEGACY_COPY = []string{
+	`insert into session (id, start)
+	select 1, coalesce((select min(coalesce(opened, time)) from legacy_process_conn), 0)
+	where exists (select 1 from legacy_process_conn) or exists (select 1 from legacy_conn_summary) or exists (select 1 from legacy_packet)`,
+
+	`insert or ignore into device (session_id, name)
+	select 1, device from legacy_conn_summary union select 1, device from legacy_packet`,
+
+	`insert or ignore into users (session_id, uid, username)
+	select distinct 1, s.uid, p.username
+	from legacy_process_conn p
+	join (select uid, inode from legacy_tcp_conn union select uid, inode from legacy_udp_conn) s on s.inode = p.inode
+	where s.uid is not null and p.username is not null`,
+
+	`insert or ignore into process (session_id, pid, startTime, command, commandLine, cgroup)
+	select 1, pid, coalesce(startTime, 0), command, commandLine, cgroup from legacy_process_conn`,
+
+	`insert or ignore into process (session_id, pid, startTime)
+	select 1, ppid, coalesce(pstartTime, 0) from legacy_parent_pid`,
+
+	`insert or ignore into process_parent (process_id, parent_id, level)
+	select p.id, a.id, pp.level
+	from legacy_parent_pid pp
+	join process p on p.pid = pp.pid and p.startTime = coalesce(pp.startTime, 0)
+	join process a on a.pid = pp.ppid and a.startTime = coalesce(pp.pstartTime, 0)`,
+
+	`insert or ignore into connection (session_id, protocol, localAddr, localPort, remAddr, remPort, inode, uid, sl, st, state, txQueue, rxQueue)
+	select 1, 'TCP', localAddr, localPort, remAddr, remPort, inode, uid, sl, st, state, txQueue, rxQueue from legacy_tcp_conn`,
+
+	`insert or ignore into connection (session_id, protocol, localAddr, localPort, remAddr, remPort, inode, uid, sl, st, txQueue, rxQueue)
+	select 1, 'UDP', localAddr, coalesce(localPort, 0), remAddr, coalesce(remPort, 0), inode, uid, sl, st, txQueue, rxQueue from legacy_udp_conn`,
+
+	`insert or ignore into process_connection (process_id, connection_id, time, opened, closed)
+	select p.id, c.id, max(pc.time), min(pc.opened), max(pc.closed)
+	from legacy_process_conn pc
+	join process p on p.pid = pc.pid and p.startTime = coalesce(pc.startTime, 0)
+	join connection c on c.inode = pc.inode
+	group by p.id, c.id`,
+
+	`insert into conn_event (process_id, connection_id, type, time)
+	select p.id, c.id, e.type, e.time
+	from legacy_conn_event e
+	join process p on p.pid = e.pid and p.startTime = e.startTime
+	join connection c on c.protocol = e.protocol and c.inode = e.inode and c.localAddr = e.localAddr and c.localPort = e.localPort and c.remAddr = e.remAddr and c.remPort = e.remPort`,
+
+	// traffic was stored by the packet's (source, destination), so matches a connection in either direction
+	`create temporary table legacy_flow as
+	select distinct localAddr, localPort, remAddr, remPort from legacy_conn_summary
+	union select localAddr, localPort, remAddr, remPort from legacy_packet`,
+
+	`insert or ignore into connection (session_id, protocol, localAddr, localPort, remAddr, remPort, inode)
+	select 1, '', f.localAddr, f.localPort, f.remAddr, f.remPort, 0
+	from legacy_flow f
+	where not exists (
+		select 1 from connection c
+		where (c.localAddr = f.localAddr and c.localPort = f.localPort and c.remAddr = f.remAddr and c.remPort = f.remPort)
+		   or (c.localAddr = f.remAddr and c.localPort = f.remPort and c.remAddr = f.localAddr and c.remPort = f.localPort))`,
+
+	`create temporary table legacy_flow_connection as
+	select f.localAddr, f.localPort, f.remAddr, f.remPort,
+		coalesce(
+			(select max(id) from connection c where c.localAddr = f.localAddr and c.localPort = f.localPort and c.remAddr = f.remAddr and c.remPort = f.remPort),
+			(select max(id) from connection c where c.localAddr = f.remAddr and c.localPort = f.remPort and c.remAddr = f.localAddr and c.remPort = f.localPort)) as connection_id,
+		case when exists (select 1 from connection c where c.localAddr = f.localAddr and c.localPort = f.localPort and c.remAddr = f.remAddr and c.remPort = f.remPort)
+			then 'out' else 'in' end as direction
+	from legacy_flow f`,
+
+	`insert into conn_summary (connection_id, device_id, direction, size, start, end, retransmissions, outOfOrder, duplicateAcks, zeroWindows, handshakeRtt)
+	select f.connection_id, d.id, f.direction, s.size, s.start, s.end, s.retransmissions, s.outOfOrder, s.duplicateAcks, s.zeroWindows, s.handshakeRtt
+	from legacy_conn_summary s
+	join device d on d.name = s.device
+	join legacy_flow_connection f on f.localAddr = s.localAddr and f.localPort = s.localPort and f.remAddr = s.remAddr and f.remPort = s.remPort`,
+
+	`insert into packet (connection_id, device_id, direction, size, time)
+	select f.connection_id, d.id, f.direction, p.size, p.time
+	from legacy_packet p
+	join device d on d.name = p.device
+	join legacy_flow_connection f on f.localAddr = p.localAddr and f.localPort = p.localPort and f.remAddr = p.remAddr and f.remPort = p.remPort`,
+
+	`insert into tcp_state_transition (connection_id, fromState, toState, time)
+	select c.id, t.fromState, t.toState, t.time
+	from legacy_tcp_state_transition t
+	join connection c on c.protocol = 'TCP' and c.inode = t.inode and c.localAddr = t.localAddr and c.localPort = t.localPort and c.remAddr = t.remAddr and c.remPort = t.remPort`,
+
+	`insert into tcp_queue_stall (connection_id, queue, start, end, maxBytes, flagged)
+	select c.id, t.queue, t.start, t.end, t.maxBytes, t.flagged
+	from legacy_tcp_queue_stall t
+	join connection c on c.protocol = 'TCP' and c.inode = t.inode and c.localAddr = t.localAddr and c.localPort = t.localPort and c.remAddr = t.remAddr and c.remPort = t.remPort`,
+
+	`insert into process_tcp_state (process_id, time, state, count)
+	select p.id, (select start from session where id = 1), t.state, t.count
+	from legacy_process_tcp_state t
+	join process p on p.pid = t.pid and p.startTime = t.startTime`,
+
+	`insert into process_tcp_flow (process_id, time, connections, retransmissions, outOfOrder, duplicateAcks, zeroWindows, meanHandshakeRtt, maxHandshakeRtt)
+	select p.id, (select start from session where id = 1), t.connections, t.retransmissions, t.outOfOrder, t.duplicateAcks, t.zeroWindows, t.meanHandshakeRtt, t.maxHandshakeRtt
+	from legacy_process_tcp_flow t
+	join process p on p.pid = t.pid and p.startTime = t.startTime`,
+
+	`drop table legacy_flow`,
+	`drop table legacy_flow_connection`,
+}
+
+// A migration that only runs statements
+func migrateExecFunc(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// List a table's columns
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("select name from pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	columns := map[string]bool{}
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+
+	return columns, rows.Err()
+}
+
+// Bring unversioned captures up to the last unversioned schema: create missing tables, and
+// add columns that older versions of puffin did not write
+func migrateLegacySchema(tx *sql.Tx) error {
+	for _, create := range LEGACY_TABLES {
+		if _, err := tx.Exec(create); err != nil {
+			return err
+		}
+	}
+
+	for table, added := range LEGACY_COLUMNS {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+
+		for _, column := range added {
+			if columns[strings.ToLower(column[0])] {
+				continue
+			}
+
+			if _, err := tx.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column[0], column[1])); err != nil {
+				return err
+			}
+		}
+	}
+
+	// older captures declared users with a missing comma, as a single column
+	columns, err := tableColumns(tx, "users")
+	if err != nil {
+		return err
+	}
+
+	if !columns["username"] {
+		if _, err := tx.Exec("drop table users"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(LEGACY_TABLES["users"]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Move the unversioned tables aside, create the normalised tables, and copy everything across
+func migrateNormalisedSchema(tx *sql.Tx) error {
+	for table := range LEGACY_TABLES {
+		if _, err := tx.Exec(fmt.Sprintf("alter table %s rename to legacy_%s", table, table)); err != nil {
+			return err
+		}
+	}
+
+	for _, statement := range NORMALISED_TABLES {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	for _, statement := range LEGACY_COPY {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("copying legacy capture: %v", err)
+		}
+	}
+
+	for table := range LEGACY_TABLES {
+		if _, err := tx.Exec("drop table legacy_" + table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The schema version of a capture database; zero if it is empty or unversioned
+func CaptureSchemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(CREATE_SCHEMA_VERSION_TABLE); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version)
+
+	return version, err
+}
+
+// Apply every migration newer than the database, each in its own transaction
+func MigrateCaptureDB(db *sql.DB) error {
+	version, err := CaptureSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	latest := MIGRATIONS[len(MIGRATIONS)-1].Version
+	if version > latest {
+		return fmt.Errorf("capture has schema version %d, but this puffin only supports up to %d", version, latest)
+	}
+
+	for _, migration := range MIGRATIONS {
+		if migration.Version <= version {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := migration.Apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating capture to schema version %d: %v", migration.Version, err)
+		}
+
+		_, err = tx.Exec("insert into schema_version (version, description, applied) values (?, ?, ?)", migration.Version, migration.Description, time.Now().UnixNano())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
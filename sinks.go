@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SINK_QUEUE_SIZE = 64                     // alerts buffered per sink before new ones are dropped
+	SINK_TIMEOUT    = 10 * time.Second       // default timeout for a webhook request or exec hook
+	WEBHOOK_RETRIES = 3                      // default retries for a failed webhook
+	WEBHOOK_BACKOFF = 500 * time.Millisecond // doubled after each failed attempt
+	SYSLOG_ADDRESS  = "/dev/log"             // the local syslog (or journald) socket
+	SYSLOG_PRI      = 3*8 + 4                // facility daemon, severity warning
+	SYSLOG_SD_ID    = "puffin@32473"
+)
+
+// RFC 5424 timestamps have at most six fractional digits, so RFC3339Nano's nine are rejected
+const SYSLOG_TIME_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
+
+// At most Count alerts are delivered per sliding window
+type SinkRateLimit struct {
+	Count int          `yaml:"count"`
+	Per   RuleDuration `yaml:"per"`
+}
+
+// A destination for alerts, as configured in a rules file
+type SinkConfig struct {
+	Type      string            `yaml:"type"`    // webhook, syslog, exec or stderr
+	URL       string            `yaml:"url"`     // webhook: where alerts are POSTed
+	Headers   map[string]string `yaml:"headers"` // webhook: extra request headers
+	Retries   *int              `yaml:"retries"` // webhook: retries after a failed delivery
+	Address   string            `yaml:"address"` // syslog: a unix socket path, or udp:// or tcp:// host:port
+	Tag       string            `yaml:"tag"`     // syslog: the APP-NAME
+	Command   []string          `yaml:"command"` // exec: the command & arguments to run
+	Timeout   RuleDuration      `yaml:"timeout"` // webhook & exec
+	RateLimit *SinkRateLimit    `yaml:"rate_limit"`
+	Dedup     RuleDuration      `yaml:"dedup"` // suppress repeats of a rule & group within this window
+}
+
+// Delivers a single alert
+type AlertSink interface {
+	Send(alert AlertEvent) error
+}
+
+// Writes alerts as JSON lines to stderr, so they don't interleave with JSON reports on stdout
+type StderrSink struct{}
+
+func (sink StderrSink) Send(alert AlertEvent) error {
+	bytes, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stderr, string(bytes))
+	return err
+}
+
+// POSTs each alert as JSON, retrying with a backoff on network errors and 5xx or 429 responses
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+	Retries int
+	client  *http.Client
+}
+
+func (sink *WebhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range sink.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := sink.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("webhook %s: %s", sink.URL, res.Status)
+	}
+	if res.StatusCode >= 300 {
+		return false, fmt.Errorf("webhook %s: %s", sink.URL, res.Status)
+	}
+
+	return false, nil
+}
+
+func (sink *WebhookSink) Send(alert AlertEvent) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	backoff := WEBHOOK_BACKOFF
+	for attempt := 0; ; attempt++ {
+		retry, err := sink.post(body)
+		if err == nil || !retry || attempt >= sink.Retries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Sends each alert to syslog as an RFC 5424 message, with the alert's details as structured data
+type SyslogSink struct {
+	Network  string
+	Address  string
+	Tag      string
+	hostname string
+	conn     net.Conn
+}
+
+// Escape a structured-data parameter value, per RFC 5424 section 6.3.3
+func escapeSDValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// Format an alert as an RFC 5424 syslog message
+func FormatSyslogMessage(alert AlertEvent, hostname string, tag string) string {
+	params := [][2]string{
+		{"rule", alert.Rule},
+		{"group", alert.Group},
+		{"bytes", fmt.Sprint(alert.Bytes)},
+		{"windowBytes", fmt.Sprint(alert.WindowBytes)},
+		{"connections", fmt.Sprint(alert.Connections)},
+		{"pid", fmt.Sprint(alert.ProcessSocket.Pid)},
+		{"command", alert.ProcessSocket.Command},
+		{"user", alert.ProcessSocket.UserName},
+	}
+
+	if conn := alert.ProcessSocket.Connection; conn != nil {
+		params = append(params,
+			[2]string{"protocol", conn.GetType()},
+			[2]string{"remAddr", conn.GetRemAddr().String()},
+			[2]string{"remPort", fmt.Sprint(conn.GetRemPort())})
+	}
+
+	data := "[" + SYSLOG_SD_ID
+	for _, param := range params {
+		data += " " + param[0] + `="` + escapeSDValue(param[1]) + `"`
+	}
+	data += "]"
+
+	msg := alert.Rule
+	if len(alert.Description) > 0 {
+		msg += ": " + alert.Description
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		SYSLOG_PRI, alert.Time.Format(SYSLOG_TIME_FORMAT), hostname, tag, os.Getpid(), alert.Type, data, msg)
+}
+
+func (sink *SyslogSink) Send(alert AlertEvent) error {
+	if sink.conn == nil {
+		conn, err := net.Dial(sink.Network, sink.Address)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+
+	msg := FormatSyslogMessage(alert, sink.hostname, sink.Tag)
+
+	// stream transports need framing; use octet-counting (RFC 6587)
+	if sink.Network == "tcp" || sink.Network == "unix" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	if _, err := sink.conn.Write([]byte(msg)); err != nil {
+		// reconnect on the next alert
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// Runs a command for each alert, with the alert as PUFFIN_* environment variables and as JSON on stdin
+type ExecSink struct {
+	Command []string
+	Timeout time.Duration
+}
+
+// The environment variables describing an alert
+func AlertEnvironment(alert AlertEvent) []string {
+	pidConn := alert.ProcessSocket
+	env := []string{
+		"PUFFIN_EVENT_TYPE=" + alert.Type,
+		"PUFFIN_RULE=" + alert.Rule,
+		"PUFFIN_DESCRIPTION=" + alert.Description,
+		"PUFFIN_TIME=" + alert.Time.Format(time.RFC3339Nano),
+		"PUFFIN_GROUP_BY=" + alert.GroupBy,
+		"PUFFIN_GROUP=" + alert.Group,
+		"PUFFIN_BYTES=" + fmt.Sprint(alert.Bytes),
+		"PUFFIN_WINDOW_BYTES=" + fmt.Sprint(alert.WindowBytes),
+		"PUFFIN_CONNECTIONS=" + fmt.Sprint(alert.Connections),
+		"PUFFIN_PID=" + fmt.Sprint(pidConn.Pid),
+		"PUFFIN_START_TIME=" + fmt.Sprint(pidConn.StartTime),
+		"PUFFIN_USER=" + pidConn.UserName,
+		"PUFFIN_COMMAND=" + pidConn.Command,
+		"PUFFIN_COMMAND_LINE=" + pidConn.CommandLine,
+		"PUFFIN_CGROUP=" + pidConn.Cgroup,
+	}
+
+	if conn := pidConn.Connection; conn != nil {
+		env = append(env,
+			"PUFFIN_PROTOCOL="+conn.GetType(),
+			"PUFFIN_LOCAL_ADDR="+conn.GetLocalAddr().String(),
+			"PUFFIN_LOCAL_PORT="+fmt.Sprint(conn.GetLocalPort()),
+			"PUFFIN_REMOTE_ADDR="+conn.GetRemAddr().String(),
+			"PUFFIN_REMOTE_PORT="+fmt.Sprint(conn.GetRemPort()))
+	}
+
+	return env
+}
+
+func (sink *ExecSink) Send(alert AlertEvent) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sink.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, sink.Command[0], sink.Command[1:]...)
+	cmd.Env = append(os.Environ(), AlertEnvironment(alert)...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("exec hook %s: %v", sink.Command[0], err)
+	}
+
+	return nil
+}
+
+// Drops alerts that repeat a rule & group within the dedup window, or exceed the rate limit
+type SinkThrottle struct {
+	RateLimit *SinkRateLimit
+	Dedup     time.Duration
+	sent      []time.Time
+	lastSent  map[string]time.Time
+}
+
+// Should an alert be delivered now? Alerts only count against the limits once recorded
+func (throttle *SinkThrottle) Allow(alert AlertEvent, now time.Time) bool {
+	// forget groups outside the dedup window, so the map doesn't grow with every group
+	for key, last := range throttle.lastSent {
+		if now.Sub(last) >= throttle.Dedup {
+			delete(throttle.lastSent, key)
+		}
+	}
+
+	if _, ok := throttle.lastSent[alert.Rule+"/"+alert.Group]; ok {
+		return false
+	}
+
+	if limit := throttle.RateLimit; limit != nil {
+		recent := []time.Time{}
+		for _, sent := range throttle.sent {
+			if now.Sub(sent) < time.Duration(limit.Per) {
+				recent = append(recent, sent)
+			}
+		}
+		throttle.sent = recent
+
+		if len(throttle.sent) >= limit.Count {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Count an alert that was queued for delivery against the limits
+func (throttle *SinkThrottle) Record(alert AlertEvent, now time.Time) {
+	if throttle.RateLimit != nil {
+		throttle.sent = append(throttle.sent, now)
+	}
+
+	if throttle.Dedup > 0 {
+		throttle.lastSent[alert.Rule+"/"+alert.Group] = now
+	}
+}
+
+// A sink, with its throttle and queue of pending alerts
+type queuedSink struct {
+	name     string
+	sink     AlertSink
+	throttle *SinkThrottle
+	queue    chan AlertEvent
+}
+
+// Delivers alerts to every sink. Each sink has its own queue and goroutine, so a slow or
+// failing sink does not delay the others, or capture
+type AlertDispatcher struct {
+	lock  sync.Mutex
+	sinks []*queuedSink
+}
+
+// Construct a sink from its configuration
+func NewAlertSink(config SinkConfig) (AlertSink, error) {
+	timeout := time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = SINK_TIMEOUT
+	}
+
+	switch config.Type {
+	case "stderr":
+		return StderrSink{}, nil
+
+	case "webhook":
+		if _, err := url.ParseRequestURI(config.URL); err != nil {
+			return nil, fmt.Errorf("webhook: invalid url %q", config.URL)
+		}
+
+		retries := WEBHOOK_RETRIES
+		if config.Retries != nil {
+			retries = *config.Retries
+		}
+
+		return &WebhookSink{config.URL, config.Headers, retries, &http.Client{Timeout: timeout}}, nil
+
+	case "syslog":
+		network, address := "unixgram", SYSLOG_ADDRESS
+		if len(config.Address) > 0 {
+			address = config.Address
+		}
+
+		for _, scheme := range []string{"udp", "tcp", "unix", "unixgram"} {
+			if strings.HasPrefix(address, scheme+"://") {
+				network, address = scheme, strings.TrimPrefix(address, scheme+"://")
+			}
+		}
+
+		tag := config.Tag
+		if len(tag) == 0 {
+			tag = "puffin"
+		}
+
+		hostname, err := os.Hostname()
+		if err != nil || len(hostname) == 0 {
+			hostname = "-"
+		}
+
+		return &SyslogSink{network, address, tag, hostname, nil}, nil
+
+	case "exec":
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("exec: a command is required")
+		}
+
+		return &ExecSink{config.Command, timeout}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+}
+
+// Open every configured sink, or stderr if none are configured
+func NewAlertDispatcher(configs []SinkConfig) (*AlertDispatcher, error) {
+	if len(configs) == 0 {
+		configs = []SinkConfig{{Type: "stderr"}}
+	}
+
+	dispatcher := &AlertDispatcher{}
+
+	for idx, config := range configs {
+		sink, err := NewAlertSink(config)
+		if err != nil {
+			return nil, fmt.Errorf("sink %d: %v", idx+1, err)
+		}
+
+		if config.RateLimit != nil && (config.RateLimit.Count <= 0 || config.RateLimit.Per <= 0) {
+			return nil, fmt.Errorf("sink %d: a rate_limit needs a positive count and 'per' duration", idx+1)
+		}
+
+		queued := &queuedSink{
+			name:     config.Type,
+			sink:     sink,
+			throttle: &SinkThrottle{config.RateLimit, time.Duration(config.Dedup), nil, map[string]time.Time{}},
+			queue:    make(chan AlertEvent, SINK_QUEUE_SIZE),
+		}
+
+		dispatcher.sinks = append(dispatcher.sinks, queued)
+		go queued.deliver()
+	}
+
+	return dispatcher, nil
+}
+
+func (queued *queuedSink) deliver() {
+	for alert := range queued.queue {
+		if err := queued.sink.Send(alert); err != nil {
+			log.Printf("%s sink: could not deliver alert %s: %v", queued.name, alert.Rule, err)
+		}
+	}
+}
+
+// Queue alerts for delivery, without blocking. Alerts are dropped if a sink's queue is full
+func (dispatcher *AlertDispatcher) Dispatch(alerts []AlertEvent, now time.Time) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	for _, alert := range alerts {
+		for _, queued := range dispatcher.sinks {
+			if !queued.throttle.Allow(alert, now) {
+				continue
+			}
+
+			select {
+			case queued.queue <- alert:
+				queued.throttle.Record(alert, now)
+			default:
+				log.Printf("%s sink: queue full, dropping alert %s", queued.name, alert.Rule)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAlert() AlertEvent {
+	conn := &TCPConnection{1, net.ParseIP("10.0.0.1"), 40000, net.ParseIP("10.0.0.2"), 443, 1, 0, 0, 1000, 1234}
+
+	return AlertEvent{
+		Type:          "alert",
+		Rule:          "large-upload",
+		Description:   `sent "a lot"`,
+		Time:          time.Date(2026, 1, 2, 3, 4, 5, 123456789, time.UTC),
+		GroupBy:       "process",
+		Group:         "curl]",
+		Bytes:         2048,
+		WindowBytes:   1024,
+		Connections:   1,
+		ProcessSocket: PidSocket{"alice", "curl", "curl https://example.com", 42, 100, nil, "/user.slice", conn, time.Time{}},
+	}
+}
+
+func TestWebhookSinkRetriesServerErrors(t *testing.T) {
+	var lock sync.Mutex
+	var bodies [][]byte
+	var headers []http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+		bodies = append(bodies, body)
+		headers = append(headers, req.Header.Clone())
+
+		// fail the first attempt, so the sink must retry
+		if len(bodies) == 1 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	sink, err := NewAlertSink(SinkConfig{Type: "webhook", URL: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := testAlert()
+	if err := sink.Send(alert); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(bodies) != 2 {
+		t.Fatalf("webhook received %d requests, expected 2", len(bodies))
+	}
+
+	expected, err := json.Marshal(alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bodies[1]) != string(expected) {
+		t.Errorf("webhook received %s, expected %s", bodies[1], expected)
+	}
+
+	if got := headers[1].Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization header is %q", got)
+	}
+	if got := headers[1].Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type header is %q", got)
+	}
+}
+
+func TestWebhookSinkDoesNotRetryClientErrors(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+
+		res.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink, err := NewAlertSink(SinkConfig{Type: "webhook", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Send(testAlert()); err == nil {
+		t.Fatal("expected an error for a 400 response")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if requests != 1 {
+		t.Errorf("webhook received %d requests, expected 1", requests)
+	}
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG, with at most six fractional digits
+var syslogPattern = regexp.MustCompile(`^<28>1 (\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{1,6}(?:Z|[+-]\d\d:\d\d)) \S+ puffin-test \d+ alert \[puffin@32473 (.*)\] (.*)$`)
+
+func checkSyslogMessage(t *testing.T, msg string) {
+	t.Helper()
+
+	match := syslogPattern.FindStringSubmatch(msg)
+	if match == nil {
+		t.Fatalf("not an RFC 5424 message: %q", msg)
+	}
+
+	if match[1] != "2026-01-02T03:04:05.123456Z" {
+		t.Errorf("timestamp is %q", match[1])
+	}
+
+	for _, param := range []string{`rule="large-upload"`, `group="curl\]"`, `bytes="2048"`, `pid="42"`, `remAddr="10.0.0.2"`, `remPort="443"`} {
+		if !strings.Contains(match[2], param) {
+			t.Errorf("structured data %q is missing %s", match[2], param)
+		}
+	}
+
+	if match[3] != `large-upload: sent "a lot"` {
+		t.Errorf("message is %q", match[3])
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sink, err := NewAlertSink(SinkConfig{Type: "syslog", Address: "udp://" + listener.LocalAddr().String(), Tag: "puffin-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Send(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64*1024)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	count, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSyslogMessage(t, string(buf[:count]))
+}
+
+// Send two alerts over one stream connection, so framing must separate them
+func testSyslogStream(t *testing.T, listener net.Listener, address string) {
+
+	messages := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(messages)
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for {
+			// MSG-LEN SP SYSLOG-MSG
+			var size int
+			if _, err := fmt.Fscanf(reader, "%d ", &size); err != nil {
+				close(messages)
+				return
+			}
+
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				close(messages)
+				return
+			}
+			messages <- string(msg)
+		}
+	}()
+
+	sink, err := NewAlertSink(SinkConfig{Type: "syslog", Address: address, Tag: "puffin-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := 0; idx < 2; idx++ {
+		if err := sink.Send(testAlert()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for idx := 0; idx < 2; idx++ {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				t.Fatal("syslog listener could not read a framed message")
+			}
+			checkSyslogMessage(t, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a syslog message")
+		}
+	}
+}
+
+func TestSyslogSinkTCPOctetCounting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	testSyslogStream(t, listener, "tcp://"+listener.Addr().String())
+}
+
+func TestSyslogSinkUnixStreamOctetCounting(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "log")
+
+	listener, err := net.Listen("unix", fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	testSyslogStream(t, listener, "unix://"+fpath)
+}
+
+func TestSinkThrottleCountsOnlyQueuedAlerts(t *testing.T) {
+	now := time.Now()
+	queued := &queuedSink{"test", nil, &SinkThrottle{&SinkRateLimit{1, RuleDuration(time.Minute)}, time.Minute, nil, map[string]time.Time{}}, make(chan AlertEvent)}
+	dispatcher := &AlertDispatcher{sinks: []*queuedSink{queued}}
+
+	// nothing reads the unbuffered queue, so the alert is dropped
+	dispatcher.Dispatch([]AlertEvent{testAlert()}, now)
+	if len(queued.throttle.sent) != 0 || len(queued.throttle.lastSent) != 0 {
+		t.Fatal("a dropped alert counted against the limits")
+	}
+
+	queued.queue = make(chan AlertEvent, 2)
+	dispatcher.Dispatch([]AlertEvent{testAlert(), testAlert()}, now)
+	if len(queued.queue) != 1 {
+		t.Fatalf("queued %d alerts, expected the duplicate to be dropped", len(queued.queue))
+	}
+	<-queued.queue
+
+	// once the dedup window passes, the group is forgotten
+	later := now.Add(2 * time.Minute)
+	dispatcher.Dispatch([]AlertEvent{testAlert()}, later)
+	if len(queued.queue) != 1 || len(queued.throttle.lastSent) != 1 || !queued.throttle.lastSent["large-upload/curl]"].Equal(later) {
+		t.Errorf("expected the alert to be sent again, with only its group remembered")
+	}
+}
+
+func TestFormatSyslogMessageTruncatesFractionalSeconds(t *testing.T) {
+	alert := testAlert()
+	alert.Time = time.Date(2026, 1, 2, 3, 4, 5, 999999999, time.FixedZone("", 2*60*60))
+
+	msg := FormatSyslogMessage(alert, "host", "puffin")
+	if !strings.HasPrefix(msg, "<28>1 2026-01-02T03:04:05.999999+02:00 host puffin ") {
+		t.Errorf("unexpected header in %q", msg)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// An address as one host sees it, and the address the other end of the connection sees
+type AddressTranslation struct {
+	From string `yaml:"from"` // an IP, or IP:port
+	To   string `yaml:"to"`
+}
+
+type AddressMapFile struct {
+	Translations []AddressTranslation `yaml:"translations"`
+}
+
+// An address, and optionally a port
+type addressPort struct {
+	addr string
+	port uint64 // zero for every port
+}
+
+func parseAddressPort(str string) (addressPort, error) {
+	host, portStr, err := net.SplitHostPort(str)
+	if err != nil {
+		host, portStr = str, ""
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addressPort{}, fmt.Errorf("%q is not an IP or IP:port", str)
+	}
+	if len(portStr) == 0 {
+		return addressPort{ip.String(), 0}, nil
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return addressPort{}, fmt.Errorf("%q has an invalid port", str)
+	}
+
+	return addressPort{ip.String(), port}, nil
+}
+
+// Translates the addresses hosts see into those their peers see, so connections through static
+// or port-forwarding NAT can be stitched. A translation for an IP:port wins over one for the IP
+type AddressMap struct {
+	translations map[addressPort]addressPort
+}
+
+// Load an address-translation map from a YAML file
+func LoadAddressMap(fpath string) (*AddressMap, error) {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var file AddressMapFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+
+	nat := &AddressMap{map[addressPort]addressPort{}}
+
+	for idx, translation := range file.Translations {
+		from, err := parseAddressPort(translation.From)
+		if err != nil {
+			return nil, fmt.Errorf("translation %d: from: %v", idx+1, err)
+		}
+
+		to, err := parseAddressPort(translation.To)
+		if err != nil {
+			return nil, fmt.Errorf("translation %d: to: %v", idx+1, err)
+		}
+
+		if from.port == 0 && to.port != 0 {
+			return nil, fmt.Errorf("translation %d: a whole address can't be translated to a single port", idx+1)
+		}
+
+		nat.translations[from] = to
+	}
+
+	return nat, nil
+}
+
+// The address & port a peer would see; untranslated addresses are returned as they are
+func (nat *AddressMap) Translate(addr string, port uint64) (string, uint64) {
+	if nat == nil {
+		return addr, port
+	}
+
+	if to, ok := nat.translations[addressPort{addr, port}]; ok {
+		if to.port == 0 {
+			return to.addr, port
+		}
+		return to.addr, to.port
+	}
+
+	if to, ok := nat.translations[addressPort{addr, 0}]; ok {
+		return to.addr, port
+	}
+
+	return addr, port
+}
+
+// One end of a stitched connection
+type StitchEndpoint struct {
+	Host      string `json:"host"`
+	Pid       int    `json:"pid"`
+	StartTime uint64 `json:"start_time"`
+	Command   string `json:"command"`
+	Addr      string `json:"addr"`
+	Port      uint64 `json:"port"`
+}
+
+// A connection both ends of which were captured, e.g. on two hosts reporting to a collector
+type StitchedConnection struct {
+	Protocol   string         `json:"protocol"`
+	Client     StitchEndpoint `json:"client"`
+	Server     StitchEndpoint `json:"server"`
+	BytesOut   int            `json:"bytes_out"`  // client to server
+	BytesIn    int            `json:"bytes_in"`   // server to client
+	Open       bool           `json:"open"`       // while either end is open
+	Translated bool           `json:"translated"` // matched through the address-translation map
+}
+
+func stitchEndpoint(conn *APIConnection) StitchEndpoint {
+	return StitchEndpoint{conn.Host, conn.Pid, conn.StartTime, conn.Command, conn.LocalAddr, conn.LocalPort}
+}
+
+// A connection's 4-tuple as its peer would see it
+type stitchTuple struct {
+	localAddr  string
+	localPort  uint64
+	remAddr    string
+	remPort    uint64
+	translated bool
+}
+
+func translateConnection(nat *AddressMap, conn *APIConnection) stitchTuple {
+	localAddr, localPort := nat.Translate(conn.LocalAddr, conn.LocalPort)
+	remAddr, remPort := nat.Translate(conn.RemAddr, conn.RemPort)
+	translated := localAddr != conn.LocalAddr || localPort != conn.LocalPort || remAddr != conn.RemAddr || remPort != conn.RemPort
+
+	return stitchTuple{localAddr, localPort, remAddr, remPort, translated}
+}
+
+func (tuple stitchTuple) key(protocol string) string {
+	return fmt.Sprintf("%s %s:%d %s:%d", protocol, tuple.localAddr, tuple.localPort, tuple.remAddr, tuple.remPort)
+}
+
+// The key of the connection at the other end
+func (tuple stitchTuple) mirrorKey(protocol string) string {
+	return fmt.Sprintf("%s %s:%d %s:%d", protocol, tuple.remAddr, tuple.remPort, tuple.localAddr, tuple.localPort)
+}
+
+func isLoopback(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The ports listened on, by host & protocol. Sockets without a remote port are listening
+// (or unconnected, for UDP)
+type listeningPorts map[string]bool
+
+func listenKey(conn *APIConnection) string {
+	return conn.Host + " " + conn.Protocol + " " + strconv.FormatUint(conn.LocalPort, 10)
+}
+
+func findListeningPorts(conns []APIConnection) listeningPorts {
+	listening := listeningPorts{}
+	for idx := range conns {
+		if conns[idx].RemPort == 0 {
+			listening[listenKey(&conns[idx])] = true
+		}
+	}
+
+	return listening
+}
+
+// Whether a connection is to a port its host listens on, i.e. it was accepted rather than made
+func (listening listeningPorts) accepted(conn *APIConnection) bool {
+	return listening[listenKey(conn)]
+}
+
+// Match connections whose 4-tuples mirror each other, after translation. Loopback connections
+// only match on the same host, since every host has its own. The end that listens on its port
+// is the server; failing that, the end with the lower port. Returns the stitched connections,
+// and how many connections had no captured peer
+func StitchConnections(conns []APIConnection, nat *AddressMap) ([]StitchedConnection, int) {
+	stitched, matched := stitchConnections(conns, nat)
+	unmatched := 0
+
+	for idx := range conns {
+		if conns[idx].RemPort != 0 && !matched[idx] {
+			unmatched++
+		}
+	}
+
+	return stitched, unmatched
+}
+
+// Stitch connections, returning which (by index) were matched
+func stitchConnections(conns []APIConnection, nat *AddressMap) ([]StitchedConnection, map[int]bool) {
+	listening := findListeningPorts(conns)
+	tuples := make([]stitchTuple, len(conns))
+	byKey := map[string][]int{}
+
+	for idx := range conns {
+		conn := &conns[idx]
+		if conn.RemPort == 0 {
+			continue
+		}
+
+		tuples[idx] = translateConnection(nat, conn)
+		key := tuples[idx].key(conn.Protocol)
+		byKey[key] = append(byKey[key], idx)
+	}
+
+	stitched := []StitchedConnection{}
+	matched := map[int]bool{}
+
+	for idx := range conns {
+		conn := &conns[idx]
+		if conn.RemPort == 0 || matched[idx] {
+			continue
+		}
+
+		tuple := tuples[idx]
+		loopback := isLoopback(tuple.localAddr) || isLoopback(tuple.remAddr)
+
+		peerIdx := -1
+		for _, candidate := range byKey[tuple.mirrorKey(conn.Protocol)] {
+			if candidate != idx && !matched[candidate] && (!loopback || conns[candidate].Host == conn.Host) {
+				peerIdx = candidate
+				break
+			}
+		}
+
+		if peerIdx < 0 {
+			continue
+		}
+
+		matched[idx], matched[peerIdx] = true, true
+		client, server := conn, &conns[peerIdx]
+
+		if clientListens, serverListens := listening.accepted(client), listening.accepted(server); clientListens != serverListens {
+			if clientListens {
+				client, server = server, client
+			}
+		} else if client.LocalPort < server.LocalPort {
+			client, server = server, client
+		}
+
+		link := StitchedConnection{
+			Protocol:   conn.Protocol,
+			Client:     stitchEndpoint(client),
+			Server:     stitchEndpoint(server),
+			BytesOut:   client.BytesOut,
+			BytesIn:    client.BytesIn,
+			Open:       client.Open || server.Open,
+			Translated: tuple.translated || tuples[peerIdx].translated,
+		}
+
+		// each end may have seen traffic the other missed, e.g. before its capture started
+		if server.BytesIn > link.BytesOut {
+			link.BytesOut = server.BytesIn
+		}
+		if server.BytesOut > link.BytesIn {
+			link.BytesIn = server.BytesOut
+		}
+
+		stitched = append(stitched, link)
+	}
+
+	return stitched, matched
+}
+
+// A service: the processes running a command on a host
+type DependencyNode struct {
+	Id      string `json:"id"`
+	Host    string `json:"host,omitempty"`
+	Command string `json:"command"`
+	Pids    []int  `json:"pids"`
+}
+
+// The connections one service made to another over a protocol
+type DependencyEdge struct {
+	Source      string   `json:"source"` // the client
+	Target      string   `json:"target"` // the server
+	Protocol    string   `json:"protocol"`
+	Ports       []uint64 `json:"ports"` // the server's ports
+	Connections int      `json:"connections"`
+	BytesOut    int      `json:"bytes_out"` // client to server
+	BytesIn     int      `json:"bytes_in"`
+}
+
+// Which services call which, from connections stitched across hosts
+type DependencyGraph struct {
+	Nodes       []DependencyNode     `json:"nodes"`
+	Edges       []DependencyEdge     `json:"edges"`
+	Connections []StitchedConnection `json:"connections"`
+	Unmatched   int                  `json:"unmatched"` // connections whose peer was not captured
+}
+
+func serviceId(host string, command string) string {
+	if len(host) == 0 {
+		return command
+	}
+	return host + COLLECTOR_HOST_SEPARATOR + command
+}
+
+// Stitch connections, then group them into calls between services
+func BuildDependencyGraph(conns []APIConnection, nat *AddressMap) DependencyGraph {
+	stitched, unmatched := StitchConnections(conns, nat)
+	graph := DependencyGraph{[]DependencyNode{}, []DependencyEdge{}, stitched, unmatched}
+
+	nodes := map[string]*DependencyNode{}
+	pids := map[string]map[int]bool{}
+	addNode := func(end StitchEndpoint) string {
+		id := serviceId(end.Host, end.Command)
+		if _, ok := nodes[id]; !ok {
+			nodes[id] = &DependencyNode{id, end.Host, end.Command, []int{}}
+			pids[id] = map[int]bool{}
+		}
+		if !pids[id][end.Pid] {
+			pids[id][end.Pid] = true
+			nodes[id].Pids = append(nodes[id].Pids, end.Pid)
+		}
+		return id
+	}
+
+	edges := map[string]*DependencyEdge{}
+	ports := map[string]map[uint64]bool{}
+
+	for _, link := range stitched {
+		source, target := addNode(link.Client), addNode(link.Server)
+		key := source + "\x00" + target + "\x00" + link.Protocol
+
+		edge, ok := edges[key]
+		if !ok {
+			edge = &DependencyEdge{Source: source, Target: target, Protocol: link.Protocol, Ports: []uint64{}}
+			edges[key] = edge
+			ports[key] = map[uint64]bool{}
+		}
+
+		if !ports[key][link.Server.Port] {
+			ports[key][link.Server.Port] = true
+			edge.Ports = append(edge.Ports, link.Server.Port)
+		}
+		edge.Connections++
+		edge.BytesOut += link.BytesOut
+		edge.BytesIn += link.BytesIn
+	}
+
+	for _, node := range nodes {
+		sort.Ints(node.Pids)
+		graph.Nodes = append(graph.Nodes, *node)
+	}
+	for _, edge := range edges {
+		sort.Slice(edge.Ports, func(i, j int) bool { return edge.Ports[i] < edge.Ports[j] })
+		graph.Edges = append(graph.Edges, *edge)
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].Id < graph.Nodes[j].Id
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		left, right := graph.Edges[i], graph.Edges[j]
+		if left.BytesOut+left.BytesIn != right.BytesOut+right.BytesIn {
+			return left.BytesOut+left.BytesIn > right.BytesOut+right.BytesIn
+		}
+		return left.Source+left.Target+left.Protocol < right.Source+right.Target+right.Protocol
+	})
+
+	return graph
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	PACKET_STREAM_BUFFER   = 8192        // packets queued for the stream writer before capture blocks
+	PACKET_STREAM_BATCH    = 10000       // write once this many packets are pending...
+	PACKET_STREAM_INTERVAL = time.Second // ...or this often
+	PACKET_STREAM_PENDING  = 100000      // packets kept to retry while writes fail, before more are dropped
+	INSERT_BATCH_ROWS      = 500         // rows per multi-row insert
+)
+
+// Insert rows using multi-row inserts, in batches
+func InsertRows(db SQLExecutor, table string, columns []string, rows [][]interface{}) error {
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) values ", table, strings.Join(columns, ", "))
+
+	for start := 0; start < len(rows); start += INSERT_BATCH_ROWS {
+		end := start + INSERT_BATCH_ROWS
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		batch := rows[start:end]
+		args := make([]interface{}, 0, len(batch)*len(columns))
+		for _, row := range batch {
+			args = append(args, row...)
+		}
+
+		query := prefix + strings.TrimSuffix(strings.Repeat(placeholder+", ", len(batch)), ", ")
+		if _, err := db.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Streams packets into a capture database as they are captured, from a background goroutine.
+// Packets are staged by device & 4-tuple, and attributed to connections when the capture is flushed
+type PacketStream struct {
+	Path    string
+	db      *sql.DB
+	packets chan PacketData
+	syncs   chan chan error
+	done    chan error
+}
+
+func OpenPacketStream(fpath string) (*PacketStream, error) {
+	db, err := sql.Open("sqlite3", fpath+SQLITE_OPTIONS)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := MigrateCaptureDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	stream := &PacketStream{
+		Path:    fpath,
+		db:      db,
+		packets: make(chan PacketData, PACKET_STREAM_BUFFER),
+		syncs:   make(chan chan error),
+		done:    make(chan error),
+	}
+
+	go stream.run()
+	return stream, nil
+}
+
+// Write pending packets in a single transaction
+func (stream *PacketStream) write(pending []PacketData) error {
+	if len(pending) == 0 {
+		return nil
+	}
+
+	rows := make([][]interface{}, len(pending))
+	for idx, pkt := range pending {
+		rows[idx] = []interface{}{pkt.Device, pkt.GetId(), pkt.Size, pkt.Timestamp}
+	}
+
+	tx, err := stream.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := InsertRows(tx, "packet_stream", []string{"device", "flowId", "size", "time"}, rows); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (stream *PacketStream) run() {
+	pending := []PacketData{}
+	failed := false // the last write failed, so pending packets are retried on the next tick
+	dropped := 0    // packets discarded while writes failed, since the last sync
+
+	ticker := time.NewTicker(PACKET_STREAM_INTERVAL)
+	defer ticker.Stop()
+
+	add := func(pkt PacketData) {
+		if len(pending) >= PACKET_STREAM_PENDING {
+			dropped++
+			return
+		}
+		pending = append(pending, pkt)
+	}
+
+	// pending packets are only forgotten once written
+	flush := func() error {
+		err := stream.write(pending)
+		if failed = err != nil; !failed {
+			pending = pending[:0]
+		}
+		return err
+	}
+
+	// a sync fails if it can't write, or if packets were dropped since the last one
+	result := func(err error) error {
+		if err == nil && dropped > 0 {
+			err = fmt.Errorf("dropped %d packets that could not be written to %s", dropped, stream.Path)
+		}
+		dropped = 0
+		return err
+	}
+
+	for {
+		select {
+		case pkt, ok := <-stream.packets:
+			if !ok {
+				stream.done <- result(flush())
+				return
+			}
+
+			add(pkt)
+			if len(pending) < PACKET_STREAM_BATCH || failed {
+				continue
+			}
+
+		case reply := <-stream.syncs:
+			// the caller is blocked, so everything it has written is already queued
+			for drained := false; !drained; {
+				select {
+				case pkt := <-stream.packets:
+					add(pkt)
+				default:
+					drained = true
+				}
+			}
+
+			reply <- result(flush())
+			continue
+
+		case <-ticker.C:
+		}
+
+		if err := flush(); err != nil {
+			log.Printf("could not stream packets to %s, will retry: %v", stream.Path, err)
+		}
+	}
+}
+
+// Queue a packet to be written
+func (stream *PacketStream) Write(pkt PacketData) {
+	stream.packets <- pkt
+}
+
+// Write every queued packet, returning once they are committed
+func (stream *PacketStream) Sync() error {
+	reply := make(chan error)
+	stream.syncs <- reply
+
+	return <-reply
+}
+
+// Write every queued packet, and close the database
+func (stream *PacketStream) Close() error {
+	close(stream.packets)
+	err := <-stream.done
+
+	if closeErr := stream.db.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
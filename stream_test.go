@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPacketStreamRetriesFailedWrites(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "capture.db")
+
+	stream, err := OpenPacketStream(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	db, err := sql.Open("sqlite3", fpath+SQLITE_OPTIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	local, rem := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	write := func(count int) {
+		for idx := 0; idx < count; idx++ {
+			stream.Write(PacketData{"eth0", time.Now().UnixNano(), local, 40000, rem, 443, 100, IPPROTO_TCP, nil})
+		}
+	}
+
+	// writes fail while the staging table is missing
+	if _, err := db.Exec("alter table packet_stream rename to packet_stream_moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	write(10)
+	if err := stream.Sync(); err == nil {
+		t.Fatal("sync succeeded, but its packets could not be written")
+	}
+
+	if _, err := db.Exec("alter table packet_stream_moved rename to packet_stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	write(5)
+	if err := stream.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRow("select count(*) from packet_stream").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 15 {
+		t.Errorf("wrote %d packets, expected the failed ones to be retried for 15", count)
+	}
+}
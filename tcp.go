@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -37,48 +38,32 @@ func ProcHash(v6 bool) (string, error) {
 	return string(currHash.Sum(nil)), err
 }
 
-// Watch /proc/net/tcp and /proc/net/tcp6 for changes by emitting a file-change
-// periodically
-func NetTCPWatcher(tcpChan chan []Connection, pfs *procfs.FS) {
-	hashv4 := ""
-	hashv6 := ""
-
-	for {
-		changed := false
-		currHashv4, _ := ProcHash(false)
+// Read every IPv4 and IPv6 TCP connection
+func ReadTCPConnections(pfs *procfs.FS) []Connection {
+	mconns := make([]Connection, 0)
 
-		mconns := make([]Connection, 0)
+	for _, read := range []func() (procfs.NetTCP, error){pfs.NetTCP, pfs.NetTCP6} {
+		conns, _ := read()
 
-		if hashv4 != currHashv4 {
-			changed = true
-			hashv4 = currHashv4
-
-			conns, _ := pfs.NetTCP()
-			mconns = make([]Connection, len(conns))
-
-			for idx, conn := range conns {
-				tcpConn := TCPConnection{conn.Sl, conn.LocalAddr, conn.LocalPort, conn.RemAddr, conn.RemPort, conn.St, conn.TxQueue, conn.RxQueue, conn.UID, conn.Inode}
-				mconns[idx] = tcpConn
-			}
+		for _, conn := range conns {
+			mconns = append(mconns, TCPConnection{conn.Sl, conn.LocalAddr, conn.LocalPort, conn.RemAddr, conn.RemPort, conn.St, conn.TxQueue, conn.RxQueue, conn.UID, conn.Inode})
 		}
+	}
 
-		currHashv6, _ := ProcHash(false)
-
-		if hashv6 != currHashv6 {
-			changed = true
-			hashv6 = currHashv6
+	return mconns
+}
 
-			// todo expand array
-			conns, _ := pfs.NetTCP6()
+// Watch /proc/net/tcp and /proc/net/tcp6 for changes by emitting a file-change
+// periodically
+func NetTCPWatcher(tcpChan chan []Connection, pfs *procfs.FS) {
+	hash := ""
 
-			for _, conn := range conns {
-				tcpConn := TCPConnection{conn.Sl, conn.LocalAddr, conn.LocalPort, conn.RemAddr, conn.RemPort, conn.St, conn.TxQueue, conn.RxQueue, conn.UID, conn.Inode}
-				mconns = append(mconns, tcpConn)
-			}
-		}
+	for {
+		currHash, _ := ProcHash(false)
 
-		if changed {
-			tcpChan <- mconns
+		if hash != currHash {
+			hash = currHash
+			tcpChan <- ReadTCPConnections(pfs)
 		}
 
 		time.Sleep(500 * time.Millisecond)
@@ -107,6 +92,11 @@ func (tcp TCPConnection) GetST() uint64 {
 	return tcp.st
 }
 
+// Decode the numeric TCP state into its kernel name (ESTABLISHED, TIME_WAIT, ...)
+func (tcp TCPConnection) GetStateName() string {
+	return TCPStateName(tcp.st)
+}
+
 func (tcp TCPConnection) GetTxQueue() uint64 {
 	return tcp.txQueue
 }
@@ -148,3 +138,21 @@ func (tcp TCPConnection) GetInode() uint64 {
 func (conn TCPConnection) GetId() string {
 	return conn.GetLocalAddr().String() + fmt.Sprint(conn.GetLocalPort()) + conn.GetRemAddr().String() + fmt.Sprint(conn.GetRemPort())
 }
+
+// The connection fields are unexported, so marshal them explicitly (with a decoded state)
+func (tcp TCPConnection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":      tcp.GetType(),
+		"sl":        tcp.sl,
+		"localaddr": tcp.localAddr,
+		"localport": tcp.localPort,
+		"remaddr":   tcp.remAddr,
+		"remport":   tcp.remPort,
+		"st":        tcp.st,
+		"state":     tcp.GetStateName(),
+		"txqueue":   tcp.txQueue,
+		"rxqueue":   tcp.rxQueue,
+		"uid":       tcp.uid,
+		"inode":     tcp.inode,
+	})
+}
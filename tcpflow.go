@@ -0,0 +1,291 @@
+package main
+
+import "fmt"
+
+// Segments re-sent within this many nanoseconds of the previous segment are
+// assumed to be reordered in-flight rather than retransmitted (as Wireshark does)
+const OUT_OF_ORDER_THRESHOLD = int64(3_000_000)
+
+// TCP header information extracted from a packet, used for flow analysis
+type TCPSegment struct {
+	Seq        uint32
+	Ack        uint32
+	SYN        bool
+	ACK        bool
+	FIN        bool
+	RST        bool
+	Window     uint16
+	PayloadLen int
+}
+
+// Loss and latency indicators for a TCP connection, covering both directions
+type TCPFlowStats struct {
+	Retransmissions int   `json:"retransmissions"`
+	OutOfOrder      int   `json:"out_of_order"`
+	DuplicateAcks   int   `json:"duplicate_acks"`
+	ZeroWindows     int   `json:"zero_windows"`
+	HandshakeRTT    int64 `json:"handshake_rtt"` // SYN -> SYN-ACK in nanoseconds, zero if the handshake was not observed
+}
+
+// Combine the statistics of two directions, connections or flushes
+func (stats *TCPFlowStats) Add(other TCPFlowStats) {
+	stats.Retransmissions += other.Retransmissions
+	stats.OutOfOrder += other.OutOfOrder
+	stats.DuplicateAcks += other.DuplicateAcks
+	stats.ZeroWindows += other.ZeroWindows
+
+	if other.HandshakeRTT > stats.HandshakeRTT {
+		stats.HandshakeRTT = other.HandshakeRTT
+	}
+}
+
+// What we know about one direction of a TCP connection
+type tcpSenderState struct {
+	hasData  bool
+	maxEnd   uint32 // the highest sequence-number + length sent so far
+	lastData int64  // timestamp of the last segment carrying data
+	hasAck   bool
+	lastAck  uint32
+	lastWin  uint16
+	synTime  int64
+}
+
+// Analysis state for a TCP connection, keyed by the sending endpoint
+type TCPFlow struct {
+	Stats    TCPFlowStats
+	senders  map[string]*tcpSenderState
+	lastSeen int64 // timestamp of the latest segment
+}
+
+// Store TCP flow analysis by canonical connection-id
+type TCPFlowStore = map[string]*TCPFlow
+
+// Compare sequence-numbers, allowing for wraparound
+func seqBefore(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func endpointId(addr fmt.Stringer, port uint64) string {
+	return addr.String() + fmt.Sprint(port)
+}
+
+// The id of the same connection, seen from the opposite direction
+func (pkt *PacketData) GetReverseId() string {
+	return pkt.RemAddr.String() + fmt.Sprint(pkt.RemPort) + pkt.LocalAddr.String() + fmt.Sprint(pkt.LocalPort)
+}
+
+// A direction-independent connection-id, so both halves of a connection share analysis
+func (pkt *PacketData) GetCanonicalId() string {
+	if pkt.GetId() < pkt.GetReverseId() {
+		return pkt.GetId()
+	}
+
+	return pkt.GetReverseId()
+}
+
+// Update connection analysis with a single segment
+func (flow *TCPFlow) Observe(pkt PacketData) {
+	seg := pkt.TCP
+	src := endpointId(pkt.LocalAddr, pkt.LocalPort)
+	dst := endpointId(pkt.RemAddr, pkt.RemPort)
+
+	sender, ok := flow.senders[src]
+	if !ok {
+		sender = &tcpSenderState{}
+		flow.senders[src] = sender
+	}
+
+	flow.lastSeen = pkt.Timestamp
+
+	// handshake: remember when the SYN was sent, and time the reply
+	if seg.SYN && !seg.ACK {
+		sender.synTime = pkt.Timestamp
+	} else if seg.SYN && seg.ACK {
+		if peer, ok := flow.senders[dst]; ok && peer.synTime > 0 && flow.Stats.HandshakeRTT == 0 {
+			flow.Stats.HandshakeRTT = pkt.Timestamp - peer.synTime
+		}
+	}
+
+	// SYN and FIN each consume a sequence number
+	length := uint32(seg.PayloadLen)
+	if seg.SYN || seg.FIN {
+		length++
+	}
+
+	if length > 0 {
+		end := seg.Seq + length
+
+		if sender.hasData && seqBefore(seg.Seq, sender.maxEnd) {
+			if pkt.Timestamp-sender.lastData < OUT_OF_ORDER_THRESHOLD {
+				flow.Stats.OutOfOrder++
+			} else {
+				flow.Stats.Retransmissions++
+			}
+		}
+
+		if !sender.hasData || seqBefore(sender.maxEnd, end) {
+			sender.maxEnd = end
+		}
+
+		sender.hasData = true
+		sender.lastData = pkt.Timestamp
+	}
+
+	if seg.RST {
+		return
+	}
+
+	// zero-window: count each time the receiver's window closes
+	if seg.Window == 0 && (!sender.hasAck || sender.lastWin != 0) {
+		flow.Stats.ZeroWindows++
+	}
+
+	// duplicate ACK: a pure ACK repeating the previous ACK and window
+	if seg.ACK {
+		if length == 0 && sender.hasAck && seg.Ack == sender.lastAck && seg.Window == sender.lastWin {
+			flow.Stats.DuplicateAcks++
+		}
+
+		sender.hasAck = true
+		sender.lastAck = seg.Ack
+	}
+
+	sender.lastWin = seg.Window
+}
+
+// Analyse a TCP packet, and copy the connection's updated statistics onto the stored data for
+// one direction: the canonical one if it has traffic, otherwise the other. The statistics cover
+// both directions, so they are cleared from the direction not chosen rather than counted twice
+func TrackTCPFlow(flows TCPFlowStore, store MachineNetworkStorage, pkt PacketData) {
+	if pkt.TCP == nil {
+		return
+	}
+
+	id := pkt.GetCanonicalId()
+	flow, ok := flows[id]
+	if !ok {
+		flow = &TCPFlow{senders: map[string]*tcpSenderState{}}
+		flows[id] = flow
+	}
+
+	flow.Observe(pkt)
+
+	other := pkt.GetId()
+	if other == id {
+		other = pkt.GetReverseId()
+	}
+
+	conns := store[pkt.Device]
+	if _, ok := conns[id]; !ok {
+		id, other = other, id
+	}
+
+	if tgt, ok := conns[id]; ok {
+		tgt.TCPFlow = flow.Stats
+		conns[id] = tgt
+	}
+	if tgt, ok := conns[other]; ok {
+		tgt.TCPFlow = TCPFlowStats{}
+		conns[other] = tgt
+	}
+}
+
+// A connection's flow statistics on a device, whichever direction holds them
+func connectionTCPFlow(conns map[string]StoredConnectionData, pidConn PidSocket) (TCPFlowStats, bool) {
+	out, hasOut := conns[pidConn.GetId()]
+	in, hasIn := conns[pidConn.GetReverseId()]
+
+	stats := out.TCPFlow
+	stats.Add(in.TCPFlow)
+
+	return stats, hasOut || hasIn
+}
+
+// Reset loss counters once they have been written out, so each flush counts only its own
+// segments, and forget flows with no segments since a given timestamp
+func ExpireTCPFlows(flows TCPFlowStore, before int64) {
+	for id, flow := range flows {
+		if flow.lastSeen < before {
+			delete(flows, id)
+			continue
+		}
+
+		flow.Stats = TCPFlowStats{HandshakeRTT: flow.Stats.HandshakeRTT}
+	}
+}
+
+// Per-process TCP loss and latency indicators
+type ProcessTCPFlows struct {
+	Type             string `json:"type"`
+	Pid              int    `json:"pid"`
+	StartTime        uint64 `json:"start_time"`
+	Command          string `json:"command"`
+	Connections      int    `json:"connections"`
+	Retransmissions  int    `json:"retransmissions"`
+	OutOfOrder       int    `json:"out_of_order"`
+	DuplicateAcks    int    `json:"duplicate_acks"`
+	ZeroWindows      int    `json:"zero_windows"`
+	MeanHandshakeRTT int64  `json:"mean_handshake_rtt"`
+	MaxHandshakeRTT  int64  `json:"max_handshake_rtt"`
+}
+
+// Sum TCP flow statistics over every connection owned by each process
+func CountProcessTCPFlows(pidConns *[]PidSocket, store MachineNetworkStorage) []ProcessTCPFlows {
+	byPid := map[ProcessId]*ProcessTCPFlows{}
+	rttCounts := map[ProcessId]int64{}
+	seen := map[string]bool{}
+	pids := []ProcessId{}
+
+	for _, pidConn := range *pidConns {
+		if pidConn.Connection.GetType() != "TCP" {
+			continue
+		}
+
+		id := pidConn.GetProcessId()
+
+		for _, conns := range store {
+			stats, ok := connectionTCPFlow(conns, pidConn)
+			key := id.String() + "/" + pidConn.GetId()
+
+			if !ok || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			summary, ok := byPid[id]
+			if !ok {
+				summary = &ProcessTCPFlows{Type: JSON_PROCESS_TCP_FLOWS, Pid: id.Pid, StartTime: id.StartTime, Command: pidConn.Command}
+				byPid[id] = summary
+				pids = append(pids, id)
+			}
+
+			summary.Connections++
+			summary.Retransmissions += stats.Retransmissions
+			summary.OutOfOrder += stats.OutOfOrder
+			summary.DuplicateAcks += stats.DuplicateAcks
+			summary.ZeroWindows += stats.ZeroWindows
+
+			if stats.HandshakeRTT > 0 {
+				summary.MeanHandshakeRTT += stats.HandshakeRTT
+				rttCounts[id]++
+
+				if stats.HandshakeRTT > summary.MaxHandshakeRTT {
+					summary.MaxHandshakeRTT = stats.HandshakeRTT
+				}
+			}
+		}
+	}
+
+	summaries := make([]ProcessTCPFlows, len(pids))
+	for idx, pid := range pids {
+		summary := *byPid[pid]
+
+		if rttCounts[pid] > 0 {
+			summary.MeanHandshakeRTT /= rttCounts[pid]
+		}
+
+		summaries[idx] = summary
+	}
+
+	return summaries
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TCP states, as numbered in the kernel's include/net/tcp_states.h and
+// exported in the `st` column of /proc/net/tcp
+var TCP_STATES = map[uint64]string{
+	1:  "ESTABLISHED",
+	2:  "SYN_SENT",
+	3:  "SYN_RECV",
+	4:  "FIN_WAIT1",
+	5:  "FIN_WAIT2",
+	6:  "TIME_WAIT",
+	7:  "CLOSE",
+	8:  "CLOSE_WAIT",
+	9:  "LAST_ACK",
+	10: "LISTEN",
+	11: "CLOSING",
+	12: "NEW_SYN_RECV",
+}
+
+// How long a send or receive queue must stay non-empty before we flag it
+const QUEUE_STALL_THRESHOLD = 5 * time.Second
+
+// Given a numeric TCP state, return its name
+func TCPStateName(st uint64) string {
+	if name, ok := TCP_STATES[st]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("UNKNOWN(%d)", st)
+}
+
+// A change in TCP state observed between two /proc/net/tcp snapshots
+type TCPStateTransition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// A period over which a send or receive queue was observed to be non-empty
+type TCPQueueStall struct {
+	Queue    string    `json:"queue"` // "tx" or "rx"
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	MaxBytes uint64    `json:"max_bytes"`
+}
+
+func (stall *TCPQueueStall) Duration() time.Duration {
+	return stall.Until.Sub(stall.Since)
+}
+
+// Is this stall long enough to suggest a slow peer (tx) or a slow consumer (rx)?
+func (stall *TCPQueueStall) Stalled() bool {
+	return stall.Duration() >= QUEUE_STALL_THRESHOLD
+}
+
+// The state history of a single TCP connection over a capture
+type TCPStateHistory struct {
+	Connection  TCPConnection        `json:"-"`
+	State       string               `json:"state"`
+	FirstSeen   time.Time            `json:"first_seen"`
+	LastSeen    time.Time            `json:"last_seen"`
+	Transitions []TCPStateTransition `json:"transitions"`
+	TxStalls    []TCPQueueStall      `json:"tx_stalls"`
+	RxStalls    []TCPQueueStall      `json:"rx_stalls"`
+	txStall     *TCPQueueStall
+	rxStall     *TCPQueueStall
+}
+
+// Update an in-progress queue-stall with the queue size at a given time; returns the
+// in-progress stall (if any) and, when a stall has just ended, the finished stall
+func updateQueueStall(curr *TCPQueueStall, queue string, size uint64, now time.Time) (*TCPQueueStall, *TCPQueueStall) {
+	// the stall lasted until the queue was first seen empty again
+	if size == 0 {
+		if curr != nil {
+			curr.Until = now
+		}
+		return nil, curr
+	}
+
+	if curr == nil {
+		return &TCPQueueStall{queue, now, now, size}, nil
+	}
+
+	curr.Until = now
+	if size > curr.MaxBytes {
+		curr.MaxBytes = size
+	}
+
+	return curr, nil
+}
+
+// Record a newly observed snapshot of this connection
+func (hist *TCPStateHistory) Observe(conn TCPConnection, now time.Time) {
+	state := conn.GetStateName()
+
+	if state != hist.State {
+		hist.Transitions = append(hist.Transitions, TCPStateTransition{hist.State, state, now})
+		hist.State = state
+	}
+
+	hist.Connection = conn
+	hist.LastSeen = now
+
+	var done *TCPQueueStall
+	hist.txStall, done = updateQueueStall(hist.txStall, "tx", conn.GetTxQueue(), now)
+	if done != nil {
+		hist.TxStalls = append(hist.TxStalls, *done)
+	}
+
+	hist.rxStall, done = updateQueueStall(hist.rxStall, "rx", conn.GetRxQueue(), now)
+	if done != nil {
+		hist.RxStalls = append(hist.RxStalls, *done)
+	}
+}
+
+// Close off any in-progress queue stalls, so they are included in reports
+func (hist *TCPStateHistory) Finish(now time.Time) {
+	if hist.txStall != nil {
+		hist.txStall.Until = now
+		hist.TxStalls = append(hist.TxStalls, *hist.txStall)
+		hist.txStall = nil
+	}
+
+	if hist.rxStall != nil {
+		hist.rxStall.Until = now
+		hist.RxStalls = append(hist.RxStalls, *hist.rxStall)
+		hist.rxStall = nil
+	}
+}
+
+// Only the queue-stalls long enough to be worth flagging
+func (hist *TCPStateHistory) FlaggedStalls() []TCPQueueStall {
+	flagged := []TCPQueueStall{}
+
+	for _, stalls := range [][]TCPQueueStall{hist.TxStalls, hist.RxStalls} {
+		for _, stall := range stalls {
+			if stall.Stalled() {
+				flagged = append(flagged, stall)
+			}
+		}
+	}
+
+	return flagged
+}
+
+// Identifies a connection by both endpoints; connection-ids join addresses and ports without a
+// separator, so distinct connections can share an id
+type TCPStateKey struct {
+	LocalAddr string
+	LocalPort uint64
+	RemAddr   string
+	RemPort   uint64
+}
+
+func GetTCPStateKey(conn Connection) TCPStateKey {
+	return TCPStateKey{conn.GetLocalAddr().String(), conn.GetLocalPort(), conn.GetRemAddr().String(), conn.GetRemPort()}
+}
+
+// Track TCP state history by connection
+type TCPStateStore = map[TCPStateKey]*TCPStateHistory
+
+// Update state history from a list of process-sockets; non-TCP sockets are ignored
+func TrackTCPStates(states TCPStateStore, pidConns *[]PidSocket, now time.Time) {
+	seen := map[TCPStateKey]bool{}
+
+	for _, pidConn := range *pidConns {
+		conn, ok := pidConn.Connection.(TCPConnection)
+		if !ok {
+			continue
+		}
+
+		// several processes may share a socket; only observe it once per snapshot
+		id := GetTCPStateKey(conn)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		hist, ok := states[id]
+		if !ok {
+			hist = &TCPStateHistory{
+				State:       conn.GetStateName(),
+				FirstSeen:   now,
+				Transitions: []TCPStateTransition{},
+				TxStalls:    []TCPQueueStall{},
+				RxStalls:    []TCPQueueStall{},
+			}
+			states[id] = hist
+		}
+
+		hist.Observe(conn, now)
+	}
+}
+
+// Close off all in-progress queue stalls before reporting
+func FinishTCPStates(states TCPStateStore, now time.Time) {
+	for _, hist := range states {
+		hist.Finish(now)
+	}
+}
+
+// Forget transitions and finished stalls once they have been written out, along with
+// connections not seen since a given time. In-progress stalls are kept until they finish
+func DrainTCPStates(states TCPStateStore, before time.Time) {
+	for id, hist := range states {
+		if hist.LastSeen.Before(before) {
+			delete(states, id)
+			continue
+		}
+
+		hist.Transitions = []TCPStateTransition{}
+		hist.TxStalls = []TCPQueueStall{}
+		hist.RxStalls = []TCPQueueStall{}
+	}
+}
+
+// Per-process counts of TCP connections in each state
+type ProcessTCPStates struct {
+	Type      string         `json:"type"`
+	Pid       int            `json:"pid"`
+	StartTime uint64         `json:"start_time"`
+	Command   string         `json:"command"`
+	States    map[string]int `json:"states"`
+}
+
+// Count the TCP connections each process has in each state
+func CountProcessTCPStates(pidConns *[]PidSocket) []ProcessTCPStates {
+	byPid := map[ProcessId]*ProcessTCPStates{}
+	pids := []ProcessId{}
+
+	for _, pidConn := range *pidConns {
+		conn, ok := pidConn.Connection.(TCPConnection)
+		if !ok {
+			continue
+		}
+
+		id := pidConn.GetProcessId()
+		counts, ok := byPid[id]
+		if !ok {
+			counts = &ProcessTCPStates{JSON_PROCESS_TCP_STATES, id.Pid, id.StartTime, pidConn.Command, map[string]int{}}
+			byPid[id] = counts
+			pids = append(pids, id)
+		}
+
+		counts.States[conn.GetStateName()]++
+	}
+
+	summaries := make([]ProcessTCPStates, len(pids))
+	for idx, pid := range pids {
+		summaries[idx] = *byPid[pid]
+	}
+
+	return summaries
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	TIMESERIES_QUEUE_SIZE = 16 // batches buffered before new ones are dropped
+	TIMESERIES_TIMEOUT    = 10 * time.Second
+	INFLUX_CONTENT        = "text/plain; charset=utf-8"
+	INFLUX_TOKEN_VAR      = "INFLUX_TOKEN" // sent as an Authorization token to HTTP write endpoints, if set
+)
+
+// Characters Graphite treats specially in a path component
+var GRAPHITE_UNSAFE_PATTERN = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// Placeholders in a Graphite path template, e.g. {host}
+var GRAPHITE_PLACEHOLDER_PATTERN = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// Options for periodically reporting traffic counters as InfluxDB line protocol or Graphite plaintext
+type TimeSeriesOptions struct {
+	Format   string // influx or graphite
+	Dest     string // influx: -, a file or an HTTP write URL. graphite: host:port
+	Interval time.Duration
+	Prefix   string      // prefixes measurement names & paths
+	Tags     [][2]string // tags added to every series, host included
+	Path     string      // graphite: a path template, to which the field name is appended
+}
+
+// Parse tags written as key=value,key=value
+func ParseMetricTags(str string) ([][2]string, error) {
+	tags := [][2]string{}
+
+	for _, pair := range strings.Split(str, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("--metric-tags: expected key=value, got %q", pair)
+		}
+
+		tags = append(tags, [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+
+	return tags, nil
+}
+
+// Read time-series options from the command-line; nil when no destination was given
+func ParseTimeSeriesOptions(opts docopt.Opts) (*TimeSeriesOptions, error) {
+	tsOpts := &TimeSeriesOptions{}
+
+	if dest, _ := opts.String("--influx"); len(dest) > 0 {
+		tsOpts.Format, tsOpts.Dest = "influx", dest
+	} else if dest, _ := opts.String("--graphite"); len(dest) > 0 {
+		tsOpts.Format, tsOpts.Dest = "graphite", dest
+	} else {
+		return nil, nil
+	}
+
+	interval, _ := opts.Int("--metric-interval")
+	if interval <= 0 {
+		return nil, fmt.Errorf("--metric-interval must be a positive number of seconds")
+	}
+	tsOpts.Interval = time.Duration(interval) * time.Second
+
+	tsOpts.Prefix, _ = opts.String("--metric-prefix")
+	tsOpts.Path, _ = opts.String("--graphite-path")
+
+	str, _ := opts.String("--metric-tags")
+	tags, err := ParseMetricTags(str)
+	if err != nil {
+		return nil, err
+	}
+
+	// tag series with the hostname, unless a host tag was given
+	hasHost := false
+	for _, tag := range tags {
+		hasHost = hasHost || tag[0] == "host"
+	}
+	if !hasHost {
+		hostname, _ := os.Hostname()
+		tags = append([][2]string{{"host", hostname}}, tags...)
+	}
+	tsOpts.Tags = tags
+
+	return tsOpts, nil
+}
+
+// A process, remote address or device's counters, and the tags identifying it
+type timeSeries struct {
+	Kind    string // process, remote or device
+	Name    string // identifies the series in Graphite paths
+	Tags    [][2]string
+	Counter TrafficCounter
+}
+
+// The fields written for each series
+var TIMESERIES_FIELDS = []string{"bytes_out", "bytes_in", "packets_out", "packets_in"}
+
+func (series *timeSeries) fields() []int64 {
+	counter := series.Counter
+	return []int64{counter.Bytes[0], counter.Bytes[1], counter.Packets[0], counter.Packets[1]}
+}
+
+// The id of the container a cgroup belongs to, if its name includes one
+func containerId(cgroup string) string {
+	ids := CONTAINER_ID_PATTERN.FindAllString(cgroup, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// Build a series per tracked process, remote address and device
+func buildTimeSeries(counters *TrafficCounters, conns *ConnectionTable) []timeSeries {
+	counters.Prune(conns)
+	series := []timeSeries{}
+
+	processIds, processConns := trackedByProcess(conns)
+	for _, id := range processIds {
+		latest := processConns[id][len(processConns[id])-1].ProcessSocket
+		pid := strconv.Itoa(id.Pid)
+
+		series = append(series, timeSeries{"process", graphiteComponent(latest.Command) + "." + pid, [][2]string{
+			{"pid", pid},
+			{"command", latest.Command},
+			{"user", latest.UserName},
+			{"container", containerId(latest.Cgroup)},
+		}, counters.Process(id)})
+	}
+
+	for _, addr := range counters.Remotes() {
+		series = append(series, timeSeries{"remote", graphiteComponent(addr), [][2]string{{"remote", addr}}, counters.Remote(addr)})
+	}
+
+	for _, name := range counters.Devices() {
+		series = append(series, timeSeries{"device", graphiteComponent(name), [][2]string{{"device", name}}, counters.Device(name)})
+	}
+
+	return series
+}
+
+var INFLUX_MEASUREMENT_ESCAPER = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+var INFLUX_TAG_ESCAPER = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// Write series as InfluxDB line protocol, one line per series with nanosecond timestamps. Empty tags
+// are left out, as InfluxDB rejects them
+func FormatInfluxLines(series []timeSeries, prefix string, tags [][2]string, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	for idx := range series {
+		entry := &series[idx]
+
+		lineTags := append(append([][2]string{}, tags...), entry.Tags...)
+		sort.SliceStable(lineTags, func(i, j int) bool {
+			return lineTags[i][0] < lineTags[j][0]
+		})
+
+		buf.WriteString(INFLUX_MEASUREMENT_ESCAPER.Replace(prefix + "_" + entry.Kind))
+		for _, tag := range lineTags {
+			if len(tag[1]) > 0 {
+				buf.WriteString("," + INFLUX_TAG_ESCAPER.Replace(tag[0]) + "=" + INFLUX_TAG_ESCAPER.Replace(tag[1]))
+			}
+		}
+
+		for fieldIdx, value := range entry.fields() {
+			sep := ","
+			if fieldIdx == 0 {
+				sep = " "
+			}
+			buf.WriteString(sep + TIMESERIES_FIELDS[fieldIdx] + "=" + strconv.FormatInt(value, 10) + "i")
+		}
+
+		buf.WriteString(" " + strconv.FormatInt(now.UnixNano(), 10) + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// Make a value safe to use as a single Graphite path component
+func graphiteComponent(value string) string {
+	if len(value) == 0 {
+		return "unknown"
+	}
+	return GRAPHITE_UNSAFE_PATTERN.ReplaceAllString(value, "_")
+}
+
+// Fill a path template's placeholders: {prefix}, {kind}, {name}, or any tag. Unknown placeholders become "unknown"
+func graphitePath(template string, prefix string, entry *timeSeries, tags [][2]string) string {
+	values := map[string]string{
+		"prefix": graphiteComponent(prefix),
+		"kind":   entry.Kind,
+		"name":   entry.Name,
+	}
+	for _, tag := range append(append([][2]string{}, tags...), entry.Tags...) {
+		values[tag[0]] = graphiteComponent(tag[1])
+	}
+
+	return GRAPHITE_PLACEHOLDER_PATTERN.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if value, ok := values[placeholder[1:len(placeholder)-1]]; ok {
+			return value
+		}
+		return "unknown"
+	})
+}
+
+// Write series as Graphite plaintext, a line per field with second timestamps
+func FormatGraphiteLines(series []timeSeries, template string, prefix string, tags [][2]string, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	for idx := range series {
+		entry := &series[idx]
+		path := graphitePath(template, prefix, entry, tags)
+
+		for fieldIdx, value := range entry.fields() {
+			fmt.Fprintf(&buf, "%s.%s %d %d\n", path, TIMESERIES_FIELDS[fieldIdx], value, now.Unix())
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Somewhere batches of lines are written
+type timeSeriesWriter interface {
+	Write(batch []byte) error
+	Close() error
+}
+
+// Appends lines to stdout or a file
+type fileSeriesWriter struct {
+	file *os.File
+}
+
+func (writer *fileSeriesWriter) Write(batch []byte) error {
+	_, err := writer.file.Write(batch)
+	return err
+}
+
+func (writer *fileSeriesWriter) Close() error {
+	if writer.file == os.Stdout {
+		return nil
+	}
+	return writer.file.Close()
+}
+
+// POSTs lines to an InfluxDB (v1 /write, or v2 /api/v2/write) endpoint
+type httpSeriesWriter struct {
+	URL    string
+	Token  string
+	client *http.Client
+}
+
+func (writer *httpSeriesWriter) Write(batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, writer.URL, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", INFLUX_CONTENT)
+	if len(writer.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+writer.Token)
+	}
+
+	res, err := writer.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", writer.URL, res.Status)
+	}
+
+	return nil
+}
+
+func (writer *httpSeriesWriter) Close() error {
+	return nil
+}
+
+// Sends lines to Graphite over TCP, reconnecting after a failed write
+type tcpSeriesWriter struct {
+	Address string
+	conn    net.Conn
+}
+
+func (writer *tcpSeriesWriter) Write(batch []byte) error {
+	if writer.conn == nil {
+		conn, err := net.DialTimeout("tcp", writer.Address, TIMESERIES_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		writer.conn = conn
+	}
+
+	writer.conn.SetWriteDeadline(time.Now().Add(TIMESERIES_TIMEOUT))
+	if _, err := writer.conn.Write(batch); err != nil {
+		writer.conn.Close()
+		writer.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (writer *tcpSeriesWriter) Close() error {
+	if writer.conn == nil {
+		return nil
+	}
+	return writer.conn.Close()
+}
+
+func newTimeSeriesWriter(opts *TimeSeriesOptions) (timeSeriesWriter, error) {
+	if opts.Format == "graphite" {
+		return &tcpSeriesWriter{Address: opts.Dest}, nil
+	}
+
+	if opts.Dest == "-" {
+		return &fileSeriesWriter{os.Stdout}, nil
+	}
+
+	if strings.HasPrefix(opts.Dest, "http://") || strings.HasPrefix(opts.Dest, "https://") {
+		return &httpSeriesWriter{opts.Dest, os.Getenv(INFLUX_TOKEN_VAR), &http.Client{Timeout: TIMESERIES_TIMEOUT}}, nil
+	}
+
+	file, err := os.OpenFile(opts.Dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSeriesWriter{file}, nil
+}
+
+// Periodically reports cumulative traffic counters per process, remote address and device
+type TimeSeriesReporter struct {
+	Options  *TimeSeriesOptions
+	counters *TrafficCounters
+	writer   timeSeriesWriter
+	batches  chan []byte
+	done     chan bool
+}
+
+func NewTimeSeriesReporter(opts *TimeSeriesOptions) (*TimeSeriesReporter, error) {
+	writer, err := newTimeSeriesWriter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	reporter := &TimeSeriesReporter{
+		Options:  opts,
+		counters: NewTrafficCounters(),
+		writer:   writer,
+		batches:  make(chan []byte, TIMESERIES_QUEUE_SIZE),
+		done:     make(chan bool),
+	}
+
+	go reporter.send()
+	return reporter, nil
+}
+
+func (reporter *TimeSeriesReporter) send() {
+	for batch := range reporter.batches {
+		if err := reporter.writer.Write(batch); err != nil {
+			log.Printf("could not write metrics to %s: %v", reporter.Options.Dest, err)
+		}
+	}
+
+	reporter.done <- true
+}
+
+// Count traffic stored since the last update
+func (reporter *TimeSeriesReporter) Update(conns *ConnectionTable, store MachineNetworkStorage) {
+	reporter.counters.Update(conns, store)
+}
+
+// Count from zero once the store is emptied
+func (reporter *TimeSeriesReporter) Reset() {
+	reporter.counters.Reset()
+}
+
+// Queue the current counters to be written, without blocking. Batches are dropped if the destination falls behind
+func (reporter *TimeSeriesReporter) Push(conns *ConnectionTable, now time.Time) {
+	opts := reporter.Options
+	series := buildTimeSeries(reporter.counters, conns)
+
+	var batch []byte
+	if opts.Format == "graphite" {
+		batch = FormatGraphiteLines(series, opts.Path, opts.Prefix, opts.Tags, now)
+	} else {
+		batch = FormatInfluxLines(series, opts.Prefix, opts.Tags, now)
+	}
+
+	select {
+	case reporter.batches <- batch:
+	default:
+		log.Printf("metric queue full, dropping batch")
+	}
+}
+
+// Push the final counters, and wait for queued batches to be written
+func (reporter *TimeSeriesReporter) Close(conns *ConnectionTable, store MachineNetworkStorage, now time.Time) error {
+	reporter.Update(conns, store)
+	reporter.Push(conns, now)
+
+	close(reporter.batches)
+	<-reporter.done
+
+	return reporter.writer.Close()
+}
@@ -17,16 +17,29 @@ type Connection interface {
 	GetType() string
 }
 
+// Identifies a process by pid and start-time (in clock-ticks since boot, from /proc/<pid>/stat),
+// since pids are reused once a process exits
+type ProcessId struct {
+	Pid       int    `json:"pid"`
+	StartTime uint64 `json:"start_time"`
+}
+
+func (id ProcessId) String() string {
+	return fmt.Sprint(id.Pid) + "@" + fmt.Sprint(id.StartTime)
+}
+
 // Represents an association between process-based information (user, command, pid), and a
 // transport-layer connection
 type PidSocket struct {
-	UserName    string     `json:"username"`
-	Command     string     `json:"command"`
-	CommandLine string     `json:"command_line"`
-	Pid         int        `json:"pid"`
-	PidParents  []int      `json:"parent_pids"`
-	Connection  Connection `json:"connection"`
-	Time        time.Time  `json:"time"`
+	UserName    string      `json:"username"`
+	Command     string      `json:"command"`
+	CommandLine string      `json:"command_line"`
+	Pid         int         `json:"pid"`
+	StartTime   uint64      `json:"start_time"`
+	PidParents  []ProcessId `json:"parent_pids"`
+	Cgroup      string      `json:"cgroup"`
+	Connection  Connection  `json:"connection"`
+	Time        time.Time   `json:"time"`
 }
 
 // Information to extract from each packet, where possible.
@@ -39,6 +52,8 @@ type PacketData struct {
 	RemAddr   net.IP
 	RemPort   uint64
 	Size      int
+	Protocol  uint8       // The transport protocol number, such as IPPROTO_TCP; zero when unknown
+	TCP       *TCPSegment // TCP header information, if this is a TCP packet
 }
 
 // Store packets by <device>.<connid> as an array of some packet-data
@@ -60,6 +75,16 @@ func (conn *PidSocket) GetId() string {
 	return conn.Connection.GetId()
 }
 
+// The id packets received on the connection are stored under
+func (conn *PidSocket) GetReverseId() string {
+	sock := conn.Connection
+	return sock.GetRemAddr().String() + fmt.Sprint(sock.GetRemPort()) + sock.GetLocalAddr().String() + fmt.Sprint(sock.GetLocalPort())
+}
+
+func (conn *PidSocket) GetProcessId() ProcessId {
+	return ProcessId{conn.Pid, conn.StartTime}
+}
+
 // TODO add connid here
 type StoredConnectionData struct {
 	LocalAddr net.IP
@@ -70,15 +95,36 @@ type StoredConnectionData struct {
 	From      int                // The time the least recent was received,
 	To        int                // The time the most recent packet was received
 	Packets   []StoredPacketData // Information about each packet received
+	Count     int                // The number of packets received, which outlives pruned packets
+	Protocol  uint8              // The transport protocol number of the packets, or zero when unknown
+	TCPFlow   TCPFlowStats       // Retransmission, ordering, window and RTT analysis for TCP connections
 }
 
 type MachineNetworkStorage = map[string]map[string]StoredConnectionData
 
+// What each object in the JSON report is, named by its type field
+const (
+	JSON_CONNECTION         = "connection"
+	JSON_PROCESS_TCP_STATES = "process_tcp_states"
+	JSON_PROCESS_TCP_FLOWS  = "process_tcp_flows"
+)
+
 type OutputRow struct {
+	Type          string             `json:"type"`
 	Device        string             `json:"device"`
+	Direction     string             `json:"direction"` // out when sent by the local side of the connection
 	ProcessSocket PidSocket          `json:"process_socket"`
 	TotalBytes    int                `json:"bytes"`
 	From          int                `json:"from"`
 	To            int                `json:"to"`
 	Packets       []StoredPacketData `json:"packets"`
+	TCPState      *TCPStateHistory   `json:"tcp_state,omitempty"`
+	TCPFlow       *TCPFlowStats      `json:"tcp_flow,omitempty"`
+	Lifetime      ConnectionLifetime `json:"lifetime"`
+}
+
+// Every process-socket for a single protocol, as of one /proc snapshot
+type PidSocketSnapshot struct {
+	Protocol   string
+	PidSockets *[]PidSocket
 }
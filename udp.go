@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"time"
@@ -8,47 +9,32 @@ import (
 	"github.com/prometheus/procfs"
 )
 
-// Watch /proc/net/udp and /proc/net/udp6 for changes by emitting a file-change
-// periodically
-func NetUDPWatcher(udpChan chan []Connection, pfs *procfs.FS) {
-	hashv4 := ""
-	hashv6 := ""
-
-	for {
-		changed := false
-		currHashv4, _ := ProcHash(false)
+// Read every IPv4 and IPv6 UDP connection
+func ReadUDPConnections(pfs *procfs.FS) []Connection {
+	mconns := make([]Connection, 0)
 
-		mconns := make([]Connection, 0)
+	for _, read := range []func() (procfs.NetUDP, error){pfs.NetUDP, pfs.NetUDP6} {
+		conns, _ := read()
 
-		if hashv4 != currHashv4 {
-			changed = true
-			hashv4 = currHashv4
-
-			conns, _ := pfs.NetUDP()
-			mconns = make([]Connection, len(conns))
-
-			for idx, conn := range conns {
-				mconns[idx] = UDPConnection{conn.Sl, conn.LocalAddr, conn.RemAddr, conn.St, conn.TxQueue, conn.RxQueue, conn.UID, conn.Inode}
-			}
+		for _, conn := range conns {
+			mconns = append(mconns, UDPConnection{conn.Sl, conn.LocalAddr, conn.LocalPort, conn.RemAddr, conn.RemPort, conn.St, conn.TxQueue, conn.RxQueue, conn.UID, conn.Inode})
 		}
+	}
 
-		currHashv6, _ := ProcHash(false)
-
-		if hashv6 != currHashv6 {
-			changed = true
-			hashv6 = currHashv6
+	return mconns
+}
 
-			// todo expand array
-			conns, _ := pfs.NetUDP6()
+// Watch /proc/net/udp and /proc/net/udp6 for changes by emitting a file-change
+// periodically
+func NetUDPWatcher(udpChan chan []Connection, pfs *procfs.FS) {
+	hash := ""
 
-			for _, conn := range conns {
-				udpConn := UDPConnection{conn.Sl, conn.LocalAddr, conn.RemAddr, conn.St, conn.TxQueue, conn.RxQueue, conn.UID, conn.Inode}
-				mconns = append(mconns, udpConn)
-			}
-		}
+	for {
+		currHash, _ := ProcHash(false)
 
-		if changed {
-			udpChan <- mconns
+		if hash != currHash {
+			hash = currHash
+			udpChan <- ReadUDPConnections(pfs)
 		}
 
 		time.Sleep(500 * time.Millisecond)
@@ -58,7 +44,9 @@ func NetUDPWatcher(udpChan chan []Connection, pfs *procfs.FS) {
 type UDPConnection struct {
 	sl        uint64 `json:"sl"`
 	localAddr net.IP `json:"localaddr"`
+	localPort uint64 `json:"localport"`
 	remAddr   net.IP `json:"remaddr"`
+	remPort   uint64 `json:"remport"`
 	st        uint64 `json:"st"`
 	txQueue   uint64 `json:"txqueue"`
 	rxQueue   uint64 `json:"rxqueue"`
@@ -95,7 +83,7 @@ func (udp UDPConnection) GetLocalAddr() net.IP {
 }
 
 func (udp UDPConnection) GetLocalPort() uint64 {
-	return 0
+	return udp.localPort
 }
 
 func (udp UDPConnection) GetRemAddr() net.IP {
@@ -103,7 +91,7 @@ func (udp UDPConnection) GetRemAddr() net.IP {
 }
 
 func (udp UDPConnection) GetRemPort() uint64 {
-	return 0
+	return udp.remPort
 }
 
 func (udp UDPConnection) GetUID() uint64 {
@@ -113,3 +101,20 @@ func (udp UDPConnection) GetUID() uint64 {
 func (udp UDPConnection) GetInode() uint64 {
 	return udp.inode
 }
+
+// The connection fields are unexported, so marshal them explicitly
+func (udp UDPConnection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":      udp.GetType(),
+		"sl":        udp.sl,
+		"localaddr": udp.localAddr,
+		"localport": udp.localPort,
+		"remaddr":   udp.remAddr,
+		"remport":   udp.remPort,
+		"st":        udp.st,
+		"txqueue":   udp.txQueue,
+		"rxqueue":   udp.rxQueue,
+		"uid":       udp.uid,
+		"inode":     udp.inode,
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The web UI: static files that read the API they're served alongside
+//
+//go:embed ui
+var UI_FILES embed.FS
+
+// Serve the embedded web UI. It loads nothing from elsewhere, so the policy forbids it
+func UIHandler() http.Handler {
+	files, err := fs.Sub(UI_FILES, "ui")
+	if err != nil {
+		panic(err)
+	}
+
+	server := http.FileServer(http.FS(files))
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !allowGet(res, req) {
+			return
+		}
+
+		res.Header().Set("Content-Security-Policy", "default-src 'self'")
+		res.Header().Set("X-Content-Type-Options", "nosniff")
+		server.ServeHTTP(res, req)
+	})
+}
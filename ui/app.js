@@ -0,0 +1,456 @@
+'use strict'
+
+// A dashboard for puffin's API. Live captures stream per-second updates from /api/stream; saved
+// captures are read once, with bandwidth shown as totals over the capture
+
+const SPARKLINE_STEPS = 60 // one per second while live
+const CAPTURE_STEPS = 120 // a saved capture's timeline is split into this many steps
+const SANKEY_NODES = 12 // processes or remote hosts shown before the rest are grouped
+const BANDWIDTH_ROWS = 15
+const PROCESS_IDLE_MS = 10000 // live processes are listed this long after their last traffic
+const REFRESH_MS = 5000 // how often live connections are re-read
+
+const SVG = 'http://www.w3.org/2000/svg'
+
+const state = {
+  live: false,
+  processes: new Map(), // by pid@startTime
+  devices: new Map(), // by name: { out: [], in: [] }
+  connections: [],
+  sort: { key: 'bytes_out', descending: true },
+  filter: '',
+  openOnly: false
+}
+
+async function getJSON (path) {
+  const res = await fetch(path)
+  if (!res.ok) {
+    throw new Error(`${path}: ${res.status} ${res.statusText}`)
+  }
+  return res.json()
+}
+
+function element (tag, attrs = {}, ...children) {
+  const node = document.createElement(tag)
+  for (const [key, value] of Object.entries(attrs)) {
+    node.setAttribute(key, value)
+  }
+  node.append(...children)
+  return node
+}
+
+function svgElement (tag, attrs = {}) {
+  const node = document.createElementNS(SVG, tag)
+  for (const [key, value] of Object.entries(attrs)) {
+    node.setAttribute(key, value)
+  }
+  return node
+}
+
+function formatBytes (bytes) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB']
+  let idx = 0
+  while (bytes >= 1024 && idx < units.length - 1) {
+    bytes /= 1024
+    idx++
+  }
+  return `${bytes.toFixed(idx === 0 ? 0 : 1)} ${units[idx]}`
+}
+
+function formatRate (bytes) {
+  return state.live ? `${formatBytes(bytes)}/s` : formatBytes(bytes)
+}
+
+function formatTime (str) {
+  return str ? new Date(str).toLocaleString() : ''
+}
+
+function processKey (proc) {
+  return `${proc.host || ''}/${proc.pid}@${proc.start_time}`
+}
+
+// a collector's processes and connections are named by their host too
+function commandLabel (entry) {
+  return entry.host ? `${entry.host}: ${entry.command}` : entry.command
+}
+
+// -- bandwidth by process
+
+function renderBandwidth () {
+  const now = Date.now()
+  const list = document.getElementById('bandwidth')
+
+  const processes = [...state.processes.values()]
+    .filter(proc => !state.live || now - proc.seen < PROCESS_IDLE_MS)
+    .sort((a, b) => (b.bytes_out + b.bytes_in) - (a.bytes_out + a.bytes_in))
+    .slice(0, BANDWIDTH_ROWS)
+
+  const max = Math.max(1, ...processes.map(proc => proc.bytes_out + proc.bytes_in))
+
+  list.replaceChildren(...processes.map(proc => {
+    const out = element('span')
+    const inbound = element('span')
+    out.style.width = `${100 * proc.bytes_out / max}%`
+    inbound.style.width = `${100 * proc.bytes_in / max}%`
+
+    return element('li', { title: `${commandLabel(proc)} (pid ${proc.pid})` },
+      element('span', { class: 'name' }, `${commandLabel(proc)} (${proc.pid})`),
+      element('span', { class: 'bar' }, out, inbound),
+      element('span', { class: 'number out' }, `↑ ${formatRate(proc.bytes_out)}`),
+      element('span', { class: 'number in' }, `↓ ${formatRate(proc.bytes_in)}`))
+  }))
+
+  if (processes.length === 0) {
+    list.replaceChildren(element('li', { class: 'empty' }, 'No traffic yet'))
+  }
+}
+
+// -- device sparklines
+
+function sparkline (values, max, direction) {
+  const step = 100 / Math.max(1, values.length - 1)
+  const points = values.map((value, idx) => `${(idx * step).toFixed(2)},${(36 - 34 * value / max).toFixed(2)}`)
+
+  return svgElement('polyline', { class: direction, points: points.join(' '), 'vector-effect': 'non-scaling-stroke' })
+}
+
+function renderDevices () {
+  const container = document.getElementById('devices')
+  const names = [...state.devices.keys()].sort()
+
+  container.replaceChildren(...names.map(name => {
+    const series = state.devices.get(name)
+    const max = Math.max(1, ...series.out, ...series.in)
+    const svg = svgElement('svg', { viewBox: '0 0 100 36', preserveAspectRatio: 'none' })
+    svg.append(sparkline(series.out, max, 'out'), sparkline(series.in, max, 'in'))
+
+    const total = values => values.reduce((sum, value) => sum + value, 0)
+    const out = state.live ? series.out[series.out.length - 1] : total(series.out)
+    const inbound = state.live ? series.in[series.in.length - 1] : total(series.in)
+
+    return element('div', { class: 'device' },
+      element('span', { class: 'name' }, name),
+      svg,
+      element('span', { class: 'number out' }, `↑ ${formatRate(out)}`),
+      element('span', { class: 'number in' }, `↓ ${formatRate(inbound)}`))
+  }))
+
+  if (names.length === 0) {
+    container.replaceChildren(element('p', { class: 'empty' }, 'No traffic yet'))
+  }
+}
+
+function pushDeviceSample (name, out, inbound) {
+  if (!state.devices.has(name)) {
+    state.devices.set(name, { out: new Array(SPARKLINE_STEPS).fill(0), in: new Array(SPARKLINE_STEPS).fill(0) })
+  }
+
+  const series = state.devices.get(name)
+  series.out.push(out)
+  series.in.push(inbound)
+  series.out.splice(0, series.out.length - SPARKLINE_STEPS)
+  series.in.splice(0, series.in.length - SPARKLINE_STEPS)
+}
+
+async function loadTimeline (window, step) {
+  const timeline = await getJSON(`/api/timeline?window=${window}&step=${step}`)
+
+  state.devices.clear()
+  for (const device of timeline.devices) {
+    state.devices.set(device.name, { out: device.bytes_out, in: device.bytes_in })
+  }
+}
+
+// -- process to remote host sankey
+
+// Keep the largest keys, grouping the rest as "other"
+function largest (totals, limit) {
+  const keys = [...totals.entries()].sort((a, b) => b[1] - a[1]).map(([key]) => key)
+  const kept = new Set(keys.slice(0, limit))
+
+  return key => kept.has(key) ? key : 'other'
+}
+
+function sankeyColumn (totals, x, height, padding, total) {
+  const nodes = new Map()
+  const scale = (height - padding * (totals.size - 1)) / total
+  let y = 0
+
+  for (const [key, bytes] of [...totals.entries()].sort((a, b) => b[1] - a[1])) {
+    const size = Math.max(1, bytes * scale)
+    nodes.set(key, { key, bytes, x, y, size, offset: 0 })
+    y += size + padding
+  }
+
+  return { nodes, scale }
+}
+
+function renderSankey () {
+  const svg = document.getElementById('sankey')
+  const flows = new Map()
+  const processTotals = new Map()
+  const remoteTotals = new Map()
+
+  for (const conn of state.connections) {
+    const bytes = conn.bytes_out + conn.bytes_in
+    if (bytes === 0) {
+      continue
+    }
+    processTotals.set(commandLabel(conn), (processTotals.get(commandLabel(conn)) || 0) + bytes)
+    remoteTotals.set(conn.rem_addr, (remoteTotals.get(conn.rem_addr) || 0) + bytes)
+  }
+
+  const processOf = largest(processTotals, SANKEY_NODES)
+  const remoteOf = largest(remoteTotals, SANKEY_NODES)
+  const left = new Map()
+  const right = new Map()
+  let total = 0
+
+  for (const conn of state.connections) {
+    const bytes = conn.bytes_out + conn.bytes_in
+    if (bytes === 0) {
+      continue
+    }
+
+    const source = processOf(commandLabel(conn))
+    const target = remoteOf(conn.rem_addr)
+    const key = `${source}\u0000${target}`
+
+    flows.set(key, { source, target, bytes: (flows.has(key) ? flows.get(key).bytes : 0) + bytes })
+    left.set(source, (left.get(source) || 0) + bytes)
+    right.set(target, (right.get(target) || 0) + bytes)
+    total += bytes
+  }
+
+  const width = svg.clientWidth || 900
+  const rows = Math.max(left.size, right.size)
+  const height = Math.max(120, rows * 28)
+  const labelWidth = 180
+  const nodeWidth = 10
+  const padding = 6
+
+  svg.setAttribute('viewBox', `0 0 ${width} ${height}`)
+  svg.setAttribute('height', height)
+  svg.replaceChildren()
+
+  if (total === 0) {
+    const text = svgElement('text', { x: 0, y: 20 })
+    text.textContent = 'No attributed traffic yet'
+    svg.append(text)
+    return
+  }
+
+  const sources = sankeyColumn(left, labelWidth, height, padding, total)
+  const targets = sankeyColumn(right, width - labelWidth - nodeWidth, height, padding, total)
+  const scale = Math.min(sources.scale, targets.scale)
+
+  for (const flow of [...flows.values()].sort((a, b) => b.bytes - a.bytes)) {
+    const from = sources.nodes.get(flow.source)
+    const to = targets.nodes.get(flow.target)
+    const size = Math.max(1, flow.bytes * scale)
+
+    const y0 = from.y + from.offset + size / 2
+    const y1 = to.y + to.offset + size / 2
+    from.offset += size
+    to.offset += size
+
+    const x0 = from.x + nodeWidth
+    const x1 = to.x
+    const mid = (x0 + x1) / 2
+
+    const path = svgElement('path', { d: `M${x0},${y0} C${mid},${y0} ${mid},${y1} ${x1},${y1}`, 'stroke-width': size })
+    const title = svgElement('title')
+    title.textContent = `${flow.source} → ${flow.target}: ${formatBytes(flow.bytes)}`
+    path.append(title)
+    svg.append(path)
+  }
+
+  for (const [column, anchor, dx] of [[sources, 'end', -6], [targets, 'start', nodeWidth + 6]]) {
+    for (const node of column.nodes.values()) {
+      const title = svgElement('title')
+      title.textContent = `${node.key}: ${formatBytes(node.bytes)}`
+
+      const rect = svgElement('rect', { x: node.x, y: node.y, width: nodeWidth, height: node.size })
+      rect.append(title)
+
+      const label = svgElement('text', { x: node.x + dx, y: node.y + node.size / 2, 'text-anchor': anchor, 'dominant-baseline': 'middle' })
+      label.textContent = `${node.key} (${formatBytes(node.bytes)})`
+
+      svg.append(rect, label)
+    }
+  }
+}
+
+// -- connection table
+
+function connectionValue (conn, key) {
+  switch (key) {
+    case 'local':
+      return `${conn.local_addr}:${conn.local_port}`
+    case 'remote':
+      return `${conn.rem_addr}:${conn.rem_port}`
+    case 'packets':
+      return conn.packets_out + conn.packets_in
+    case 'opened':
+      return new Date(conn.opened).getTime()
+    case 'state':
+      return conn.state || (conn.open ? 'open' : 'closed')
+    default:
+      return conn[key]
+  }
+}
+
+function matchesFilter (conn) {
+  if (state.openOnly && !conn.open) {
+    return false
+  }
+  if (state.filter.length === 0) {
+    return true
+  }
+
+  const text = [commandLabel(conn), conn.pid, conn.protocol, connectionValue(conn, 'local'), connectionValue(conn, 'remote'), connectionValue(conn, 'state')]
+    .join(' ')
+    .toLowerCase()
+
+  return state.filter.split(/\s+/).every(term => text.includes(term))
+}
+
+function renderConnections () {
+  const { key, descending } = state.sort
+  const conns = state.connections.filter(matchesFilter).sort((a, b) => {
+    const left = connectionValue(a, key)
+    const right = connectionValue(b, key)
+    const order = typeof left === 'number' && typeof right === 'number'
+      ? left - right
+      : String(left).localeCompare(String(right))
+
+    return descending ? -order : order
+  })
+
+  for (const th of document.querySelectorAll('#connections th')) {
+    th.classList.toggle('sorted', th.dataset.key === key)
+    th.classList.toggle('ascending', th.dataset.key === key && !descending)
+  }
+
+  document.querySelector('#connections tbody').replaceChildren(...conns.map(conn => element('tr', { class: conn.open ? 'open' : 'closed' },
+    element('td', {}, commandLabel(conn)),
+    element('td', { class: 'number' }, String(conn.pid)),
+    element('td', {}, conn.protocol),
+    element('td', {}, connectionValue(conn, 'local')),
+    element('td', {}, connectionValue(conn, 'remote')),
+    element('td', {}, connectionValue(conn, 'state')),
+    element('td', { class: 'number out' }, formatBytes(conn.bytes_out)),
+    element('td', { class: 'number in' }, formatBytes(conn.bytes_in)),
+    element('td', { class: 'number' }, String(conn.packets_out + conn.packets_in)),
+    element('td', {}, formatTime(conn.opened)))))
+
+  document.getElementById('connection-count').textContent = `${conns.length} of ${state.connections.length}`
+}
+
+async function loadConnections () {
+  state.connections = await getJSON('/api/connections')
+  renderConnections()
+  renderSankey()
+}
+
+// -- live updates
+
+function onUpdate (update) {
+  const now = Date.now()
+
+  for (const proc of update.processes) {
+    state.processes.set(processKey(proc), { ...proc, seen: now })
+  }
+  // processes without traffic this interval have no bandwidth
+  for (const [key, proc] of state.processes) {
+    if (proc.seen !== now) {
+      state.processes.set(key, { ...proc, bytes_out: 0, bytes_in: 0 })
+    }
+  }
+
+  const seen = new Set()
+  for (const device of update.devices) {
+    pushDeviceSample(device.name, device.bytes_out, device.bytes_in)
+    seen.add(device.name)
+  }
+  for (const name of state.devices.keys()) {
+    if (!seen.has(name)) {
+      pushDeviceSample(name, 0, 0)
+    }
+  }
+
+  renderBandwidth()
+  renderDevices()
+}
+
+function subscribe () {
+  const stream = new EventSource('/api/stream')
+  const connectionState = document.getElementById('connection-state')
+
+  stream.addEventListener('open', () => { connectionState.textContent = 'streaming' })
+  stream.addEventListener('error', () => { connectionState.textContent = 'reconnecting…' })
+  stream.addEventListener('update', event => onUpdate(JSON.parse(event.data)))
+  stream.addEventListener('dropped', event => {
+    connectionState.textContent = `missed ${JSON.parse(event.data).count} updates`
+  })
+}
+
+// -- start up
+
+function bindControls () {
+  for (const th of document.querySelectorAll('#connections th')) {
+    th.addEventListener('click', () => {
+      const key = th.dataset.key
+      state.sort = { key, descending: state.sort.key === key ? !state.sort.descending : true }
+      renderConnections()
+    })
+  }
+
+  document.getElementById('filter').addEventListener('input', event => {
+    state.filter = event.target.value.trim().toLowerCase()
+    renderConnections()
+  })
+
+  document.getElementById('open-only').addEventListener('change', event => {
+    state.openOnly = event.target.checked
+    renderConnections()
+  })
+
+  window.addEventListener('resize', renderSankey)
+}
+
+async function start () {
+  bindControls()
+
+  const status = await getJSON('/api/status')
+  state.live = status.live
+
+  document.getElementById('source').textContent = status.live ? 'live capture' : status.source
+  document.getElementById('span').textContent = status.live
+    ? `since ${formatTime(status.start)}`
+    : `${formatTime(status.start)} – ${formatTime(status.now)}`
+
+  if (status.live) {
+    await loadTimeline(`${SPARKLINE_STEPS - 1}s`, '1s')
+    subscribe()
+    setInterval(() => loadConnections().catch(console.error), REFRESH_MS)
+  } else {
+    document.getElementById('bandwidth-title').textContent = 'Traffic by process'
+
+    for (const proc of await getJSON('/api/processes')) {
+      state.processes.set(processKey(proc), proc)
+    }
+
+    const span = Math.max(1, new Date(status.now) - new Date(status.start))
+    await loadTimeline(`${span}ms`, `${Math.ceil(span / CAPTURE_STEPS)}ms`)
+  }
+
+  renderBandwidth()
+  renderDevices()
+  await loadConnections()
+}
+
+start().catch(err => {
+  document.getElementById('connection-state').textContent = `could not load: ${err.message}`
+  console.error(err)
+})